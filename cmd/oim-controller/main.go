@@ -18,7 +18,6 @@ import (
 )
 
 var (
-	version           = "unknown" // set at build time
 	printVersion      = flag.Bool("version", false, "output version information and exit")
 	endpoint          = flag.String("endpoint", "tcp://:8999", "OIM controller endpoint for net.Listen")
 	spdk              = flag.String("spdk", "/var/tmp/vhost.sock", "SPDK VHost RPC socket path")
@@ -41,7 +40,7 @@ func main() {
 	log.Set(logger)
 
 	if *printVersion {
-		logger.Infof("oim-controller %s", version)
+		logger.Infof("oim-controller %s", oimcommon.Version)
 		return
 	}
 
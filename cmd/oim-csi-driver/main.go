@@ -9,7 +9,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/intel/oim/pkg/log"
 	"github.com/intel/oim/pkg/oim-common"
@@ -17,19 +27,9 @@ import (
 )
 
 var (
-	version            = "unknown" // set at build time
-	printVersion       = flag.Bool("version", false, "output version information and exit")
-	endpoint           = flag.String("endpoint", "unix:///tmp/csi.sock", "CSI endpoint")
-	driverName         = flag.String("drivername", "oim-csi-driver", "name of the driver")
-	nodeID             = flag.String("nodeid", "", "node id")
-	spdkSocket         = flag.String("spdk-socket", "", "SPDK VHost socket path. If set, then the driver will controll that SPDK instance directly.")
-	oimRegistryAddress = flag.String("oim-registry-address", "", "OIM registry address in the format expected by grpc.Dial. If set, then the driver will use a OIM controller via the registry instead of a local SPDK daemon.")
-	ca                 = flag.String("ca", "", "the required CA's .crt file which is used for verifying connections")
-	key                = flag.String("key", "", "the base name of the required .key and .crt files that authenticate and authorize the controller")
-	controllerID       = flag.String("controller-id", "", "The ID under which the OIM controller can be found in the registry.")
-	emulate            = flag.String("emulate", "", "name of CSI driver to emulate for node operations")
-	csiversion         = flag.String("csiversion", "1.0", "CSI version that is to be implemented by the driver (1.0 or 0.3)")
-	_                  = log.InitSimpleFlags()
+	printVersion = flag.Bool("version", false, "output version information and exit")
+	config       = oimcsidriver.NewConfigFromFlags(flag.CommandLine)
+	_            = log.InitSimpleFlags()
 )
 
 func main() {
@@ -39,33 +39,196 @@ func main() {
 	log.Set(logger)
 
 	if *printVersion {
-		logger.Infof("oim-csi-driver %s", version)
+		logger.Infof("oim-csi-driver %s", oimcommon.Version)
 		return
 	}
+	if err := config.LoadConfigFile(); err != nil {
+		logger.Fatalf("Invalid config file: %s\n", err)
+	}
+	if err := config.Validate(); err != nil {
+		logger.Fatalf("Invalid configuration: %s\n", err)
+	}
 
-	closer, err := oimcommon.InitTracer(*driverName)
+	closer, err := oimcommon.InitTracer(config.DriverName)
 	if err != nil {
 		logger.Fatalf("Failed to initialize tracer: %s\n", err)
 	}
 	defer closer.Close()
 
 	options := []oimcsidriver.Option{
-		oimcsidriver.WithDriverName(*driverName),
-		oimcsidriver.WithDriverVersion(version),
-		oimcsidriver.WithCSIEndpoint(*endpoint),
-		oimcsidriver.WithNodeID(*nodeID),
-		oimcsidriver.WithVHostEndpoint(*spdkSocket),
-		oimcsidriver.WithOIMRegistryAddress(*oimRegistryAddress),
-		oimcsidriver.WithOIMControllerID(*controllerID),
-		oimcsidriver.WithRegistryCreds(*ca, *key),
-		oimcsidriver.WithEmulation(*emulate),
-		oimcsidriver.WithCSIVersion(*csiversion),
+		oimcsidriver.WithLogger(logger),
+		oimcsidriver.WithDriverName(config.DriverName),
+		oimcsidriver.WithDriverVersion(oimcommon.Version),
+		oimcsidriver.WithCSIEndpoint(config.CSIEndpoint),
+		oimcsidriver.WithNodeID(config.NodeID),
+		oimcsidriver.WithVHostEndpoint(config.VHostEndpoint),
+		oimcsidriver.WithVHostSocketDir(config.VHostSocketDir),
+		oimcsidriver.WithSPDKPoolSize(config.SPDKConnections),
+		oimcsidriver.WithOIMRegistryAddress(config.OIMRegistryAddress),
+		oimcsidriver.WithDryRun(config.DryRun),
+		oimcsidriver.WithOIMControllerID(config.OIMControllerID),
+		oimcsidriver.WithRegistryCreds(config.CAFile, config.KeyFile),
+		oimcsidriver.WithOIMCallRetries(config.OIMCallAttempts, config.OIMCallTimeout),
+		oimcsidriver.WithDeviceTimeout(config.DeviceTimeout),
+		oimcsidriver.WithProbeTimeout(config.ProbeTimeout),
+		oimcsidriver.WithEmulation(config.Emulate),
+		oimcsidriver.WithCSIVersion(config.CSIVersion),
+		oimcsidriver.WithPrewarmBandwidthLimit(config.PrewarmBandwidthLimit),
+		oimcsidriver.WithPrewarmMaxBytes(config.PrewarmMaxBytes),
+		oimcsidriver.WithMaxConcurrentOperations(config.MaxConcurrentOps),
+	}
+	if config.VolumeNamePattern != oimcsidriver.DefaultVolumeNamePattern {
+		validator, err := oimcsidriver.NewRegexpVolumeNameValidator(config.VolumeNamePattern)
+		if err != nil {
+			logger.Fatalf("Invalid volume name pattern: %s\n", err)
+		}
+		options = append(options, oimcsidriver.WithVolumeNameValidator(validator))
+	}
+	if config.AuditLog != "" {
+		auditLogger, err := oimcsidriver.OpenAuditLog(config.AuditLog)
+		if err != nil {
+			logger.Fatalf("Failed to open audit log: %s\n", err)
+		}
+		options = append(options, oimcsidriver.WithAuditLogger(auditLogger))
+	}
+	if config.MetadataShared {
+		options = append(options, oimcsidriver.WithSharedMetadataStore(config.MetadataFile))
+	} else if config.MetadataFile != "" {
+		options = append(options, oimcsidriver.WithMetadataStore(config.MetadataFile))
+	}
+	if config.MaxVolumesPerNode > 0 {
+		options = append(options, oimcsidriver.WithMaxVolumesPerNode(config.MaxVolumesPerNode))
+	}
+	if config.LVStoreCacheTTL > 0 {
+		options = append(options, oimcsidriver.WithLVStoreCacheTTL(config.LVStoreCacheTTL))
+	}
+	if config.CreateBaseDuration > 0 || config.ThickBytesPerSecond > 0 {
+		options = append(options, oimcsidriver.WithDeadlineEstimator(oimcsidriver.DeadlineEstimator{
+			Base:                config.CreateBaseDuration,
+			ThickBytesPerSecond: config.ThickBytesPerSecond,
+		}))
+	}
+	if config.CloneRateLimit > 0 {
+		options = append(options, oimcsidriver.WithCloneRateLimit(config.CloneRateLimit, config.CloneBurst))
+	}
+	if config.ImageDir != "" {
+		options = append(options, oimcsidriver.WithImageDir(config.ImageDir))
+	}
+	if config.TenantTokens != "" {
+		tokens, err := oimcsidriver.LoadTenantTokens(config.TenantTokens)
+		if err != nil {
+			logger.Fatalf("Failed to load tenant tokens: %s\n", err)
+		}
+		options = append(options, oimcsidriver.WithTokenAuth(tokens))
+	}
+	if config.LockEtcdEndpoints != "" {
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   strings.Split(config.LockEtcdEndpoints, ","),
+			DialTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			logger.Fatalf("Failed to create etcd client: %s\n", err)
+		}
+		defer client.Close()
+		lockCtx, cancelLock := context.WithCancel(log.WithLogger(context.Background(), logger))
+		defer cancelLock()
+		store, err := oimcsidriver.NewEtcdLockStore(lockCtx, client, config.LockEtcdPrefix, config.NodeID, config.LockEtcdTTL)
+		if err != nil {
+			logger.Fatalf("Failed to create etcd lock store: %s\n", err)
+		}
+		options = append(options, oimcsidriver.WithLockStore(store))
+	}
+	if config.TopologyConfig != "" {
+		affinity, err := oimcsidriver.LoadNodeAffinity(config.TopologyConfig)
+		if err != nil {
+			logger.Fatalf("Failed to load topology config: %s\n", err)
+		}
+		options = append(options, oimcsidriver.WithNodeAffinity(affinity))
+	}
+	if config.ControllerSelection != "" {
+		selector, err := oimcsidriver.NewControllerSelector(config.ControllerSelection)
+		if err != nil {
+			logger.Fatalf("Invalid OIM controller selection: %s\n", err)
+		}
+		options = append(options, oimcsidriver.WithControllerSelector(selector))
+	}
+	if config.SPDKTraceFile != "" {
+		options = append(options, oimcsidriver.WithSPDKTraceFile(config.SPDKTraceFile))
+	}
+	if config.SPDKMaxFailures > 0 {
+		options = append(options, oimcsidriver.WithSPDKCircuitBreaker(config.SPDKMaxFailures, config.SPDKResetTimeout))
+	}
+	if config.SnapshotGCInterval != 0 {
+		options = append(options, oimcsidriver.WithSnapshotGarbageCollection(config.SnapshotGCInterval))
+	}
+	if config.DefragSchedule != "" {
+		options = append(options, oimcsidriver.WithDefragmentation(config.DefragSchedule, config.DefragIOPSThreshold))
+	}
+	if config.NeedsKubernetes() {
+		kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.Kubeconfig)
+		if err != nil {
+			logger.Fatalf("Failed to create Kubernetes client configuration: %s\n", err)
+		}
+		client, err := kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			logger.Fatalf("Failed to create Kubernetes client: %s\n", err)
+		}
+		if config.PropagateTags {
+			options = append(options, oimcsidriver.WithTagPropagation(client))
+		}
+		if config.ReadCryptoKeySecrets {
+			options = append(options, oimcsidriver.WithSecretReader(oimcsidriver.NewSecretReader(client)))
+		}
+		if config.StorageClassDefaults {
+			defaults, err := oimcsidriver.LoadDefaultStorageClassConfig(client, config.Namespace)
+			if err != nil {
+				logger.Fatalf("Failed to load StorageClass defaults: %s\n", err)
+			}
+			options = append(options, oimcsidriver.WithStorageClassDefaults(defaults))
+		}
+		if config.RecordEvents {
+			options = append(options, oimcsidriver.WithEventRecorder(oimcsidriver.NewEventRecorder(client, config.DriverName)))
+		}
+		if config.TrackRevisions {
+			dynamicClient, err := dynamic.NewForConfig(kubeConfig)
+			if err != nil {
+				logger.Fatalf("Failed to create dynamic Kubernetes client: %s\n", err)
+			}
+			options = append(options, oimcsidriver.WithStorageClassVersioning(client, dynamicClient))
+		}
 	}
 	driver, err := oimcsidriver.New(options...)
 	if err != nil {
 		logger.Fatalf("Failed to initialize driver: %s\n", err)
 	}
-	if err := driver.Run(context.Background()); err != nil {
+	if config.EnableProfiling {
+		go func() {
+			logger.Fatal(oimcsidriver.ServeProfiling(config.ProfilingPort))
+		}()
+	}
+	if config.WebhookAddress != "" {
+		cert, err := tls.LoadX509KeyPair(config.WebhookCertFile, config.WebhookKeyFile)
+		if err != nil {
+			logger.Fatalf("Failed to load webhook certificate: %s\n", err)
+		}
+		webhook := oimcsidriver.NewWebhookServer(config.DriverName)
+		if err := webhook.Start(config.WebhookAddress, &tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+			logger.Fatalf("Failed to start webhook: %s\n", err)
+		}
+	}
+	if config.MetricsEndpoint != "" {
+		go func() {
+			logger.Fatal(driver.ServeMetrics(config.MetricsEndpoint))
+		}()
+	}
+	ctx := log.WithLogger(context.Background(), logger)
+	stop := oimcsidriver.GracefulStopOnSignal(ctx, driver, config.DrainTimeout, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if config.ConfigFile != "" {
+		stopReload := oimcsidriver.ReloadOnSignal(ctx, driver, config, syscall.SIGHUP)
+		defer stopReload()
+	}
+	if err := driver.Run(ctx); err != nil {
 		logger.Fatal(err)
 	}
 }
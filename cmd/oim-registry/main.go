@@ -17,7 +17,6 @@ import (
 )
 
 var (
-	version      = "unknown" // set at build time
 	printVersion = flag.Bool("version", false, "output version information and exit")
 	endpoint     = flag.String("endpoint", "unix:///tmp/registry.sock", "OIM registry endpoint")
 	ca           = flag.String("ca", "", "the required CA's .crt file which is used for verifying connections")
@@ -33,7 +32,7 @@ func main() {
 	log.Set(logger)
 
 	if *printVersion {
-		logger.Infof("oim-registry %s", version)
+		logger.Infof("oim-registry %s", oimcommon.Version)
 		return
 	}
 
@@ -22,7 +22,6 @@ import (
 )
 
 var (
-	version      = "unknown" // set at build time
 	printVersion = flag.Bool("version", false, "output version information and exit")
 
 	endpoint = flag.String("registry", "", "the gRPC endpoint of the OIM registry (for example, dns:///localhost:8999)")
@@ -50,7 +49,7 @@ func main() {
 	log.Set(logger)
 
 	if *printVersion {
-		logger.Infof("oimctl %s", version)
+		logger.Infof("oimctl %s", oimcommon.Version)
 		return
 	}
 
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcommon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// A Monday.
+	now := time.Date(2018, 10, 15, 10, 30, 20, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+		err  string
+	}{
+		{"* * * * *", time.Date(2018, 10, 15, 10, 31, 0, 0, time.UTC), ""},
+		{"*/15 * * * *", time.Date(2018, 10, 15, 10, 45, 0, 0, time.UTC), ""},
+		{"30 2 * * *", time.Date(2018, 10, 16, 2, 30, 0, 0, time.UTC), ""},
+		{"0 3 * * 0", time.Date(2018, 10, 21, 3, 0, 0, 0, time.UTC), ""},
+		{"0 0 1 1 *", time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), ""},
+		{"0 22-23 * * 1-5", time.Date(2018, 10, 15, 22, 0, 0, 0, time.UTC), ""},
+		{"5,35 10 * * *", time.Date(2018, 10, 15, 10, 35, 0, 0, time.UTC), ""},
+		// Either day of month or day of week.
+		{"0 0 20 * 2", time.Date(2018, 10, 16, 0, 0, 0, 0, time.UTC), ""},
+		{"0 0 30 2 *", time.Time{}, ""},
+		{"* * * *", time.Time{}, `cron expression "* * * *": expected 5 fields, got 4`},
+		{"60 * * * *", time.Time{}, `cron expression "60 * * * *": minute: "60" out of range 0-59`},
+		{"*/0 * * * *", time.Time{}, `cron expression "*/0 * * * *": minute: invalid step in "*/0"`},
+		{"a * * * *", time.Time{}, `cron expression "a * * * *": minute: invalid value in "a"`},
+		{"* * 0 * *", time.Time{}, `cron expression "* * 0 * *": day of month: "0" out of range 1-31`},
+	}
+
+	for _, c := range cases {
+		schedule, err := ParseCronSchedule(c.expr)
+		if c.err != "" {
+			if assert.Error(t, err, c.expr) {
+				assert.Equal(t, c.err, err.Error(), c.expr)
+			}
+			continue
+		}
+		if assert.NoError(t, err, c.expr) {
+			assert.Equal(t, c.next, schedule.Next(now), c.expr)
+		}
+	}
+}
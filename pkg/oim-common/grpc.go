@@ -75,19 +75,36 @@ func ChooseDialOpts(endpoint string, opts ...grpc.DialOption) []grpc.DialOption
 // file (foo.crt, implies foo.key) or the base name (foo for foo.crt
 // and foo.key).
 func LoadTLSConfig(caFile, key, peerName string) (*tls.Config, error) {
+	crtFile, keyFile := TLSFiles(key)
+	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load X509 key pair for key=%q", key)
+	}
+
+	tlsConfig, err := NewTLSConfig(caFile, peerName)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+	return tlsConfig, nil
+}
+
+// TLSFiles returns the names of the .crt and .key file for a key
+// parameter as accepted by LoadTLSConfig.
+func TLSFiles(key string) (crtFile, keyFile string) {
 	var base string
 	if strings.HasSuffix(key, ".key") || strings.HasSuffix(key, ".crt") {
 		base = key[0 : len(key)-4]
 	} else {
 		base = key
 	}
-	crtFile := base + ".crt"
-	keyFile := base + ".key"
-	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
-	if err != nil {
-		return nil, errors.Wrapf(err, "load X509 key pair for key=%q", key)
-	}
+	return base + ".crt", base + ".key"
+}
 
+// NewTLSConfig is like LoadTLSConfig, except that it does not load
+// any certificate. The caller is responsible for setting either
+// Certificates or the GetCertificate/GetClientCertificate callbacks.
+func NewTLSConfig(caFile, peerName string) (*tls.Config, error) {
 	certPool := x509.NewCertPool()
 	bs, err := ioutil.ReadFile(caFile) // nolint: gosec
 	if err != nil {
@@ -118,10 +135,9 @@ func LoadTLSConfig(caFile, key, peerName string) (*tls.Config, error) {
 			return nil
 		},
 
-		Certificates: []tls.Certificate{certificate},
-		RootCAs:      certPool,
-		ClientCAs:    certPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
+		RootCAs:    certPool,
+		ClientCAs:  certPool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
 	}
 	return tlsConfig, nil
 }
@@ -18,6 +18,10 @@ const (
 
 	// RegistryPCI is the special registry path element with the PCI address of an accelerator card.
 	RegistryPCI = "pci"
+
+	// RegistryFreeBytes is the special registry path element with the
+	// storage capacity that is still available in an OIM controller.
+	RegistryFreeBytes = "free-bytes"
 )
 
 // SplitRegistryPath separates the path into elements.
@@ -43,12 +43,30 @@ func ParseEndpoint(ep string) (string, string, error) {
 type NonBlockingGRPCServer struct {
 	Endpoint      string
 	ServerOptions []grpc.ServerOption
-	wg            sync.WaitGroup
-	server        *grpc.Server
+	// Interceptors are called in order after logging the request.
+	Interceptors []grpc.UnaryServerInterceptor
+	wg           sync.WaitGroup
+	server       *grpc.Server
 
 	addr net.Addr
 }
 
+// ChainUnaryServer combines several interceptors into one. The first
+// one is the outermost, i.e. it gets called first and sees the final
+// result.
+func ChainUnaryServer(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
 // RegisterService is a callback that adds a service to the given gRPC server.
 type RegisterService func(*grpc.Server)
 
@@ -81,7 +99,7 @@ func (s *NonBlockingGRPCServer) Start(ctx context.Context, services ...RegisterS
 	// 		opentracing.GlobalTracer(),
 	// 		otgrpc.SpanDecorator(TraceGRPCPayload(formatter))),
 	// 	LogGRPCServer(logger, formatter))
-	interceptor := LogGRPCServer(logger, formatter)
+	interceptor := ChainUnaryServer(append([]grpc.UnaryServerInterceptor{LogGRPCServer(logger, formatter)}, s.Interceptors...)...)
 	opts := []grpc.ServerOption{
 		grpc.UnaryInterceptor(interceptor),
 	}
@@ -7,9 +7,11 @@ SPDX-License-Identifier: Apache-2.0
 package oimcommon
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
 )
 
 func TestParseEndpoint(t *testing.T) {
@@ -64,3 +66,25 @@ func TestParseEndpoint(t *testing.T) {
 	_, _, err = ParseEndpoint("")
 	assert.NotNil(t, err)
 }
+
+func TestChainUnaryServer(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name+" pre")
+			resp, err := handler(ctx, req)
+			calls = append(calls, name+" post")
+			return resp, err
+		}
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return req, nil
+	}
+
+	chain := ChainUnaryServer(interceptor("first"), interceptor("second"))
+	resp, err := chain(context.Background(), "request", &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "request", resp)
+	assert.Equal(t, []string{"first pre", "second pre", "handler", "second post", "first post"}, calls)
+}
@@ -0,0 +1,38 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcommon
+
+import (
+	"runtime"
+
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// Version, GitCommit and BuildDate describe the binary. The Makefile
+// sets them with -ldflags -X. Version is the output of "git describe"
+// and therefore a semantic version like v0.1.0-12-g0123abc.
+var (
+	Version   = "v0.0.0-unknown"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// BuildManifest returns information about the binary in the format
+// used for the manifest in the CSI GetPluginInfo response.
+func BuildManifest() map[string]string {
+	return map[string]string{
+		"gitCommit": GitCommit,
+		"buildDate": BuildDate,
+		"goVersion": runtime.Version(),
+	}
+}
+
+// ValidateVersion checks that the version is a semantic version.
+func ValidateVersion(v string) error {
+	_, err := version.ParseSemantic(v)
+	return err
+}
@@ -0,0 +1,35 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcommon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersion(t *testing.T) {
+	// Whatever gets set at build time must also be valid.
+	assert.NoError(t, ValidateVersion(Version), "Version")
+
+	for v, valid := range map[string]bool{
+		"v0.1.0":                   true,
+		"v0.1.0-12-g0123abc":       true,
+		"v0.1.0-12-g0123abc-dirty": true,
+		"1.2.3":                    true,
+		"unknown":                  false,
+		"0123abc":                  false,
+		"v1.2":                     false,
+	} {
+		err := ValidateVersion(v)
+		if valid {
+			assert.NoError(t, err, v)
+		} else {
+			assert.Error(t, err, v)
+		}
+	}
+}
@@ -8,6 +8,7 @@ package oimcontroller
 
 import (
 	"context"
+	"strconv"
 	"sync"
 	"time"
 
@@ -465,6 +466,35 @@ func (c *Controller) register(ctx context.Context) {
 			Value: c.controllerAddr,
 		},
 	})
+
+	// Also publish how much storage is left, for GetCapacity in
+	// the OIM CSI driver.
+	if c.SPDK != nil {
+		free, err := c.freeBytes(ctx)
+		if err != nil {
+			log.L().Infow("determining free capacity", "error", err)
+			return
+		}
+		registry.SetValue(ctx, &oim.SetValueRequest{
+			Value: &oim.Value{
+				Path:  c.controllerID + "/" + oimcommon.RegistryFreeBytes,
+				Value: strconv.FormatInt(free, 10),
+			},
+		})
+	}
+}
+
+// freeBytes returns the combined free space of all logical volume stores.
+func (c *Controller) freeBytes(ctx context.Context) (int64, error) {
+	lvstores, err := spdk.GetLVStores(ctx, c.SPDK, spdk.GetLVStoresArgs{})
+	if err != nil {
+		return 0, errors.Wrap(err, "GetLVStores")
+	}
+	var free int64
+	for _, lvs := range lvstores {
+		free += lvs.FreeBytes()
+	}
+	return free, nil
 }
 
 // Close ends the interaction with the OIM Registry, if one was configured,
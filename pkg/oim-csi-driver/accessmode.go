@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
+)
+
+// accessModeSupport describes whether a backend supports an access
+// mode.
+type accessModeSupport struct {
+	supported bool
+	// readOnly restricts the mode to volumes which never change,
+	// i.e. snapshots.
+	readOnly bool
+	// reason explains why the mode is not supported.
+	reason string
+}
+
+// accessModes is the capability table of a backend. Modes which
+// are not listed are not supported.
+type accessModes map[csi.VolumeCapability_AccessMode_Mode]accessModeSupport
+
+var (
+	// While in theory writing blocks on one node and reading them on others could work,
+	// in practice caching effects might break that. Better don't allow it.
+	multiNodeSingleWriter = accessModeSupport{reason: "multi-node reader, single writer not supported"}
+	// Neither the block device nor the filesystems on top of it
+	// coordinate writes from different nodes, so allowing this
+	// would corrupt data.
+	multiNodeMultiWriter = accessModeSupport{reason: "multi-node reader, multi-node writer not supported"}
+
+	localAccessModes = accessModes{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:       {supported: true},
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:  {supported: true},
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:   {supported: true, readOnly: true},
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: multiNodeSingleWriter,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:  multiNodeMultiWriter,
+	}
+
+	remoteAccessModes = accessModes{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:      {supported: true},
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: {supported: true},
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY: {
+			reason: "multi-node reader only not supported, the OIM controller only provides writable volumes",
+		},
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: multiNodeSingleWriter,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:  multiNodeMultiWriter,
+	}
+)
+
+// checkAccessMode returns the reason why the access mode cannot be
+// used for the volume, or an empty string if it can. Without a
+// volume ID (i.e. before creating the volume), restrictions for
+// read-only modes are not checked.
+func (od *oimDriver) checkAccessMode(ctx context.Context, volumeID string, mode csi.VolumeCapability_AccessMode_Mode) (string, error) {
+	support, ok := od.accessModes[mode]
+	if !ok {
+		return fmt.Sprintf("%s not supported", mode), nil
+	}
+	if !support.supported {
+		return support.reason, nil
+	}
+	if support.readOnly && volumeID != "" {
+		return od.checkMultiNodeReader(ctx, volumeID)
+	}
+	return "", nil
+}
+
+// accessMode0 converts a CSI 0.3 access mode. Both versions use the
+// same numbers.
+func accessMode0(mode csi0.VolumeCapability_AccessMode_Mode) csi.VolumeCapability_AccessMode_Mode {
+	return csi.VolumeCapability_AccessMode_Mode(mode)
+}
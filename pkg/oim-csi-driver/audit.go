@@ -0,0 +1,110 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// AuditRecord describes one mutating CSI operation.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// Name is the name chosen by the CO for a new volume or snapshot.
+	Name       string `json:"name,omitempty"`
+	VolumeID   string `json:"volume_id,omitempty"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	// Peer is the address of the client. Identity is the common
+	// name from its certificate, if it connected via TLS.
+	Peer     string `json:"peer,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	// Code is the gRPC status code of the operation, "OK" on
+	// success.
+	Code  string `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLogger records mutating CSI operations.
+type AuditLogger interface {
+	Audit(record AuditRecord) error
+}
+
+// JSONAuditLogger writes each record as one line of JSON.
+type JSONAuditLogger struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+var _ AuditLogger = &JSONAuditLogger{}
+
+// NewJSONAuditLogger creates a logger which writes to out.
+func NewJSONAuditLogger(out io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger{encoder: json.NewEncoder(out)}
+}
+
+// OpenAuditLog creates a logger which appends to the file, or
+// writes to stdout for "-". The file remains open for the lifetime of
+// the process.
+func OpenAuditLog(path string) (*JSONAuditLogger, error) {
+	if path == "-" {
+		return NewJSONAuditLogger(os.Stdout), nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600) // nolint: gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "open audit log")
+	}
+	return NewJSONAuditLogger(file), nil
+}
+
+// Audit implements AuditLogger. The encoder writes each line with a
+// single Write call, so records do not get interleaved in files
+// opened for appending.
+func (l *JSONAuditLogger) Audit(record AuditRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.encoder.Encode(record)
+}
+
+// audit completes the record with the information from the context
+// and the result of the operation and logs it, if enabled. Failures
+// are logged, but do not fail the operation.
+func (od *oimDriver) audit(ctx context.Context, record AuditRecord, err error) {
+	if od.auditLogger == nil {
+		return
+	}
+	record.Time = time.Now().UTC()
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			record.Peer = p.Addr.String()
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			record.Identity = tlsInfo.State.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	record.Code = status.Code(err).String()
+	if err != nil {
+		record.Error = status.Convert(err).Message()
+	}
+	if err := od.auditLogger.Audit(record); err != nil {
+		log.FromContext(ctx).Errorw("audit log failed",
+			"operation", record.Operation,
+			"error", err,
+		)
+	}
+}
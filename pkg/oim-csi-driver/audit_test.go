@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/peer"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func parseAuditRecords(t *testing.T, data []byte) []AuditRecord {
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), "line %q", scanner.Text())
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAudit(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+	var out bytes.Buffer
+	driver, err := New(WithVHostEndpoint(fake.Path), WithAuditLogger(NewJSONAuditLogger(&out)))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.UnixAddr{Name: "/csi/csi.sock", Net: "unix"},
+	})
+
+	volume, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	require.NoError(t, err)
+	volumeID := volume.GetVolume().GetVolumeId()
+	snapshot, err := od.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           "snap",
+		SourceVolumeId: volumeID,
+	})
+	require.NoError(t, err)
+	snapshotID := snapshot.GetSnapshot().GetSnapshotId()
+	_, err = od.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	require.NoError(t, err)
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	_, err = od.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "invalid"})
+	require.Error(t, err)
+	// Read-only operations are not recorded.
+	_, err = od.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+
+	records := parseAuditRecords(t, out.Bytes())
+	require.Len(t, records, 5, "records: %s", out.String())
+	for i, record := range records {
+		assert.False(t, record.Time.IsZero(), "time of record #%d", i)
+		assert.Equal(t, "/csi/csi.sock", record.Peer, "peer of record #%d", i)
+	}
+	expected := []AuditRecord{
+		{Operation: "CreateVolume", Name: "vol", VolumeID: volumeID, Code: "OK"},
+		{Operation: "CreateSnapshot", Name: "snap", VolumeID: volumeID, SnapshotID: snapshotID, Code: "OK"},
+		{Operation: "DeleteSnapshot", SnapshotID: snapshotID, Code: "OK"},
+		{Operation: "DeleteVolume", VolumeID: volumeID, Code: "OK"},
+		{Operation: "CreateVolume", Name: "invalid", Code: "InvalidArgument", Error: "Volume Capabilities missing in request"},
+	}
+	for i := range expected {
+		expected[i].Time = records[i].Time
+		expected[i].Peer = records[i].Peer
+	}
+	assert.Equal(t, expected, records)
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "audit.log")
+
+	// Existing content is kept.
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"operation":"old","code":"OK"}`+"\n"), 0600))
+	logger, err := OpenAuditLog(path)
+	require.NoError(t, err)
+	require.NoError(t, logger.Audit(AuditRecord{Operation: "new", Code: "OK"}))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	records := parseAuditRecords(t, data)
+	require.Len(t, records, 2)
+	assert.Equal(t, "old", records[0].Operation)
+	assert.Equal(t, "new", records[1].Operation)
+
+	_, err = OpenAuditLog(filepath.Join(tmp, "no-such-dir", "audit.log"))
+	assert.Error(t, err)
+}
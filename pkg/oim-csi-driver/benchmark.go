@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// benchmarkParameter is the StorageClass parameter which enables
+// running FIOBenchmark in NodeStageVolume.
+const benchmarkParameter = "run_benchmark_on_attach"
+
+// BenchmarkResult is the baseline performance of a volume as
+// measured by FIOBenchmark.
+type BenchmarkResult struct {
+	ReadIOPS          float64 `json:"read_iops"`
+	WriteIOPS         float64 `json:"write_iops"`
+	ReadLatencyP99us  float64 `json:"read_latency_p99_us"`
+	WriteLatencyP99us float64 `json:"write_latency_p99_us"`
+}
+
+// FIOBenchmark measures the performance of a block device with fio.
+// The default workload only reads, so it is safe to run on a device
+// which already contains data.
+type FIOBenchmark struct {
+	// Command is the fio binary.
+	Command string
+	// Jobs is the number of parallel jobs.
+	Jobs int
+	// BlockSize is the size of each I/O request.
+	BlockSize string
+	// ReadWrite is the I/O pattern, as in the fio rw option.
+	ReadWrite string
+	// Runtime is how long fio runs.
+	Runtime time.Duration
+}
+
+// NewFIOBenchmark returns a benchmark with four jobs doing 4K random
+// reads for 10 seconds.
+func NewFIOBenchmark() *FIOBenchmark {
+	return &FIOBenchmark{
+		Command:   "fio",
+		Jobs:      4,
+		BlockSize: "4k",
+		ReadWrite: "randread",
+		Runtime:   10 * time.Second,
+	}
+}
+
+func benchmarkEnabled(volumeContext map[string]string) bool {
+	return volumeContext[benchmarkParameter] == "true"
+}
+
+// Run invokes fio for the device and returns the aggregated result
+// of all jobs.
+func (b *FIOBenchmark) Run(ctx context.Context, devicePath string) (BenchmarkResult, error) {
+	args := []string{
+		"--name=oim-benchmark",
+		"--filename=" + devicePath,
+		"--direct=1",
+		"--ioengine=libaio",
+		"--rw=" + b.ReadWrite,
+		"--bs=" + b.BlockSize,
+		fmt.Sprintf("--numjobs=%d", b.Jobs),
+		fmt.Sprintf("--runtime=%d", int(b.Runtime.Seconds())),
+		"--time_based",
+		"--group_reporting",
+		"--output-format=json",
+	}
+	if b.ReadWrite == "read" || b.ReadWrite == "randread" {
+		args = append(args, "--readonly")
+	}
+	cmd := exec.CommandContext(ctx, b.Command, args...)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return BenchmarkResult{}, errors.Wrapf(err, "%s: %s", b.Command, string(exitErr.Stderr))
+		}
+		return BenchmarkResult{}, errors.Wrap(err, b.Command)
+	}
+	return parseFIOOutput(output)
+}
+
+// fioOutput contains the parts of the fio JSON output that we need.
+type fioOutput struct {
+	Jobs []struct {
+		Read  fioStats `json:"read"`
+		Write fioStats `json:"write"`
+	} `json:"jobs"`
+}
+
+type fioStats struct {
+	IOPS   float64 `json:"iops"`
+	ClatNS struct {
+		Percentile map[string]float64 `json:"percentile"`
+	} `json:"clat_ns"`
+}
+
+func (s fioStats) p99us() float64 {
+	return s.ClatNS.Percentile["99.000000"] / 1000
+}
+
+func parseFIOOutput(output []byte) (BenchmarkResult, error) {
+	var parsed fioOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return BenchmarkResult{}, errors.Wrap(err, "parse fio output")
+	}
+	// With --group_reporting there is exactly one entry.
+	if len(parsed.Jobs) != 1 {
+		return BenchmarkResult{}, errors.Errorf("expected one job in fio output, got %d", len(parsed.Jobs))
+	}
+	job := parsed.Jobs[0]
+	return BenchmarkResult{
+		ReadIOPS:          job.Read.IOPS,
+		WriteIOPS:         job.Write.IOPS,
+		ReadLatencyP99us:  job.Read.p99us(),
+		WriteLatencyP99us: job.Write.p99us(),
+	}, nil
+}
+
+// runBenchmark stores the result in the volume metadata. Failures
+// are only logged because the volume is usable without a benchmark.
+func (od *oimDriver) runBenchmark(ctx context.Context, volumeID, device string) {
+	log.FromContext(ctx).Infow("running benchmark", "volumeid", volumeID, "device", device)
+	result, err := od.benchmark.Run(ctx, device)
+	if err != nil {
+		log.FromContext(ctx).Warnw("benchmark failed", "volumeid", volumeID, "error", err)
+		return
+	}
+	log.FromContext(ctx).Infow("benchmark done", "volumeid", volumeID, "result", result)
+	od.metadata.update(volumeID, func(metadata *VolumeMetadata) {
+		metadata.Benchmark = &result
+	})
+}
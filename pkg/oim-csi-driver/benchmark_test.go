@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+// fioJSON is a shortened version of the output of fio 3.1.
+const fioJSON = `{
+  "fio version" : "fio-3.1",
+  "jobs" : [
+    {
+      "jobname" : "oim-benchmark",
+      "read" : {
+        "io_bytes" : 4096000,
+        "iops" : 25000.5,
+        "clat_ns" : {
+          "percentile" : {
+            "50.000000" : 142336,
+            "99.000000" : 257024
+          }
+        }
+      },
+      "write" : {
+        "io_bytes" : 0,
+        "iops" : 0.0,
+        "clat_ns" : {
+          "percentile" : {
+            "99.000000" : 0
+          }
+        }
+      }
+    }
+  ]
+}`
+
+func TestFIOBenchmark(t *testing.T) {
+	result, err := parseFIOOutput([]byte(fioJSON))
+	require.NoError(t, err)
+	assert.Equal(t, BenchmarkResult{ReadIOPS: 25000.5, ReadLatencyP99us: 257.024}, result)
+
+	_, err = parseFIOOutput([]byte(`{"jobs": []}`))
+	assert.Error(t, err, "no jobs")
+	_, err = parseFIOOutput([]byte(`garbage`))
+	assert.Error(t, err, "invalid JSON")
+
+	// Replace fio with a script which checks some parameters.
+	tmp, err := ioutil.TempDir("", "fio")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	fio := filepath.Join(tmp, "fio")
+	err = ioutil.WriteFile(fio, []byte(`#!/bin/sh
+case "$*" in *--filename=/dev/foo*--readonly*) ;; *) echo "unexpected: $*" >&2; exit 1;; esac
+cat <<EOF
+`+fioJSON+`
+EOF
+`), 0700)
+	require.NoError(t, err)
+	b := NewFIOBenchmark()
+	b.Command = fio
+	result, err = b.Run(context.Background(), "/dev/foo")
+	require.NoError(t, err)
+	assert.Equal(t, 25000.5, result.ReadIOPS)
+	_, err = b.Run(context.Background(), "/dev/bar")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unexpected")
+	}
+}
+
+func TestVolumeInspect(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetBDevsArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		if args.Name == "vol1" || args.Name == "vol2" {
+			return []spdk.BDev{{Name: args.Name, BlockSize: 512, NumBlocks: 2048}}, nil
+		}
+		return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "no such bdev"}
+	})
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	endpoint := "unix://" + tmp + "/oim-driver.sock"
+	driver, err := New(WithCSIEndpoint(endpoint), WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	result := BenchmarkResult{ReadIOPS: 1000}
+	driver.(*oimDriver03).metadata.update("vol1", func(metadata *VolumeMetadata) {
+		metadata.Benchmark = &result
+	})
+	s, err := driver.Start(ctx)
+	require.NoError(t, err)
+	defer s.ForceStop(ctx)
+
+	opts := oimcommon.ChooseDialOpts(endpoint, grpc.WithBlock(), grpc.WithInsecure())
+	conn, err := grpc.Dial(endpoint, opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	metadata, err := VolumeInspect(ctx, conn, "vol1")
+	require.NoError(t, err)
+	assert.Equal(t, &VolumeMetadata{Benchmark: &result}, metadata, "with benchmark")
+
+	metadata, err = VolumeInspect(ctx, conn, "vol2")
+	require.NoError(t, err)
+	assert.Equal(t, &VolumeMetadata{}, metadata, "no metadata")
+
+	_, err = VolumeInspect(ctx, conn, "no-such-volume")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %s", err)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/mount"
+)
+
+// blockDeviceFile is the block special file inside the staging
+// directory of a raw block volume. It stays valid after the
+// temporary device node from the backend is gone.
+const blockDeviceFile = "device"
+
+// deviceNumber returns the major:minor number of a block device.
+func deviceNumber(info os.FileInfo) (uint64, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return 0, errors.Errorf("%s is not a block device", info.Name())
+	}
+	return uint64(stat.Rdev), nil // nolint: unconvert
+}
+
+// kernelDevice returns /dev/<name> for a block device as named by
+// the kernel, found via the <major>:<minor> symlink under sys
+// (normally /sys/dev/block), or an empty string if unknown.
+func kernelDevice(sys string, rdev uint64) string {
+	path, err := filepath.EvalSymlinks(filepath.Join(sys, fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev))))
+	if err != nil {
+		return ""
+	}
+	return "/dev/" + filepath.Base(path)
+}
+
+// stageBlock provides a raw block volume in the staging directory
+// instead of formatting and mounting it.
+func (od *oimDriver) stageBlock(ctx context.Context, lock *volumeLock, volumeID, stagingTargetPath string, request interface{}, volumeContext map[string]string) error {
+	node := filepath.Join(stagingTargetPath, blockDeviceFile)
+	if info, err := os.Stat(node); err == nil {
+		if _, err := deviceNumber(info); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		// Already staged, nothing to do.
+		return nil
+	}
+	if err := os.MkdirAll(stagingTargetPath, 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	log.FromContext(ctx).Infow("staging block device",
+		"target", stagingTargetPath,
+		"volumeid", volumeID,
+	)
+	device, cleanup, err := od.createDevice(ctx, volumeID, request, volumeContext)
+	if cleanup != nil {
+		defer cleanup()
+	}
+	if err != nil {
+		return err
+	}
+	lock.attach()
+	if err := checkDeviceSize(device, volumeContext); err != nil {
+		return err
+	}
+	if err := checkDeviceSerial(ctx, "/sys/dev/block", device, volumeContext); err != nil {
+		return err
+	}
+	checkNUMANode(ctx, "/sys", "/proc", volumeContext)
+	info, err := os.Stat(device)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	rdev, err := deviceNumber(info)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := syscall.Mknod(node, syscall.S_IFBLK|0600, int(rdev)); err != nil {
+		return status.Error(codes.Internal, errors.Wrap(err, "mknod").Error())
+	}
+	return nil
+}
+
+// unstageBlock undoes stageBlock. It returns false if the volume
+// was not staged as raw block volume.
+func (od *oimDriver) unstageBlock(ctx context.Context, volumeID, stagingTargetPath string) (bool, error) {
+	node := filepath.Join(stagingTargetPath, blockDeviceFile)
+	info, err := os.Stat(node)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, status.Error(codes.Internal, err.Error())
+	}
+	rdev, err := deviceNumber(info)
+	if err != nil {
+		return true, status.Error(codes.Internal, err.Error())
+	}
+	log.FromContext(ctx).Infow("unstaging block device",
+		"target", stagingTargetPath,
+		"volumeid", volumeID,
+	)
+	device := kernelDevice("/sys/dev/block", rdev)
+	if err := os.Remove(node); err != nil {
+		return true, status.Error(codes.Internal, err.Error())
+	}
+	return true, od.deleteDevice(ctx, volumeID, device)
+}
+
+// publishBlock bind-mounts the staged block device onto a block
+// special file at the target path.
+func publishBlock(mounter mount.Interface, volumeID, stagingTargetPath, targetPath string, readOnly bool) error {
+	info, err := os.Stat(filepath.Join(stagingTargetPath, blockDeviceFile))
+	if os.IsNotExist(err) {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s not staged at %s", volumeID, stagingTargetPath))
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	rdev, err := deviceNumber(info)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// A bind-mounted file cannot be detected reliably by comparing
+	// it with its parent directory, so check the mount table.
+	notMnt, err := mount.IsNotMountPoint(mounter, targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return status.Error(codes.Internal, errors.Wrap(err, "validate target path").Error())
+	}
+	if err == nil && !notMnt {
+		// Already published.
+		return nil
+	}
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+			return status.Error(codes.Internal, errors.Wrap(err, "make target dir").Error())
+		}
+		if err := syscall.Mknod(targetPath, syscall.S_IFBLK|0600, int(rdev)); err != nil {
+			return status.Error(codes.Internal, errors.Wrap(err, "mknod").Error())
+		}
+	}
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	if err := mounter.Mount(filepath.Join(stagingTargetPath, blockDeviceFile), targetPath, "", options); err != nil {
+		os.Remove(targetPath) // nolint: gosec
+		return status.Error(codes.Internal, errors.Wrap(err, "bind mount of block device failed").Error())
+	}
+	return nil
+}
+
+// unpublishBlock removes a block device created by publishBlock. It
+// returns false if the target is not a block device.
+func unpublishBlock(mounter mount.Interface, targetPath string) (bool, error) {
+	info, err := os.Stat(targetPath)
+	if err != nil || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return false, nil
+	}
+	notMnt, err := mount.IsNotMountPoint(mounter, targetPath)
+	if err != nil {
+		return true, status.Error(codes.Internal, errors.Wrap(err, "check target path").Error())
+	}
+	if !notMnt {
+		if err := mounter.Unmount(targetPath); err != nil {
+			return true, status.Error(codes.Internal, errors.Wrap(err, "unmount failed").Error())
+		}
+	}
+	if err := os.Remove(targetPath); err != nil {
+		return true, status.Error(codes.Internal, err.Error())
+	}
+	return true, nil
+}
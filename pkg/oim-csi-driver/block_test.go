@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/mount"
+)
+
+// setupLoopDevice attaches a new loop device to a file with the
+// given size and returns its name, or skips the test if that is not
+// possible.
+func setupLoopDevice(t *testing.T, size int64) (string, func()) {
+	file, err := ioutil.TempFile("", "loop")
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, file.Truncate(size))
+	out, err := exec.Command("losetup", "--find", "--show", file.Name()).CombinedOutput()
+	if err != nil {
+		os.Remove(file.Name())
+		t.Skipf("setting up loop device failed: %s: %s", err, out)
+	}
+	device := strings.TrimSpace(string(out))
+	return device, func() {
+		exec.Command("losetup", "--detach", device).Run()
+		os.Remove(file.Name())
+	}
+}
+
+func TestBlockVolume(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	device, cleanup := setupLoopDevice(t, mib)
+	defer cleanup()
+	nvme := &fakeNVMeExecutor{device: device}
+	od, fake, _ := newFakeDriver(t, WithNVMeExecutor(nvme))
+	defer fake.Close()
+
+	tmp, err := ioutil.TempDir("", "block")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	stagingTargetPath := filepath.Join(tmp, "staging")
+	targetPath := filepath.Join(tmp, "pod", "volume")
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	publish := func() error {
+		_, err := od.oimDriver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol",
+			StagingTargetPath: stagingTargetPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+	stage := func() error {
+		_, err := od.oimDriver.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol",
+			StagingTargetPath: stagingTargetPath,
+			VolumeCapability:  capability,
+			VolumeContext: map[string]string{
+				transportContextKey: nvmeofTransport,
+				nqnContextKey:       "nqn.2016-06.io.spdk:cnode1",
+				traddrContextKey:    "192.168.0.1",
+				trsvcidContextKey:   "4420",
+			},
+		})
+		return err
+	}
+	isBlockDevice := func(path string) bool {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false
+		}
+		_, err = deviceNumber(info)
+		return err == nil
+	}
+
+	err = publish()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "not staged: %v", err)
+
+	require.NoError(t, stage())
+	assert.True(t, isBlockDevice(filepath.Join(stagingTargetPath, blockDeviceFile)), "staged device")
+	require.NoError(t, stage(), "idempotent")
+	assert.Len(t, nvme.calls, 1, "connected once")
+
+	require.NoError(t, publish())
+	mounter := mount.New("")
+	defer mounter.Unmount(targetPath)
+	notMnt, err := mount.IsNotMountPoint(mounter, targetPath)
+	require.NoError(t, err)
+	assert.False(t, notMnt, "published device is mounted")
+	assert.True(t, isBlockDevice(targetPath), "published device")
+	require.NoError(t, publish(), "idempotent")
+
+	_, err = od.oimDriver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol",
+		TargetPath: targetPath,
+	})
+	require.NoError(t, err)
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err), "target removed: %v", err)
+
+	_, err = od.oimDriver.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingTargetPath,
+	})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(stagingTargetPath, blockDeviceFile))
+	assert.True(t, os.IsNotExist(err), "staged device removed: %v", err)
+	assert.Equal(t, "disconnect nqn.2016-06.io.spdk:cnode1", nvme.calls[len(nvme.calls)-1])
+}
@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/fsnotify/fsnotify.v1"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/oim-common"
+)
+
+// CertificateRotator holds the TLS key pair used for connections
+// to the OIM registry in memory and replaces it when the files on
+// disk change, for example because cert-manager rotated them. The
+// tls.Config returned by TLSConfig picks up the current key pair
+// during each TLS handshake, so no restart of the driver is needed.
+type CertificateRotator struct {
+	caFile  string
+	crtFile string
+	keyFile string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+}
+
+// NewCertificateRotator loads the key pair identified by key (same
+// semantic as for oimcommon.LoadTLSConfig) and returns a rotator
+// for it. Call Run to start watching for changes.
+func NewCertificateRotator(caFile, key string) (*CertificateRotator, error) {
+	crtFile, keyFile := oimcommon.TLSFiles(key)
+	cr := &CertificateRotator{
+		caFile:  caFile,
+		crtFile: crtFile,
+		keyFile: keyFile,
+	}
+	if err := cr.reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// TLSConfig returns a configuration which verifies the peer against
+// the CA and presents the most recently loaded certificate. The CA
+// file is read anew for each call because its content can also
+// change over time.
+func (cr *CertificateRotator) TLSConfig(peerName string) (*tls.Config, error) {
+	tlsConfig, err := oimcommon.NewTLSConfig(cr.caFile, peerName)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cr.getCertificate(), nil
+	}
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cr.getCertificate(), nil
+	}
+	return tlsConfig, nil
+}
+
+// Run watches the directories containing the key pair until the
+// context is done. Watching the directories instead of the files
+// themselves also catches the symlink swapping used by Kubernetes
+// when updating secrets.
+func (cr *CertificateRotator) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "create file watcher")
+	}
+	defer watcher.Close()
+	dirs := map[string]bool{
+		filepath.Dir(cr.crtFile): true,
+		filepath.Dir(cr.keyFile): true,
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return errors.Wrapf(err, "watch %s", dir)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-watcher.Events:
+			log.FromContext(ctx).Debugw("TLS files changed",
+				"file", event.Name,
+				"op", event.Op,
+			)
+			// While the files are being replaced, the new
+			// key pair might be incomplete. We keep the
+			// current one in that case and try again on
+			// the next event.
+			if err := cr.reload(ctx); err != nil {
+				log.FromContext(ctx).Warnw("keeping current TLS certificate",
+					"error", err,
+				)
+			}
+		case err := <-watcher.Errors:
+			return errors.Wrap(err, "watching TLS files")
+		}
+	}
+}
+
+func (cr *CertificateRotator) getCertificate() *tls.Certificate {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.certificate
+}
+
+func (cr *CertificateRotator) reload(ctx context.Context) error {
+	certificate, err := tls.LoadX509KeyPair(cr.crtFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "load X509 key pair %s/%s", cr.crtFile, cr.keyFile)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return errors.Wrapf(err, "parse %s", cr.crtFile)
+	}
+	certificate.Leaf = leaf
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cr.certificate != nil && cr.certificate.Leaf.Equal(leaf) {
+		// Nothing changed, avoid logging the same certificate again.
+		return nil
+	}
+	cr.certificate = &certificate
+	log.FromContext(ctx).Infow("loaded TLS certificate",
+		"file", cr.crtFile,
+		"subject", leaf.Subject.CommonName,
+		"expires", leaf.NotAfter,
+	)
+	return nil
+}
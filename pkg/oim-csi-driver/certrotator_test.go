@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func copyFile(t *testing.T, from, to string) {
+	data, err := ioutil.ReadFile(from)
+	require.NoError(t, err)
+	// Write to a temporary file first and then rename, like
+	// tools which update certificates are expected to do.
+	tmp := to + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	require.NoError(t, err)
+	err = os.Rename(tmp, to)
+	require.NoError(t, err)
+}
+
+func TestCertificateRotator(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmp, err := ioutil.TempDir("", "cert-rotator")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	ca := os.ExpandEnv("${TEST_WORK}/ca/ca.crt")
+	install := func(name string) {
+		for _, suffix := range []string{".crt", ".key"} {
+			copyFile(t, os.ExpandEnv("${TEST_WORK}/ca/"+name+suffix), filepath.Join(tmp, "tls"+suffix))
+		}
+	}
+	install("host.host-0")
+
+	cr, err := NewCertificateRotator(ca, filepath.Join(tmp, "tls"))
+	require.NoError(t, err)
+	assert.Equal(t, "host.host-0", cr.getCertificate().Leaf.Subject.CommonName)
+
+	tlsConfig, err := cr.TLSConfig("component.registry")
+	require.NoError(t, err)
+	assert.Empty(t, tlsConfig.Certificates, "static certificates")
+
+	done := make(chan error)
+	go func() {
+		done <- cr.Run(ctx)
+	}()
+
+	// Give the watcher some time to start.
+	time.Sleep(100 * time.Millisecond)
+	install("controller.host-0")
+	commonName := func() string {
+		certificate, err := tlsConfig.GetClientCertificate(nil)
+		require.NoError(t, err)
+		return certificate.Leaf.Subject.CommonName
+	}
+	for start := time.Now(); commonName() != "controller.host-0"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			require.Fail(t, "new certificate not loaded")
+		}
+	}
+
+	// Invalid files are ignored.
+	err = ioutil.WriteFile(filepath.Join(tmp, "tls.crt"), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "controller.host-0", commonName())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
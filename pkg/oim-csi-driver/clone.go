@@ -0,0 +1,134 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// cloneSnapshotSuffix is appended to the name of a new volume to get
+// the name of the temporary snapshot from which it gets cloned.
+const cloneSnapshotSuffix = "-clone-source"
+
+// cloneLVol creates a new logical volume with the content of an
+// existing volume or snapshot. SPDK can only clone snapshots, so for
+// a volume this takes a temporary snapshot of the source first and
+// removes it again at the end. The clone gets inflated, so the
+// resulting volume depends neither on the source nor on a snapshot.
+// Its size is the size of the source unless more is required.
+func (l *localSPDK) cloneLVol(ctx context.Context, client *spdk.Client, name, sourceID string, fromSnapshot bool, requiredBytes, limitBytes int64) (volumeInfo, error) {
+	kind := "volume"
+	if fromSnapshot {
+		kind = "snapshot"
+	}
+	source, err := getLVol(ctx, client, sourceID)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	if source == nil {
+		return volumeInfo{}, status.Error(codes.NotFound, fmt.Sprintf("source %s %s not found", kind, sourceID))
+	}
+	if source.DriverSpecific.LVol.Snapshot != fromSnapshot {
+		return volumeInfo{}, status.Error(codes.InvalidArgument, fmt.Sprintf("%s is not a %s", sourceID, kind))
+	}
+	lvstores, err := spdk.GetLVStores(ctx, client, spdk.GetLVStoresArgs{UUID: source.DriverSpecific.LVol.LVolStoreUUID})
+	if err != nil || len(lvstores) != 1 {
+		return volumeInfo{}, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get logical volume store of %s: %v", sourceID, err))
+	}
+	lvs := lvstores[0]
+
+	sourceSize := source.BlockSize * source.NumBlocks
+	capacity := sourceSize
+	if requiredBytes > capacity {
+		capacity, err = volumeSize(requiredBytes, limitBytes, lvs.ClusterSize)
+		if err != nil {
+			return volumeInfo{}, err
+		}
+	}
+	if limitBytes != 0 && capacity > limitBytes {
+		return volumeInfo{}, status.Error(codes.OutOfRange, fmt.Sprintf("source %s %s with %d bytes exceeds limit %d", kind, sourceID, sourceSize, limitBytes))
+	}
+
+	// The clone is in the same store as the source and can be
+	// found via its alias.
+	existing, err := getLVol(ctx, client, lvs.Name+"/"+name)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	if existing != nil {
+		volSize := existing.BlockSize * existing.NumBlocks
+		if existing.DriverSpecific.LVol.Snapshot || volSize != capacity {
+			return volumeInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different content or size already exist", name))
+		}
+		return volumeInfo{volumeID: existing.UUID, bdevUUID: existing.UUID, lvstoreUUID: lvs.UUID, latencyClass: latencyClass(ctx, client, lvs), numaNode: numaNode(ctx, client, "/sys", lvs), capacityBytes: volSize}, nil
+	}
+	// Inflating allocates all clusters of the clone.
+	if capacity > lvs.FreeBytes() {
+		return volumeInfo{}, status.Error(codes.OutOfRange, fmt.Sprintf("Requested capacity %d exceeds free space %d in logical volume store %s", capacity, lvs.FreeBytes(), lvs.Name))
+	}
+
+	log.FromContext(ctx).Infow("cloning logical volume",
+		"name", name,
+		"source", sourceID,
+		"bytes", capacity,
+	)
+	snapshotID := source.UUID
+	if !fromSnapshot {
+		snapshotID, err = spdk.SnapshotLVol(ctx, client, spdk.SnapshotLVolArgs{
+			LVolName:     source.UUID,
+			SnapshotName: name + cloneSnapshotSuffix,
+		})
+		if err != nil {
+			return volumeInfo{}, status.Error(codes.Internal, fmt.Sprintf("Failed to snapshot source volume: %s", err))
+		}
+		defer func() {
+			// Once the clone is inflated, the source is the only
+			// clone and SPDK merges the snapshot back into it.
+			if err := spdk.DeleteLVol(ctx, client, spdk.LVolArgs{Name: snapshotID}); err != nil {
+				log.FromContext(ctx).Errorw("delete temporary snapshot",
+					"snapshotid", snapshotID,
+					"error", err,
+				)
+			}
+		}()
+	}
+
+	uuid, err := spdk.CloneLVol(ctx, client, spdk.CloneLVolArgs{
+		SnapshotName: snapshotID,
+		CloneName:    name,
+	})
+	if err != nil {
+		return volumeInfo{}, status.Error(codes.Internal, fmt.Sprintf("Failed to clone source %s: %s", kind, err))
+	}
+	// Without inflating, the clone would keep the snapshot alive.
+	// When that or resizing fails, start over on the next attempt.
+	abort := func(what string, err error) (volumeInfo, error) {
+		if err := spdk.DeleteLVol(ctx, client, spdk.LVolArgs{Name: uuid}); err != nil {
+			log.FromContext(ctx).Errorw("delete incomplete clone",
+				"volumeid", uuid,
+				"error", err,
+			)
+		}
+		return volumeInfo{}, status.Error(codes.Internal, fmt.Sprintf("Failed to %s clone: %s", what, err))
+	}
+	if err := spdk.InflateLVol(ctx, client, spdk.LVolArgs{Name: uuid}); err != nil {
+		return abort("inflate", err)
+	}
+	if capacity > sourceSize {
+		if err := spdk.ResizeLVol(ctx, client, spdk.ResizeLVolArgs{Name: uuid, Size: capacity}); err != nil {
+			return abort("resize", err)
+		}
+	}
+	return volumeInfo{volumeID: uuid, bdevUUID: uuid, lvstoreUUID: lvs.UUID, latencyClass: latencyClass(ctx, client, lvs), numaNode: numaNode(ctx, client, "/sys", lvs), capacityBytes: capacity, created: true}, nil
+}
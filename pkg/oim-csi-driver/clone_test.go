@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestCloneVolume(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	sourceID := fl.add("source", 2*mib)
+
+	clone := func(name, sourceID string, requiredBytes int64) (*csi.Volume, error) {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: requiredBytes},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID},
+				},
+			},
+		})
+		return response.GetVolume(), err
+	}
+
+	_, err = clone("missing", "no-such-volume", 0)
+	assert.Equal(t, codes.NotFound, status.Code(err), "missing source: %v", err)
+
+	volume, err := clone("clone", sourceID, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2*mib, volume.GetCapacityBytes(), "size of source")
+	assert.Equal(t, sourceID, volume.GetContentSource().GetVolume().GetVolumeId())
+	lvol := fl.find(volume.GetVolumeId())
+	require.NotNil(t, lvol, "clone created")
+
+	// The clone and the source are independent, the temporary
+	// snapshot is gone.
+	assert.False(t, lvol.DriverSpecific.LVol.Clone, "clone inflated")
+	assert.Nil(t, fl.find("lvs/clone"+cloneSnapshotSuffix), "temporary snapshot removed")
+	assert.False(t, fl.find(sourceID).DriverSpecific.LVol.Clone, "source no longer a clone")
+
+	// Idempotent.
+	again, err := clone("clone", sourceID, 0)
+	require.NoError(t, err)
+	assert.Equal(t, volume.GetVolumeId(), again.GetVolumeId())
+
+	// Larger than the source.
+	larger, err := clone("larger", sourceID, 3*mib)
+	require.NoError(t, err)
+	assert.Equal(t, 3*mib, larger.GetCapacityBytes())
+	lvol = fl.find(larger.GetVolumeId())
+	require.NotNil(t, lvol, "larger clone created")
+	assert.Equal(t, 3*mib, lvol.NumBlocks*lvol.BlockSize)
+
+	// Removing the source does not affect the clone.
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: sourceID})
+	require.NoError(t, err)
+	assert.NotNil(t, fl.find(volume.GetVolumeId()), "clone still exists")
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+	require.NoError(t, err)
+}
+
+func TestVolumeFromSnapshot(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := driver.(*oimDriver03)
+	sourceID := fl.add("source", 2*mib)
+
+	snapshot, err := od.oimDriver.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           "snap",
+		SourceVolumeId: sourceID,
+	})
+	require.NoError(t, err)
+	snapshotID := snapshot.GetSnapshot().GetSnapshotId()
+
+	restore := func(name, snapshotID string) (*csi.Volume, error) {
+		response, err := od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+				},
+			},
+		})
+		return response.GetVolume(), err
+	}
+
+	_, err = restore("missing", "no-such-snapshot")
+	require.Error(t, err)
+	assert.Equal(t, codes.NotFound, status.Code(err), "missing snapshot: %v", err)
+	assert.Contains(t, err.Error(), "snapshot no-such-snapshot not found")
+
+	start := len(fake.Methods())
+	volume, err := restore("restored", snapshotID)
+	require.NoError(t, err)
+	var methods []string
+	for _, method := range fake.Methods()[start:] {
+		if method != "get_bdevs" && method != "bdev_lvol_get_lvstores" {
+			methods = append(methods, method)
+		}
+	}
+	assert.Equal(t, []string{"bdev_lvol_clone", "bdev_lvol_inflate"}, methods, "SPDK calls")
+	lvol := fl.find("lvs/restored")
+	require.NotNil(t, lvol, "volume created")
+	assert.Equal(t, lvol.UUID, volume.GetVolumeId())
+	assert.Equal(t, 2*mib, volume.GetCapacityBytes())
+	assert.False(t, lvol.DriverSpecific.LVol.Clone, "clone inflated")
+
+	// The snapshot is not needed by the new volume.
+	_, err = od.oimDriver.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	require.NoError(t, err)
+	assert.NotNil(t, fl.find(volume.GetVolumeId()), "volume still exists")
+}
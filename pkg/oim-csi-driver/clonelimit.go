@@ -0,0 +1,47 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cloneLimiter limits how many volumes per second get created from
+// an existing volume or snapshot. Each of those needs clone metadata
+// in the logical volume store, which a burst of requests might
+// exhaust. A nil cloneLimiter imposes no limit.
+type cloneLimiter struct {
+	limiter *rate.Limiter
+}
+
+func newCloneLimiter(rps float64, burst int) *cloneLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &cloneLimiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+}
+
+// wait blocks until the clone may proceed. It fails right away when
+// that would be after the deadline of the context.
+func (cl *cloneLimiter) wait(ctx context.Context) error {
+	if cl == nil {
+		return nil
+	}
+	if err := cl.limiter.Wait(ctx); err != nil {
+		code := codes.DeadlineExceeded
+		if ctx.Err() != nil {
+			code = status.FromContextError(ctx.Err()).Code()
+		}
+		return status.Error(code, fmt.Sprintf("waiting for clone rate limit of %g per second: %s", float64(cl.limiter.Limit()), err))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestCloneRateLimit(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path), WithCloneRateLimit(10, 1))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	sourceID := fl.add("source", mib)
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	clone := func(ctx context.Context, name string) error {
+		_, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: capabilities,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID},
+				},
+			},
+		})
+		return err
+	}
+
+	// All clones of a burst get queued and succeed.
+	const clones = 4
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make([]error, clones)
+	for i := 0; i < clones; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = clone(context.Background(), fmt.Sprintf("clone-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		assert.NoError(t, err, "clone #%d", i)
+	}
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, "clones delayed, took only %s", time.Since(start))
+
+	// A deadline which cannot be met fails without creating a
+	// volume.
+	require.NoError(t, clone(context.Background(), "clone-next"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = clone(ctx, "clone-late")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "%v", err)
+	assert.Nil(t, fl.find("lvs/clone-late"), "no volume")
+
+	// Normal volumes are not limited.
+	_, err = od.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "plain",
+		VolumeCapabilities: capabilities,
+	})
+	assert.NoError(t, err, "volume without source")
+}
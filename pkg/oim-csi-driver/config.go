@@ -0,0 +1,329 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// Config contains the settings of the oim-csi-driver command. Each
+// field corresponds to a command line flag, see NewConfigFromFlags
+// for their meaning.
+type Config struct {
+	CSIEndpoint       string
+	DriverName        string
+	NodeID            string
+	CSIVersion        string
+	Emulate           string
+	VolumeNamePattern string
+	DryRun            bool
+	ConfigFile        string
+
+	VHostEndpoint    string
+	VHostSocketDir   string
+	SPDKConnections  int
+	SPDKMaxFailures  int
+	SPDKResetTimeout time.Duration
+	SPDKTraceFile    string
+
+	OIMRegistryAddress  string
+	OIMControllerID     string
+	CAFile              string
+	KeyFile             string
+	OIMCallAttempts     int
+	OIMCallTimeout      time.Duration
+	DeviceTimeout       time.Duration
+	TopologyConfig      string
+	ControllerSelection string
+
+	ProbeTimeout          time.Duration
+	DrainTimeout          time.Duration
+	CreateBaseDuration    time.Duration
+	ThickBytesPerSecond   int64
+	PrewarmBandwidthLimit int
+	PrewarmMaxBytes       int64
+	DefragSchedule        string
+	DefragIOPSThreshold   float64
+	SnapshotGCInterval    time.Duration
+	MaxConcurrentOps      int
+	CloneRateLimit        float64
+	CloneBurst            int
+	AuditLog              string
+	MetadataFile          string
+	MetadataShared        bool
+	ImageDir              string
+	MaxVolumesPerNode     int64
+	LVStoreCacheTTL       time.Duration
+	TenantTokens          string
+	LockEtcdEndpoints     string
+	LockEtcdPrefix        string
+	LockEtcdTTL           time.Duration
+	MetricsEndpoint       string
+	EnableProfiling       bool
+	ProfilingPort         int
+	WebhookAddress        string
+	WebhookCertFile       string
+	WebhookKeyFile        string
+
+	Kubeconfig           string
+	PropagateTags        bool
+	TrackRevisions       bool
+	RecordEvents         bool
+	ReadCryptoKeySecrets bool
+	StorageClassDefaults bool
+	Namespace            string
+}
+
+// NewConfigFromFlags registers the command line flags of the driver
+// in the flag set. The returned Config gets filled in when the flag
+// set is parsed.
+func NewConfigFromFlags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.StringVar(&c.CSIEndpoint, "endpoint", "unix:///tmp/csi.sock", "CSI endpoint")
+	fs.StringVar(&c.DriverName, "drivername", "oim-csi-driver", "name of the driver")
+	fs.StringVar(&c.NodeID, "nodeid", "", "node id")
+	fs.StringVar(&c.CSIVersion, "csiversion", csi10, "CSI version that is to be implemented by the driver (1.0 or 0.3)")
+	fs.StringVar(&c.Emulate, "emulate", "", "name of CSI driver to emulate for node operations")
+	fs.StringVar(&c.VolumeNamePattern, "volume-name-pattern", DefaultVolumeNamePattern, "regular expression that names of new volumes must match")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "keep volumes only in memory instead of using SPDK or a OIM controller, for testing")
+	fs.StringVar(&c.ConfigFile, "config-file", "", "file with additional flags, one name=value per line, which override the command line. Re-read on SIGHUP, then only --max-concurrent-ops, --clone-rate-limit-rps and --clone-burst may change.")
+
+	fs.StringVar(&c.VHostEndpoint, "spdk-socket", "", "SPDK VHost socket path. If set, then the driver will controll that SPDK instance directly.")
+	fs.StringVar(&c.VHostSocketDir, "vhost-socket-dir", "", "directory in which SPDK creates vhost sockets, defaults to the directory of --spdk-socket")
+	fs.IntVar(&c.SPDKConnections, "spdk-connections", 1, "maximum number of concurrent connections to the SPDK VHost socket")
+	fs.IntVar(&c.SPDKMaxFailures, "spdk-max-failures", 0, "stop sending requests to SPDK after this many consecutive communication failures, 0 to disable")
+	fs.StringVar(&c.SPDKTraceFile, "spdk-trace-file", "", "file to which each SPDK JSON-RPC request and response is appended as JSON line, with key material redacted, empty to disable")
+	fs.DurationVar(&c.SPDKResetTimeout, "spdk-reset-timeout", 10*time.Second, "how long to stop sending requests to SPDK after --spdk-max-failures")
+
+	fs.StringVar(&c.OIMRegistryAddress, "oim-registry-address", "", "OIM registry address in the format expected by grpc.Dial. If set, then the driver will use a OIM controller via the registry instead of a local SPDK daemon.")
+	fs.StringVar(&c.OIMControllerID, "controller-id", "", "The ID under which the OIM controller can be found in the registry.")
+	fs.StringVar(&c.CAFile, "ca", "", "the required CA's .crt file which is used for verifying connections")
+	fs.StringVar(&c.KeyFile, "key", "", "the base name of the required .key and .crt files that authenticate and authorize the controller")
+	fs.IntVar(&c.OIMCallAttempts, "oim-call-attempts", defaultCallAttempts, "how often calls to the OIM controller are tried when they time out or the controller is unavailable")
+	fs.DurationVar(&c.OIMCallTimeout, "oim-call-timeout", 0, "timeout for each attempt of a call to the OIM controller, 0 for the deadline of the CSI request")
+	fs.DurationVar(&c.DeviceTimeout, "device-timeout", 0, "how long to wait for the block device of a volume provided by the OIM controller, 0 for waiting until the request times out")
+	fs.StringVar(&c.TopologyConfig, "topology-config", "", "JSON file which maps OIM controller IDs to the topology labels of the nodes that can access their storage, enables provisioning through all of these controllers")
+	fs.StringVar(&c.ControllerSelection, "oim-controller-selection", "", "how to choose among the OIM controllers allowed by --topology-config: round-robin or capacity (most free space), default is the controller of the host")
+
+	fs.DurationVar(&c.ProbeTimeout, "probe-timeout", 5*time.Second, "how long Probe waits for SPDK or the OIM registry before reporting the driver as unhealthy, 0 for no limit")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", 30*time.Second, "how long in-flight calls may run after SIGTERM before they get cancelled and rolled back")
+	fs.DurationVar(&c.CreateBaseDuration, "create-base-duration", 0, "minimum time that creating a volume may take, even when the request has a shorter deadline, 0 to use the deadline of the request")
+	fs.Int64Var(&c.ThickBytesPerSecond, "thick-provisioning-bytes-per-second", 0, "expected speed of creating thick volumes, extends the minimum time of --create-base-duration for large volumes, 0 to ignore the size")
+	fs.IntVar(&c.PrewarmBandwidthLimit, "prewarm-bandwidth-limit-mbps", 0, "maximum MB/s read while prewarming volumes with prewarm_on_attach=true, 0 for unlimited")
+	fs.Int64Var(&c.PrewarmMaxBytes, "prewarm-max-bytes", 0, "maximum number of bytes read while prewarming a volume, 0 for the entire volume")
+	fs.StringVar(&c.DefragSchedule, "defrag-schedule", "", "cron expression (minute hour day-of-month month day-of-week) for defragmenting logical volumes, empty to disable")
+	fs.Float64Var(&c.DefragIOPSThreshold, "defrag-iops-threshold", 1000, "defragmentation is skipped when SPDK handles more I/O operations per second than this")
+	fs.DurationVar(&c.SnapshotGCInterval, "snapshot-gc-interval", 0, "how often to delete snapshots whose retainFor duration has passed, zero to disable")
+	fs.IntVar(&c.MaxConcurrentOps, "max-concurrent-ops", 0, "maximum number of volume and snapshot creations and deletions that run at the same time, others wait until their deadline, 0 for unlimited")
+	fs.Float64Var(&c.CloneRateLimit, "clone-rate-limit-rps", 0, "maximum number of volumes per second that get cloned or restored from a snapshot, others wait until their deadline, 0 for unlimited")
+	fs.IntVar(&c.CloneBurst, "clone-burst", 1, "number of clones that may exceed --clone-rate-limit-rps in a burst")
+	fs.StringVar(&c.AuditLog, "audit-log", "", "file to which a JSON record is appended for each mutating CSI operation, - for stdout, empty to disable")
+	fs.StringVar(&c.MetadataFile, "metadata-file", DefaultMetadataFile, "JSON file in which volume and snapshot metadata is kept across restarts, empty to keep it only in memory")
+	fs.BoolVar(&c.MetadataShared, "metadata-shared", false, "--metadata-file is shared with the drivers on all nodes and gets read again when modified by them, required for migrating volumes")
+	fs.StringVar(&c.ImageDir, "image-dir", "", "directory with RAW images that StorageClasses may reference with the localImage parameter, empty to disable")
+	fs.Int64Var(&c.MaxVolumesPerNode, "max-volumes-per-node", 0, "maximum number of volumes attached to the node, reduced by the number of existing vhost sockets, 0 for unlimited")
+	fs.DurationVar(&c.LVStoreCacheTTL, "lvstore-cache-ttl", 0, "how long the logical volume stores are cached when choosing the one with the most free space for a volume without lvstoreName, 0 to query SPDK for each volume")
+	fs.StringVar(&c.TenantTokens, "tenant-tokens", "", "JSON file which maps bearer tokens to tenants, enables token authentication of CSI controller calls, empty to disable")
+	fs.StringVar(&c.LockEtcdEndpoints, "lock-etcd-endpoints", "", "comma-separated etcd client URLs where the node which has staged a volume gets recorded, prevents staging a volume on two nodes at once, empty to disable")
+	fs.StringVar(&c.LockEtcdPrefix, "lock-etcd-prefix", "/oim/locks/", "prefix of the etcd keys for --lock-etcd-endpoints")
+	fs.DurationVar(&c.LockEtcdTTL, "lock-etcd-ttl", time.Minute, "the locks of a node expire when its driver is not running for this long, before that they can be removed with etcdctl del --prefix <prefix><volume ID>/")
+	fs.StringVar(&c.MetricsEndpoint, "metrics-endpoint", "", "address (like :8080) on which Prometheus metrics are served under /metrics, empty to disable")
+	fs.BoolVar(&c.EnableProfiling, "enable-profiling", false, "serve net/http/pprof under /debug/pprof/ on --profiling-port of the loopback interface, only supported by binaries built with -tags profiling")
+	fs.IntVar(&c.ProfilingPort, "profiling-port", 6060, "loopback port for --enable-profiling")
+	fs.StringVar(&c.WebhookAddress, "webhook-address", "", "address (like :8443) on which an admission webhook for validating StorageClass and VolumeSnapshotClass parameters is served via HTTPS, empty to disable")
+	fs.StringVar(&c.WebhookCertFile, "webhook-cert", "", "TLS certificate file for --webhook-address")
+	fs.StringVar(&c.WebhookKeyFile, "webhook-key", "", "TLS key file for --webhook-address")
+
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", "", "kubeconfig file for accessing the Kubernetes API server, in-cluster configuration is used if empty")
+	fs.BoolVar(&c.PropagateTags, "propagate-pvc-tags", false, "copy oim.io/tag/ labels of PVCs into the volume metadata, requires access to the Kubernetes API server")
+	fs.BoolVar(&c.TrackRevisions, "track-storage-class-revisions", false, "record the old parameters as OIMStorageClassRevision when a StorageClass of the driver changes, requires access to the Kubernetes API server")
+	fs.BoolVar(&c.RecordEvents, "record-events", false, "create Kubernetes events for the PVCs of created and deleted volumes, requires access to the Kubernetes API server and the external-provisioner with --extra-create-metadata")
+	fs.BoolVar(&c.ReadCryptoKeySecrets, "read-crypto-key-secrets", false, "read the keys of encrypted volumes from the Secret referenced by the cryptoKeySecretRef parameter, requires access to the Kubernetes API server")
+	fs.BoolVar(&c.StorageClassDefaults, "storage-class-defaults", false, "read default StorageClass parameters at startup from the "+DefaultStorageClassConfigMap+" ConfigMap in --namespace, requires access to the Kubernetes API server")
+	fs.StringVar(&c.Namespace, "namespace", os.Getenv("POD_NAMESPACE"), "namespace of the driver, defaults to the POD_NAMESPACE environment variable")
+	return c
+}
+
+// runtimeFlags are the flags which may change when reloading the
+// config file, see RuntimeSettings.
+var runtimeFlags = map[string]bool{
+	"max-concurrent-ops":   true,
+	"clone-rate-limit-rps": true,
+	"clone-burst":          true,
+}
+
+// LoadConfigFile applies the flags in the config file, if there is
+// one.
+func (c *Config) LoadConfigFile() error {
+	if c.ConfigFile == "" {
+		return nil
+	}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	loaded := NewConfigFromFlags(fs)
+	// The flags point into loaded, so this keeps them bound.
+	*loaded = *c
+	if err := readConfigFile(fs, c.ConfigFile); err != nil {
+		return err
+	}
+	*c = *loaded
+	return nil
+}
+
+// Reload reads the config file again and returns the resulting new
+// configuration. Flags which cannot change at runtime keep their
+// current value, with a warning. Lines that were removed from the
+// file also keep their current value.
+func (c *Config) Reload(ctx context.Context) (*Config, error) {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	reloaded := NewConfigFromFlags(fs)
+	*reloaded = *c
+	current := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		current[f.Name] = f.Value.String()
+	})
+	if err := readConfigFile(fs, c.ConfigFile); err != nil {
+		return nil, err
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if runtimeFlags[f.Name] || f.Value.String() == current[f.Name] {
+			return
+		}
+		log.FromContext(ctx).Warnw("flag cannot change without restart, ignoring it",
+			"flag", f.Name,
+			"value", f.Value.String(),
+			"current", current[f.Name],
+		)
+		if setErr := f.Value.Set(current[f.Name]); setErr != nil && err == nil {
+			err = errors.Wrapf(setErr, "restore --%s", f.Name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := reloaded.Validate(); err != nil {
+		return nil, err
+	}
+	return reloaded, nil
+}
+
+// readConfigFile sets the flags found in the file. Empty lines and
+// lines starting with # are ignored, the leading dashes of flag names
+// are optional.
+func readConfigFile(fs *flag.FlagSet, filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrap(err, "read config file")
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := strings.TrimLeft(line, "-"), "true"
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		if err := fs.Set(name, value); err != nil {
+			return errors.Wrapf(err, "%s:%d", filename, i+1)
+		}
+	}
+	return nil
+}
+
+// RuntimeSettings returns the settings for Driver.Reconfigure.
+func (c *Config) RuntimeSettings() RuntimeSettings {
+	return RuntimeSettings{
+		MaxConcurrentOps: c.MaxConcurrentOps,
+		CloneRateLimit:   c.CloneRateLimit,
+		CloneBurst:       c.CloneBurst,
+	}
+}
+
+// NeedsKubernetes is true when some feature needs access to the
+// Kubernetes API server.
+func (c *Config) NeedsKubernetes() bool {
+	return c.PropagateTags || c.TrackRevisions || c.RecordEvents || c.ReadCryptoKeySecrets || c.StorageClassDefaults
+}
+
+// Validate checks the configuration for missing or conflicting
+// settings before the driver gets created.
+func (c *Config) Validate() error {
+	backends := 0
+	for _, enabled := range []bool{c.VHostEndpoint != "", c.OIMRegistryAddress != "", c.DryRun} {
+		if enabled {
+			backends++
+		}
+	}
+	switch {
+	case c.CSIEndpoint == "":
+		return errors.New("CSI endpoint is required")
+	case backends == 0:
+		return errors.New("one of SPDK socket, OIM registry address or dry-run mode is required")
+	case backends > 1:
+		return errors.New("SPDK socket, OIM registry address and dry-run mode are mutually exclusive")
+	case c.OIMRegistryAddress != "" && (c.OIMControllerID == "" || c.CAFile == "" || c.KeyFile == ""):
+		return errors.New("OIM registry requires controller ID, CA file and key file")
+	case c.TopologyConfig != "" && c.OIMRegistryAddress == "":
+		return errors.New("topology config requires a OIM registry")
+	case c.ControllerSelection != "" && c.TopologyConfig == "":
+		return errors.New("OIM controller selection requires a topology config")
+	case c.CSIVersion != csi10 && c.CSIVersion != csi03:
+		return errors.Errorf("CSI version must be %s or %s, not %q", csi10, csi03, c.CSIVersion)
+	case c.SPDKConnections < 1:
+		return errors.Errorf("SPDK connections must be at least 1, not %d", c.SPDKConnections)
+	case c.MaxConcurrentOps < 0:
+		return errors.Errorf("maximum concurrent operations must not be negative, not %d", c.MaxConcurrentOps)
+	case c.MaxVolumesPerNode < 0:
+		return errors.Errorf("maximum volumes per node must not be negative, not %d", c.MaxVolumesPerNode)
+	case c.DrainTimeout < 0:
+		return errors.Errorf("drain timeout must not be negative, not %s", c.DrainTimeout)
+	case c.CreateBaseDuration < 0:
+		return errors.Errorf("create base duration must not be negative, not %s", c.CreateBaseDuration)
+	case c.ThickBytesPerSecond < 0:
+		return errors.Errorf("thick provisioning bytes per second must not be negative, not %d", c.ThickBytesPerSecond)
+	case c.LVStoreCacheTTL < 0:
+		return errors.Errorf("logical volume store cache TTL must not be negative, not %s", c.LVStoreCacheTTL)
+	case c.CloneRateLimit < 0:
+		return errors.Errorf("clone rate limit must not be negative, not %g", c.CloneRateLimit)
+	case c.CloneRateLimit > 0 && c.CloneBurst < 1:
+		return errors.Errorf("clone burst must be at least 1, not %d", c.CloneBurst)
+	case c.OIMCallAttempts < 1:
+		return errors.Errorf("OIM call attempts must be at least 1, not %d", c.OIMCallAttempts)
+	case c.EnableProfiling && (c.ProfilingPort < 1 || c.ProfilingPort > 65535):
+		return errors.Errorf("profiling port must be between 1 and 65535, not %d", c.ProfilingPort)
+	case c.SPDKTraceFile != "" && c.VHostEndpoint == "":
+		return errors.New("SPDK trace file requires a SPDK socket")
+	case c.ImageDir != "" && c.VHostEndpoint == "":
+		return errors.New("image directory requires a SPDK socket")
+	case c.StorageClassDefaults && c.Namespace == "":
+		return errors.New("StorageClass defaults require a namespace")
+	case c.WebhookAddress != "" && (c.WebhookCertFile == "" || c.WebhookKeyFile == ""):
+		return errors.New("webhook requires certificate and key file")
+	case c.MetadataShared && c.MetadataFile == "":
+		return errors.New("shared metadata requires a metadata file")
+	case c.LockEtcdEndpoints != "" && c.LockEtcdPrefix == "":
+		return errors.New("etcd endpoints for locks require a key prefix")
+	case c.LockEtcdEndpoints != "" && c.LockEtcdTTL < time.Second:
+		return errors.Errorf("TTL of locks in etcd must be at least 1s, not %s", c.LockEtcdTTL)
+	}
+	if c.ControllerSelection != "" {
+		if _, err := NewControllerSelector(c.ControllerSelection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestConfigFromFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := NewConfigFromFlags(fs)
+	assert.Equal(t, 1, config.SPDKConnections, "default")
+	assert.Equal(t, defaultCallAttempts, config.OIMCallAttempts, "default")
+
+	require.NoError(t, fs.Parse([]string{
+		"--spdk-socket=/var/tmp/spdk.sock",
+		"--max-concurrent-ops=4",
+		"--probe-timeout=1s",
+		"--record-events",
+	}))
+	assert.Equal(t, "/var/tmp/spdk.sock", config.VHostEndpoint)
+	assert.Equal(t, 4, config.MaxConcurrentOps)
+	assert.Equal(t, time.Second, config.ProbeTimeout)
+	assert.True(t, config.NeedsKubernetes())
+	assert.NoError(t, config.Validate())
+}
+
+func TestConfigValidate(t *testing.T) {
+	registry := func(c *Config) {
+		c.OIMRegistryAddress = "dns:///registry:8999"
+		c.OIMControllerID = "host-0"
+		c.CAFile = "ca.crt"
+		c.KeyFile = "host.host-0"
+	}
+
+	for name, tc := range map[string]struct {
+		modify func(c *Config)
+		err    string
+	}{
+		"spdk":       {func(c *Config) { c.VHostEndpoint = "/spdk.sock" }, ""},
+		"registry":   {registry, ""},
+		"dry-run":    {func(c *Config) { c.DryRun = true }, ""},
+		"no-backend": {func(c *Config) {}, "one of SPDK socket, OIM registry address or dry-run mode is required"},
+		"spdk-and-registry": {func(c *Config) {
+			registry(c)
+			c.VHostEndpoint = "/spdk.sock"
+		}, "SPDK socket, OIM registry address and dry-run mode are mutually exclusive"},
+		"no-endpoint": {func(c *Config) {
+			c.DryRun = true
+			c.CSIEndpoint = ""
+		}, "CSI endpoint is required"},
+		"no-controller-id": {func(c *Config) {
+			registry(c)
+			c.OIMControllerID = ""
+		}, "OIM registry requires controller ID, CA file and key file"},
+		"topology-without-registry": {func(c *Config) {
+			c.VHostEndpoint = "/spdk.sock"
+			c.TopologyConfig = "topology.json"
+		}, "topology config requires a OIM registry"},
+		"selection-without-topology": {func(c *Config) {
+			registry(c)
+			c.ControllerSelection = "capacity"
+		}, "OIM controller selection requires a topology config"},
+		"bad-selection": {func(c *Config) {
+			registry(c)
+			c.TopologyConfig = "topology.json"
+			c.ControllerSelection = "random"
+		}, `unknown OIM controller selection strategy "random"`},
+		"bad-csi-version": {func(c *Config) {
+			c.DryRun = true
+			c.CSIVersion = "0.2"
+		}, `CSI version must be 1.0 or 0.3, not "0.2"`},
+		"no-connections": {func(c *Config) {
+			c.VHostEndpoint = "/spdk.sock"
+			c.SPDKConnections = 0
+		}, "SPDK connections must be at least 1, not 0"},
+		"negative-ops": {func(c *Config) {
+			c.DryRun = true
+			c.MaxConcurrentOps = -1
+		}, "maximum concurrent operations must not be negative, not -1"},
+		"no-clone-burst": {func(c *Config) {
+			c.DryRun = true
+			c.CloneRateLimit = 10
+			c.CloneBurst = 0
+		}, "clone burst must be at least 1, not 0"},
+		"bad-profiling-port": {func(c *Config) {
+			c.DryRun = true
+			c.EnableProfiling = true
+			c.ProfilingPort = 0
+		}, "profiling port must be between 1 and 65535, not 0"},
+		"image-dir-without-spdk": {func(c *Config) {
+			c.DryRun = true
+			c.ImageDir = "/var/lib/oim-images"
+		}, "image directory requires a SPDK socket"},
+		"defaults-without-namespace": {func(c *Config) {
+			c.DryRun = true
+			c.StorageClassDefaults = true
+			c.Namespace = ""
+		}, "StorageClass defaults require a namespace"},
+		"webhook-without-cert": {func(c *Config) {
+			c.DryRun = true
+			c.WebhookAddress = ":8443"
+			c.WebhookKeyFile = "/certs/webhook.key"
+		}, "webhook requires certificate and key file"},
+		"etcd-without-prefix": {func(c *Config) {
+			c.DryRun = true
+			c.LockEtcdEndpoints = "http://etcd:2379"
+			c.LockEtcdPrefix = ""
+		}, "etcd endpoints for locks require a key prefix"},
+		"etcd-short-ttl": {func(c *Config) {
+			c.DryRun = true
+			c.LockEtcdEndpoints = "http://etcd:2379"
+			c.LockEtcdTTL = time.Millisecond
+		}, "TTL of locks in etcd must be at least 1s, not 1ms"},
+		"shared-metadata-without-file": {func(c *Config) {
+			c.DryRun = true
+			c.MetadataFile = ""
+			c.MetadataShared = true
+		}, "shared metadata requires a metadata file"},
+		"no-attempts": {func(c *Config) {
+			registry(c)
+			c.OIMCallAttempts = 0
+		}, "OIM call attempts must be at least 1, not 0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := NewConfigFromFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+			tc.modify(config)
+			err := config.Validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Equal(t, tc.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	filename := filepath.Join(tmp, "config")
+	write := func(content string) {
+		require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := NewConfigFromFlags(fs)
+	require.NoError(t, fs.Parse([]string{"--dry-run", "--probe-timeout=1s", "--config-file=" + filename}))
+	write("# initial settings\n\n--max-concurrent-ops=4\nprobe-timeout=2s\nrecord-events\n")
+	require.NoError(t, config.LoadConfigFile())
+	assert.Equal(t, 4, config.MaxConcurrentOps)
+	assert.Equal(t, 2*time.Second, config.ProbeTimeout, "file overrides command line")
+	assert.True(t, config.RecordEvents)
+
+	write("max-concurrent-ops=8\nclone-rate-limit-rps=2.5\nclone-burst=3\nprobe-timeout=3s\nendpoint=unix:///tmp/other.sock\n")
+	reloaded, err := config.Reload(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, RuntimeSettings{MaxConcurrentOps: 8, CloneRateLimit: 2.5, CloneBurst: 3}, reloaded.RuntimeSettings())
+	assert.Equal(t, 2*time.Second, reloaded.ProbeTimeout, "structural change rejected")
+	assert.Equal(t, config.CSIEndpoint, reloaded.CSIEndpoint, "structural change rejected")
+	assert.True(t, reloaded.RecordEvents, "removed line keeps value")
+	assert.Equal(t, 4, config.MaxConcurrentOps, "original config unchanged")
+
+	write("max-concurrent-ops=-1\n")
+	_, err = config.Reload(ctx)
+	assert.Error(t, err, "invalid value")
+	write("no-such-flag=1\n")
+	_, err = config.Reload(ctx)
+	assert.Error(t, err, "unknown flag")
+	require.NoError(t, os.Remove(filename))
+	_, err = config.Reload(ctx)
+	assert.Error(t, err, "missing file")
+}
@@ -8,96 +8,410 @@ package oimcsidriver
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"sort"
+	"strconv"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"github.com/intel/oim/pkg/log"
 )
 
-func (od *oimDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (od *oimDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (response *csi.CreateVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "CreateVolume", req)
+	defer od.observe("CreateVolume", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "CreateVolume", Name: req.GetName(), VolumeID: response.GetVolume().GetVolumeId()}, err)
+		od.volumeCreatedEvent(req.GetParameters(), response.GetVolume().GetVolumeId(), err)
+	}()
 	name := req.GetName()
 	caps := req.GetVolumeCapabilities()
 
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
+	if err := od.validateVolumeName(ctx, name); err != nil {
+		return nil, err
+	}
 	if caps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
 	for _, cap := range caps {
-		if cap.GetBlock() != nil {
-			return nil, status.Error(codes.Unimplemented, "Block Volume not supported")
-		}
-		switch cap.GetAccessMode().GetMode() {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER: // okay
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: // okay
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY: // okay
-
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
-			// While in theory writing blocks on one node and reading them on others could work,
-			// in practice caching effects might break that. Better don't allow it.
-			return nil, status.Error(codes.Unimplemented, "multi-node reader, single writer not supported")
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-			return nil, status.Error(codes.Unimplemented, "multi-node reader, multi-node writer not supported")
-		default:
-			return nil, status.Error(codes.Unimplemented, fmt.Sprintf("%s not supported", cap.GetAccessMode().GetMode()))
+		message, err := od.checkAccessMode(ctx, "", cap.GetAccessMode().GetMode())
+		if err != nil {
+			return nil, err
+		}
+		if message != "" {
+			return nil, status.Error(codes.Unimplemented, message)
 		}
 	}
-	if req.GetVolumeContentSource() != nil {
-		return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+	var sourceVolumeID, sourceSnapshotID string
+	if source := req.GetVolumeContentSource(); source != nil {
+		switch {
+		case source.GetVolume() != nil:
+			sourceVolumeID = source.GetVolume().GetVolumeId()
+			if sourceVolumeID == "" {
+				return nil, status.Error(codes.InvalidArgument, "Source Volume ID missing in request")
+			}
+		case source.GetSnapshot() != nil:
+			sourceSnapshotID = source.GetSnapshot().GetSnapshotId()
+			if sourceSnapshotID == "" {
+				return nil, status.Error(codes.InvalidArgument, "Source Snapshot ID missing in request")
+			}
+		default:
+			return nil, status.Error(codes.InvalidArgument, "unknown volume content source")
+		}
 	}
-
-	// Serialize operations per volume by name.
-	if name == "" {
-		return nil, status.Error(codes.InvalidArgument, "empty name")
+	requiredBytes := req.GetCapacityRange().GetRequiredBytes()
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if err := checkCapacityRange(requiredBytes, limitBytes); err != nil {
+		return nil, err
 	}
-	volumeNameMutex.LockKey(name)
-	defer volumeNameMutex.UnlockKey(name)
 
-	actualBytes, err := od.backend.createVolume(ctx, name, req.GetCapacityRange().GetRequiredBytes())
+	parameters := od.storageClassDefaults.apply(req.GetParameters())
+	volume, err := od.createVolume(ctx, name, createRequest{
+		requiredBytes:    requiredBytes,
+		limitBytes:       limitBytes,
+		parameters:       parameters,
+		revision:         parametersRevision(req.GetParameters()),
+		sourceVolumeID:   sourceVolumeID,
+		sourceSnapshotID: sourceSnapshotID,
+		requisite:        topologySegments(req.GetAccessibilityRequirements().GetRequisite()),
+		preferred:        topologySegments(req.GetAccessibilityRequirements().GetPreferred()),
+	})
 	if err != nil {
 		return nil, err
 	}
+	vc := volumeContext(parameters, parametersRevision(req.GetParameters()))
+	vc[capacityContextKey] = strconv.FormatInt(volume.capacityBytes, 10)
+	if volume.bdevUUID != "" {
+		vc[bdevUUIDContextKey] = volume.bdevUUID
+	}
+	if volume.lvstoreUUID != "" {
+		vc[lvstoreUUIDContextKey] = volume.lvstoreUUID
+	}
+	if volume.latencyClass != "" {
+		vc[latencyClassContextKey] = volume.latencyClass
+	}
+	if volume.numaNode != "" {
+		vc[numaNodeContextKey] = volume.numaNode
+	}
+	var topology []*csi.Topology
+	if volume.topology != nil {
+		vc[topologyContextKey] = encodeTopology(volume.topology)
+		topology = append(topology, &csi.Topology{Segments: volume.topology})
+	}
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			// We use the unique name also as ID.
-			VolumeId:      name,
-			CapacityBytes: actualBytes,
+			VolumeId:           volume.volumeID,
+			CapacityBytes:      volume.capacityBytes,
+			VolumeContext:      vc,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: topology,
 		},
 	}, nil
 }
 
-func (od *oimDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+func topologySegments(topologies []*csi.Topology) []map[string]string {
+	var segments []map[string]string
+	for _, topology := range topologies {
+		segments = append(segments, topology.GetSegments())
+	}
+	return segments
+}
+
+// createVolume creates a new volume or returns the one that was
+// created earlier for the same name and request.
+func (od *oimDriver) createVolume(ctx context.Context, name string, request createRequest) (volumeInfo, error) {
+	if err := od.startupFailure(); err != nil {
+		return volumeInfo{}, err
+	}
+	name = tenantName(ctx, name)
+
+	// Serialize operations per volume by name. All other
+	// operations only know the volume ID, which is locked below
+	// as soon as it is known.
+	volumeNameMutex.LockKey(name)
+	defer volumeNameMutex.UnlockKey(name)
+
+	release, err := od.currentOps().acquire(ctx)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	defer release()
+
+	if request.sourceSnapshotID != "" {
+		// Only snapshots created by the driver can be used.
+		metadata, ok := od.metadata.getSnapshot(request.sourceSnapshotID)
+		if !ok {
+			return volumeInfo{}, status.Error(codes.NotFound, fmt.Sprintf("snapshot %s not found", request.sourceSnapshotID))
+		}
+		if !visibleTo(ctx, metadata.Tenant) {
+			return volumeInfo{}, status.Error(codes.PermissionDenied, fmt.Sprintf("snapshot %s belongs to another tenant", request.sourceSnapshotID))
+		}
+	}
+	if request.sourceVolumeID != "" {
+		if err := od.checkVolumeTenant(ctx, request.sourceVolumeID); err != nil {
+			return volumeInfo{}, err
+		}
+	}
+
+	image, imageSize, err := od.localImage(request.parameters)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	if image != "" {
+		if request.sourceVolumeID != "" || request.sourceSnapshotID != "" {
+			return volumeInfo{}, status.Error(codes.InvalidArgument, fmt.Sprintf("%s parameter cannot be combined with a volume content source", localImageParameter))
+		}
+		if imageSize > request.requiredBytes {
+			if request.limitBytes != 0 && imageSize > request.limitBytes {
+				return volumeInfo{}, status.Error(codes.OutOfRange, fmt.Sprintf("image with %d bytes exceeds limit bytes %d", imageSize, request.limitBytes))
+			}
+			request.requiredBytes = imageSize
+		}
+	}
+
+	if created, ok := od.created.get(name); ok {
+		// The volume might have been removed without DeleteVolume.
+		err := od.backend.checkVolumeExists(ctx, created.volume.volumeID)
+		switch {
+		case status.Code(err) == codes.NotFound:
+			od.created.forget(created.volume.volumeID)
+		case err != nil:
+			return volumeInfo{}, err
+		case !created.request.equal(request):
+			return volumeInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("volume %s was created with different parameters", name))
+		default:
+			return created.volume, nil
+		}
+	}
+
+	reservation, err := od.reserveQuota(request)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	defer reservation.release()
+	if request.sourceVolumeID != "" || request.sourceSnapshotID != "" {
+		if err := od.currentClones().wait(ctx); err != nil {
+			return volumeInfo{}, err
+		}
+	}
+	createCtx, cancel := od.deadlines.withDeadline(ctx, od.drain.stopContext(), request.requiredBytes, request.parameters)
+	volume, err := od.backend.createVolume(createCtx, name, request)
+	cancel()
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	if volume.volumeID != name {
+		volumeNameMutex.LockKey(volume.volumeID)
+		defer volumeNameMutex.UnlockKey(volume.volumeID)
+	}
+	// The backend may have rounded up or used the size of the
+	// source.
+	if err := reservation.extendTo(volume.capacityBytes); err != nil {
+		od.removeVolume(ctx, volume.volumeID, "removing volume which exceeds quota failed")
+		return volumeInfo{}, err
+	}
+	if image != "" {
+		if err := od.populateVolume(ctx, volume.volumeID, image); err != nil {
+			// A volume with incomplete content must not be
+			// found by a retry.
+			od.removeVolume(ctx, volume.volumeID, "removing volume with incomplete image failed")
+			return volumeInfo{}, err
+		}
+	}
+	od.created.set(name, createdVolume{request: request, volume: volume})
+	od.metadata.update(volume.volumeID, func(metadata *VolumeMetadata) {
+		metadata.StorageClassRevision = request.revision
+		metadata.Claim = claimFromParameters(request.parameters)
+		metadata.SizeBytes = volume.capacityBytes
+		metadata.Name = name
+		metadata.Tenant = tenantFromContext(ctx)
+	})
+	return volume, nil
+}
+
+// removeVolume deletes a volume that was created, but must not be
+// used. This must work even when the request timed out, therefore
+// errors are only logged.
+func (od *oimDriver) removeVolume(ctx context.Context, volumeID, message string) {
+	cleanupCtx, cancel := context.WithTimeout(log.WithLogger(context.Background(), log.FromContext(ctx)), rollbackTimeout)
+	defer cancel()
+	if err := od.backend.deleteVolume(cleanupCtx, volumeID); err != nil {
+		log.FromContext(ctx).Errorw(message,
+			"volumeid", volumeID,
+			"error", err,
+		)
+	}
+}
+
+// checkCapacityRange rejects invalid capacity ranges. Zero means
+// "not set" for both values.
+func checkCapacityRange(requiredBytes, limitBytes int64) error {
+	if requiredBytes < 0 || limitBytes < 0 {
+		return status.Error(codes.InvalidArgument, "negative capacity range")
+	}
+	if limitBytes != 0 && requiredBytes > limitBytes {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("required bytes %d exceed limit bytes %d", requiredBytes, limitBytes))
+	}
+	return nil
+}
+
+// volumeSize returns the size of a new volume: the required size (or
+// 1MiB if not set) rounded up to a multiple of the allocation unit of
+// the backend, like the cluster size of a logical volume store. It is
+// an error when rounding up exceeds the limit.
+func volumeSize(requiredBytes, limitBytes, unit int64) (int64, error) {
+	size := requiredBytes
+	if size == 0 {
+		size = mib
+		if limitBytes != 0 && limitBytes < size {
+			size = limitBytes
+		}
+	}
+	if unit > 1 {
+		size = (size + unit - 1) / unit * unit
+	}
+	if limitBytes != 0 && size > limitBytes {
+		return 0, status.Error(codes.OutOfRange, fmt.Sprintf("%d bytes rounded up to a multiple of %d bytes exceed limit bytes %d", size, unit, limitBytes))
+	}
+	return size, nil
+}
+
+func (od *oimDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (_ *csi.DeleteVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "DeleteVolume", req)
+	defer od.observe("DeleteVolume", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "DeleteVolume", VolumeID: req.GetVolumeId()}, err)
+	}()
 	// Check arguments
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
 	name := req.GetVolumeId()
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
+	if err := od.checkVolumeTenant(ctx, name); err != nil {
+		return nil, err
+	}
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(name)
 	defer volumeNameMutex.UnlockKey(name)
 
+	release, err := od.currentOps().acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The metadata is gone after deleting the volume.
+	metadata, _ := od.metadata.get(name)
 	if err := od.backend.deleteVolume(ctx, name); err != nil {
 		return nil, err
 	}
+	od.metadata.delete(name)
+	od.created.forget(name)
+	od.volumeDeletedEvent(metadata.Claim, name)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (od *oimDriver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (_ *csi.ControllerPublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "ControllerPublishVolume", req)
+	defer od.observe("ControllerPublishVolume", time.Now(), &err)
+	socket, err := od.publishVolume(ctx, req.GetVolumeId(), req.GetNodeId(), req.GetVolumeCapability() != nil, req.GetReadonly())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{
+			publishContextVHostSocket: socket,
+		},
+	}, nil
+}
+
+// publishVolume makes the volume available to the node via vhost-blk.
+// Only supported with local SPDK.
+func (od *oimDriver) publishVolume(ctx context.Context, volumeID, nodeID string, hasCapability, readonly bool) (string, error) {
+	if !od.local.enabled() {
+		return "", status.Error(codes.Unimplemented, "")
+	}
+	if volumeID == "" {
+		return "", status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if nodeID == "" {
+		return "", status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+	if !hasCapability {
+		return "", status.Error(codes.InvalidArgument, "Volume Capability missing in request")
+	}
+	if nodeID != od.nodeID {
+		// Local SPDK is only accessible on the node that it runs on.
+		return "", status.Error(codes.NotFound, fmt.Sprintf("node %s not found", nodeID))
+	}
+	if err := od.checkVolumeTenant(ctx, volumeID); err != nil {
+		return "", err
+	}
+
+	// Serialize operations per volume by ID.
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	return od.local.publishVolume(ctx, volumeID, nodeID, readonly)
 }
 
-func (od *oimDriver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (_ *csi.ControllerUnpublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "ControllerUnpublishVolume", req)
+	defer od.observe("ControllerUnpublishVolume", time.Now(), &err)
+	if err := od.unpublishVolume(ctx, req.GetVolumeId(), req.GetNodeId()); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (od *oimDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+func (od *oimDriver) unpublishVolume(ctx context.Context, volumeID, nodeID string) error {
+	if !od.local.enabled() {
+		return status.Error(codes.Unimplemented, "")
+	}
+	if volumeID == "" {
+		return status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if err := od.checkVolumeTenant(ctx, volumeID); err != nil {
+		return err
+	}
+
+	// Serialize operations per volume by ID.
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	return od.local.unpublishVolume(ctx, volumeID, nodeID)
+}
+
+// checkMultiNodeReader determines whether the volume can be used
+// read-only on several nodes at once. It returns the reason if not.
+func (od *oimDriver) checkMultiNodeReader(ctx context.Context, volumeID string) (string, error) {
+	readOnly, err := od.backend.isReadOnly(ctx, volumeID)
+	if err != nil {
+		return "", err
+	}
+	if !readOnly {
+		// Only snapshots are guaranteed to not change while being read.
+		return fmt.Sprintf("multi-node reader only not supported, %s is a writable volume and not a snapshot", volumeID), nil
+	}
+	return "", nil
+}
+
+func (od *oimDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (_ *csi.ValidateVolumeCapabilitiesResponse, err error) {
+	ctx = od.withLogger(ctx, "ValidateVolumeCapabilities", req)
+	defer od.observe("ValidateVolumeCapabilities", time.Now(), &err)
 
 	// Check arguments
 	if len(req.GetVolumeId()) == 0 {
@@ -107,11 +421,14 @@ func (od *oimDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
 	name := req.GetVolumeId()
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
+	if err := od.checkVolumeTenant(ctx, name); err != nil {
+		return nil, err
+	}
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(name)
 	defer volumeNameMutex.UnlockKey(name)
 
@@ -128,60 +445,203 @@ func (od *oimDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 		Parameters:    req.Parameters,
 	}
 	for _, cap := range req.VolumeCapabilities {
-		if cap.GetBlock() != nil {
-			/* Known unsupported mode. Fail the validation. */
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: "Block Volume not supported"}, nil
-		}
-		if cap.GetMount() == nil {
+		if cap.GetMount() == nil && cap.GetBlock() == nil {
 			/* Must be something else, an unknown mode. Ignore it. */
 			continue
 		}
 		// We could check fs type and mount flags for MountVolume, but let's assume that they are okay.
 		// Now check the access mode.
-		switch cap.GetAccessMode().GetMode() {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER: // okay
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: // okay
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY: // okay
-
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
-			// While in theory writing blocks on one node and reading them on others could work,
-			// in practice caching effects might break that. Better don't allow it.
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: "multi-node reader, single writer not supported"}, nil
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: "multi-node reader, multi-node writer not supported"}, nil
-		default:
+		if _, known := od.accessModes[cap.GetAccessMode().GetMode()]; !known {
 			/* unknown, not supported */
 			continue
 		}
+		message, err := od.checkAccessMode(ctx, req.GetVolumeId(), cap.GetAccessMode().GetMode())
+		if err != nil {
+			return nil, err
+		}
+		if message != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: message}, nil
+		}
 		confirmed.VolumeCapabilities = append(confirmed.VolumeCapabilities, cap)
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{Confirmed: confirmed}, nil
 }
 
-func (od *oimDriver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (_ *csi.ListVolumesResponse, err error) {
+	ctx = od.withLogger(ctx, "ListVolumes", req)
+	defer od.observe("ListVolumes", time.Now(), &err)
+	volumes, nextToken, err := od.listVolumes(ctx, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	response := &csi.ListVolumesResponse{
+		NextToken: nextToken,
+	}
+	for _, volume := range volumes {
+		response.Entries = append(response.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      volume.volumeID,
+				CapacityBytes: volume.capacityBytes,
+				VolumeContext: od.listVolumeContext(volume.volumeID),
+			},
+		})
+	}
+	return response, nil
+}
+
+// listVolumes returns one page of volumes, sorted by ID.
+func (od *oimDriver) listVolumes(ctx context.Context, startingToken string, maxEntries int32) ([]volumeInfo, string, error) {
+	after, err := decodeToken(startingToken, maxEntries)
+	if err != nil {
+		return nil, "", err
+	}
+	all, err := od.backend.listVolumes(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	var volumes []volumeInfo
+	for _, volume := range all {
+		metadata, _ := od.metadata.get(volume.volumeID)
+		if visibleTo(ctx, metadata.Tenant) {
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].volumeID < volumes[j].volumeID
+	})
+	start, end, nextToken := paginate(len(volumes), func(i int) string { return volumes[i].volumeID }, after, maxEntries)
+	return volumes[start:end], nextToken, nil
+}
+
+// decodeToken checks the paging parameters of a list request and
+// returns the ID after which the page starts. The token is the
+// encoded ID of the last entry on the previous page. That way a token
+// remains valid even when entries get created or deleted between
+// calls, which would shift a numeric offset.
+func decodeToken(startingToken string, maxEntries int32) (string, error) {
+	if maxEntries < 0 {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("invalid max entries %d", maxEntries))
+	}
+	if startingToken == "" {
+		return "", nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(startingToken)
+	if err != nil || len(decoded) == 0 {
+		return "", status.Error(codes.Aborted, fmt.Sprintf("invalid starting token %q", startingToken))
+	}
+	return string(decoded), nil
+}
+
+// paginate determines the range [start, end) of the n entries, sorted
+// by ID, which forms the page after the given ID, plus the token for
+// the next page. The token is empty when there are no more entries.
+func paginate(n int, id func(i int) string, after string, maxEntries int32) (int, int, string) {
+	start := sort.Search(n, func(i int) bool {
+		return id(i) > after
+	})
+	if maxEntries == 0 || int(maxEntries) >= n-start {
+		return start, n, ""
+	}
+	end := start + int(maxEntries)
+	return start, end, base64.RawURLEncoding.EncodeToString([]byte(id(end - 1)))
 }
 
-func (od *oimDriver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// listVolumeContext returns the part of the original volume context
+// that is still known for an existing volume.
+func (od *oimDriver) listVolumeContext(volumeID string) map[string]string {
+	metadata, _ := od.metadata.get(volumeID)
+	if metadata.StorageClassRevision == "" {
+		return nil
+	}
+	return map[string]string{
+		revisionContextKey: metadata.StorageClassRevision,
+	}
+}
+
+func (od *oimDriver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (_ *csi.GetCapacityResponse, err error) {
+	ctx = od.withLogger(ctx, "GetCapacity", req)
+	defer od.observe("GetCapacity", time.Now(), &err)
+	capacity, err := od.getCapacity(ctx, req.GetAccessibleTopology().GetSegments())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: capacity,
+	}, nil
+}
+
+// getCapacity returns the free capacity of the backend, or zero if
+// the topology segments exclude the node that the driver runs on.
+func (od *oimDriver) getCapacity(ctx context.Context, segments map[string]string) (int64, error) {
+	if node, ok := segments[topologyKeyNode]; ok && node != od.nodeID {
+		return 0, nil
+	}
+	return od.backend.getCapacity(ctx)
 }
 
 // ControllerGetCapabilities implements the default GRPC callout.
 // Default supports all capabilities
-func (od *oimDriver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+func (od *oimDriver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (_ *csi.ControllerGetCapabilitiesResponse, err error) {
+	defer od.observe("ControllerGetCapabilities", time.Now(), &err)
 	return &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: od.cap,
 	}, nil
 }
 
-func (od *oimDriver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (response *csi.CreateSnapshotResponse, err error) {
+	ctx = od.withLogger(ctx, "CreateSnapshot", req)
+	defer od.observe("CreateSnapshot", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "CreateSnapshot", Name: req.GetName(), VolumeID: req.GetSourceVolumeId(), SnapshotID: response.GetSnapshot().GetSnapshotId()}, err)
+	}()
+	snapshot, err := od.createSnapshot(ctx, req.GetName(), req.GetSourceVolumeId(), req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateSnapshotResponse{
+		Snapshot: snapshot.csi(),
+	}, nil
 }
 
-func (od *oimDriver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (_ *csi.DeleteSnapshotResponse, err error) {
+	ctx = od.withLogger(ctx, "DeleteSnapshot", req)
+	defer od.observe("DeleteSnapshot", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "DeleteSnapshot", SnapshotID: req.GetSnapshotId()}, err)
+	}()
+	if err := od.deleteSnapshot(ctx, req.GetSnapshotId()); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (od *oimDriver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (_ *csi.ListSnapshotsResponse, err error) {
+	ctx = od.withLogger(ctx, "ListSnapshots", req)
+	defer od.observe("ListSnapshots", time.Now(), &err)
+	snapshots, nextToken, err := od.listSnapshots(ctx, req.GetSnapshotId(), req.GetSourceVolumeId(), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	response := &csi.ListSnapshotsResponse{
+		NextToken: nextToken,
+	}
+	for _, snapshot := range snapshots {
+		response.Entries = append(response.Entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshot.csi(),
+		})
+	}
+	return response, nil
+}
+
+func (s snapshotInfo) csi() *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     s.snapshotID,
+		SourceVolumeId: s.SourceVolumeID,
+		SizeBytes:      s.SizeBytes,
+		CreationTime: &timestamp.Timestamp{
+			Seconds: s.CreationTime.Unix(),
+			Nanos:   int32(s.CreationTime.Nanosecond()),
+		},
+		ReadyToUse: true,
+	}
 }
@@ -9,6 +9,8 @@ package oimcsidriver
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -16,89 +18,166 @@ import (
 	"github.com/intel/oim/pkg/spec/csi/v0"
 )
 
-func (od *oimDriver03) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (od *oimDriver03) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (response *csi.CreateVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "CreateVolume", req)
+	defer od.observe("CreateVolume", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "CreateVolume", Name: req.GetName(), VolumeID: response.GetVolume().GetId()}, err)
+		od.volumeCreatedEvent(req.GetParameters(), response.GetVolume().GetId(), err)
+	}()
 	name := req.GetName()
 	caps := req.GetVolumeCapabilities()
 
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
+	if err := od.validateVolumeName(ctx, name); err != nil {
+		return nil, err
+	}
 	if caps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
 	for _, cap := range caps {
-		if cap.GetBlock() != nil {
-			return nil, status.Error(codes.Unimplemented, "Block Volume not supported")
+		message, err := od.checkAccessMode(ctx, "", accessMode0(cap.GetAccessMode().GetMode()))
+		if err != nil {
+			return nil, err
 		}
-		switch cap.GetAccessMode().GetMode() {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER: // okay
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: // okay
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY: // okay
-
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
-			// While in theory writing blocks on one node and reading them on others could work,
-			// in practice caching effects might break that. Better don't allow it.
-			return nil, status.Error(codes.Unimplemented, "multi-node reader, single writer not supported")
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-			return nil, status.Error(codes.Unimplemented, "multi-node reader, multi-node writer not supported")
-		default:
-			return nil, status.Error(codes.Unimplemented, fmt.Sprintf("%s not supported", cap.GetAccessMode().GetMode()))
+		if message != "" {
+			return nil, status.Error(codes.Unimplemented, message)
 		}
 	}
-	if req.GetVolumeContentSource() != nil {
-		return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+	var sourceSnapshotID string
+	if source := req.GetVolumeContentSource(); source != nil {
+		if source.GetSnapshot() == nil {
+			return nil, status.Error(codes.InvalidArgument, "unknown volume content source")
+		}
+		sourceSnapshotID = source.GetSnapshot().GetId()
+		if sourceSnapshotID == "" {
+			return nil, status.Error(codes.InvalidArgument, "Source Snapshot ID missing in request")
+		}
 	}
-
-	// Serialize operations per volume by name.
-	if name == "" {
-		return nil, status.Error(codes.InvalidArgument, "empty name")
+	requiredBytes := req.GetCapacityRange().GetRequiredBytes()
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if err := checkCapacityRange(requiredBytes, limitBytes); err != nil {
+		return nil, err
 	}
-	volumeNameMutex.LockKey(name)
-	defer volumeNameMutex.UnlockKey(name)
 
-	actualBytes, err := od.backend.createVolume(ctx, name, req.GetCapacityRange().GetRequiredBytes())
+	parameters := od.storageClassDefaults.apply(req.GetParameters())
+	volume, err := od.createVolume(ctx, name, createRequest{
+		requiredBytes:    requiredBytes,
+		limitBytes:       limitBytes,
+		parameters:       parameters,
+		revision:         parametersRevision(req.GetParameters()),
+		sourceSnapshotID: sourceSnapshotID,
+		requisite:        topologySegments0(req.GetAccessibilityRequirements().GetRequisite()),
+		preferred:        topologySegments0(req.GetAccessibilityRequirements().GetPreferred()),
+	})
 	if err != nil {
 		return nil, err
 	}
+	vc := volumeContext(parameters, parametersRevision(req.GetParameters()))
+	vc[capacityContextKey] = strconv.FormatInt(volume.capacityBytes, 10)
+	if volume.bdevUUID != "" {
+		vc[bdevUUIDContextKey] = volume.bdevUUID
+	}
+	if volume.lvstoreUUID != "" {
+		vc[lvstoreUUIDContextKey] = volume.lvstoreUUID
+	}
+	if volume.latencyClass != "" {
+		vc[latencyClassContextKey] = volume.latencyClass
+	}
+	if volume.numaNode != "" {
+		vc[numaNodeContextKey] = volume.numaNode
+	}
+	var topology []*csi.Topology
+	if volume.topology != nil {
+		vc[topologyContextKey] = encodeTopology(volume.topology)
+		topology = append(topology, &csi.Topology{Segments: volume.topology})
+	}
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			// We use the unique name also as ID.
-			Id:            name,
-			CapacityBytes: actualBytes,
-			Attributes:    req.GetParameters(),
+			Id:                 volume.volumeID,
+			CapacityBytes:      volume.capacityBytes,
+			Attributes:         vc,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: topology,
 		},
 	}, nil
 }
 
-func (od *oimDriver03) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+func topologySegments0(topologies []*csi.Topology) []map[string]string {
+	var segments []map[string]string
+	for _, topology := range topologies {
+		segments = append(segments, topology.GetSegments())
+	}
+	return segments
+}
+
+func (od *oimDriver03) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (_ *csi.DeleteVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "DeleteVolume", req)
+	defer od.observe("DeleteVolume", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "DeleteVolume", VolumeID: req.GetVolumeId()}, err)
+	}()
 	// Check arguments
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
 	name := req.GetVolumeId()
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
+	if err := od.checkVolumeTenant(ctx, name); err != nil {
+		return nil, err
+	}
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(name)
 	defer volumeNameMutex.UnlockKey(name)
 
+	release, err := od.currentOps().acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The metadata is gone after deleting the volume.
+	metadata, _ := od.metadata.get(name)
 	if err := od.backend.deleteVolume(ctx, name); err != nil {
 		return nil, err
 	}
+	od.metadata.delete(name)
+	od.created.forget(name)
+	od.volumeDeletedEvent(metadata.Claim, name)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (od *oimDriver03) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver03) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (_ *csi.ControllerPublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "ControllerPublishVolume", req)
+	defer od.observe("ControllerPublishVolume", time.Now(), &err)
+	socket, err := od.publishVolume(ctx, req.GetVolumeId(), req.GetNodeId(), req.GetVolumeCapability() != nil, req.GetReadonly())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishInfo: map[string]string{
+			publishContextVHostSocket: socket,
+		},
+	}, nil
 }
 
-func (od *oimDriver03) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver03) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (_ *csi.ControllerUnpublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "ControllerUnpublishVolume", req)
+	defer od.observe("ControllerUnpublishVolume", time.Now(), &err)
+	if err := od.unpublishVolume(ctx, req.GetVolumeId(), req.GetNodeId()); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (od *oimDriver03) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+func (od *oimDriver03) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (_ *csi.ValidateVolumeCapabilitiesResponse, err error) {
+	ctx = od.withLogger(ctx, "ValidateVolumeCapabilities", req)
+	defer od.observe("ValidateVolumeCapabilities", time.Now(), &err)
 
 	// Check arguments
 	if len(req.GetVolumeId()) == 0 {
@@ -108,11 +187,14 @@ func (od *oimDriver03) ValidateVolumeCapabilities(ctx context.Context, req *csi.
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
 	name := req.GetVolumeId()
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
+	if err := od.checkVolumeTenant(ctx, name); err != nil {
+		return nil, err
+	}
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(name)
 	defer volumeNameMutex.UnlockKey(name)
 
@@ -122,37 +204,119 @@ func (od *oimDriver03) ValidateVolumeCapabilities(ctx context.Context, req *csi.
 	}
 
 	for _, cap := range req.VolumeCapabilities {
-		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: ""}, nil
+		message, err := od.checkAccessMode(ctx, req.GetVolumeId(), accessMode0(cap.GetAccessMode().GetMode()))
+		if err != nil {
+			return nil, err
+		}
+		if message != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: message}, nil
 		}
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true, Message: ""}, nil
 }
 
-func (od *oimDriver03) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver03) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (_ *csi.ListVolumesResponse, err error) {
+	ctx = od.withLogger(ctx, "ListVolumes", req)
+	defer od.observe("ListVolumes", time.Now(), &err)
+	volumes, nextToken, err := od.listVolumes(ctx, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	response := &csi.ListVolumesResponse{
+		NextToken: nextToken,
+	}
+	for _, volume := range volumes {
+		response.Entries = append(response.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				Id:            volume.volumeID,
+				CapacityBytes: volume.capacityBytes,
+				Attributes:    od.listVolumeContext(volume.volumeID),
+			},
+		})
+	}
+	return response, nil
 }
 
-func (od *oimDriver03) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver03) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (_ *csi.GetCapacityResponse, err error) {
+	ctx = od.withLogger(ctx, "GetCapacity", req)
+	defer od.observe("GetCapacity", time.Now(), &err)
+	capacity, err := od.getCapacity(ctx, req.GetAccessibleTopology().GetSegments())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: capacity,
+	}, nil
 }
 
 // ControllerGetCapabilities implements the default GRPC callout.
 // Default supports all capabilities
-func (od *oimDriver03) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+func (od *oimDriver03) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (_ *csi.ControllerGetCapabilitiesResponse, err error) {
+	defer od.observe("ControllerGetCapabilities", time.Now(), &err)
 	return &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: od.cap,
 	}, nil
 }
 
-func (od *oimDriver03) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver03) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (response *csi.CreateSnapshotResponse, err error) {
+	ctx = od.withLogger(ctx, "CreateSnapshot", req)
+	defer od.observe("CreateSnapshot", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "CreateSnapshot", Name: req.GetName(), VolumeID: req.GetSourceVolumeId(), SnapshotID: response.GetSnapshot().GetId()}, err)
+	}()
+	snapshot, err := od.createSnapshot(ctx, req.GetName(), req.GetSourceVolumeId(), req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateSnapshotResponse{
+		Snapshot: snapshot03(snapshot),
+	}, nil
 }
 
-func (od *oimDriver03) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (od *oimDriver03) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (_ *csi.DeleteSnapshotResponse, err error) {
+	ctx = od.withLogger(ctx, "DeleteSnapshot", req)
+	defer od.observe("DeleteSnapshot", time.Now(), &err)
+	defer func() {
+		od.audit(ctx, AuditRecord{Operation: "DeleteSnapshot", SnapshotID: req.GetSnapshotId()}, err)
+	}()
+	if err := od.deleteSnapshot(ctx, req.GetSnapshotId()); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (od *oimDriver03) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (_ *csi.ListSnapshotsResponse, err error) {
+	ctx = od.withLogger(ctx, "ListSnapshots", req)
+	defer od.observe("ListSnapshots", time.Now(), &err)
+	snapshots, nextToken, err := od.listSnapshots(ctx, req.GetSnapshotId(), req.GetSourceVolumeId(), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	response := &csi.ListSnapshotsResponse{
+		NextToken: nextToken,
+	}
+	for _, snapshot := range snapshots {
+		response.Entries = append(response.Entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshot03(snapshot),
+		})
+	}
+	return response, nil
 }
 
-func (od *oimDriver03) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// snapshot03 converts to CSI 0.3. The expiry goes into the status
+// details because CSI 1.0 has no place for it.
+func snapshot03(s snapshotInfo) *csi.Snapshot {
+	snapshot := &csi.Snapshot{
+		Id:             s.snapshotID,
+		SourceVolumeId: s.SourceVolumeID,
+		SizeBytes:      s.SizeBytes,
+		CreatedAt:      s.CreationTime.UnixNano(),
+		Status: &csi.SnapshotStatus{
+			Type: csi.SnapshotStatus_READY,
+		},
+	}
+	if s.ExpiryUnixSeconds != 0 {
+		snapshot.Status.Details = fmt.Sprintf("expires %s", time.Unix(s.ExpiryUnixSeconds, 0).UTC().Format(time.RFC3339))
+	}
+	return snapshot
 }
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/oim-csi-driver"
+	"github.com/intel/oim/pkg/oim-csi-driver/fakecontroller"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+const mib = 1024 * 1024
+
+// newFakeController returns a driver which gets called via gRPC.
+func newFakeController(t *testing.T, options ...oimcsidriver.Option) *fakecontroller.Controller {
+	c, err := fakecontroller.New(options...)
+	require.NoError(t, err)
+	return c
+}
+
+func TestListVolumesCapability(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	c := newFakeController(t)
+	defer c.Close()
+
+	response, err := c.ControllerClient().ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	require.NoError(t, err)
+	var caps []string
+	for _, cap := range response.GetCapabilities() {
+		caps = append(caps, cap.GetRpc().GetType().String())
+	}
+	assert.Contains(t, strings.Join(caps, ","), "LIST_VOLUMES")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	c := newFakeController(t, oimcsidriver.WithSPDKCircuitBreaker(1, time.Hour))
+	defer c.Close()
+
+	// Cannot be decoded, which looks like a communication failure.
+	c.HandleSPDK("bdev_lvol_get_lvstores", "garbage")
+	_, err := c.ControllerClient().CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "CreateVolume: %v", err)
+
+	// Now SPDK does not get called at all.
+	calls := len(c.SPDK.Calls())
+	_, err = c.ControllerClient().DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol"})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "DeleteVolume: %v", err)
+	assert.Equal(t, calls, len(c.SPDK.Calls()), "SPDK calls")
+}
+
+func TestGetCapacity(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	c := newFakeController(t, oimcsidriver.WithNodeID("host-0"))
+	defer c.Close()
+
+	c.HandleSPDK("bdev_lvol_get_lvstores", []spdk.LVStore{
+		{Name: "lvs0", ClusterSize: 4 * mib, FreeClusters: 10, TotalDataClusters: 20},
+		{Name: "lvs1", ClusterSize: mib, FreeClusters: 3, TotalDataClusters: 3},
+	})
+	for name, tc := range map[string]struct {
+		segments map[string]string
+		expected int64
+	}{
+		"no topology":    {nil, 43 * mib},
+		"this node":      {map[string]string{"oim.intel.com/node": "host-0"}, 43 * mib},
+		"other segments": {map[string]string{"zone": "a"}, 43 * mib},
+		"other node":     {map[string]string{"oim.intel.com/node": "host-1"}, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := &csi.GetCapacityRequest{}
+			if tc.segments != nil {
+				req.AccessibleTopology = &csi.Topology{Segments: tc.segments}
+			}
+			response, err := c.ControllerClient().GetCapacity(ctx, req)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, response.GetAvailableCapacity())
+		})
+	}
+
+	c.FailSPDK("bdev_lvol_get_lvstores", spdk.ERROR_METHOD_NOT_FOUND, "no such method")
+	_, err := c.ControllerClient().GetCapacity(ctx, &csi.GetCapacityRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "SPDK error: %s", err)
+}
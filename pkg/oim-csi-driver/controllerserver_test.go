@@ -0,0 +1,737 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/log/level"
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+// fakeBDevs emulates the SPDK calls for Malloc BDevs in a Fake.
+type fakeBDevs struct {
+	mutex sync.Mutex
+	bdevs map[string]spdk.BDev
+}
+
+func newFakeBDevs(fake *testspdk.Fake) *fakeBDevs {
+	fb := &fakeBDevs{bdevs: map[string]spdk.BDev{}}
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetBDevsArgs
+		if params != nil {
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, err
+			}
+		}
+		fb.mutex.Lock()
+		defer fb.mutex.Unlock()
+		result := []spdk.BDev{}
+		for name, bdev := range fb.bdevs {
+			if args.Name == "" || args.Name == name {
+				result = append(result, bdev)
+			}
+		}
+		if args.Name != "" && len(result) == 0 {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+		}
+		return result, nil
+	})
+	fake.Handle("construct_malloc_bdev", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.ConstructMallocBDevArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fb.add(args.Name, args.BlockSize*args.NumBlocks)
+		return args.Name, nil
+	})
+	fake.Handle("delete_bdev", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.DeleteBDevArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fb.mutex.Lock()
+		defer fb.mutex.Unlock()
+		if _, ok := fb.bdevs[args.Name]; !ok {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+		}
+		delete(fb.bdevs, args.Name)
+		return nil, nil
+	})
+	fake.Handle("get_nbd_disks", func(params json.RawMessage) (interface{}, error) {
+		return []spdk.StartNBDDiskArgs{}, nil
+	})
+	fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+		return []spdk.LVStore{}, nil
+	})
+	return fb
+}
+
+func (fb *fakeBDevs) add(name string, size int64) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.bdevs[name] = spdk.BDev{
+		Name:        name,
+		ProductName: mallocProductName,
+		BlockSize:   512,
+		NumBlocks:   size / 512,
+	}
+}
+
+func (fb *fakeBDevs) remove(name string) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	delete(fb.bdevs, name)
+}
+
+// newFakeDriver returns a driver which uses a fake SPDK.
+func newFakeDriver(t *testing.T, options ...Option) (*oimDriver03, *testspdk.Fake, *fakeBDevs) {
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	fb := newFakeBDevs(fake)
+	driver, err := New(append([]Option{WithVHostEndpoint(fake.Path)}, options...)...)
+	if err != nil {
+		fake.Close()
+	}
+	require.NoError(t, err)
+	return driver.(*oimDriver03), fake, fb
+}
+
+func TestListVolumes(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, fb := newFakeDriver(t)
+	defer fake.Close()
+
+	list := func(token string, max int32) ([]string, string, error) {
+		response, err := od.oimDriver.ListVolumes(ctx, &csi.ListVolumesRequest{
+			StartingToken: token,
+			MaxEntries:    max,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		var ids []string
+		for _, entry := range response.GetEntries() {
+			ids = append(ids, entry.GetVolume().GetVolumeId())
+		}
+		return ids, response.GetNextToken(), nil
+	}
+
+	// Empty store.
+	ids, next, err := list("", 0)
+	require.NoError(t, err)
+	assert.Empty(t, ids, "empty")
+	assert.Empty(t, next, "empty")
+
+	for i := 4; i >= 0; i-- {
+		fb.add(fmt.Sprintf("vol-%d", i), mib)
+	}
+	// Not created by us.
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		result := []spdk.BDev{{Name: "other", ProductName: "Split Disk"}}
+		fb.mutex.Lock()
+		defer fb.mutex.Unlock()
+		for _, bdev := range fb.bdevs {
+			result = append(result, bdev)
+		}
+		return result, nil
+	})
+
+	// Everything at once.
+	ids, next, err = list("", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vol-0", "vol-1", "vol-2", "vol-3", "vol-4"}, ids, "all")
+	assert.Empty(t, next, "all")
+
+	// Page by page.
+	var all []string
+	token := ""
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 5, "too many pages")
+		ids, next, err = list(token, 2)
+		require.NoError(t, err)
+		assert.True(t, len(ids) <= 2, "page size")
+		all = append(all, ids...)
+		if next == "" {
+			break
+		}
+		assert.NotContains(t, next, "vol", "token should be opaque")
+		token = next
+	}
+	assert.Equal(t, []string{"vol-0", "vol-1", "vol-2", "vol-3", "vol-4"}, all, "paged")
+
+	// Tokens are stable.
+	_, first, err := list("", 2)
+	require.NoError(t, err)
+	ids1, _, err := list(first, 2)
+	require.NoError(t, err)
+	ids2, _, err := list(first, 2)
+	require.NoError(t, err)
+	assert.Equal(t, ids1, ids2, "same token, same page")
+	assert.Equal(t, []string{"vol-2", "vol-3"}, ids1)
+
+	// Concurrent deletes shrink the list, including the volume
+	// that the token refers to. Pagination continues after it.
+	fb.remove("vol-1")
+	fb.remove("vol-2")
+	ids, next, err = list(first, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vol-3", "vol-4"}, ids, "after delete")
+	assert.Empty(t, next, "after delete")
+
+	// Stale token beyond the end of the list.
+	fb.remove("vol-3")
+	fb.remove("vol-4")
+	ids, next, err = list(first, 2)
+	require.NoError(t, err)
+	assert.Empty(t, ids, "beyond end")
+	assert.Empty(t, next, "beyond end")
+
+	// Invalid token.
+	_, _, err = list("!!!", 2)
+	assert.Equal(t, codes.Aborted, status.Code(err), "invalid token: %s", err)
+	_, _, err = list("", -1)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "negative max entries: %s", err)
+}
+
+func TestSharedSPDKClient(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, fb := newFakeDriver(t)
+	defer fake.Close()
+	fb.add("vol1", mib)
+
+	for i := 0; i < 5; i++ {
+		_, err := od.oimDriver.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, fake.Connections(), "connection reused")
+
+	// Reconnects after SPDK dropped the connection.
+	fake.Disconnect()
+	_, err := od.oimDriver.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.Connections(), "reconnected")
+
+	client, err := spdk.New(fake.Path)
+	require.NoError(t, err)
+	driver, err := New(WithSPDKClient(client))
+	require.NoError(t, err)
+	_, err = driver.(*oimDriver03).oimDriver.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "provided client")
+	assert.Equal(t, 3, fake.Connections(), "provided client used")
+	require.NoError(t, driver.(*oimDriver03).local.close())
+}
+
+// fakeVHostBlk emulates vhost-blk controllers in a Fake.
+func fakeVHostBlk(fake *testspdk.Fake) map[string]spdk.ConstructVHostBlkControllerArgs {
+	controllers := map[string]spdk.ConstructVHostBlkControllerArgs{}
+	fake.Handle("get_vhost_controllers", func(params json.RawMessage) (interface{}, error) {
+		result := []map[string]interface{}{}
+		for _, args := range controllers {
+			result = append(result, map[string]interface{}{
+				"ctrlr": args.Controller,
+				"backend_specific": map[string]interface{}{
+					"block": map[string]interface{}{
+						"bdev":     args.DevName,
+						"readonly": args.ReadOnly,
+					},
+				},
+			})
+		}
+		return result, nil
+	})
+	fake.Handle("vhost_create_blk_controller", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.ConstructVHostBlkControllerArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		if _, ok := controllers[args.Controller]; ok {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "controller exists"}
+		}
+		controllers[args.Controller] = args
+		return true, nil
+	})
+	fake.Handle("remove_vhost_controller", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.RemoveVHostControllerArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		delete(controllers, args.Controller)
+		return true, nil
+	})
+	return controllers
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, fb := newFakeDriver(t, WithNodeID("host-0"), WithVHostSocketDir("/var/run/spdk"))
+	defer fake.Close()
+	controllers := fakeVHostBlk(fake)
+	fb.add("vol-0", mib)
+
+	capability := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	publish := func(volumeID, nodeID string) (string, error) {
+		response, err := od.oimDriver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           nodeID,
+			VolumeCapability: capability,
+		})
+		return response.GetPublishContext()[publishContextVHostSocket], err
+	}
+
+	socket, err := publish("vol-0", "host-0")
+	require.NoError(t, err)
+	assert.Equal(t, "/var/run/spdk/"+vhostBlkController("vol-0", "host-0"), socket)
+	require.Len(t, controllers, 1)
+	assert.Equal(t, "vol-0", controllers[vhostBlkController("vol-0", "host-0")].DevName)
+
+	// Idempotent.
+	socket2, err := publish("vol-0", "host-0")
+	require.NoError(t, err)
+	assert.Equal(t, socket, socket2)
+	assert.Len(t, controllers, 1, "no duplicate controller")
+
+	_, err = publish("no-such-volume", "host-0")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %s", err)
+	_, err = publish("vol-0", "host-1")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown node: %s", err)
+	_, err = publish("", "host-0")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "no volume: %s", err)
+
+	unpublish := func(volumeID, nodeID string) error {
+		_, err := od.oimDriver.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   nodeID,
+		})
+		return err
+	}
+	require.NoError(t, unpublish("vol-0", "host-1"), "other node")
+	assert.Len(t, controllers, 1, "other node")
+	require.NoError(t, unpublish("vol-0", "host-0"))
+	assert.Empty(t, controllers)
+	require.NoError(t, unpublish("vol-0", "host-0"), "idempotent")
+
+	// Without node ID, all controllers of the volume are removed.
+	_, err = publish("vol-0", "host-0")
+	require.NoError(t, err)
+	require.NoError(t, unpublish("vol-0", ""))
+	assert.Empty(t, controllers)
+}
+
+func TestWithLogger(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	var output bytes.Buffer
+	logger := log.NewSimpleLogger(log.SimpleConfig{
+		Level:  level.Info,
+		Output: &output,
+	})
+	od, fake, fb := newFakeDriver(t, WithNodeID("host-0"), WithVHostSocketDir("/var/run/spdk"), WithLogger(logger))
+	defer fake.Close()
+	fakeVHostBlk(fake)
+	fb.add("vol-0", mib)
+
+	_, err := od.oimDriver.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "vol-0",
+		NodeId:   "host-0",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, output.String(), "creating vhost-blk controller")
+	for _, field := range []string{"ControllerPublishVolume", "volumeid", "vol-0", "nodeid", "host-0"} {
+		assert.Contains(t, output.String(), field)
+	}
+}
+
+func TestCapacityRange(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	for name, tc := range map[string]struct {
+		required, limit int64
+		code            codes.Code
+		capacity        int64
+	}{
+		"unset":               {0, 0, codes.OK, mib},
+		"limit-only":          {0, 4 * mib, codes.OK, mib},
+		"limit-below-default": {0, mib / 2, codes.OutOfRange, 0},
+		"required-only":       {1, 0, codes.OK, mib},
+		"round-up":            {mib + mib/2, 0, codes.OK, 2 * mib},
+		"round-up-to-limit":   {mib + mib/2, 2 * mib, codes.OK, 2 * mib},
+		"round-up-over-limit": {mib + mib/2, mib + mib/2, codes.OutOfRange, 0},
+		"exact":               {3 * mib, 3 * mib, codes.OK, 3 * mib},
+		"required-over-limit": {2 * mib, mib, codes.InvalidArgument, 0},
+		"negative":            {-1, 0, codes.InvalidArgument, 0},
+		"no-space":            {200 * mib, 0, codes.OutOfRange, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name: name,
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: tc.required,
+					LimitBytes:    tc.limit,
+				},
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+			})
+			require.Equal(t, tc.code, status.Code(err), "%v", err)
+			if err != nil {
+				assert.Nil(t, fl.find("lvs/"+name), "no volume created")
+				return
+			}
+			volume := response.GetVolume()
+			assert.Equal(t, tc.capacity, volume.GetCapacityBytes())
+			assert.Equal(t, fmt.Sprintf("%d", tc.capacity), volume.GetVolumeContext()[capacityContextKey])
+			lvol := fl.find("lvs/" + name)
+			require.NotNil(t, lvol, "volume created")
+			assert.Equal(t, lvol.UUID, volume.GetVolumeId())
+			assert.Equal(t, tc.capacity, lvol.NumBlocks*lvol.BlockSize)
+		})
+	}
+}
+
+func TestThinProvisioning(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	for name, tc := range map[string]struct {
+		parameters map[string]string
+		code       codes.Code
+		thin       bool
+	}{
+		"default": {nil, codes.OK, true},
+		"thin":    {map[string]string{thinProvisionParameter: "true"}, codes.OK, true},
+		"thick":   {map[string]string{thinProvisionParameter: "false"}, codes.OK, false},
+		"invalid": {map[string]string{thinProvisionParameter: "yes"}, codes.InvalidArgument, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:       name,
+				Parameters: tc.parameters,
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+			})
+			require.Equal(t, tc.code, status.Code(err), "%v", err)
+			lvol := fl.find("lvs/" + name)
+			if err != nil {
+				assert.Nil(t, lvol, "no volume created")
+				return
+			}
+			require.NotNil(t, lvol, "volume created")
+			assert.Equal(t, tc.thin, lvol.DriverSpecific.LVol.ThinProvision)
+		})
+	}
+}
+
+func TestClearMethod(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	for name, tc := range map[string]struct {
+		parameters map[string]string
+		code       codes.Code
+		params     string
+	}{
+		"default":      {nil, codes.OK, ""},
+		"none":         {map[string]string{clearMethodParameter: "none"}, codes.OK, `"clear_method":"none"`},
+		"unmap":        {map[string]string{clearMethodParameter: "unmap"}, codes.OK, `"clear_method":"unmap"`},
+		"write_zeroes": {map[string]string{clearMethodParameter: "write_zeroes"}, codes.OK, `"clear_method":"write_zeroes"`},
+		"invalid":      {map[string]string{clearMethodParameter: "shred"}, codes.InvalidArgument, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			calls := len(fake.Calls())
+			_, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:       name,
+				Parameters: tc.parameters,
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+			})
+			require.Equal(t, tc.code, status.Code(err), "%v", err)
+			var created []string
+			for _, call := range fake.Calls()[calls:] {
+				if call.Method == "bdev_lvol_create" {
+					created = append(created, string(call.Params))
+				}
+			}
+			if err != nil {
+				assert.Contains(t, err.Error(), "must be one of none, unmap, write_zeroes")
+				assert.Empty(t, created, "no volume created")
+				assert.Nil(t, fl.find("lvs/"+name), "no volume created")
+				return
+			}
+			require.Len(t, created, 1, "volume created")
+			if tc.params != "" {
+				assert.Contains(t, created[0], tc.params)
+			} else {
+				assert.NotContains(t, created[0], "clear_method")
+			}
+		})
+	}
+}
+
+func TestLVStoreName(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+	fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+		return []spdk.LVStore{
+			{UUID: "lvs-uuid", Name: "lvs", TotalDataClusters: 100, FreeClusters: 100, BlockSize: 512, ClusterSize: mib},
+			{UUID: "lvs2-uuid", Name: "lvs2", TotalDataClusters: 100, FreeClusters: 100, BlockSize: 512, ClusterSize: mib},
+		}, nil
+	})
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	for name, tc := range map[string]struct {
+		parameters map[string]string
+		code       codes.Code
+		uuid       string
+	}{
+		"default": {nil, codes.OK, "lvs-uuid"},
+		"first":   {map[string]string{lvstoreParameter: "lvs"}, codes.OK, "lvs-uuid"},
+		"second":  {map[string]string{lvstoreParameter: "lvs2"}, codes.OK, "lvs2-uuid"},
+		"missing": {map[string]string{lvstoreParameter: "no-such-lvs"}, codes.InvalidArgument, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			calls := len(fake.Calls())
+			response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:       name,
+				Parameters: tc.parameters,
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+			})
+			require.Equal(t, tc.code, status.Code(err), "%v", err)
+			var created []spdk.CreateLVolArgs
+			for _, call := range fake.Calls()[calls:] {
+				if call.Method == "bdev_lvol_create" {
+					var args spdk.CreateLVolArgs
+					require.NoError(t, json.Unmarshal(call.Params, &args))
+					created = append(created, args)
+				}
+			}
+			if err != nil {
+				assert.Empty(t, created, "no volume created")
+				return
+			}
+			require.Len(t, created, 1, "volume created")
+			assert.Equal(t, tc.uuid, created[0].UUID)
+			assert.Equal(t, tc.uuid, response.GetVolume().GetVolumeContext()[lvstoreUUIDContextKey])
+		})
+	}
+}
+
+func TestCreateVolumeIdempotency(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, fb := newFakeDriver(t)
+	defer fake.Close()
+
+	create := func(requiredBytes int64, parameters map[string]string) (*csi.Volume, error) {
+		response, err := od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          "vol",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: requiredBytes},
+			Parameters:    parameters,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return response.GetVolume(), err
+	}
+	constructed := func() int {
+		count := 0
+		for _, method := range fake.Methods() {
+			if method == "construct_malloc_bdev" {
+				count++
+			}
+		}
+		return count
+	}
+
+	volume, err := create(mib, map[string]string{"a": "b"})
+	require.NoError(t, err)
+	again, err := create(mib, map[string]string{"a": "b"})
+	require.NoError(t, err, "identical")
+	assert.Equal(t, volume, again, "identical")
+	assert.Equal(t, 1, constructed(), "identical")
+
+	_, err = create(mib, map[string]string{"a": "c"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "other parameters: %s", err)
+	_, err = create(mib, nil)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "no parameters: %s", err)
+	_, err = create(2*mib, map[string]string{"a": "b"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "other size: %s", err)
+
+	// Removed behind the back of the driver.
+	fb.remove(volume.GetVolumeId())
+	_, err = create(mib, map[string]string{"a": "b"})
+	require.NoError(t, err, "recreated")
+	assert.Equal(t, 2, constructed(), "recreated")
+
+	// Deleted, so other parameters are fine.
+	_, err = od.oimDriver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+	require.NoError(t, err)
+	_, err = create(mib, nil)
+	require.NoError(t, err, "after DeleteVolume")
+	assert.Equal(t, 3, constructed(), "after DeleteVolume")
+}
+
+func TestDeleteVolumeNotFound(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	for name, tc := range map[string]struct {
+		code     int
+		expected codes.Code
+	}{
+		"invalid-params": {spdk.ERROR_INVALID_PARAMS, codes.OK},
+		"enoent":         {-int(syscall.ENOENT), codes.OK},
+		"enodev":         {-int(syscall.ENODEV), codes.OK},
+		"other":          {spdk.ERROR_INTERNAL_ERROR, codes.Internal},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake, err := testspdk.NewFake()
+			require.NoError(t, err)
+			defer fake.Close()
+			newFakeLVols(fake)
+			driver, err := New(WithVHostEndpoint(fake.Path))
+			require.NoError(t, err)
+			od := &driver.(*oimDriver03).oimDriver
+
+			response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name: "vol",
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+			})
+			require.NoError(t, err)
+
+			// Removed after get_bdevs found it.
+			fake.Handle("bdev_lvol_delete", func(params json.RawMessage) (interface{}, error) {
+				return nil, testspdk.FakeError{Code: tc.code, Message: "lvol not found"}
+			})
+			_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: response.GetVolume().GetVolumeId()})
+			assert.Equal(t, tc.expected, status.Code(err), "%v", err)
+		})
+	}
+}
+
+func TestAccessModes(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, fb := newFakeDriver(t)
+	defer fake.Close()
+	fb.add("vol", mib)
+
+	capabilities := func(mode csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability {
+		return []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}}
+	}
+
+	result, err := od.oimDriver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "vol",
+		VolumeCapabilities: capabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, result.GetConfirmed(), "single node writer")
+
+	result, err = od.oimDriver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "vol",
+		VolumeCapabilities: capabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+	})
+	require.NoError(t, err)
+	assert.Nil(t, result.GetConfirmed(), "multi node writer")
+	assert.Equal(t, "multi-node reader, multi-node writer not supported", result.GetMessage())
+
+	result0, err := od.ValidateVolumeCapabilities(ctx, &csi0.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "vol",
+		VolumeCapabilities: []*csi0.VolumeCapability{{
+			AccessType: &csi0.VolumeCapability_Mount{Mount: &csi0.VolumeCapability_MountVolume{}},
+			AccessMode: &csi0.VolumeCapability_AccessMode{Mode: csi0.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}},
+	})
+	require.NoError(t, err)
+	assert.False(t, result0.GetSupported(), "multi node writer, CSI 0.3")
+	assert.Equal(t, "multi-node reader, multi-node writer not supported", result0.GetMessage())
+
+	_, err = od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "other",
+		VolumeCapabilities: capabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+	})
+	assert.Equal(t, codes.Unimplemented, status.Code(err), "create multi node writer: %s", err)
+
+	// The OIM controller cannot provide read-only volumes.
+	remote := &oimDriver{accessModes: remoteAccessModes}
+	reason, err := remote.checkAccessMode(ctx, "vol", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)
+	require.NoError(t, err)
+	assert.Contains(t, reason, "OIM controller")
+	reason, err = remote.checkAccessMode(ctx, "vol", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+const (
+	// encryptedParameter enables encryption of a new volume with
+	// a crypto BDev on top of it when set to "true".
+	encryptedParameter = "encrypted"
+	// cryptoKeySecretRefParameter is the <namespace>/<name> of
+	// the Secret with the keys of an encrypted volume.
+	cryptoKeySecretRefParameter = "cryptoKeySecretRef"
+	// cryptoKeySecretKey and cryptoKey2SecretKey are the entries
+	// in the Secret with the two AES-XTS keys.
+	cryptoKeySecretKey  = "key"
+	cryptoKey2SecretKey = "key2"
+
+	// cryptoPMD is the DPDK poll mode driver of the software
+	// crypto module of SPDK.
+	cryptoPMD    = "crypto_aesni_mb"
+	cryptoCipher = "AES_XTS"
+)
+
+// SecretReader provides the data of Kubernetes Secrets.
+type SecretReader interface {
+	ReadSecret(ctx context.Context, namespace, name string) (map[string][]byte, error)
+}
+
+type kubeSecretReader struct {
+	client kubernetes.Interface
+}
+
+// NewSecretReader creates a reader which gets Secrets from the
+// Kubernetes API server.
+func NewSecretReader(client kubernetes.Interface) SecretReader {
+	return &kubeSecretReader{client: client}
+}
+
+func (k *kubeSecretReader) ReadSecret(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	secret, err := k.client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// cryptoKeys are the keys for spdk.CreateCryptoBDevArgs.
+type cryptoKeys struct {
+	key, key2 string
+}
+
+// cryptoBDevName returns the name of the crypto BDev of an encrypted
+// volume. This BDev instead of the volume itself gets exposed via NBD
+// and vhost.
+func cryptoBDevName(volumeID string) string {
+	return volumeID + "_crypto"
+}
+
+// exposedBDev returns the name of the BDev which represents the
+// volume. Only the crypto BDev claims volumes, so a claimed volume
+// must be encrypted.
+func exposedBDev(volume spdk.BDev, volumeID string) string {
+	if volume.Claimed {
+		return cryptoBDevName(volumeID)
+	}
+	return volumeID
+}
+
+// cryptoKeySecret checks the encryption parameters. It returns the
+// namespace and name of the Secret with the keys, or empty strings
+// when the parameters do not ask for encryption.
+func cryptoKeySecret(parameters map[string]string) (string, string, error) {
+	switch value := parameters[encryptedParameter]; value {
+	case "", "false":
+		return "", "", nil
+	case "true":
+	default:
+		return "", "", status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s parameter %q, must be true or false", encryptedParameter, value))
+	}
+	ref := parameters[cryptoKeySecretRefParameter]
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", status.Error(codes.InvalidArgument, fmt.Sprintf("%s parameter %q must have the format <namespace>/<name>", cryptoKeySecretRefParameter, ref))
+	}
+	return parts[0], parts[1], nil
+}
+
+// cryptoKeys returns nil when the parameters do not ask for
+// encryption, otherwise the keys from the referenced Secret.
+func (l *localSPDK) cryptoKeys(ctx context.Context, parameters map[string]string) (*cryptoKeys, error) {
+	namespace, name, err := cryptoKeySecret(parameters)
+	if err != nil || name == "" {
+		return nil, err
+	}
+	ref := namespace + "/" + name
+	if l.secrets == nil {
+		return nil, status.Error(codes.FailedPrecondition, "encrypted volumes need access to Secrets, which is not enabled")
+	}
+	data, err := l.secrets.ReadSecret(ctx, namespace, name)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, errors.Wrapf(err, "read Secret %s", ref).Error())
+	}
+	keys := &cryptoKeys{
+		key:  string(data[cryptoKeySecretKey]),
+		key2: string(data[cryptoKey2SecretKey]),
+	}
+	if keys.key == "" || keys.key2 == "" {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Secret %s must contain %s and %s", ref, cryptoKeySecretKey, cryptoKey2SecretKey))
+	}
+	return keys, nil
+}
+
+// createCryptoBDev puts a crypto BDev on top of the volume, unless it
+// already exists.
+func (l *localSPDK) createCryptoBDev(ctx context.Context, client *spdk.Client, volumeID string, keys cryptoKeys) error {
+	name := cryptoBDevName(volumeID)
+	_, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: name})
+	switch {
+	case err == nil:
+		// Created before (idempotency!).
+		return nil
+	case !spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS):
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get BDevs from SPDK: %s", err))
+	}
+	log.FromContext(ctx).Infow("creating crypto BDev",
+		"volumeid", volumeID,
+		"bdev", name,
+	)
+	if _, err := spdk.CreateCryptoBDev(ctx, client, spdk.CreateCryptoBDevArgs{
+		BaseBDevName: volumeID,
+		Name:         name,
+		CryptoPMD:    cryptoPMD,
+		Key:          keys.key,
+		Cipher:       cryptoCipher,
+		Key2:         keys.key2,
+	}); err != nil {
+		return spdk.GRPCError(err, fmt.Sprintf("Failed to create crypto BDev for %s", volumeID))
+	}
+	return nil
+}
+
+// deleteCryptoBDev removes the crypto BDev of an encrypted volume, if
+// it still exists.
+func (l *localSPDK) deleteCryptoBDev(ctx context.Context, client *spdk.Client, volumeID string) error {
+	name := cryptoBDevName(volumeID)
+	log.FromContext(ctx).Infow("deleting crypto BDev",
+		"volumeid", volumeID,
+		"bdev", name,
+	)
+	if err := spdk.DeleteCryptoBDev(ctx, client, spdk.DeleteCryptoBDevArgs{Name: name}); err != nil && !spdkIsNotFound(err) {
+		return spdk.GRPCError(err, fmt.Sprintf("Failed to delete crypto BDev %s", name))
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+type fakeSecrets map[string]map[string][]byte
+
+func (f fakeSecrets) ReadSecret(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	data, ok := f[namespace+"/"+name]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+// fakeCrypto adds crypto BDevs on top of the logical volumes of a
+// fakeLVols.
+func fakeCrypto(fake *testspdk.Fake, fl *fakeLVols) map[string]spdk.CreateCryptoBDevArgs {
+	cryptos := map[string]spdk.CreateCryptoBDevArgs{}
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetBDevsArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		if _, ok := cryptos[args.Name]; ok {
+			return []spdk.BDev{{Name: args.Name, ProductName: "crypto"}}, nil
+		}
+		if lvol := fl.find(args.Name); lvol != nil {
+			return []spdk.BDev{*lvol}, nil
+		}
+		return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+	})
+	fake.Handle("bdev_crypto_create", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.CreateCryptoBDevArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.find(args.BaseBDevName)
+		if lvol == nil || lvol.Claimed {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "cannot claim base bdev"}
+		}
+		lvol.Claimed = true
+		cryptos[args.Name] = args
+		return args.Name, nil
+	})
+	fake.Handle("bdev_crypto_delete", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.DeleteCryptoBDevArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		crypto, ok := cryptos[args.Name]
+		if !ok {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+		}
+		fl.find(crypto.BaseBDevName).Claimed = false
+		delete(cryptos, args.Name)
+		return true, nil
+	})
+	// Claimed logical volumes cannot be deleted.
+	fake.Handle("bdev_lvol_delete", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.LVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.find(args.Name)
+		switch {
+		case lvol == nil:
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol not found"}
+		case lvol.Claimed:
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol is claimed"}
+		}
+		delete(fl.lvols, lvol.UUID)
+		return true, nil
+	})
+	return cryptos
+}
+
+func TestEncryptedVolumes(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	cryptos := fakeCrypto(fake, fl)
+	controllers := fakeVHostBlk(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path), WithNodeID("host-0"))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	create := func(name string, parameters map[string]string) (string, error) {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       name,
+			Parameters: parameters,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return response.GetVolume().GetVolumeId(), err
+	}
+	parameters := map[string]string{
+		encryptedParameter:          "true",
+		cryptoKeySecretRefParameter: "default/keys",
+	}
+
+	// Nothing gets created when the keys are not available.
+	_, err = create("no-reader", parameters)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "%v", err)
+	od.local.secrets = fakeSecrets{
+		"default/keys":    {"key": []byte("0123456789123456"), "key2": []byte("9876543210987654")},
+		"default/partial": {"key": []byte("0123456789123456")},
+	}
+	for name, tc := range map[string]struct {
+		parameters map[string]string
+		code       codes.Code
+	}{
+		"invalid":   {map[string]string{encryptedParameter: "yes"}, codes.InvalidArgument},
+		"no-ref":    {map[string]string{encryptedParameter: "true"}, codes.InvalidArgument},
+		"bad-ref":   {map[string]string{encryptedParameter: "true", cryptoKeySecretRefParameter: "keys"}, codes.InvalidArgument},
+		"no-secret": {map[string]string{encryptedParameter: "true", cryptoKeySecretRefParameter: "default/no-such-secret"}, codes.FailedPrecondition},
+		"no-key2":   {map[string]string{encryptedParameter: "true", cryptoKeySecretRefParameter: "default/partial"}, codes.FailedPrecondition},
+	} {
+		_, err := create(name, tc.parameters)
+		assert.Equal(t, tc.code, status.Code(err), "%s: %v", name, err)
+	}
+	assert.Empty(t, fl.lvols, "no volumes created")
+
+	// A new volume gets removed when encrypting it fails.
+	fake.Handle("bdev_crypto_create", func(params json.RawMessage) (interface{}, error) {
+		return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "no crypto device"}
+	})
+	_, err = create("crypto-failure", parameters)
+	require.Error(t, err)
+	assert.Empty(t, fl.lvols, "volume removed")
+	cryptos = fakeCrypto(fake, fl)
+
+	volumeID, err := create("encrypted", parameters)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]spdk.CreateCryptoBDevArgs{
+		volumeID + "_crypto": {
+			BaseBDevName: volumeID,
+			Name:         volumeID + "_crypto",
+			CryptoPMD:    "crypto_aesni_mb",
+			Key:          "0123456789123456",
+			Cipher:       "AES_XTS",
+			Key2:         "9876543210987654",
+		},
+	}, cryptos)
+
+	// The crypto BDev gets exposed instead of the volume.
+	_, err = od.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   "host-0",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, volumeID+"_crypto", controllers[vhostBlkController(volumeID, "host-0")].DevName)
+	_, err = od.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   "host-0",
+	})
+	require.NoError(t, err)
+	assert.Empty(t, controllers)
+
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	assert.Empty(t, cryptos)
+	assert.Nil(t, fl.find(volumeID))
+}
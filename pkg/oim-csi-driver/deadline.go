@@ -0,0 +1,74 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"time"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// DeadlineEstimator predicts how long SPDK needs for creating a
+// volume. Thick provisioning allocates and clears all clusters, so
+// it takes longer for larger volumes, while thin volumes only need
+// the base time.
+type DeadlineEstimator struct {
+	// Base is the time needed for any volume.
+	Base time.Duration
+	// ThickBytesPerSecond is how fast SPDK allocates thick
+	// volumes. Zero means "as fast as thin volumes".
+	ThickBytesPerSecond int64
+}
+
+// Estimate returns the expected duration of creating a volume.
+func (e DeadlineEstimator) Estimate(sizeBytes int64, thin bool) time.Duration {
+	duration := e.Base
+	if !thin && e.ThickBytesPerSecond > 0 {
+		duration += time.Duration(float64(sizeBytes) / float64(e.ThickBytesPerSecond) * float64(time.Second))
+	}
+	return duration
+}
+
+// withDeadline returns the context for creating a volume. When the
+// deadline of the request leaves less time than estimated, the
+// operation continues until now + estimate, even after the caller
+// gave up. The CO then finds the volume when it tries again. Only
+// cancelling the stop context aborts it earlier. A nil estimator
+// keeps the context as it is.
+func (e *DeadlineEstimator) withDeadline(ctx, stop context.Context, sizeBytes int64, parameters map[string]string) (context.Context, context.CancelFunc) {
+	if e == nil {
+		return ctx, func() {}
+	}
+	thin, err := thinProvisioning(parameters)
+	if err != nil {
+		// Will be rejected by the backend.
+		thin = true
+	}
+	estimated := time.Now().Add(e.Estimate(sizeBytes, thin))
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Before(estimated) {
+		return context.WithCancel(ctx)
+	}
+	log.FromContext(ctx).Infow("extending deadline",
+		"size", sizeBytes,
+		"thin", thin,
+		"deadline", estimated,
+	)
+	return context.WithDeadline(valuesOnly{ctx, stop}, estimated)
+}
+
+// valuesOnly keeps the values of a context, like the logger and
+// tenant, but not its deadline and cancellation. It gets cancelled
+// together with the stop context instead.
+type valuesOnly struct {
+	context.Context
+	stop context.Context
+}
+
+func (valuesOnly) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (v valuesOnly) Done() <-chan struct{}     { return v.stop.Done() }
+func (v valuesOnly) Err() error                { return v.stop.Err() }
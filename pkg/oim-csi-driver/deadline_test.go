@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestDeadlineEstimator(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	estimator := &DeadlineEstimator{Base: time.Second, ThickBytesPerSecond: gib}
+	timeout := 10 * time.Second
+
+	for name, tc := range map[string]struct {
+		thin     string
+		size     int64
+		extended time.Duration
+	}{
+		"thin-small":  {"true", gib, 0},
+		"thin-large":  {"true", tib, 0},
+		"thick-small": {"false", gib, 0},
+		"thick-large": {"false", tib, time.Second + 1024*time.Second},
+		"default":     {"", tib, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parameters := map[string]string{}
+			if tc.thin != "" {
+				parameters[thinProvisionParameter] = tc.thin
+			}
+			parent, cancelParent := context.WithTimeout(context.WithValue(context.Background(), tenantKey{}, "a"), timeout)
+			defer cancelParent()
+			stop, cancelStop := context.WithCancel(context.Background())
+			defer cancelStop()
+			start := time.Now()
+			ctx, cancel := estimator.withDeadline(parent, stop, tc.size, parameters)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok, "deadline")
+			expected := timeout
+			if tc.extended != 0 {
+				expected = tc.extended
+			}
+			assert.InDelta(t, float64(start.Add(expected).UnixNano()), float64(deadline.UnixNano()), float64(time.Second), "deadline")
+			assert.Equal(t, "a", tenantFromContext(ctx), "values are kept")
+
+			// Only an extended deadline survives the caller
+			// giving up.
+			cancelParent()
+			if tc.extended != 0 {
+				assert.NoError(t, ctx.Err())
+			} else {
+				assert.Error(t, ctx.Err())
+			}
+
+			// Stopping the driver aborts it.
+			cancelStop()
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+				t.Error("not stopped")
+			}
+		})
+	}
+
+	// No deadline, no estimator: nothing changes.
+	ctx, cancel := estimator.withDeadline(context.Background(), context.Background(), tib, map[string]string{thinProvisionParameter: "false"})
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assert.False(t, ok, "no deadline")
+	var none *DeadlineEstimator
+	parent, cancelParent := context.WithTimeout(context.Background(), timeout)
+	defer cancelParent()
+	ctx, cancel = none.withDeadline(parent, context.Background(), tib, nil)
+	defer cancel()
+	assert.Equal(t, parent, ctx)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultStorageClassConfigMap is the name of the ConfigMap in the
+// namespace of the driver with default StorageClass parameters.
+const DefaultStorageClassConfigMap = "oim-csi-defaults"
+
+// DefaultStorageClassConfig contains default values for StorageClass
+// parameters, like lvstoreName or clearMethod, that are shared by
+// many StorageClasses. The precedence is:
+// - a parameter that is set explicitly in the StorageClass
+// - the entry in the DefaultStorageClassConfig
+// - the default of the driver for a parameter that is not set
+type DefaultStorageClassConfig map[string]string
+
+// LoadDefaultStorageClassConfig reads the DefaultStorageClassConfigMap
+// once. A missing ConfigMap is the same as one without entries.
+func LoadDefaultStorageClassConfig(client kubernetes.Interface, namespace string) (DefaultStorageClassConfig, error) {
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(DefaultStorageClassConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return DefaultStorageClassConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DefaultStorageClassConfig(configMap.Data), nil
+}
+
+// apply returns the parameters extended by the defaults. The
+// original map is not modified.
+func (defaults DefaultStorageClassConfig) apply(parameters map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return parameters
+	}
+	merged := make(map[string]string, len(defaults)+len(parameters))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range parameters {
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestDefaultStorageClassConfigApply(t *testing.T) {
+	defaults := DefaultStorageClassConfig{lvstoreParameter: "lvs2", clearMethodParameter: "none"}
+	parameters := map[string]string{clearMethodParameter: "write_zeroes"}
+
+	merged := defaults.apply(parameters)
+	assert.Equal(t, map[string]string{lvstoreParameter: "lvs2", clearMethodParameter: "write_zeroes"}, merged, "explicit parameters take precedence")
+	assert.Equal(t, map[string]string{clearMethodParameter: "write_zeroes"}, parameters, "original parameters")
+	assert.Equal(t, parameters, DefaultStorageClassConfig(nil).apply(parameters), "no defaults")
+}
+
+func TestStorageClassDefaults(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+	fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+		return []spdk.LVStore{
+			{UUID: "lvs-uuid", Name: "lvs", TotalDataClusters: 100, FreeClusters: 100, BlockSize: 512, ClusterSize: mib},
+			{UUID: "lvs2-uuid", Name: "lvs2", TotalDataClusters: 100, FreeClusters: 100, BlockSize: 512, ClusterSize: mib},
+		}, nil
+	})
+	driver, err := New(WithVHostEndpoint(fake.Path), WithStorageClassDefaults(DefaultStorageClassConfig{lvstoreParameter: "lvs2"}))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	for name, tc := range map[string]struct {
+		parameters map[string]string
+		uuid       string
+	}{
+		"inherited": {nil, "lvs2-uuid"},
+		"explicit":  {map[string]string{lvstoreParameter: "lvs"}, "lvs-uuid"},
+	} {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       name,
+			Parameters: tc.parameters,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		require.NoError(t, err, name)
+		assert.Equal(t, tc.uuid, response.GetVolume().GetVolumeContext()[lvstoreUUIDContextKey], name)
+		// The revision matches the StorageClass, which has no defaults.
+		revision := parametersRevision(tc.parameters)
+		assert.Equal(t, revision, response.GetVolume().GetVolumeContext()[revisionContextKey], name)
+		metadata, _ := od.metadata.get(response.GetVolume().GetVolumeId())
+		assert.Equal(t, revision, metadata.StorageClassRevision, name)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// lvolProductName is how SPDK describes logical volumes in get_bdevs.
+const lvolProductName = "Logical Volume"
+
+// OnlineDefragmenter rewrites fragmented logical volumes so that
+// their clusters are stored sequentially again. It runs according
+// to a cron schedule, but only does something when the SPDK daemon
+// is mostly idle at that time. Volumes which are currently staged
+// are skipped.
+type OnlineDefragmenter struct {
+	local         *localSPDK
+	schedule      *oimcommon.CronSchedule
+	iopsThreshold float64
+	// sampleInterval is the time over which IOPS are measured.
+	sampleInterval time.Duration
+}
+
+// Run triggers defragmentation according to the schedule until the
+// context is done.
+func (d *OnlineDefragmenter) Run(ctx context.Context) error {
+	for {
+		next := d.schedule.Next(time.Now())
+		if next.IsZero() {
+			return errors.New("defragmentation schedule never triggers")
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		if err := d.defragment(ctx); err != nil {
+			log.FromContext(ctx).Warnw("defragmentation failed", "error", err)
+		}
+	}
+}
+
+// defragment processes all logical volumes once, if the I/O load
+// is low enough.
+func (d *OnlineDefragmenter) defragment(ctx context.Context) error {
+	client, err := d.local.connect()
+	if err != nil {
+		return errors.Wrap(err, "connect to SPDK")
+	}
+
+	iops, err := d.measureIOPS(ctx, client)
+	if err != nil {
+		return err
+	}
+	if iops > d.iopsThreshold {
+		log.FromContext(ctx).Infow("skipping defragmentation because of I/O load",
+			"iops", iops,
+			"threshold", d.iopsThreshold,
+		)
+		return nil
+	}
+
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{})
+	if err != nil {
+		return errors.Wrap(err, "get BDevs")
+	}
+	for _, bdev := range bdevs {
+		if bdev.ProductName != lvolProductName {
+			continue
+		}
+		if err := d.defragmentVolume(ctx, client, bdev.Name); err != nil {
+			log.FromContext(ctx).Warnw("defragmenting volume failed",
+				"volumeid", bdev.Name,
+				"error", err,
+			)
+		}
+	}
+	return nil
+}
+
+func (d *OnlineDefragmenter) defragmentVolume(ctx context.Context, client *spdk.Client, volumeID string) error {
+	// Serialize operations per volume by ID.
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	nbdDevice, err := findNBDDevice(ctx, client, volumeID)
+	if err != nil {
+		return err
+	}
+	if nbdDevice != "" {
+		log.FromContext(ctx).Debugw("skipping defragmentation of staged volume", "volumeid", volumeID)
+		return nil
+	}
+	// A VM may be using a published volume.
+	controller, err := findVHostController(ctx, client, volumeID)
+	if err != nil {
+		return err
+	}
+	if controller != "" {
+		log.FromContext(ctx).Debugw("skipping defragmentation of published volume",
+			"volumeid", volumeID,
+			"controller", controller,
+		)
+		return nil
+	}
+
+	before, err := spdk.GetLVolClusterMap(ctx, client, spdk.GetLVolClusterMapArgs{Name: volumeID})
+	if err != nil {
+		return errors.Wrap(err, "get cluster map")
+	}
+	ratioBefore := fragmentation(before)
+	if ratioBefore == 0 {
+		return nil
+	}
+
+	log.FromContext(ctx).Infow("defragmenting volume",
+		"volumeid", volumeID,
+		"fragmentation", ratioBefore,
+	)
+	args := spdk.LVolArgs{Name: volumeID}
+	if err := spdk.InflateLVol(ctx, client, args); err != nil {
+		return errors.Wrap(err, "inflate")
+	}
+	if err := spdk.ThinProvisionLVol(ctx, client, args); err != nil {
+		return errors.Wrap(err, "thin provision")
+	}
+	after, err := spdk.GetLVolClusterMap(ctx, client, spdk.GetLVolClusterMapArgs{Name: volumeID})
+	if err != nil {
+		return errors.Wrap(err, "get cluster map")
+	}
+	log.FromContext(ctx).Infow("defragmented volume",
+		"volumeid", volumeID,
+		"fragmentation-before", ratioBefore,
+		"fragmentation-after", fragmentation(after),
+	)
+	return nil
+}
+
+// measureIOPS samples the I/O statistics of all BDevs twice and
+// returns the combined read and write operations per second.
+func (d *OnlineDefragmenter) measureIOPS(ctx context.Context, client *spdk.Client) (float64, error) {
+	totalOps := func() (int64, error) {
+		stat, err := spdk.GetBDevsIOStat(ctx, client, spdk.GetBDevsArgs{})
+		if err != nil {
+			return 0, errors.Wrap(err, "get BDev I/O statistics")
+		}
+		var ops int64
+		for _, bdev := range stat.BDevs {
+			ops += bdev.NumReadOps + bdev.NumWriteOps
+		}
+		return ops, nil
+	}
+
+	start := time.Now()
+	first, err := totalOps()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(d.sampleInterval):
+	}
+	second, err := totalOps()
+	if err != nil {
+		return 0, err
+	}
+	return float64(second-first) / time.Since(start).Seconds(), nil
+}
+
+// fragmentation returns the fraction of allocated clusters which
+// are not followed by the next cluster of the underlying blobstore,
+// i.e. 0 for a volume that is stored sequentially.
+func fragmentation(clusterMap spdk.LVolClusterMap) float64 {
+	var allocated, jumps int
+	previous := int64(-1)
+	for _, cluster := range clusterMap.Clusters {
+		if cluster < 0 {
+			continue
+		}
+		if allocated > 0 && cluster != previous+1 {
+			jumps++
+		}
+		allocated++
+		previous = cluster
+	}
+	if allocated <= 1 {
+		return 0
+	}
+	return float64(jumps) / float64(allocated-1)
+}
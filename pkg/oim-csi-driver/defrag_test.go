@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestFragmentation(t *testing.T) {
+	for name, tc := range map[string]struct {
+		clusters []int64
+		expected float64
+	}{
+		"empty":      {nil, 0},
+		"one":        {[]int64{5}, 0},
+		"sequential": {[]int64{1, 2, 3, 4, 5}, 0},
+		"holes":      {[]int64{1, -1, 2, -1, 3}, 0},
+		"reversed":   {[]int64{3, 2, 1}, 1},
+		"half":       {[]int64{1, 2, 7, 8, 3}, 0.5},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, fragmentation(spdk.LVolClusterMap{ClusterSize: 4096, Clusters: tc.clusters}))
+		})
+	}
+}
+
+func TestOnlineDefragmenter(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fake.Handle("get_nbd_disks", func(params json.RawMessage) (interface{}, error) {
+		return []spdk.StartNBDDiskArgs{{BDevName: "vol2", NBDDevice: "/dev/nbd0"}}, nil
+	})
+	controllers := fakeVHostBlk(fake)
+	controllers["vhost-vol4"] = spdk.ConstructVHostBlkControllerArgs{Controller: "vhost-vol4", DevName: "vol4"}
+	inflated := map[string]bool{}
+	fake.Handle("bdev_lvol_get_cluster_map", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetLVolClusterMapArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		if args.Name == "vol3" || inflated[args.Name] {
+			return spdk.LVolClusterMap{ClusterSize: 4096, Clusters: []int64{1, 2, 3}}, nil
+		}
+		return spdk.LVolClusterMap{ClusterSize: 4096, Clusters: []int64{3, 1, 2}}, nil
+	})
+	fake.Handle("bdev_lvol_inflate", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.LVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		inflated[args.Name] = true
+		return nil, nil
+	})
+	fake.Handle("bdev_lvol_thin_provision", func(params json.RawMessage) (interface{}, error) {
+		return nil, nil
+	})
+
+	d := &OnlineDefragmenter{
+		local:          &localSPDK{vhostEndpoint: fake.Path},
+		iopsThreshold:  100,
+		sampleInterval: 10 * time.Millisecond,
+	}
+
+	// Busy, nothing happens. The fake is not called concurrently,
+	// so updating the counter in the handler is safe.
+	var ops int64
+	fake.Handle("get_bdevs_iostat", func(params json.RawMessage) (interface{}, error) {
+		ops += 1000000
+		return spdk.GetBDevsIOStatResponse{
+			BDevs: []spdk.BDevIOStat{{Name: "vol1", NumReadOps: ops}},
+		}, nil
+	})
+	err = d.defragment(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"get_bdevs_iostat", "get_bdevs_iostat"}, fake.Methods(), "busy")
+	assert.Empty(t, inflated, "busy")
+
+	// Idle, only vol1 gets defragmented: vol2 is staged, vol3
+	// is not fragmented and vol4 is published.
+	fake.Handle("get_bdevs_iostat", func(params json.RawMessage) (interface{}, error) {
+		return spdk.GetBDevsIOStatResponse{
+			BDevs: []spdk.BDevIOStat{{Name: "vol1", NumReadOps: ops}},
+		}, nil
+	})
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		return []spdk.BDev{
+			{Name: "vol1", ProductName: lvolProductName},
+			{Name: "vol2", ProductName: lvolProductName},
+			{Name: "vol3", ProductName: lvolProductName},
+			{Name: "vol4", ProductName: lvolProductName},
+			{Name: "malloc", ProductName: mallocProductName},
+		}, nil
+	})
+	err = d.defragment(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"vol1": true}, inflated, "idle")
+	assert.Contains(t, fake.Methods(), "bdev_lvol_thin_provision")
+}
@@ -0,0 +1,231 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+const (
+	// oimService and oimDomain are what OIM controllers announce
+	// via DNS-SD.
+	oimService = "_oim._tcp"
+	oimDomain  = "local."
+
+	// controllerIDText is the TXT record entry with the ID of the
+	// controller. The instance name is used when it is missing.
+	controllerIDText = "controllerid="
+
+	// expireInterval is how often expired announcements get
+	// removed.
+	expireInterval = 10 * time.Second
+)
+
+// ServiceEntry is the announcement of one OIM controller.
+type ServiceEntry struct {
+	Instance  string
+	Addresses []net.IP
+	Port      int
+	Text      []string
+	// TTL is the validity of the announcement in seconds. Zero
+	// means that the controller is gone.
+	TTL uint32
+}
+
+// ServiceBrowser finds DNS-SD services. It has the semantic of
+// Resolver.Browse in github.com/grandcat/zeroconf: Browse returns
+// immediately, sends entries until the context is done and then
+// closes the channel.
+type ServiceBrowser interface {
+	Browse(ctx context.Context, service, domain string, entries chan<- *ServiceEntry) error
+}
+
+// mDNSDiscovery tracks which OIM controllers are currently announced
+// via mDNS/DNS-SD. As a ControllerSelector it only offers those
+// controllers to the actual selector. Calls to a controller which
+// disappears get canceled.
+type mDNSDiscovery struct {
+	browser ServiceBrowser
+	// selector chooses among the discovered controllers, nil for
+	// preferring hostControllerID.
+	selector         ControllerSelector
+	hostControllerID string
+
+	mutex       sync.Mutex
+	controllers map[string]*discoveredController
+	now         func() time.Time
+}
+
+type discoveredController struct {
+	address string
+	expires time.Time
+	// gone gets closed when the controller disappears.
+	gone chan struct{}
+}
+
+var _ ControllerSelector = &mDNSDiscovery{}
+
+func newMDNSDiscovery(browser ServiceBrowser) *mDNSDiscovery {
+	return &mDNSDiscovery{
+		browser:     browser,
+		controllers: map[string]*discoveredController{},
+		now:         time.Now,
+	}
+}
+
+// Run browses until the context is done.
+func (d *mDNSDiscovery) Run(ctx context.Context) error {
+	entries := make(chan *ServiceEntry, 10)
+	if err := d.browser.Browse(ctx, oimService, oimDomain, entries); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return nil
+			}
+			d.update(ctx, entry)
+		case <-ticker.C:
+			d.expire(ctx)
+		}
+	}
+}
+
+func (d *mDNSDiscovery) update(ctx context.Context, entry *ServiceEntry) {
+	controllerID := entry.Instance
+	for _, text := range entry.Text {
+		if strings.HasPrefix(text, controllerIDText) {
+			controllerID = text[len(controllerIDText):]
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if entry.TTL == 0 {
+		d.remove(ctx, controllerID, "goodbye")
+		return
+	}
+	var address string
+	if len(entry.Addresses) > 0 {
+		address = net.JoinHostPort(entry.Addresses[0].String(), strconv.Itoa(entry.Port))
+	}
+	expires := d.now().Add(time.Duration(entry.TTL) * time.Second)
+	if controller, ok := d.controllers[controllerID]; ok {
+		controller.address = address
+		controller.expires = expires
+		return
+	}
+	log.FromContext(ctx).Infow("discovered OIM controller",
+		"controllerid", controllerID,
+		"address", address,
+	)
+	d.controllers[controllerID] = &discoveredController{
+		address: address,
+		expires: expires,
+		gone:    make(chan struct{}),
+	}
+}
+
+func (d *mDNSDiscovery) expire(ctx context.Context) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := d.now()
+	for controllerID, controller := range d.controllers {
+		if now.After(controller.expires) {
+			d.remove(ctx, controllerID, "expired")
+		}
+	}
+}
+
+// remove must be called with the mutex locked.
+func (d *mDNSDiscovery) remove(ctx context.Context, controllerID, reason string) {
+	controller, ok := d.controllers[controllerID]
+	if !ok {
+		return
+	}
+	log.FromContext(ctx).Infow("OIM controller disappeared",
+		"controllerid", controllerID,
+		"address", controller.address,
+		"reason", reason,
+	)
+	close(controller.gone)
+	delete(d.controllers, controllerID)
+}
+
+// available checks whether the controller is currently announced.
+func (d *mDNSDiscovery) available(controllerID string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, ok := d.controllers[controllerID]
+	return ok
+}
+
+// watch returns a context which gets canceled when the controller
+// disappears.
+func (d *mDNSDiscovery) watch(ctx context.Context, controllerID string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	d.mutex.Lock()
+	controller, ok := d.controllers[controllerID]
+	d.mutex.Unlock()
+	if ok {
+		go func() {
+			select {
+			case <-controller.gone:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// discovered returns those candidates which are currently announced.
+func (d *mDNSDiscovery) discovered(ctx context.Context, candidates []string) ([]string, error) {
+	d.expire(ctx)
+	var discovered []string
+	for _, controllerID := range candidates {
+		if d.available(controllerID) {
+			discovered = append(discovered, controllerID)
+		}
+	}
+	if len(discovered) == 0 {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("none of the OIM controllers %v were discovered", candidates))
+	}
+	return discovered, nil
+}
+
+// SelectController removes all candidates which are not currently
+// announced.
+func (d *mDNSDiscovery) SelectController(ctx context.Context, capacity ControllerCapacity, candidates []string) (string, error) {
+	discovered, err := d.discovered(ctx, candidates)
+	if err != nil {
+		return "", err
+	}
+	if d.selector != nil {
+		return d.selector.SelectController(ctx, capacity, discovered)
+	}
+	for _, controllerID := range discovered {
+		if controllerID == d.hostControllerID {
+			return controllerID, nil
+		}
+	}
+	return discovered[0], nil
+}
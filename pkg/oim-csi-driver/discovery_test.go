@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spec/oim/v0"
+)
+
+// fakeBrowser passes on the announcements sent by the test.
+type fakeBrowser struct {
+	announce chan *ServiceEntry
+}
+
+func (f *fakeBrowser) Browse(ctx context.Context, service, domain string, entries chan<- *ServiceEntry) error {
+	go func() {
+		defer close(entries)
+		for {
+			select {
+			case entry := <-f.announce:
+				entries <- entry
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func announcement(controllerID string, ttl uint32) *ServiceEntry {
+	return &ServiceEntry{
+		Instance:  "oim-" + controllerID,
+		Addresses: []net.IP{net.ParseIP("192.168.0.1")},
+		Port:      8999,
+		Text:      []string{controllerIDText + controllerID},
+		TTL:       ttl,
+	}
+}
+
+// waitFor polls until the condition is true.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for start := time.Now(); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			require.FailNow(t, "timed out waiting for "+what)
+		}
+	}
+}
+
+func TestMDNSDiscovery(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	browser := &fakeBrowser{announce: make(chan *ServiceEntry)}
+	d := newMDNSDiscovery(browser)
+	d.hostControllerID = "host-1"
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	done := make(chan error)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+	candidates := []string{"host-0", "host-1", "host-2"}
+
+	_, err := d.SelectController(ctx, nil, candidates)
+	assert.Equal(t, codes.Unavailable, status.Code(err), "nothing discovered: %v", err)
+
+	browser.announce <- announcement("host-0", 120)
+	browser.announce <- announcement("host-1", 60)
+	waitFor(t, "host-1", func() bool { return d.available("host-1") })
+	controllerID, err := d.SelectController(ctx, nil, candidates)
+	require.NoError(t, err)
+	assert.Equal(t, "host-1", controllerID, "host controller preferred")
+	controllerID, err = d.SelectController(ctx, nil, candidates[0:1])
+	require.NoError(t, err)
+	assert.Equal(t, "host-0", controllerID, "only candidate")
+
+	// Calls get canceled when the controller leaves.
+	watchCtx, watchCancel := d.watch(ctx, "host-1")
+	defer watchCancel()
+	browser.announce <- announcement("host-1", 0)
+	select {
+	case <-watchCtx.Done():
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "call not canceled")
+	}
+	assert.False(t, d.available("host-1"))
+	controllerID, err = d.SelectController(ctx, nil, candidates)
+	require.NoError(t, err)
+	assert.Equal(t, "host-0", controllerID, "remaining controller")
+
+	// Announcements which are not renewed expire.
+	now = now.Add(121 * time.Second)
+	_, err = d.SelectController(ctx, nil, candidates)
+	assert.Equal(t, codes.Unavailable, status.Code(err), "expired: %v", err)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestMDNSDiscoveryRetry(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	registryAddress, controllers := startMockControllers(ctx, t, tmp, "host-0", "host-1")
+	// The first call to host-1 never returns.
+	controllers["host-1"].Stall = 1
+
+	browser := &fakeBrowser{announce: make(chan *ServiceEntry)}
+	driver, err := New(WithCSIEndpoint("unix://"+tmp+"/oim-driver.sock"),
+		WithOIMRegistryAddress(registryAddress),
+		WithRegistryCreds(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/host.host-0")),
+		WithOIMControllerID("host-0"),
+		WithNodeAffinity(NodeAffinity{
+			"host-0": {"zone": "a"},
+			"host-1": {"zone": "b"},
+		}),
+		WithMDNSDiscovery(browser),
+	)
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	go od.remote.discovery.Run(ctx)
+	browser.announce <- announcement("host-0", 120)
+	browser.announce <- announcement("host-1", 120)
+	waitFor(t, "host-1", func() bool { return od.remote.discovery.available("host-1") })
+
+	type result struct {
+		resp *csi.CreateVolumeResponse
+		err  error
+	}
+	created := make(chan result)
+	go func() {
+		resp, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          "vol",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: mib},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{{Segments: map[string]string{"zone": "b"}}},
+			},
+		})
+		created <- result{resp, err}
+	}()
+	waitFor(t, "call to host-1", func() bool { return len(controllers["host-1"].provisioned()) > 0 })
+	browser.announce <- announcement("host-1", 0)
+
+	var r result
+	select {
+	case r = <-created:
+	case <-time.After(30 * time.Second):
+		require.FailNow(t, "CreateVolume stuck")
+	}
+	require.NoError(t, r.err)
+	assert.Equal(t, "vol", r.resp.GetVolume().GetVolumeId(), "created on host-0")
+	assert.Equal(t, []oim.ProvisionMallocBDevRequest{{BdevName: "vol", Size_: mib}}, controllers["host-0"].provisioned())
+	assert.Equal(t, []oim.ProvisionMallocBDevRequest{{BdevName: "vol", Size_: mib}, {BdevName: "vol"}}, controllers["host-1"].provisioned(), "rolled back on host-1")
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/oim-common"
+)
+
+// drainer tracks the in-flight calls of the server started by Start,
+// so that GracefulStop can let them finish before stopping the
+// server. The zero value is ready to use.
+type drainer struct {
+	mutex    sync.Mutex
+	server   *oimcommon.NonBlockingGRPCServer
+	draining bool
+	next     int
+	inflight map[int]context.CancelFunc
+	// idle gets closed once draining has started and no calls
+	// remain.
+	idle chan struct{}
+	// stop gets cancelled together with the in-flight calls.
+	stop       context.Context
+	cancelStop context.CancelFunc
+}
+
+// stopContext returns a context which is only cancelled when drain
+// cancels the in-flight calls. Operations which must outlive the
+// request context of their call use it instead.
+func (d *drainer) stopContext() context.Context {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.stopContextLocked()
+}
+
+func (d *drainer) stopContextLocked() context.Context {
+	if d.stop == nil {
+		d.stop, d.cancelStop = context.WithCancel(context.Background())
+	}
+	return d.stop
+}
+
+// intercept rejects calls with Unavailable once draining has started
+// and otherwise tracks them until they return.
+func (d *drainer) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	d.mutex.Lock()
+	if d.draining {
+		d.mutex.Unlock()
+		return nil, status.Error(codes.Unavailable, "driver is shutting down")
+	}
+	if d.inflight == nil {
+		d.inflight = map[int]context.CancelFunc{}
+	}
+	id := d.next
+	d.next++
+	ctx, cancel := context.WithCancel(ctx)
+	d.inflight[id] = cancel
+	d.mutex.Unlock()
+
+	defer func() {
+		cancel()
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		delete(d.inflight, id)
+		if d.draining && len(d.inflight) == 0 {
+			close(d.idle)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// drain rejects all future calls and waits up to the timeout for
+// the in-flight ones. Calls which are still running then get
+// cancelled, which makes them roll back what they have created so
+// far. drain returns the number of cancelled calls.
+func (d *drainer) drain(ctx context.Context, timeout time.Duration) int {
+	d.mutex.Lock()
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		if len(d.inflight) == 0 {
+			close(d.idle)
+		}
+	}
+	idle := d.idle
+	d.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	d.mutex.Lock()
+	cancelled := len(d.inflight)
+	for _, cancel := range d.inflight {
+		cancel()
+	}
+	d.stopContextLocked()
+	d.cancelStop()
+	d.mutex.Unlock()
+	log.FromContext(ctx).Warnw("cancelled in-flight calls", "calls", cancelled)
+
+	// Rollbacks are limited by rollbackTimeout, so waiting
+	// longer than that would only be for calls which ignore
+	// cancellation.
+	select {
+	case <-idle:
+	case <-time.After(rollbackTimeout):
+		log.FromContext(ctx).Errorw("in-flight calls did not finish after cancellation")
+	}
+	return cancelled
+}
+
+// GracefulStop stops accepting new calls, waits up to the timeout
+// for in-flight calls and cancels the remaining ones, then stops the
+// server started by Start. It returns an error when calls had to be
+// cancelled.
+func (od *oimDriver) GracefulStop(timeout time.Duration) error {
+	ctx := context.Background()
+	if od.logger != nil {
+		ctx = log.WithLogger(ctx, od.logger)
+	}
+	cancelled := od.drain.drain(ctx, timeout)
+	od.drain.mutex.Lock()
+	server := od.drain.server
+	od.drain.mutex.Unlock()
+	if server != nil {
+		server.Stop(ctx)
+	}
+	if cancelled > 0 {
+		return errors.Errorf("%d in-flight calls cancelled after %s", cancelled, timeout)
+	}
+	return nil
+}
+
+// GracefulStopOnSignal calls GracefulStop for the driver when the
+// process receives one of the signals. The returned function stops
+// waiting for them.
+func GracefulStopOnSignal(ctx context.Context, driver Driver, timeout time.Duration, signals ...os.Signal) func() {
+	received := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(received, signals...)
+	go func() {
+		select {
+		case sig := <-received:
+			log.FromContext(ctx).Infow("shutting down", "signal", sig, "timeout", timeout)
+			if err := driver.GracefulStop(timeout); err != nil {
+				log.FromContext(ctx).Errorw("graceful stop", "error", err)
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(received)
+		close(done)
+	}
+}
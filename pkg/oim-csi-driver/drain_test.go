@@ -0,0 +1,212 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestDrainer(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	var d drainer
+
+	// Nothing in flight.
+	assert.Equal(t, 0, d.drain(ctx, time.Second))
+	_, err := d.intercept(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "new call while draining: %v", err)
+
+	// A call which does not finish in time gets cancelled and
+	// rolls back.
+	d = drainer{}
+	entered := make(chan struct{})
+	rolledBack := make(chan struct{})
+	go d.intercept(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		close(entered)
+		<-ctx.Done()
+		close(rolledBack)
+		return nil, ctx.Err()
+	})
+	<-entered
+	assert.Equal(t, 1, d.drain(ctx, 10*time.Millisecond))
+	select {
+	case <-rolledBack:
+	default:
+		t.Error("drain returned before the call rolled back")
+	}
+}
+
+func TestGracefulStopOnSignal(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	fake.Handle("bdev_lvol_create", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.CreateLVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		close(entered)
+		<-release
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		return fl.create(args.LVolName, args.Size).UUID, nil
+	})
+
+	tmp, err := ioutil.TempDir("", "drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	endpoint := "unix://" + tmp + "/csi.sock"
+	driver, err := New(WithCSIEndpoint(endpoint), WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	s, err := driver.Start(ctx)
+	require.NoError(t, err)
+	defer s.ForceStop(ctx)
+	conn, err := grpc.Dial(endpoint, oimcommon.ChooseDialOpts(endpoint, grpc.WithBlock(), grpc.WithInsecure())...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	created := make(chan error)
+	go func() {
+		_, err := csi.NewControllerClient(conn).CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: "vol",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		created <- err
+	}()
+	<-entered
+
+	stop := GracefulStopOnSignal(ctx, driver, 10*time.Second, syscall.SIGTERM)
+	defer stop()
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	for i := 0; ; i++ {
+		_, err := csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+		if status.Code(err) == codes.Unavailable {
+			break
+		}
+		require.True(t, i < 100, "driver not draining after SIGTERM: %v", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The in-flight call completes, then the server stops.
+	close(release)
+	assert.NoError(t, <-created, "CreateVolume")
+	s.Wait(ctx)
+
+	// No orphans: the volume is known to the driver.
+	od := &driver.(*oimDriver03).oimDriver
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+	require.Len(t, fl.lvols, 1)
+	for uuid := range fl.lvols {
+		metadata, ok := od.metadata.get(uuid)
+		assert.True(t, ok, "metadata for %s", uuid)
+		assert.Equal(t, "vol", metadata.Name)
+	}
+}
+
+// blockingBackend creates volumes only when the context gets
+// cancelled.
+type blockingBackend struct {
+	OIMBackend
+	entered chan struct{}
+	done    chan error
+}
+
+func (b *blockingBackend) createVolume(ctx context.Context, name string, request createRequest) (volumeInfo, error) {
+	close(b.entered)
+	<-ctx.Done()
+	b.done <- ctx.Err()
+	return volumeInfo{}, ctx.Err()
+}
+
+func TestDrainExtendedCreate(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+
+	tmp, err := ioutil.TempDir("", "drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	endpoint := "unix://" + tmp + "/csi.sock"
+	driver, err := New(WithCSIEndpoint(endpoint), WithVHostEndpoint(fake.Path),
+		WithDeadlineEstimator(DeadlineEstimator{Base: time.Hour}))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	backend := &blockingBackend{OIMBackend: od.backend, entered: make(chan struct{}), done: make(chan error, 1)}
+	od.backend = backend
+	s, err := driver.Start(ctx)
+	require.NoError(t, err)
+	defer s.ForceStop(ctx)
+	conn, err := grpc.Dial(endpoint, oimcommon.ChooseDialOpts(endpoint, grpc.WithBlock(), grpc.WithInsecure())...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The caller gives up, but creating the volume continues
+	// with the extended deadline.
+	callCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err = csi.NewControllerClient(conn).CreateVolume(callCtx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "CreateVolume: %v", err)
+	select {
+	case <-backend.entered:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "volume not created")
+	}
+	select {
+	case err := <-backend.done:
+		require.FailNow(t, "creating the volume aborted", "%v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Draining still cancels it.
+	err = driver.GracefulStop(10 * time.Millisecond)
+	assert.Error(t, err, "in-flight call cancelled")
+	select {
+	case err := <-backend.done:
+		assert.Equal(t, context.Canceled, err)
+	default:
+		t.Error("creating the volume not cancelled")
+	}
+}
@@ -8,7 +8,11 @@ SPDX-License-Identifier: Apache-2.0
 package oimcsidriver
 
 import (
+	"context"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/intel/oim/pkg/log"
 )
 
 func (od *oimDriver) setControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) {
@@ -38,3 +42,28 @@ func (od *oimDriver) setVolumeCapabilityAccessModes(vc []csi.VolumeCapability_Ac
 	}
 	od.vc = vca
 }
+
+// withLogger returns a context with a logger that records the
+// operation and, if the request has them, the name and the IDs of
+// the volume, node or snapshot that it is about. The logger set with
+// WithLogger is used unless the context already has one.
+func (od *oimDriver) withLogger(ctx context.Context, operation string, req interface{}) context.Context {
+	logger := log.FromContext(ctx)
+	if od.logger != nil {
+		logger = log.FromContextFallback(ctx, od.logger)
+	}
+	keysAndValues := []interface{}{"operation", operation}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		keysAndValues = append(keysAndValues, "volumeid", r.GetVolumeId())
+	}
+	if r, ok := req.(interface{ GetNodeId() string }); ok && r.GetNodeId() != "" {
+		keysAndValues = append(keysAndValues, "nodeid", r.GetNodeId())
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		keysAndValues = append(keysAndValues, "snapshotid", r.GetSnapshotId())
+	}
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		keysAndValues = append(keysAndValues, "name", r.GetName())
+	}
+	return log.WithLogger(ctx, logger.With(keysAndValues...))
+}
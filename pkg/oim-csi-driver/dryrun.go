@@ -0,0 +1,147 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// dryRunCapacity is the total size of all volumes that the dry-run
+// backend can hold at once.
+const dryRunCapacity = 100 * gib
+
+// dryRunBackend is an OIMBackend which only keeps track of volumes in
+// memory. It is meant for testing the CSI side of the driver without
+// SPDK or an OIM controller, therefore it cannot provide block
+// devices for staging volumes on a node.
+type dryRunBackend struct {
+	mutex    sync.Mutex
+	capacity int64
+	counter  int
+	// volumes maps volume IDs to volumes.
+	volumes map[string]dryRunVolume
+}
+
+type dryRunVolume struct {
+	name          string
+	capacityBytes int64
+}
+
+var _ OIMBackend = &dryRunBackend{}
+
+func newDryRunBackend(capacity int64) *dryRunBackend {
+	return &dryRunBackend{
+		capacity: capacity,
+		volumes:  map[string]dryRunVolume{},
+	}
+}
+
+// used must be called while holding the mutex.
+func (d *dryRunBackend) used() int64 {
+	var used int64
+	for _, volume := range d.volumes {
+		used += volume.capacityBytes
+	}
+	return used
+}
+
+// createVolume creates Malloc BDev-like volumes with UUIDs as IDs.
+func (d *dryRunBackend) createVolume(ctx context.Context, name string, request createRequest) (volumeInfo, error) {
+	if request.sourceVolumeID != "" || request.sourceSnapshotID != "" {
+		return volumeInfo{}, status.Error(codes.Unimplemented, "volume content sources not supported in dry-run mode")
+	}
+	capacity, err := volumeSize(request.requiredBytes, request.limitBytes, 512)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for volumeID, volume := range d.volumes {
+		if volume.name != name {
+			continue
+		}
+		if volume.capacityBytes >= request.requiredBytes && (request.limitBytes == 0 || volume.capacityBytes <= request.limitBytes) {
+			return volumeInfo{volumeID: volumeID, capacityBytes: volume.capacityBytes}, nil
+		}
+		return volumeInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", name))
+	}
+	if free := d.capacity - d.used(); capacity > free {
+		return volumeInfo{}, status.Error(codes.OutOfRange, fmt.Sprintf("Requested capacity %d exceeds free space %d", capacity, free))
+	}
+	d.counter++
+	volumeID := fmt.Sprintf("00000000-0000-4000-8000-%012x", d.counter)
+	d.volumes[volumeID] = dryRunVolume{name: name, capacityBytes: capacity}
+	log.FromContext(ctx).Infow("dry-run: created volume",
+		"name", name,
+		"volumeid", volumeID,
+		"bytes", capacity,
+	)
+	return volumeInfo{volumeID: volumeID, capacityBytes: capacity}, nil
+}
+
+func (d *dryRunBackend) deleteVolume(ctx context.Context, volumeID string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.volumes[volumeID]; ok {
+		delete(d.volumes, volumeID)
+		log.FromContext(ctx).Infow("dry-run: deleted volume", "volumeid", volumeID)
+	}
+	return nil
+}
+
+func (d *dryRunBackend) checkVolumeExists(ctx context.Context, volumeID string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.volumes[volumeID]; !ok {
+		return status.Error(codes.NotFound, "")
+	}
+	return nil
+}
+
+func (d *dryRunBackend) isReadOnly(ctx context.Context, volumeID string) (bool, error) {
+	return false, nil
+}
+
+func (d *dryRunBackend) listVolumes(ctx context.Context) ([]volumeInfo, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var volumes []volumeInfo
+	for volumeID, volume := range d.volumes {
+		volumes = append(volumes, volumeInfo{volumeID: volumeID, capacityBytes: volume.capacityBytes})
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].volumeID < volumes[j].volumeID
+	})
+	return volumes, nil
+}
+
+func (d *dryRunBackend) getCapacity(ctx context.Context) (int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.capacity - d.used(), nil
+}
+
+func (d *dryRunBackend) probe(ctx context.Context) error {
+	return nil
+}
+
+func (d *dryRunBackend) createDevice(ctx context.Context, volumeID string, request interface{}) (string, cleanup, error) {
+	return "", nil, status.Error(codes.Unimplemented, "no block devices in dry-run mode")
+}
+
+func (d *dryRunBackend) deleteDevice(ctx context.Context, volumeID string) error {
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func newDryRunDriver(t *testing.T) *oimDriver {
+	driver, err := New(WithDryRun(true))
+	require.NoError(t, err)
+	return &driver.(*oimDriver03).oimDriver
+}
+
+func TestDryRunOptions(t *testing.T) {
+	_, err := New(WithDryRun(true), WithVHostEndpoint("/no/such/socket"))
+	assert.Error(t, err, "dry run with SPDK")
+	_, err = New(WithDryRun(true), WithOIMRegistryAddress("unix:///no/such/socket"))
+	assert.Error(t, err, "dry run with registry")
+	_, err = New(WithDryRun(false))
+	assert.Error(t, err, "no backend")
+}
+
+func TestDryRunCreateDelete(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od := newDryRunDriver(t)
+
+	create := func(name string, requiredBytes int64) (*csi.Volume, error) {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: requiredBytes},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return response.GetVolume(), err
+	}
+
+	volume, err := create("vol", mib)
+	require.NoError(t, err)
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$", volume.GetVolumeId(), "UUID")
+	assert.Equal(t, mib, volume.GetCapacityBytes())
+
+	again, err := create("vol", mib)
+	require.NoError(t, err, "idempotent")
+	assert.Equal(t, volume.GetVolumeId(), again.GetVolumeId())
+	_, err = create("vol", 2*mib)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "different size: %v", err)
+
+	_, err = od.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: volume.GetVolumeId(),
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	require.NoError(t, err, "validate")
+
+	list, err := od.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	if assert.Len(t, list.GetEntries(), 1) {
+		assert.Equal(t, volume.GetVolumeId(), list.GetEntries()[0].GetVolume().GetVolumeId())
+	}
+
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+	require.NoError(t, err)
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+	require.NoError(t, err, "idempotent delete")
+	list, err = od.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, list.GetEntries())
+}
+
+func TestDryRunCapacity(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od := newDryRunDriver(t)
+
+	create := func(name string, requiredBytes int64) (*csi.Volume, error) {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: requiredBytes},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return response.GetVolume(), err
+	}
+	capacity := func() int64 {
+		response, err := od.GetCapacity(ctx, &csi.GetCapacityRequest{})
+		require.NoError(t, err)
+		return response.GetAvailableCapacity()
+	}
+
+	assert.Equal(t, dryRunCapacity, capacity(), "empty")
+	big, err := create("big", dryRunCapacity-mib)
+	require.NoError(t, err)
+	assert.Equal(t, mib, capacity(), "after big volume")
+	_, err = create("too-large", 2*mib)
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "no space: %v", err)
+	_, err = create("small", mib)
+	require.NoError(t, err, "remaining space")
+	assert.Equal(t, int64(0), capacity(), "full")
+
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: big.GetVolumeId()})
+	require.NoError(t, err)
+	_, err = create("too-large", 2*mib)
+	require.NoError(t, err, "space freed")
+}
+
+func TestDryRunNode(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od := newDryRunDriver(t)
+	tmp, err := ioutil.TempDir("", "dryrun")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	_, err = od.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: tmp + "/staging",
+		VolumeCapability:  &csi.VolumeCapability{},
+	})
+	assert.Error(t, err, "no block devices")
+
+	_, err = od.Probe(ctx, &csi.ProbeRequest{})
+	assert.NoError(t, err, "probe")
+}
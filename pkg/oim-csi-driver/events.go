@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// pvcNameParameter and pvcNamespaceParameter identify the PVC
+	// that CreateVolume gets called for. The external-provisioner
+	// adds them when started with --extra-create-metadata.
+	pvcNameParameter      = kubernetesParameterPrefix + "pvc/name"
+	pvcNamespaceParameter = kubernetesParameterPrefix + "pvc/namespace"
+
+	eventReasonVolumeCreated        = "VolumeCreated"
+	eventReasonVolumeCreationFailed = "VolumeCreationFailed"
+	eventReasonVolumeDeleted        = "VolumeDeleted"
+)
+
+// ClaimReference identifies the PVC that a volume was created for.
+type ClaimReference struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// claimFromParameters returns the PVC from the CreateVolume
+// parameters, nil if unknown.
+func claimFromParameters(parameters map[string]string) *ClaimReference {
+	name, namespace := parameters[pvcNameParameter], parameters[pvcNamespaceParameter]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &ClaimReference{Namespace: namespace, Name: name}
+}
+
+func (c *ClaimReference) objectReference() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  c.Namespace,
+		Name:       c.Name,
+	}
+}
+
+// NewEventRecorder creates a recorder which sends events to the
+// Kubernetes API server with the given component as source.
+func NewEventRecorder(client kubernetes.Interface, component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+}
+
+// volumeCreatedEvent records the outcome of CreateVolume for the PVC,
+// if both the PVC and a recorder are known.
+func (od *oimDriver) volumeCreatedEvent(parameters map[string]string, volumeID string, err error) {
+	claim := claimFromParameters(parameters)
+	if od.recorder == nil || claim == nil {
+		return
+	}
+	if err != nil {
+		od.recorder.Eventf(claim.objectReference(), v1.EventTypeWarning, eventReasonVolumeCreationFailed,
+			"creating volume failed with %s: %s", status.Code(err), status.Convert(err).Message())
+		return
+	}
+	od.recorder.Eventf(claim.objectReference(), v1.EventTypeNormal, eventReasonVolumeCreated,
+		"volume %s created", volumeID)
+}
+
+// volumeDeletedEvent records a successful DeleteVolume for the PVC
+// that the volume was created for.
+func (od *oimDriver) volumeDeletedEvent(claim *ClaimReference, volumeID string) {
+	if od.recorder == nil || claim == nil {
+		return
+	}
+	od.recorder.Eventf(claim.objectReference(), v1.EventTypeNormal, eventReasonVolumeDeleted,
+		"volume %s deleted", volumeID)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+type fakeEvent struct {
+	object    runtime.Object
+	eventtype string
+	reason    string
+	message   string
+}
+
+// fakeEventRecorder is like record.FakeRecorder, but also remembers
+// the object of each event.
+type fakeEventRecorder struct {
+	mutex  sync.Mutex
+	events []fakeEvent
+}
+
+var _ record.EventRecorder = &fakeEventRecorder{}
+
+func (f *fakeEventRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.events = append(f.events, fakeEvent{object, eventtype, reason, message})
+}
+
+func (f *fakeEventRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	f.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (f *fakeEventRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	f.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func (f *fakeEventRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	f.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// take returns and forgets all events recorded so far.
+func (f *fakeEventRecorder) take() []fakeEvent {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	events := f.events
+	f.events = nil
+	return events
+}
+
+func TestEvents(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+	recorder := &fakeEventRecorder{}
+	driver, err := New(WithVHostEndpoint(fake.Path), WithEventRecorder(recorder))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	create := func(name string, parameters map[string]string) (string, error) {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       name,
+			Parameters: parameters,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return response.GetVolume().GetVolumeId(), err
+	}
+	claim := &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  "default",
+		Name:       "my-claim",
+	}
+	parameters := map[string]string{
+		pvcNameParameter:      claim.Name,
+		pvcNamespaceParameter: claim.Namespace,
+	}
+
+	// Without the PVC, there is nothing to record events for.
+	_, err = create("no-pvc", nil)
+	require.NoError(t, err)
+	assert.Empty(t, recorder.take())
+
+	volumeID, err := create("pvc", parameters)
+	require.NoError(t, err)
+	assert.Equal(t, []fakeEvent{
+		{claim, v1.EventTypeNormal, eventReasonVolumeCreated, fmt.Sprintf("volume %s created", volumeID)},
+	}, recorder.take())
+
+	_, err = create("failed", map[string]string{
+		pvcNameParameter:      claim.Name,
+		pvcNamespaceParameter: claim.Namespace,
+		lvstoreParameter:      "no-such-lvs",
+	})
+	require.Error(t, err)
+	assert.Equal(t, []fakeEvent{
+		{claim, v1.EventTypeWarning, eventReasonVolumeCreationFailed, `creating volume failed with InvalidArgument: logical volume store "no-such-lvs" from lvstoreName parameter not found`},
+	}, recorder.take())
+
+	// DeleteVolume only has the volume ID, the PVC comes from the
+	// metadata.
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	assert.Equal(t, []fakeEvent{
+		{claim, v1.EventTypeNormal, eventReasonVolumeDeleted, fmt.Sprintf("volume %s deleted", volumeID)},
+	}, recorder.take())
+}
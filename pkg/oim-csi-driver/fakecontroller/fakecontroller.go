@@ -0,0 +1,127 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package fakecontroller runs the OIM CSI driver in-process for
+// tests. The driver uses a fake SPDK and gets called through a real
+// gRPC connection, so tests cover the same request encoding and
+// interceptors as a deployed driver.
+package fakecontroller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/oim-csi-driver"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+// Controller is an OIM CSI driver with local SPDK backend, served on
+// a Unix domain socket in a temporary directory.
+type Controller struct {
+	// SPDK is the fake SPDK daemon used by the driver. Methods
+	// without a handler fail.
+	SPDK *testspdk.Fake
+	// Conn is the client connection to the driver.
+	Conn *grpc.ClientConn
+
+	tmpDir string
+	server *grpc.Server
+}
+
+// New starts a driver with the given additional options.
+func New(options ...oimcsidriver.Option) (*Controller, error) {
+	fake, err := testspdk.NewFake()
+	if err != nil {
+		return nil, errors.Wrap(err, "fake SPDK")
+	}
+	c := &Controller{SPDK: fake}
+	if err := c.start(options); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Controller) start(options []oimcsidriver.Option) error {
+	driver, err := oimcsidriver.New(append([]oimcsidriver.Option{oimcsidriver.WithVHostEndpoint(c.SPDK.Path)}, options...)...)
+	if err != nil {
+		return errors.Wrap(err, "create driver")
+	}
+	tmpDir, err := ioutil.TempDir("", "fakecontroller")
+	if err != nil {
+		return err
+	}
+	c.tmpDir = tmpDir
+	path := filepath.Join(tmpDir, "csi.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	c.server = grpc.NewServer(grpc.UnaryInterceptor(oimcommon.LogGRPCServer(log.L(), oimcommon.CompletePayloadFormatter{})))
+	driver.RegisterServices(c.server)
+	go c.server.Serve(listener)
+	endpoint := "unix://" + path
+	c.Conn, err = grpc.Dial(endpoint, oimcommon.ChooseDialOpts(endpoint, grpc.WithInsecure(), grpc.WithBlock())...)
+	if err != nil {
+		return errors.Wrap(err, "connect to driver")
+	}
+	return nil
+}
+
+// ControllerClient returns a client for the CSI controller service.
+func (c *Controller) ControllerClient() csi.ControllerClient {
+	return csi.NewControllerClient(c.Conn)
+}
+
+// IdentityClient returns a client for the CSI identity service.
+func (c *Controller) IdentityClient() csi.IdentityClient {
+	return csi.NewIdentityClient(c.Conn)
+}
+
+// NodeClient returns a client for the CSI node service.
+func (c *Controller) NodeClient() csi.NodeClient {
+	return csi.NewNodeClient(c.Conn)
+}
+
+// HandleSPDK makes the fake SPDK return the result for all future
+// calls of the method.
+func (c *Controller) HandleSPDK(method string, result interface{}) {
+	c.SPDK.Handle(method, func(params json.RawMessage) (interface{}, error) {
+		return result, nil
+	})
+}
+
+// FailSPDK makes all future calls of the method fail with the given
+// JSON-RPC error.
+func (c *Controller) FailSPDK(method string, code int, message string) {
+	c.SPDK.Handle(method, func(params json.RawMessage) (interface{}, error) {
+		return nil, testspdk.FakeError{Code: code, Message: message}
+	})
+}
+
+// Close stops the driver and the fake SPDK and removes all temporary
+// files.
+func (c *Controller) Close() {
+	if c.Conn != nil {
+		c.Conn.Close()
+	}
+	if c.server != nil {
+		c.server.Stop()
+	}
+	if c.tmpDir != "" {
+		os.RemoveAll(c.tmpDir)
+	}
+	c.SPDK.Close()
+}
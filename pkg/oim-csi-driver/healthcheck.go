@@ -0,0 +1,144 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/spdk"
+	"github.com/intel/oim/pkg/spec/oim/v0"
+)
+
+// probe checks whether the backend is reachable within the probe
+// timeout. It returns FailedPrecondition if not, which is how the CSI
+// spec expects an unhealthy plugin to respond to Probe.
+func (od *oimDriver) probe(ctx context.Context) error {
+	if od.probeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, od.probeTimeout)
+		defer cancel()
+	}
+	if err := od.backend.probe(ctx); err != nil {
+		log.FromContext(ctx).Warnw("probe failed", "error", err)
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("unhealthy: %s", err))
+	}
+	if od.startupFailure() != nil {
+		// Check again, the problem might have been fixed.
+		if err := od.checkStartup(ctx); err != nil {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("unhealthy: %s", err))
+		}
+	}
+	return nil
+}
+
+// checkStartup runs before the driver serves requests and when
+// probing after a failed check. A failure is remembered until the
+// next successful check.
+func (od *oimDriver) checkStartup(ctx context.Context) error {
+	if !od.local.enabled() {
+		return nil
+	}
+	err := od.local.checkLVStores(ctx)
+	if err != nil {
+		log.FromContext(ctx).Errorw("SPDK healthcheck failed, refusing new volumes", "error", err)
+	}
+	od.startupMutex.Lock()
+	defer od.startupMutex.Unlock()
+	od.startupError = err
+	return err
+}
+
+// startupFailure returns Unavailable while the last check of
+// checkStartup failed.
+func (od *oimDriver) startupFailure() error {
+	od.startupMutex.Lock()
+	defer od.startupMutex.Unlock()
+	if od.startupError == nil {
+		return nil
+	}
+	return status.Error(codes.Unavailable, fmt.Sprintf("SPDK healthcheck failed: %s", od.startupError))
+}
+
+// checkLVStores examines all logical volume stores and warns about
+// degraded logical volumes. It fails when some store is
+// inaccessible.
+func (l *localSPDK) checkLVStores(ctx context.Context) error {
+	client, err := l.connect()
+	if err != nil {
+		return errors.Wrap(err, "connect to SPDK")
+	}
+	lvstores, err := spdk.GetLVStores(ctx, client, spdk.GetLVStoresArgs{})
+	if err != nil {
+		return errors.Wrap(err, "get logical volume stores")
+	}
+	for _, lvs := range lvstores {
+		err := spdk.ExamineLVStore(ctx, client, spdk.ExamineLVStoreArgs{UUID: lvs.UUID})
+		if err != nil {
+			if spdk.IsJSONError(err, spdk.ERROR_METHOD_NOT_FOUND) {
+				// SPDK is too old, nothing to check.
+				break
+			}
+			return errors.Wrapf(err, "logical volume store %s inaccessible", lvs.Name)
+		}
+	}
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{})
+	if err != nil {
+		return errors.Wrap(err, "get BDevs")
+	}
+	for _, bdev := range bdevs {
+		if bdev.Error != "" && bdev.DriverSpecific != nil && bdev.DriverSpecific.LVol != nil {
+			log.FromContext(ctx).Warnw("degraded logical volume",
+				"name", bdev.Name,
+				"uuid", bdev.UUID,
+				"error", bdev.Error,
+			)
+		}
+	}
+	return nil
+}
+
+func (l *localSPDK) probe(ctx context.Context) error {
+	client, err := l.connect()
+	if err != nil {
+		return errors.Wrap(err, "connect to SPDK")
+	}
+	_, err = spdk.GetVersion(ctx, client)
+	if _, ok := err.(rpc.ServerError); ok {
+		// SPDK is too old for spdk_get_version, but it answered.
+		return nil
+	}
+	return errors.Wrap(err, "get SPDK version")
+}
+
+// probe checks that the OIM registry is reachable and knows the
+// address of the OIM controller.
+func (r *remoteSPDK) probe(ctx context.Context) error {
+	conn, err := r.dialRegistry(ctx, r.oimControllerID)
+	if err != nil {
+		return errors.Wrap(err, "connect to OIM registry")
+	}
+	defer conn.Close()
+	path := r.oimControllerID + "/" + oimcommon.RegistryAddress
+	reply, err := oim.NewRegistryClient(conn).GetValues(ctx, &oim.GetValuesRequest{
+		Path: path,
+	})
+	if err != nil {
+		return errors.Wrap(err, "get OIM controller address from registry")
+	}
+	if len(reply.GetValues()) == 0 {
+		return errors.Errorf("no OIM controller registered at path %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestProbe(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, _ := newFakeDriver(t)
+	defer fake.Close()
+	fake.Handle("spdk_get_version", func(params json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"version": "SPDK v18.10"}, nil
+	})
+
+	_, err := od.oimDriver.Probe(ctx, &csi.ProbeRequest{})
+	assert.NoError(t, err, "SPDK running")
+	_, err = od.Probe(ctx, &csi0.ProbeRequest{})
+	assert.NoError(t, err, "SPDK running, CSI 0.3")
+	assert.Contains(t, fake.Methods(), "spdk_get_version")
+
+	fake.Close()
+	_, err = od.oimDriver.Probe(ctx, &csi.ProbeRequest{})
+	require.Error(t, err, "SPDK stopped")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "SPDK stopped: %s", err)
+	_, err = od.Probe(ctx, &csi0.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "SPDK stopped, CSI 0.3: %s", err)
+}
+
+func TestProbeOldSPDK(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	od, fake, _ := newFakeDriver(t)
+	defer fake.Close()
+
+	// The fake does not implement spdk_get_version, like SPDK
+	// releases before 18.10.
+	_, err := od.oimDriver.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+}
+
+func TestStartupHealthcheck(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	create := func(name string) error {
+		_, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return err
+	}
+
+	// Degraded logical volumes only cause warnings. SPDK without
+	// bdev_lvs_examine is accepted.
+	volumeID := fl.add("degraded", mib)
+	fl.lvols[volumeID].Error = "I/O error"
+	assert.NoError(t, od.checkStartup(ctx), "degraded volume")
+	assert.NoError(t, create("vol1"))
+
+	// An inaccessible store blocks new volumes until it recovers.
+	inaccessible := true
+	fake.Handle("bdev_lvs_examine", func(params json.RawMessage) (interface{}, error) {
+		if inaccessible {
+			return nil, testspdk.FakeError{Code: -int(syscall.EIO), Message: "Input/output error"}
+		}
+		return true, nil
+	})
+	assert.Error(t, od.checkStartup(ctx), "inaccessible store")
+	err = create("vol2")
+	assert.Equal(t, codes.Unavailable, status.Code(err), "create with inaccessible store: %v", err)
+	_, err = od.Probe(ctx, &csi.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "probe with inaccessible store: %v", err)
+
+	inaccessible = false
+	_, err = od.Probe(ctx, &csi.ProbeRequest{})
+	assert.NoError(t, err, "probe after recovery")
+	assert.NoError(t, create("vol2"), "create after recovery")
+}
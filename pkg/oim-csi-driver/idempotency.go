@@ -0,0 +1,92 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"reflect"
+	"sync"
+)
+
+// createRequest is what matters about a CreateVolume call when
+// deciding whether a repeated call is identical.
+type createRequest struct {
+	requiredBytes int64
+	limitBytes    int64
+	parameters    map[string]string
+	// revision identifies the StorageClass parameters as given
+	// by the caller, before adding defaults.
+	revision string
+	// sourceVolumeID or sourceSnapshotID is set when cloning
+	// an existing volume or snapshot.
+	sourceVolumeID   string
+	sourceSnapshotID string
+
+	// requisite and preferred are the segments of the
+	// accessibility requirements.
+	requisite []map[string]string
+	preferred []map[string]string
+}
+
+// equal treats nil and empty parameters the same.
+func (cr createRequest) equal(other createRequest) bool {
+	if cr.requiredBytes != other.requiredBytes ||
+		cr.limitBytes != other.limitBytes ||
+		cr.sourceVolumeID != other.sourceVolumeID ||
+		cr.sourceSnapshotID != other.sourceSnapshotID ||
+		len(cr.parameters) != len(other.parameters) ||
+		!reflect.DeepEqual(cr.requisite, other.requisite) ||
+		!reflect.DeepEqual(cr.preferred, other.preferred) {
+		return false
+	}
+	return len(cr.parameters) == 0 || reflect.DeepEqual(cr.parameters, other.parameters)
+}
+
+// createdVolume is a volume that was created for a request.
+type createdVolume struct {
+	request createRequest
+	volume  volumeInfo
+}
+
+// idempotencyCache remembers the volumes created by CreateVolume,
+// indexed by name, so that a repeated call can return the same
+// volume (CSI spec, "CreateVolume") regardless of whether the backend
+// is able to detect that itself. Callers must serialize operations
+// per name.
+type idempotencyCache struct {
+	mutex   sync.Mutex
+	volumes map[string]createdVolume
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		volumes: map[string]createdVolume{},
+	}
+}
+
+func (ic *idempotencyCache) get(name string) (createdVolume, bool) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	created, ok := ic.volumes[name]
+	return created, ok
+}
+
+func (ic *idempotencyCache) set(name string, created createdVolume) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	ic.volumes[name] = created
+}
+
+// forget removes the entry for a volume that got deleted.
+func (ic *idempotencyCache) forget(volumeID string) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	for name, created := range ic.volumes {
+		if created.volume.volumeID == volumeID {
+			delete(ic.volumes, name)
+		}
+	}
+}
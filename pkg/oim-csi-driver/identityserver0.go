@@ -9,6 +9,7 @@ package oimcsidriver
 import (
 	"context"
 
+	"github.com/intel/oim/pkg/oim-common"
 	"github.com/intel/oim/pkg/spec/csi/v0"
 )
 
@@ -16,23 +17,37 @@ func (od *oimDriver03) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfo
 	return &csi.GetPluginInfoResponse{
 		Name:          od.driverName,
 		VendorVersion: od.version,
+		Manifest:      oimcommon.BuildManifest(),
 	}, nil
 }
 
 func (od *oimDriver03) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if err := od.probe(ctx); err != nil {
+		return nil, err
+	}
 	return &csi.ProbeResponse{}, nil
 }
 
 func (od *oimDriver03) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	capabilities := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
 		},
+	}
+	if len(od.remote.nodeAffinity) > 0 {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: capabilities,
 	}, nil
 }
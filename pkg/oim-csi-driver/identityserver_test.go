@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/version"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/oim-csi-driver"
+)
+
+func TestGetPluginInfo(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	c := newFakeController(t)
+	defer c.Close()
+
+	response, err := c.IdentityClient().GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	require.NoError(t, err)
+	reported, err := version.ParseSemantic(response.GetVendorVersion())
+	require.NoError(t, err, "reported version")
+	expected, err := version.ParseSemantic(oimcommon.Version)
+	require.NoError(t, err, "build version")
+	assert.Equal(t, expected.String(), reported.String())
+	assert.Equal(t, map[string]string{
+		"gitCommit": oimcommon.GitCommit,
+		"buildDate": oimcommon.BuildDate,
+		"goVersion": runtime.Version(),
+	}, response.GetManifest())
+
+	_, err = oimcsidriver.New(oimcsidriver.WithDriverVersion("unknown"), oimcsidriver.WithVHostEndpoint(c.SPDK.Path))
+	assert.Error(t, err, "invalid version")
+	_, err = oimcsidriver.New(oimcsidriver.WithDriverVersion("v1.2.3-4-g0123abc"), oimcsidriver.WithVHostEndpoint(c.SPDK.Path))
+	assert.NoError(t, err, "valid version")
+}
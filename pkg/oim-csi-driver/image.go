@@ -0,0 +1,153 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// localImageParameter is the StorageClass parameter with the path of
+// a RAW disk image, relative to the image directory of the driver.
+// New volumes start with a copy of the image.
+const localImageParameter = "localImage"
+
+const (
+	// imageProgressInterval is how often copying an image logs
+	// its progress.
+	imageProgressInterval = 10 * time.Second
+	imageChunkSize        = mib
+)
+
+// localImage checks the localImageParameter. It returns the absolute
+// path and the size of the image, or an empty path when the
+// parameter is not set.
+func (od *oimDriver) localImage(parameters map[string]string) (string, int64, error) {
+	image, ok := parameters[localImageParameter]
+	if !ok {
+		return "", 0, nil
+	}
+	if !od.local.enabled() {
+		return "", 0, status.Error(codes.Unimplemented, fmt.Sprintf("%s parameter only supported with local SPDK", localImageParameter))
+	}
+	if od.imageDir == "" {
+		return "", 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("%s parameter needs an image directory, which is not configured", localImageParameter))
+	}
+	path, err := imagePath(od.imageDir, image)
+	if err != nil {
+		return "", 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, status.Error(codes.InvalidArgument, fmt.Sprintf("%s parameter: %s", localImageParameter, err))
+	}
+	if !info.Mode().IsRegular() {
+		return "", 0, status.Error(codes.InvalidArgument, fmt.Sprintf("%s parameter: %s is not a regular file", localImageParameter, image))
+	}
+	return path, info.Size(), nil
+}
+
+// imagePath resolves the image name inside the directory. Names
+// which point outside of it are rejected.
+func imagePath(dir, image string) (string, error) {
+	if image == "" || filepath.IsAbs(image) {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("%s parameter %q must be a relative path", localImageParameter, image))
+	}
+	path := filepath.Join(dir, image)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("%s parameter %q is outside of the image directory", localImageParameter, image))
+	}
+	return path, nil
+}
+
+// populateVolume copies the image into a new volume through a NBD
+// device on the host of the driver.
+func (od *oimDriver) populateVolume(ctx context.Context, volumeID, image string) (finalErr error) {
+	src, err := os.Open(image) // nolint: gosec
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	device, cleanup, err := od.local.createDevice(ctx, volumeID, nil)
+	if cleanup != nil {
+		defer cleanup()
+	}
+	if err != nil {
+		return status.Error(codes.Internal, errors.Wrap(err, "create device for copying image").Error())
+	}
+	defer func() {
+		if err := od.local.deleteDevice(ctx, volumeID); err != nil && finalErr == nil {
+			finalErr = status.Error(codes.Internal, errors.Wrap(err, "remove device after copying image").Error())
+		}
+	}()
+	dst, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer dst.Close()
+
+	log.FromContext(ctx).Infow("copying image",
+		"volumeid", volumeID,
+		"image", image,
+		"device", device,
+		"bytes", info.Size(),
+	)
+	if _, err := copyImage(ctx, dst, src, info.Size(), imageProgressInterval); err != nil {
+		return status.Error(codes.Internal, errors.Wrapf(err, "copy image %s", image).Error())
+	}
+	if err := dst.Sync(); err != nil {
+		return status.Error(codes.Internal, errors.Wrap(err, "flush device").Error())
+	}
+	return nil
+}
+
+// copyImage copies chunk by chunk until the end of src or until the
+// context is done, and logs the progress after each interval.
+func copyImage(ctx context.Context, dst io.Writer, src io.Reader, size int64, interval time.Duration) (int64, error) {
+	buffer := make([]byte, imageChunkSize)
+	var copied int64
+	lastReport := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+		n, err := io.ReadFull(src, buffer)
+		if n > 0 {
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				return copied, err
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return copied, nil
+		}
+		if err != nil {
+			return copied, err
+		}
+		if time.Since(lastReport) >= interval {
+			log.FromContext(ctx).Infow("copying image", "copied", copied, "total", size)
+			lastReport = time.Now()
+		}
+	}
+}
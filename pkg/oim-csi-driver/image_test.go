@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/log/level"
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestImagePath(t *testing.T) {
+	for name, tc := range map[string]struct {
+		image string
+		path  string
+	}{
+		"plain":     {"disk.raw", "/images/disk.raw"},
+		"subdir":    {"os/disk.raw", "/images/os/disk.raw"},
+		"clean":     {"os/../disk.raw", "/images/disk.raw"},
+		"absolute":  {"/etc/passwd", ""},
+		"parent":    {"../etc/passwd", ""},
+		"traversal": {"os/../../etc/passwd", ""},
+		"dir":       {"..", ""},
+		"empty":     {"", ""},
+	} {
+		path, err := imagePath("/images", tc.image)
+		if tc.path == "" {
+			assert.Equal(t, codes.InvalidArgument, status.Code(err), "%s: %v", name, err)
+		} else if assert.NoError(t, err, name) {
+			assert.Equal(t, tc.path, path, name)
+		}
+	}
+}
+
+func TestCopyImage(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	image := bytes.Repeat([]byte("oim"), int(imageChunkSize))
+
+	var buffer, logOutput bytes.Buffer
+	ctx := log.WithLogger(context.Background(), log.NewSimpleLogger(log.SimpleConfig{Level: level.Info, Output: &logOutput}))
+	copied, err := copyImage(ctx, &buffer, bytes.NewReader(image), int64(len(image)), 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(image)), copied)
+	assert.Equal(t, image, buffer.Bytes())
+	assert.Contains(t, logOutput.String(), "copying image", "progress")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buffer.Reset()
+	_, err = copyImage(ctx, &buffer, bytes.NewReader(image), int64(len(image)), imageProgressInterval)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, buffer.Bytes())
+}
+
+func TestLocalImageParameter(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "image")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "disk.raw"), bytes.Repeat([]byte{1}, 3*int(mib)), 0600))
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	for name, tc := range map[string]struct {
+		imageDir   string
+		image      string
+		limitBytes int64
+		code       codes.Code
+	}{
+		"disabled":  {"", "disk.raw", 0, codes.FailedPrecondition},
+		"traversal": {tmp, "../disk.raw", 0, codes.InvalidArgument},
+		"missing":   {tmp, "other.raw", 0, codes.InvalidArgument},
+		"too-large": {tmp, "disk.raw", 2 * mib, codes.OutOfRange},
+	} {
+		var opts []Option
+		if tc.imageDir != "" {
+			opts = append(opts, WithImageDir(tc.imageDir))
+		}
+		driver, fake, _ := newFakeDriver(t, opts...)
+		_, err := driver.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: capabilities,
+			CapacityRange:      &csi.CapacityRange{LimitBytes: tc.limitBytes},
+			Parameters:         map[string]string{localImageParameter: tc.image},
+		})
+		assert.Equal(t, tc.code, status.Code(err), "%s: %v", name, err)
+		fake.Close()
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Like the snapshot diff API, VolumeInspect is provided as an
+// additional gRPC service with JSON encoding.
+const volumeInspectService = "oim.csi.v1.VolumeInspect"
+
+// VolumeInspectRequest is the request for VolumeInspect via gRPC.
+type VolumeInspectRequest struct {
+	VolumeID string `json:"volume_id"`
+}
+
+// VolumeInspect returns the metadata that the driver has about an
+// existing volume.
+func (od *oimDriver) VolumeInspect(ctx context.Context, volumeID string) (*VolumeMetadata, error) {
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
+	}
+	if err := od.checkVolumeTenant(ctx, volumeID); err != nil {
+		return nil, err
+	}
+
+	// Serialize operations per volume by ID.
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	metadata, ok := od.metadata.get(volumeID)
+	if !ok {
+		// Not an error, we simply don't know anything
+		// about the volume yet.
+		if err := od.backend.checkVolumeExists(ctx, volumeID); err != nil {
+			return nil, err
+		}
+	}
+	return &metadata, nil
+}
+
+// VolumeInspect invokes VolumeInspect through a connection to the
+// CSI socket of the driver.
+func VolumeInspect(ctx context.Context, conn *grpc.ClientConn, volumeID string) (*VolumeMetadata, error) {
+	request := &VolumeInspectRequest{
+		VolumeID: volumeID,
+	}
+	reply := &VolumeMetadata{}
+	if err := conn.Invoke(ctx, "/"+volumeInspectService+"/VolumeInspect", request, reply,
+		grpc.CallContentSubtype(jsonCodecName)); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func registerVolumeInspectServer(s *grpc.Server, od *oimDriver) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: volumeInspectService,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "VolumeInspect",
+				Handler:    volumeInspectHandler,
+			},
+		},
+		Streams: []grpc.StreamDesc{},
+	}, od)
+}
+
+func volumeInspectHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) { // nolint: golint
+	in := new(VolumeInspectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*oimDriver).VolumeInspect(ctx, req.(*VolumeInspectRequest).VolumeID)
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + volumeInspectService + "/VolumeInspect",
+	}
+	return interceptor(ctx, in, info, handler)
+}
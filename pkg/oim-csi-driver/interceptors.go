@@ -0,0 +1,81 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// maxPanicMessage limits how much of a panic message gets returned
+// to the caller. The complete message and the stack trace are only
+// logged.
+const maxPanicMessage = 200
+
+// interceptors returns the gRPC interceptors of the CSI server.
+func (od *oimDriver) interceptors() []grpc.UnaryServerInterceptor {
+	interceptors := []grpc.UnaryServerInterceptor{
+		logDuration,
+		od.metrics.recoverPanic,
+		od.drain.intercept,
+	}
+	if od.tokens != nil {
+		interceptors = append(interceptors, TokenAuthInterceptor(od.tokens))
+	}
+	return interceptors
+}
+
+// logDuration logs method, duration and status code of each call.
+func logDuration(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	log.FromContext(ctx).Infow("completed",
+		"method", info.FullMethod,
+		"duration", time.Since(start),
+		"code", status.Code(err),
+	)
+	return resp, err
+}
+
+// recoverPanic turns a panic in the handler into an Internal error
+// instead of crashing the driver.
+func (m *Metrics) recoverPanic(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.panics.Inc()
+			log.FromContext(ctx).Errorw("panic",
+				"method", info.FullMethod,
+				"panic", r,
+				"stack", string(debug.Stack()),
+			)
+			resp, err = nil, status.Error(codes.Internal, fmt.Sprintf("%s panicked: %s", info.FullMethod, sanitizePanic(r)))
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// sanitizePanic returns the first line of the panic message,
+// truncated to maxPanicMessage.
+func sanitizePanic(r interface{}) string {
+	message := fmt.Sprint(r)
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		message = message[:i]
+	}
+	if len(message) > maxPanicMessage {
+		message = message[:maxPanicMessage] + "..."
+	}
+	return message
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	oimcommon "github.com/intel/oim/pkg/oim-common"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	m := NewMetrics()
+	interceptor := oimcommon.ChainUnaryServer(logDuration, m.recoverPanic)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+
+	panics := func() float64 {
+		families, err := m.Registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "oim_csi_panics_total" {
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		t.Fatal("panic counter not found")
+		return 0
+	}
+
+	resp, err := interceptor(ctx, "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "request", resp)
+	assert.Equal(t, 0.0, panics())
+
+	resp, err = interceptor(ctx, "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		var volumes map[string]string
+		volumes["vol"] = "boom"
+		return nil, nil
+	})
+	assert.Nil(t, resp)
+	assert.Equal(t, codes.Internal, status.Code(err), "%v", err)
+	assert.Contains(t, status.Convert(err).Message(), "assignment to entry in nil map")
+	assert.Equal(t, 1.0, panics())
+
+	_, err = interceptor(ctx, "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic(strings.Repeat("x", 2*maxPanicMessage) + "\nsecret details")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err), "%v", err)
+	message := status.Convert(err).Message()
+	assert.NotContains(t, message, "secret details")
+	assert.True(t, len(message) < len(info.FullMethod)+maxPanicMessage+20, "message truncated: %s", message)
+	assert.Equal(t, 2.0, panics())
+}
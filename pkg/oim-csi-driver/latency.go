@@ -0,0 +1,54 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// latencyClassContextKey is the volume context entry with a hint
+// about the access latency of a volume, derived from the kind of
+// device that stores its data. It is not set when the device is
+// unknown.
+const latencyClassContextKey = "storageLatencyClass"
+
+// latencyClasses maps the product name of the SPDK BDev which stores
+// the data of a volume to its latency class:
+//
+//	ultra-low - memory (Malloc)
+//	low       - NVMe SSDs, local or via NVMe-oF
+//	medium    - Linux block devices and files (AIO)
+//	high      - network storage (iSCSI, Ceph RBD)
+var latencyClasses = map[string]string{
+	mallocProductName: "ultra-low",
+	"NVMe disk":       "low",
+	"AIO disk":        "medium",
+	"iSCSI LUN":       "high",
+	"Ceph Rbd Disk":   "high",
+}
+
+// latencyClass looks up the latency class of the base BDev of a
+// logical volume store. Because it is only a hint, failures are
+// logged and result in an empty class.
+func latencyClass(ctx context.Context, client *spdk.Client, lvs spdk.LVStore) string {
+	if lvs.BaseBDev == "" {
+		return ""
+	}
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: lvs.BaseBDev})
+	if err != nil || len(bdevs) != 1 {
+		log.FromContext(ctx).Warnw("cannot determine latency class",
+			"lvstore", lvs.Name,
+			"basebdev", lvs.BaseBDev,
+			"error", err,
+		)
+		return ""
+	}
+	return latencyClasses[bdevs[0].ProductName]
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestLatencyClass(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+
+	for name, tc := range map[string]struct {
+		productName string
+		class       string
+	}{
+		"nvme":    {"NVMe disk", "low"},
+		"aio":     {"AIO disk", "medium"},
+		"iscsi":   {"iSCSI LUN", "high"},
+		"unknown": {"Something new", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake, err := testspdk.NewFake()
+			require.NoError(t, err)
+			defer fake.Close()
+			fl := newFakeLVols(fake)
+			fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+				return []spdk.LVStore{{UUID: fakeLVStoreUUID, Name: "lvs", BaseBDev: "base0", TotalDataClusters: 100, FreeClusters: 100, BlockSize: 512, ClusterSize: mib}}, nil
+			})
+			fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+				var args spdk.GetBDevsArgs
+				if err := json.Unmarshal(params, &args); err != nil {
+					return nil, err
+				}
+				if args.Name == "base0" {
+					return []spdk.BDev{{Name: "base0", ProductName: tc.productName}}, nil
+				}
+				fl.mutex.Lock()
+				defer fl.mutex.Unlock()
+				if lvol := fl.find(args.Name); lvol != nil {
+					return []spdk.BDev{*lvol}, nil
+				}
+				return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+			})
+			driver, err := New(WithVHostEndpoint(fake.Path))
+			require.NoError(t, err)
+			od := &driver.(*oimDriver03).oimDriver
+
+			response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               "vol",
+				VolumeCapabilities: capabilities,
+			})
+			require.NoError(t, err)
+			class, ok := response.GetVolume().GetVolumeContext()[latencyClassContextKey]
+			assert.Equal(t, tc.class, class)
+			assert.Equal(t, tc.class != "", ok, "context entry only for known devices")
+		})
+	}
+
+	t.Run("malloc", func(t *testing.T) {
+		od, fake, _ := newFakeDriver(t)
+		defer fake.Close()
+		response, err := od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: capabilities,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "ultra-low", response.GetVolume().GetVolumeContext()[latencyClassContextKey])
+	})
+}
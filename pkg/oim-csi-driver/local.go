@@ -8,8 +8,14 @@ package oimcsidriver
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -21,91 +27,383 @@ import (
 	"github.com/intel/oim/pkg/spdk"
 )
 
+// mallocProductName is how SPDK describes Malloc BDevs in get_bdevs.
+const mallocProductName = "Malloc disk"
+
+// publishContextVHostSocket is the entry in the publish context
+// with the path of the vhost-blk socket for the volume.
+const publishContextVHostSocket = "vhost_socket"
+
 type localSPDK struct {
 	vhostEndpoint string
+	// vhostSocketDir is where SPDK creates the sockets of vhost
+	// controllers, by default the directory of the vhostEndpoint.
+	vhostSocketDir string
+	// poolSize is the maximum number of connections to SPDK.
+	poolSize int
+	// breaker, if set, protects SPDK while it restarts.
+	breaker *spdk.CircuitBreaker
+	// traceFile, if set, receives all SPDK calls.
+	traceFile string
+	// secrets, if set, provides the keys of encrypted volumes.
+	secrets SecretReader
+	// lvstores are used when selecting a store for new volumes.
+	lvstores lvstoreCache
+
+	// client is shared by all operations and created on demand,
+	// unless one was provided.
+	mutex  sync.Mutex
+	client *spdk.Client
 }
 
 var _ OIMBackend = &localSPDK{}
 
-func (l *localSPDK) createVolume(ctx context.Context, volumeID string, requiredBytes int64) (int64, error) {
+// enabled returns true if the driver is configured to use SPDK directly.
+func (l *localSPDK) enabled() bool {
+	return l.vhostEndpoint != "" || l.client != nil
+}
+
+// connect returns the client for SPDK. Connecting is retried on each
+// call until it succeeds, so the SPDK daemon does not need to be
+// running yet when the driver starts.
+func (l *localSPDK) connect() (*spdk.Client, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.client == nil {
+		options := []spdk.Option{spdk.WithPoolSize(l.poolSize)}
+		if l.breaker != nil {
+			options = append(options, spdk.WithCircuitBreaker(l.breaker))
+		}
+		if l.traceFile != "" {
+			options = append(options, spdk.WithTraceFile(l.traceFile))
+		}
+		client, err := spdk.New(l.vhostEndpoint, options...)
+		if err != nil {
+			return nil, err
+		}
+		l.client = client
+	}
+	return l.client, nil
+}
+
+// close disconnects from SPDK.
+func (l *localSPDK) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.client == nil {
+		return nil
+	}
+	err := l.client.Close()
+	l.client = nil
+	return err
+}
+
+// checkCircuit replaces an error with Unavailable while the circuit
+// breaker is not closed, so that callers back off instead of
+// retrying immediately. Meant to be deferred with a pointer to the
+// named error result.
+func (l *localSPDK) checkCircuit(err *error) {
+	if *err != nil && l.breaker != nil && l.breaker.State() != spdk.Closed {
+		*err = status.Error(codes.Unavailable, fmt.Sprintf("%s: %s", spdk.ErrCircuitOpen, *err))
+	}
+}
+
+// thinProvisionParameter is the StorageClass parameter which selects
+// between thin ("true", the default) and thick ("false") provisioning
+// of logical volumes.
+const thinProvisionParameter = "thinProvision"
+
+// thinProvisioning checks the thinProvisionParameter.
+func thinProvisioning(parameters map[string]string) (bool, error) {
+	switch value, ok := parameters[thinProvisionParameter]; {
+	case !ok || value == "true":
+		return true, nil
+	case value == "false":
+		return false, nil
+	default:
+		return false, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s parameter %q, must be \"true\" or \"false\"", thinProvisionParameter, value))
+	}
+}
+
+// clearMethodParameter is the StorageClass parameter which selects
+// how SPDK clears the data of a new logical volume. Clearing prevents
+// leaking old data into the volume at the cost of slower creation.
+const clearMethodParameter = "clearMethod"
+
+// clearMethods are the supported values of clearMethodParameter.
+var clearMethods = []string{
+	spdk.LVolClearMethodNone,
+	spdk.LVolClearMethodUnmap,
+	spdk.LVolClearMethodWriteZeroes,
+}
+
+// clearMethod checks the clearMethodParameter. An empty result means
+// the SPDK default.
+func clearMethod(parameters map[string]string) (string, error) {
+	value, ok := parameters[clearMethodParameter]
+	if !ok {
+		return "", nil
+	}
+	for _, method := range clearMethods {
+		if value == method {
+			return value, nil
+		}
+	}
+	return "", status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s parameter %q, must be one of %s", clearMethodParameter, value, strings.Join(clearMethods, ", ")))
+}
+
+// lvstoreParameter is the StorageClass parameter which selects the
+// logical volume store for new volumes by name. By default, the
+// first one reported by SPDK is used. Clones always end up in the
+// store of their source and ignore the parameter.
+const lvstoreParameter = "lvstoreName"
+
+// lvstoreUUIDContextKey is the volume context entry with the UUID of
+// the logical volume store that a volume was created in.
+const lvstoreUUIDContextKey = "lvstore_uuid"
+
+// lvstore returns the logical volume store with the given name, or
+// the first one if the name is empty. Without any stores, it returns
+// nil unless a specific store was requested.
+func (l *localSPDK) lvstore(ctx context.Context, client *spdk.Client, name string) (*spdk.LVStore, error) {
+	lvstores, err := spdk.GetLVStores(ctx, client, spdk.GetLVStoresArgs{})
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get logical volume stores from SPDK: %s", err))
+	}
+	for _, lvs := range lvstores {
+		if name == "" || lvs.Name == name {
+			return &lvs, nil
+		}
+	}
+	if name != "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("logical volume store %q from %s parameter not found", name, lvstoreParameter))
+	}
+	return nil, nil
+}
+
+// createVolume creates a logical volume in the logical volume store
+// selected by lvstoreParameter or selectLVStore. The UUID of the
+// logical volume is the volume ID. Without a logical volume store, a
+// Malloc BDev with the name as ID gets created instead.
+func (l *localSPDK) createVolume(ctx context.Context, name string, request createRequest) (_ volumeInfo, err error) {
+	defer l.checkCircuit(&err)
+	thin, err := thinProvisioning(request.parameters)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	clearing, err := clearMethod(request.parameters)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	limits, err := qosLimits(request.parameters)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	keys, err := l.cryptoKeys(ctx, request.parameters)
+	if err != nil {
+		return volumeInfo{}, err
+	}
 	// Connect to SPDK.
-	client, err := spdk.New(l.vhostEndpoint)
+	client, err := l.connect()
 	if err != nil {
-		return 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+		return volumeInfo{}, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	var volume volumeInfo
+	switch {
+	case request.sourceVolumeID != "":
+		volume, err = l.cloneLVol(ctx, client, name, request.sourceVolumeID, false, request.requiredBytes, request.limitBytes)
+	case request.sourceSnapshotID != "":
+		volume, err = l.cloneLVol(ctx, client, name, request.sourceSnapshotID, true, request.requiredBytes, request.limitBytes)
+	default:
+		var lvs *spdk.LVStore
+		if lvstoreName := request.parameters[lvstoreParameter]; lvstoreName != "" {
+			lvs, err = l.lvstore(ctx, client, lvstoreName)
+		} else {
+			lvs, err = l.selectLVStore(ctx, client, name, request.requiredBytes)
+		}
+		switch {
+		case err != nil:
+			return volumeInfo{}, err
+		case lvs == nil:
+			volume, err = l.createMallocBDev(ctx, client, name, request.requiredBytes, request.limitBytes)
+		default:
+			volume, err = l.createLVol(ctx, client, *lvs, name, request.requiredBytes, request.limitBytes, thin, clearing)
+		}
+	}
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	if limits != nil {
+		setQoS(ctx, client, volume.volumeID, *limits)
+	}
+	if keys != nil {
+		if err := l.createCryptoBDev(ctx, client, volume.volumeID, *keys); err != nil {
+			// The new volume would leak when the caller
+			// does not retry. One that existed before
+			// this call is not ours to remove.
+			if volume.created {
+				if err := l.deleteVolume(ctx, volume.volumeID); err != nil {
+					log.FromContext(ctx).Errorw("delete volume without crypto BDev",
+						"volumeid", volume.volumeID,
+						"error", err,
+					)
+				}
+			}
+			return volumeInfo{}, err
+		}
+	}
+	return volume, nil
+}
+
+func (l *localSPDK) createLVol(ctx context.Context, client *spdk.Client, lvs spdk.LVStore, name string, requiredBytes, limitBytes int64, thin bool, clearing string) (volumeInfo, error) {
+	// Logical volumes can be found via their alias.
+	existing, err := getLVol(ctx, client, lvs.Name+"/"+name)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	if existing != nil {
+		if existing.DriverSpecific.LVol.Snapshot {
+			return volumeInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("snapshot with the same name %s already exists", name))
+		}
+		volSize := existing.BlockSize * existing.NumBlocks
+		if volSize >= requiredBytes && (limitBytes == 0 || volSize <= limitBytes) {
+			// exisiting volume is compatible with new request and should be reused.
+			return volumeInfo{volumeID: existing.UUID, bdevUUID: existing.UUID, lvstoreUUID: lvs.UUID, latencyClass: latencyClass(ctx, client, lvs), numaNode: numaNode(ctx, client, "/sys", lvs), capacityBytes: volSize}, nil
+		}
+		return volumeInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", name))
+	}
+
+	capacity, err := volumeSize(requiredBytes, limitBytes, lvs.ClusterSize)
+	if err != nil {
+		return volumeInfo{}, err
 	}
-	defer client.Close()
+	// Also enforced for thin volumes, they would run out of
+	// space once the data gets written.
+	if capacity > lvs.FreeBytes() {
+		return volumeInfo{}, status.Error(codes.OutOfRange, fmt.Sprintf("Requested capacity %d exceeds free space %d in logical volume store %s", capacity, lvs.FreeBytes(), lvs.Name))
+	}
+
+	log.FromContext(ctx).Infow("creating logical volume",
+		"name", name,
+		"lvstore", lvs.Name,
+		"bytes", capacity,
+		"thin", thin,
+		"clearmethod", clearing,
+	)
+	uuid, err := spdk.CreateLVol(ctx, client, spdk.CreateLVolArgs{
+		LVolName:      name,
+		Size:          capacity,
+		ThinProvision: thin,
+		UUID:          lvs.UUID,
+		ClearMethod:   clearing,
+	})
+	if err != nil {
+		return volumeInfo{}, spdk.GRPCError(err, "Failed to create logical volume")
+	}
+	return volumeInfo{volumeID: uuid, bdevUUID: uuid, lvstoreUUID: lvs.UUID, latencyClass: latencyClass(ctx, client, lvs), numaNode: numaNode(ctx, client, "/sys", lvs), capacityBytes: capacity, created: true}, nil
+}
 
+func (l *localSPDK) createMallocBDev(ctx context.Context, client *spdk.Client, name string, requiredBytes, limitBytes int64) (volumeInfo, error) {
 	// Need to check for already existing volume name, and if found
 	// check for the requested capacity and already allocated capacity
-	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: volumeID})
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: name})
 	if err == nil && len(bdevs) == 1 {
 		bdev := bdevs[0]
 		// Since err is nil, it means the volume with the same name already exists
 		// need to check if the size of exisiting volume is the same as in new
 		// request
 		volSize := bdev.BlockSize * bdev.NumBlocks
-		if volSize >= requiredBytes {
+		if volSize >= requiredBytes && (limitBytes == 0 || volSize <= limitBytes) {
 			// exisiting volume is compatible with new request and should be reused.
-			return volSize, nil
+			return volumeInfo{volumeID: name, latencyClass: latencyClasses[mallocProductName], capacityBytes: volSize}, nil
 		}
-		return 0, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", volumeID))
+		return volumeInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", name))
 	}
 	// If we get an error, we might have a problem or the bdev simply doesn't exist.
 	// A bit hard to tell, unfortunately (see https://github.com/spdk/spdk/issues/319).
 	if err != nil && !spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS) {
-		return 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get BDevs from SPDK: %s", err))
+		return volumeInfo{}, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get BDevs from SPDK: %s", err))
 	}
 
 	// Check for maximum available capacity
-	capacity := requiredBytes
-	if capacity >= maxStorageCapacity {
-		return 0, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, maxStorageCapacity)
+	if requiredBytes >= maxStorageCapacity {
+		return volumeInfo{}, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", requiredBytes, maxStorageCapacity)
 	}
 
-	if capacity == 0 {
-		// If capacity is unset, round up to minimum size (1MB?).
-		capacity = mib
-	} else {
-		// Round up to multiple of 512.
-		capacity = (capacity + 511) / 512 * 512
+	// Malloc BDevs are allocated in blocks of 512 bytes.
+	capacity, err := volumeSize(requiredBytes, limitBytes, 512)
+	if err != nil {
+		return volumeInfo{}, err
 	}
 
 	// Create new Malloc bdev.
 	args := spdk.ConstructMallocBDevArgs{ConstructBDevArgs: spdk.ConstructBDevArgs{
 		NumBlocks: capacity / 512,
 		BlockSize: 512,
-		Name:      volumeID,
+		Name:      name,
 	}}
 	_, err = spdk.ConstructMallocBDev(ctx, client, args)
 	if err != nil {
-		return 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to create SPDK Malloc BDev: %s", err))
+		return volumeInfo{}, spdk.GRPCError(err, "Failed to create SPDK Malloc BDev")
 	}
-	return capacity, nil
+	return volumeInfo{volumeID: name, latencyClass: latencyClasses[mallocProductName], capacityBytes: capacity, created: true}, nil
 }
 
-func (l *localSPDK) deleteVolume(ctx context.Context, volumeID string) error {
+func (l *localSPDK) deleteVolume(ctx context.Context, volumeID string) (err error) {
+	defer l.checkCircuit(&err)
 	// Connect to SPDK.
-	client, err := spdk.New(l.vhostEndpoint)
+	client, err := l.connect()
 	if err != nil {
 		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
 	}
-	defer client.Close()
+
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: volumeID})
+	if err == nil && len(bdevs) == 1 && bdevs[0].Claimed {
+		// Encrypted, the crypto BDev must go first.
+		if err := l.deleteCryptoBDev(ctx, client, volumeID); err != nil {
+			return err
+		}
+	}
+	if err == nil && len(bdevs) == 1 && bdevs[0].DriverSpecific != nil && bdevs[0].DriverSpecific.LVol != nil {
+		if bdevs[0].DriverSpecific.LVol.Snapshot {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("%s is a snapshot, not a volume", volumeID))
+		}
+		clearQoS(ctx, client, bdevs[0])
+		// The volume might have been deleted concurrently.
+		if err := spdk.DeleteLVol(ctx, client, spdk.LVolArgs{Name: volumeID}); err != nil && !spdkIsNotFound(err) {
+			return spdk.GRPCError(err, fmt.Sprintf("Failed to delete logical volume %s", volumeID))
+		}
+		return nil
+	}
+
+	if err == nil && len(bdevs) == 1 {
+		clearQoS(ctx, client, bdevs[0])
+	}
 
 	// We must not error out when the BDev does not exist (might have been deleted already).
-	// TODO: proper detection of "bdev not found" (https://github.com/spdk/spdk/issues/319).
-	if err := spdk.DeleteBDev(ctx, client, spdk.DeleteBDevArgs{Name: volumeID}); err != nil && !spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS) {
-		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to delete SPDK Malloc BDev %s: %s", volumeID, err))
+	if err := spdk.DeleteBDev(ctx, client, spdk.DeleteBDevArgs{Name: volumeID}); err != nil && !spdkIsNotFound(err) {
+		return spdk.GRPCError(err, fmt.Sprintf("Failed to delete SPDK Malloc BDev %s", volumeID))
 	}
 	return nil
 }
 
+// spdkIsNotFound checks whether SPDK reported that a BDev does not
+// exist. Older SPDK releases only return ERROR_INVALID_PARAMS for that
+// (https://github.com/spdk/spdk/issues/319), newer ones -ENOENT or
+// -ENODEV.
+func spdkIsNotFound(err error) bool {
+	return spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS) ||
+		spdk.IsJSONError(err, -int(syscall.ENOENT)) ||
+		spdk.IsJSONError(err, -int(syscall.ENODEV))
+}
+
 func (l *localSPDK) checkVolumeExists(ctx context.Context, volumeID string) error {
 	// Connect to SPDK.
-	client, err := spdk.New(l.vhostEndpoint)
+	client, err := l.connect()
 	if err != nil {
 		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
 	}
-	defer client.Close()
 
 	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: volumeID})
 	if err == nil && len(bdevs) == 1 {
@@ -116,13 +414,189 @@ func (l *localSPDK) checkVolumeExists(ctx context.Context, volumeID string) erro
 	return status.Error(codes.NotFound, "")
 }
 
+// isReadOnly returns true for snapshots. Those are logical volumes
+// which SPDK never writes to and thus can be used by several nodes.
+func (l *localSPDK) isReadOnly(ctx context.Context, volumeID string) (bool, error) {
+	// Connect to SPDK.
+	client, err := l.connect()
+	if err != nil {
+		return false, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: volumeID})
+	if err != nil || len(bdevs) != 1 {
+		return false, status.Error(codes.NotFound, "")
+	}
+	bdev := bdevs[0]
+	return bdev.DriverSpecific != nil &&
+		bdev.DriverSpecific.LVol != nil &&
+		bdev.DriverSpecific.LVol.Snapshot, nil
+}
+
+func (l *localSPDK) listVolumes(ctx context.Context) ([]volumeInfo, error) {
+	// Connect to SPDK.
+	client, err := l.connect()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{})
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get BDevs from SPDK: %s", err))
+	}
+	var volumes []volumeInfo
+	for _, bdev := range bdevs {
+		// Only Malloc BDevs and logical volumes are created by
+		// us. Snapshots are listed separately.
+		switch {
+		case bdev.ProductName == mallocProductName:
+		case bdev.DriverSpecific != nil && bdev.DriverSpecific.LVol != nil && !bdev.DriverSpecific.LVol.Snapshot:
+		default:
+			continue
+		}
+		volumes = append(volumes, volumeInfo{
+			volumeID:      bdev.Name,
+			capacityBytes: bdev.BlockSize * bdev.NumBlocks,
+		})
+	}
+	return volumes, nil
+}
+
+func (l *localSPDK) getCapacity(ctx context.Context) (int64, error) {
+	// Connect to SPDK.
+	client, err := l.connect()
+	if err != nil {
+		return 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	lvstores, err := spdk.GetLVStores(ctx, client, spdk.GetLVStoresArgs{})
+	if err != nil {
+		return 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get logical volume stores from SPDK: %s", err))
+	}
+	var free int64
+	for _, lvs := range lvstores {
+		free += lvs.FreeBytes()
+	}
+	return free, nil
+}
+
+// vhostBlkController returns the name of the vhost-blk controller
+// which makes the volume available to the node. It gets hashed
+// because it becomes part of the socket path, which has to be short
+// and must not contain slashes.
+func vhostBlkController(volumeID, nodeID string) string {
+	hash := sha256.Sum256([]byte(volumeID + "\x00" + nodeID))
+	return "oim-blk-" + hex.EncodeToString(hash[:])[:16]
+}
+
+func (l *localSPDK) socketDir() string {
+	if l.vhostSocketDir != "" {
+		return l.vhostSocketDir
+	}
+	return filepath.Dir(l.vhostEndpoint)
+}
+
+// publishVolume ensures that there is a vhost-blk controller for the
+// volume and node and returns the path of its socket.
+func (l *localSPDK) publishVolume(ctx context.Context, volumeID, nodeID string, readonly bool) (string, error) {
+	// Connect to SPDK.
+	client, err := l.connect()
+	if err != nil {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: volumeID})
+	if err != nil {
+		if spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS) {
+			return "", status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", volumeID))
+		}
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get BDevs from SPDK: %s", err))
+	}
+	if len(bdevs) != 1 {
+		return "", status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", volumeID))
+	}
+
+	name := vhostBlkController(volumeID, nodeID)
+	socket := filepath.Join(l.socketDir(), name)
+	controllers, err := spdk.GetVHostControllers(ctx, client)
+	if err != nil {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get vhost controllers from SPDK: %s", err))
+	}
+	for _, controller := range controllers {
+		if controller.Controller != name {
+			continue
+		}
+		// Published before (idempotency!).
+		if blk, ok := controller.BackendSpecific["block"].(spdk.BlkControllerSpecific); ok && blk.ReadOnly != readonly {
+			return "", status.Error(codes.AlreadyExists, fmt.Sprintf("volume %s already published to node %s with readonly=%v", volumeID, nodeID, blk.ReadOnly))
+		}
+		return socket, nil
+	}
+
+	log.FromContext(ctx).Infow("creating vhost-blk controller",
+		"volumeid", volumeID,
+		"nodeid", nodeID,
+		"controller", name,
+	)
+	if err := spdk.ConstructVHostBlkController(ctx, client, spdk.ConstructVHostBlkControllerArgs{
+		Controller: name,
+		DevName:    exposedBDev(bdevs[0], volumeID),
+		ReadOnly:   readonly,
+	}); err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("Failed to create vhost-blk controller: %s", err))
+	}
+	return socket, nil
+}
+
+// unpublishVolume removes the vhost-blk controller for the volume and
+// node, or all controllers of the volume when the node is empty.
+func (l *localSPDK) unpublishVolume(ctx context.Context, volumeID, nodeID string) error {
+	// Connect to SPDK.
+	client, err := l.connect()
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	controllers, err := spdk.GetVHostControllers(ctx, client)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get vhost controllers from SPDK: %s", err))
+	}
+	for _, controller := range controllers {
+		blk, ok := controller.BackendSpecific["block"].(spdk.BlkControllerSpecific)
+		if !ok || (blk.BDevName != volumeID && blk.BDevName != cryptoBDevName(volumeID)) {
+			continue
+		}
+		if nodeID != "" && controller.Controller != vhostBlkController(volumeID, nodeID) {
+			continue
+		}
+		log.FromContext(ctx).Infow("removing vhost-blk controller",
+			"volumeid", volumeID,
+			"controller", controller.Controller,
+		)
+		if err := spdk.RemoveVHostController(ctx, client, spdk.RemoveVHostControllerArgs{
+			Controller: controller.Controller,
+		}); err != nil {
+			return status.Error(codes.Internal, fmt.Sprintf("Failed to remove vhost-blk controller: %s", err))
+		}
+	}
+	return nil
+}
+
 func (l *localSPDK) createDevice(ctx context.Context, volumeID string, request interface{}) (string, cleanup, error) {
 	// Connect to SPDK.
-	client, err := spdk.New(l.vhostEndpoint)
+	client, err := l.connect()
 	if err != nil {
 		return "", nil, errors.Wrap(err, "connect to SPDK")
 	}
-	defer client.Close()
+
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: volumeID})
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "get BDev %s", volumeID)
+	}
+	if len(bdevs) != 1 {
+		return "", nil, errors.Errorf("BDev %s not found", volumeID)
+	}
+	bdevName := exposedBDev(bdevs[0], volumeID)
 
 	// We might have already mapped that BDev to a NBD disk - check!
 	nbdDevice, err := findNBDDevice(ctx, client, volumeID)
@@ -176,7 +650,7 @@ func (l *localSPDK) createDevice(ctx context.Context, volumeID string, request i
 	}
 
 	args := spdk.StartNBDDiskArgs{
-		BDevName:  volumeID,
+		BDevName:  bdevName,
 		NBDDevice: nbdDevice,
 	}
 	if err := spdk.StartNBDDisk(ctx, client, args); err != nil {
@@ -187,11 +661,10 @@ func (l *localSPDK) createDevice(ctx context.Context, volumeID string, request i
 
 func (l *localSPDK) deleteDevice(ctx context.Context, volumeID string) error {
 	// Connect to SPDK.
-	client, err := spdk.New(l.vhostEndpoint)
+	client, err := l.connect()
 	if err != nil {
 		return errors.Wrap(err, "connect to SPDK")
 	}
-	defer client.Close()
 
 	// Stop NBD disk.
 	nbdDevice, err := findNBDDevice(ctx, client, volumeID)
@@ -211,9 +684,25 @@ func findNBDDevice(ctx context.Context, client *spdk.Client, volumeID string) (n
 		return "", errors.Wrap(err, "get NDB disks from SPDK")
 	}
 	for _, nbd := range nbdDisks {
-		if nbd.BDevName == volumeID {
+		if nbd.BDevName == volumeID || nbd.BDevName == cryptoBDevName(volumeID) {
 			return nbd.NBDDevice, nil
 		}
 	}
 	return "", nil
 }
+
+// findVHostController returns the name of a vhost-blk controller for
+// the volume, empty if it is not published.
+func findVHostController(ctx context.Context, client *spdk.Client, volumeID string) (string, error) {
+	controllers, err := spdk.GetVHostControllers(ctx, client)
+	if err != nil {
+		return "", errors.Wrap(err, "get vhost controllers from SPDK")
+	}
+	for _, controller := range controllers {
+		blk, ok := controller.BackendSpecific["block"].(spdk.BlkControllerSpecific)
+		if ok && (blk.BDevName == volumeID || blk.BDevName == cryptoBDevName(volumeID)) {
+			return controller.Controller, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,289 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// LockStore records which node has staged a volume, so that a volume
+// does not get attached to two nodes at once when the container
+// orchestrator calls NodeStageVolume on a new node before
+// NodeUnstageVolume on the old one. Volumes which are only read can
+// be attached to several nodes, they get locked in shared mode.
+type LockStore interface {
+	// Acquire records the owner as holder of the lock for the
+	// key. An exclusive lock fails with FailedPrecondition when a
+	// different owner holds the lock in any mode, a shared lock
+	// when a different owner holds it exclusively. Acquiring a
+	// lock again succeeds, but returns false.
+	Acquire(ctx context.Context, key, owner string, shared bool) (bool, error)
+
+	// Release removes the lock if it is held by the owner.
+	Release(ctx context.Context, key, owner string) error
+}
+
+// lockedError is the error for a lock that is held by others.
+func lockedError(key string, owners []string) error {
+	sort.Strings(owners)
+	return status.Error(codes.FailedPrecondition, fmt.Sprintf("%s is locked by %s", key, strings.Join(owners, ", ")))
+}
+
+// memLockStore is a LockStore which only works inside a single
+// process.
+type memLockStore struct {
+	mutex     sync.Mutex
+	exclusive map[string]string
+	shared    map[string]map[string]bool
+}
+
+// NewMemLockStore creates an in-memory LockStore.
+func NewMemLockStore() LockStore {
+	return &memLockStore{
+		exclusive: map[string]string{},
+		shared:    map[string]map[string]bool{},
+	}
+}
+
+func (m *memLockStore) Acquire(ctx context.Context, key, owner string, shared bool) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if current, ok := m.exclusive[key]; ok {
+		if current == owner {
+			return false, nil
+		}
+		return false, lockedError(key, []string{current})
+	}
+	owners := m.shared[key]
+	if !shared {
+		if len(owners) > 0 {
+			var current []string
+			for o := range owners {
+				current = append(current, o)
+			}
+			return false, lockedError(key, current)
+		}
+		m.exclusive[key] = owner
+		return true, nil
+	}
+	if owners[owner] {
+		return false, nil
+	}
+	if owners == nil {
+		owners = map[string]bool{}
+		m.shared[key] = owners
+	}
+	owners[owner] = true
+	return true, nil
+}
+
+func (m *memLockStore) Release(ctx context.Context, key, owner string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.exclusive[key] == owner {
+		delete(m.exclusive, key)
+	}
+	if owners := m.shared[key]; owners != nil {
+		delete(owners, owner)
+		if len(owners) == 0 {
+			delete(m.shared, key)
+		}
+	}
+	return nil
+}
+
+// etcdLockStore keeps the locks in etcd, so that they are shared by
+// the drivers on all nodes. An exclusive lock is the key
+// <prefix><key>/exclusive, a shared lock <prefix><key>/shared/<owner>.
+// The value is the owner. All keys are attached to a lease of the
+// store, so the locks of a node that is gone expire.
+type etcdLockStore struct {
+	client *clientv3.Client
+	prefix string
+	lease  clientv3.LeaseID
+}
+
+// NewEtcdLockStore creates a LockStore which stores the locks under
+// the prefix in etcd. The lease of the keys has the given TTL and is
+// kept alive until the context is done. Locks of the owner written
+// before, for example by the driver before a restart, are moved to
+// the new lease.
+//
+// The locks of a node which cannot be restarted within the TTL get
+// removed by etcd. Before that, they can be removed manually with
+// "etcdctl del --prefix <prefix><volume ID>/".
+func NewEtcdLockStore(ctx context.Context, client *clientv3.Client, prefix, owner string, ttl time.Duration) (LockStore, error) {
+	grant, err := client.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return nil, errors.Wrap(err, "grant etcd lease")
+	}
+	keepAlive, err := client.KeepAlive(ctx, grant.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "keep etcd lease alive")
+	}
+	go func() {
+		for range keepAlive {
+		}
+		if ctx.Err() == nil {
+			log.FromContext(ctx).Errorw("etcd lease of volume locks expired",
+				"lease", grant.ID,
+			)
+		}
+	}()
+	e := &etcdLockStore{client: client, prefix: prefix, lease: grant.ID}
+	if err := e.adopt(ctx, owner); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// adopt moves existing locks of the owner to the lease of the store.
+func (e *etcdLockStore) adopt(ctx context.Context, owner string) error {
+	response, err := e.client.Get(ctx, e.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return errors.Wrap(err, "list locks")
+	}
+	for _, kv := range response.Kvs {
+		if string(kv.Value) != owner || clientv3.LeaseID(kv.Lease) == e.lease {
+			continue
+		}
+		k := string(kv.Key)
+		// The lock might have been released in the meantime.
+		if _, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(k), "=", kv.ModRevision)).
+			Then(clientv3.OpPut(k, owner, clientv3.WithLease(e.lease))).
+			Commit(); err != nil {
+			return errors.Wrapf(err, "adopt lock %s", k)
+		}
+	}
+	return nil
+}
+
+func (e *etcdLockStore) keys(key, owner string) (exclusive, shared, sharedPrefix string) {
+	sharedPrefix = e.prefix + key + "/shared/"
+	return e.prefix + key + "/exclusive", sharedPrefix + owner, sharedPrefix
+}
+
+func (e *etcdLockStore) Acquire(ctx context.Context, key, owner string, shared bool) (bool, error) {
+	exclusiveKey, sharedKey, sharedPrefix := e.keys(key, owner)
+	free := []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(exclusiveKey), "=", 0)}
+	var put []clientv3.Op
+	if shared {
+		// The Get reports whether the lock was already held.
+		put = []clientv3.Op{clientv3.OpGet(sharedKey), clientv3.OpPut(sharedKey, owner, clientv3.WithLease(e.lease))}
+	} else {
+		free = append(free, clientv3.Compare(clientv3.CreateRevision(sharedPrefix).WithPrefix(), "=", 0))
+		put = []clientv3.Op{clientv3.OpPut(exclusiveKey, owner, clientv3.WithLease(e.lease))}
+	}
+	response, err := e.client.Txn(ctx).
+		If(free...).
+		Then(put...).
+		Else(clientv3.OpGet(exclusiveKey), clientv3.OpGet(sharedPrefix, clientv3.WithPrefix())).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if response.Succeeded {
+		if shared {
+			return len(response.Responses[0].GetResponseRange().Kvs) == 0, nil
+		}
+		return true, nil
+	}
+	var owners []string
+	for _, r := range response.Responses {
+		for _, kv := range r.GetResponseRange().Kvs {
+			owners = append(owners, string(kv.Value))
+		}
+	}
+	// The exclusive lock, if there is one, comes first.
+	if len(owners) == 1 && owners[0] == owner && len(response.Responses[0].GetResponseRange().Kvs) == 1 {
+		return false, nil
+	}
+	return false, lockedError(key, owners)
+}
+
+func (e *etcdLockStore) Release(ctx context.Context, key, owner string) error {
+	exclusiveKey, sharedKey, _ := e.keys(key, owner)
+	_, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(exclusiveKey), "=", owner)).
+		Then(clientv3.OpDelete(exclusiveKey), clientv3.OpDelete(sharedKey)).
+		Else(clientv3.OpDelete(sharedKey)).
+		Commit()
+	return err
+}
+
+// volumeLock is the lock of the node on a volume while staging it.
+type volumeLock struct {
+	od       *oimDriver
+	volumeID string
+	acquired bool
+	attached bool
+}
+
+// acquireVolume locks the volume for the node of the driver. The lock
+// is shared for modes in which other nodes may read the volume at the
+// same time. A new lock gets released again by done when staging
+// fails before the volume got attached to the node.
+func (od *oimDriver) acquireVolume(ctx context.Context, volumeID string, mode csi.VolumeCapability_AccessMode_Mode) (*volumeLock, error) {
+	lock := &volumeLock{od: od, volumeID: volumeID}
+	if od.lockStore == nil {
+		return lock, nil
+	}
+	acquired, err := od.lockStore.Acquire(ctx, volumeID, od.nodeID, od.accessModes[mode].readOnly)
+	if err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is staged on another node: %s", volumeID, status.Convert(err).Message()))
+		}
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("lock volume %s: %s", volumeID, err))
+	}
+	lock.acquired = acquired
+	return lock, nil
+}
+
+// attach records that the device of the volume exists on the node.
+// From then on the lock is kept even when staging fails, because
+// only NodeUnstageVolume removes the device again.
+func (l *volumeLock) attach() {
+	l.attached = true
+}
+
+// done must be called with the result of staging.
+func (l *volumeLock) done(ctx context.Context, err error) {
+	if err == nil || !l.acquired || l.attached {
+		return
+	}
+	if err := l.od.lockStore.Release(ctx, l.volumeID, l.od.nodeID); err != nil {
+		log.FromContext(ctx).Errorw("unlocking volume after failed staging",
+			"volumeid", l.volumeID,
+			"error", err,
+		)
+	}
+}
+
+// releaseVolume removes the lock of the node on the volume.
+func (od *oimDriver) releaseVolume(ctx context.Context, volumeID string) error {
+	if od.lockStore == nil {
+		return nil
+	}
+	if err := od.lockStore.Release(ctx, volumeID, od.nodeID); err != nil {
+		return status.Error(codes.Unavailable, fmt.Sprintf("unlock volume %s: %s", volumeID, err))
+	}
+	return nil
+}
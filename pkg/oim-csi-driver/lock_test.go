@@ -0,0 +1,170 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestMemLockStore(t *testing.T) {
+	testLockStore(t, NewMemLockStore())
+}
+
+// TestEtcdLockStore needs an etcd server whose client URLs are in
+// TEST_ETCD_ENDPOINTS.
+func TestEtcdLockStore(t *testing.T) {
+	endpoints := os.Getenv("TEST_ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("No etcd.")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	prefix := fmt.Sprintf("/oim-test/%d/", time.Now().UnixNano())
+	defer client.Delete(context.Background(), prefix, clientv3.WithPrefix())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, err := NewEtcdLockStore(ctx, client, prefix, "node-1", 10*time.Second)
+	require.NoError(t, err)
+	testLockStore(t, store)
+
+	// A restarted driver takes over the locks of its node.
+	_, err = store.Acquire(ctx, "other-vol", "node-1", false)
+	require.NoError(t, err)
+	restarted, err := NewEtcdLockStore(ctx, client, prefix, "node-1", 10*time.Second)
+	require.NoError(t, err)
+	_, err = client.Revoke(ctx, store.(*etcdLockStore).lease)
+	require.NoError(t, err)
+	acquired, err := restarted.Acquire(ctx, "other-vol", "node-1", false)
+	require.NoError(t, err)
+	assert.False(t, acquired, "lock adopted")
+	acquired, err = restarted.Acquire(ctx, "vol", "node-1", false)
+	require.NoError(t, err)
+	assert.True(t, acquired, "lock of node-2 expired with the lease")
+}
+
+func testLockStore(t *testing.T, store LockStore) {
+	ctx := context.Background()
+
+	acquired, err := store.Acquire(ctx, "vol", "node-1", false)
+	require.NoError(t, err)
+	assert.True(t, acquired, "new lock")
+	acquired, err = store.Acquire(ctx, "vol", "node-1", false)
+	require.NoError(t, err)
+	assert.False(t, acquired, "same owner")
+	_, err = store.Acquire(ctx, "vol", "node-2", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "other owner: %v", err)
+
+	require.NoError(t, store.Release(ctx, "vol", "node-2"))
+	_, err = store.Acquire(ctx, "vol", "node-2", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "only the owner can release: %v", err)
+	require.NoError(t, store.Release(ctx, "vol", "node-1"))
+	acquired, err = store.Acquire(ctx, "vol", "node-2", false)
+	require.NoError(t, err)
+	assert.True(t, acquired, "released")
+
+	// Readers share the lock, but exclude writers.
+	acquired, err = store.Acquire(ctx, "ro", "node-1", true)
+	require.NoError(t, err)
+	assert.True(t, acquired, "new shared lock")
+	acquired, err = store.Acquire(ctx, "ro", "node-1", true)
+	require.NoError(t, err)
+	assert.False(t, acquired, "same reader")
+	acquired, err = store.Acquire(ctx, "ro", "node-2", true)
+	require.NoError(t, err)
+	assert.True(t, acquired, "second reader")
+	_, err = store.Acquire(ctx, "ro", "node-3", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "writer while read: %v", err)
+	require.NoError(t, store.Release(ctx, "ro", "node-1"))
+	_, err = store.Acquire(ctx, "ro", "node-3", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "writer while still read: %v", err)
+	require.NoError(t, store.Release(ctx, "ro", "node-2"))
+	acquired, err = store.Acquire(ctx, "ro", "node-3", false)
+	require.NoError(t, err)
+	assert.True(t, acquired, "writer after readers")
+	_, err = store.Acquire(ctx, "ro", "node-1", true)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "reader while written: %v", err)
+}
+
+func TestNodeStageLock(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	store := NewMemLockStore()
+	tmp, err := ioutil.TempDir("", "lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	// Not a block device, so staging fails after connecting it.
+	notBlock := filepath.Join(tmp, "not-block")
+	require.NoError(t, ioutil.WriteFile(notBlock, nil, 0600))
+	nvme := &fakeNVMeExecutor{device: notBlock}
+	od, fake, _ := newFakeDriver(t, WithNodeID("node-2"), WithLockStore(store), WithNVMeExecutor(nvme))
+	defer fake.Close()
+
+	stageWithContext := func(volumeContext map[string]string) error {
+		_, err := od.oimDriver.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol",
+			StagingTargetPath: filepath.Join(tmp, "staging"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+			VolumeContext: volumeContext,
+		})
+		return err
+	}
+	stage := func() error {
+		return stageWithContext(nil)
+	}
+
+	_, err = store.Acquire(ctx, "vol", "node-1", false)
+	require.NoError(t, err)
+	err = stage()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "staged on node-1: %v", err)
+
+	// The volume does not exist, so staging on node-2 fails and
+	// must not keep the lock.
+	require.NoError(t, store.Release(ctx, "vol", "node-1"))
+	err = stage()
+	require.Error(t, err)
+	assert.NotEqual(t, codes.FailedPrecondition, status.Code(err), "not locked: %v", err)
+	acquired, err := store.Acquire(ctx, "vol", "node-1", false)
+	require.NoError(t, err)
+	assert.True(t, acquired, "lock released after failed staging")
+
+	// Once the device exists on node-2, the lock is kept until
+	// NodeUnstageVolume removes it.
+	require.NoError(t, store.Release(ctx, "vol", "node-1"))
+	err = stageWithContext(map[string]string{
+		transportContextKey: nvmeofTransport,
+		nqnContextKey:       "nqn.2016-06.io.spdk:cnode1",
+		traddrContextKey:    "192.168.0.1",
+		trsvcidContextKey:   "4420",
+	})
+	require.Error(t, err)
+	assert.Len(t, nvme.calls, 1, "connected")
+	_, err = store.Acquire(ctx, "vol", "node-1", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "lock kept after attaching: %v", err)
+}
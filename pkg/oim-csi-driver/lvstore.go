@@ -0,0 +1,106 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// lvstoreCache remembers the logical volume stores reported by SPDK
+// for a limited time. Free space in the cached stores may be
+// outdated by up to that time.
+type lvstoreCache struct {
+	ttl      time.Duration
+	mutex    sync.Mutex
+	lvstores []spdk.LVStore
+	expires  time.Time
+}
+
+// get returns the cached stores or queries SPDK once they have
+// expired. A zero TTL disables caching.
+func (c *lvstoreCache) get(ctx context.Context, client *spdk.Client) ([]spdk.LVStore, error) {
+	c.mutex.Lock()
+	if c.ttl > 0 && time.Now().Before(c.expires) {
+		lvstores := append([]spdk.LVStore(nil), c.lvstores...)
+		c.mutex.Unlock()
+		return lvstores, nil
+	}
+	c.mutex.Unlock()
+
+	// Not locked while waiting for SPDK, concurrent calls may
+	// query it in parallel.
+	lvstores, err := spdk.GetLVStores(ctx, client, spdk.GetLVStoresArgs{})
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get logical volume stores from SPDK: %s", err))
+	}
+	if c.ttl > 0 {
+		c.mutex.Lock()
+		c.lvstores = append([]spdk.LVStore(nil), lvstores...)
+		c.expires = time.Now().Add(c.ttl)
+		c.mutex.Unlock()
+	}
+	return lvstores, nil
+}
+
+// selectLVStore picks the logical volume store for a new volume when
+// lvstoreParameter is not set. With a single store, that one is
+// used, as before. Among several stores, the one with the most free
+// space that can hold the required bytes gets selected, unless one
+// of them already has a volume with that name. Without any stores,
+// it returns nil.
+func (l *localSPDK) selectLVStore(ctx context.Context, client *spdk.Client, name string, requiredBytes int64) (*spdk.LVStore, error) {
+	lvstores, err := l.lvstores.get(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	switch len(lvstores) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &lvstores[0], nil
+	}
+
+	// A retry must find the volume created earlier, even if
+	// some other store has more free space by now.
+	for i := range lvstores {
+		existing, err := getLVol(ctx, client, lvstores[i].Name+"/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return &lvstores[i], nil
+		}
+	}
+
+	var selected *spdk.LVStore
+	for i := range lvstores {
+		lvs := &lvstores[i]
+		if lvs.FreeBytes() < requiredBytes {
+			continue
+		}
+		if selected == nil || lvs.FreeBytes() > selected.FreeBytes() {
+			selected = lvs
+		}
+	}
+	if selected == nil {
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("none of the %d logical volume stores has %d free bytes", len(lvstores), requiredBytes))
+	}
+	log.FromContext(ctx).Debugw("selected logical volume store",
+		"lvstore", selected.Name,
+		"free", selected.FreeBytes(),
+	)
+	return selected, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestSelectLVStore(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	for name, tc := range map[string]struct {
+		free     []int64
+		required int64
+		code     codes.Code
+		uuid     string
+	}{
+		"single":        {[]int64{10}, mib, codes.OK, "lvs0-uuid"},
+		"single-full":   {[]int64{0}, mib, codes.OutOfRange, ""},
+		"multiple":      {[]int64{10, 30, 20}, mib, codes.OK, "lvs1-uuid"},
+		"one-qualifies": {[]int64{10, 2, 5}, 8 * mib, codes.OK, "lvs0-uuid"},
+		"none":          {[]int64{1, 2}, 3 * mib, codes.ResourceExhausted, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake, err := testspdk.NewFake()
+			require.NoError(t, err)
+			defer fake.Close()
+			newFakeLVols(fake)
+			var lvstores []spdk.LVStore
+			for i, free := range tc.free {
+				name := fmt.Sprintf("lvs%d", i)
+				lvstores = append(lvstores, spdk.LVStore{UUID: name + "-uuid", Name: name, TotalDataClusters: 100, FreeClusters: free, BlockSize: 512, ClusterSize: mib})
+			}
+			fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+				return lvstores, nil
+			})
+			driver, err := New(WithVHostEndpoint(fake.Path))
+			require.NoError(t, err)
+			od := &driver.(*oimDriver03).oimDriver
+
+			response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:          "vol",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: tc.required},
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+			})
+			require.Equal(t, tc.code, status.Code(err), "%v", err)
+			assert.Equal(t, tc.uuid, response.GetVolume().GetVolumeContext()[lvstoreUUIDContextKey])
+		})
+	}
+}
+
+func TestSelectLVStoreRetry(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	lvstores := []spdk.LVStore{
+		{UUID: "lvs0-uuid", Name: "lvs0", TotalDataClusters: 100, FreeClusters: 10, BlockSize: 512, ClusterSize: mib},
+		{UUID: "lvs1-uuid", Name: "lvs1", TotalDataClusters: 100, FreeClusters: 20, BlockSize: 512, ClusterSize: mib},
+	}
+	lvstoreCalls := 0
+	fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+		lvstoreCalls++
+		return lvstores, nil
+	})
+	// Volumes get the name of their store as prefix.
+	fake.Handle("bdev_lvol_create", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.CreateLVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.create(args.LVolName, args.Size)
+		lvol.Aliases[0] = strings.TrimSuffix(args.UUID, "-uuid") + "/" + args.LVolName
+		return lvol.UUID, nil
+	})
+	driver, err := New(WithVHostEndpoint(fake.Path), WithLVStoreCacheTTL(time.Hour))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	create := func(name string) string {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		require.NoError(t, err, name)
+		return response.GetVolume().GetVolumeContext()[lvstoreUUIDContextKey]
+	}
+
+	assert.Equal(t, "lvs1-uuid", create("vol"))
+	require.NotNil(t, fl.find("lvs1/vol"), "volume created")
+
+	// Once lvs0 has more free space, the existing volume is still
+	// found. Forgetting about it simulates a restart of the driver.
+	lvstores[0].FreeClusters = 50
+	od.local.lvstores.expires = time.Time{}
+	od.created.forget(fl.find("lvs1/vol").UUID)
+	assert.Equal(t, "lvs1-uuid", create("vol"), "retry")
+	assert.Nil(t, fl.find("lvs0/vol"), "no second volume")
+	assert.Equal(t, "lvs0-uuid", create("other"), "new volume")
+	assert.Equal(t, 2, lvstoreCalls, "cached")
+}
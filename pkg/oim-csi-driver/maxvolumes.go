@@ -0,0 +1,63 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// availableVolumes returns how many more volumes may get attached to
+// the node: the configured maximum minus the vhost controllers whose
+// sockets exist already. Zero means "unlimited" in NodeGetInfo, so
+// at least one is reported while the limit is enabled.
+func (od *oimDriver) availableVolumes(ctx context.Context) int64 {
+	if od.maxVolumesPerNode == 0 {
+		return 0
+	}
+	if !od.local.enabled() {
+		return od.maxVolumesPerNode
+	}
+	dir := od.local.socketDir()
+	existing, err := countSockets(dir)
+	if err != nil {
+		log.FromContext(ctx).Warnw("counting vhost sockets failed",
+			"dir", dir,
+			"error", err,
+		)
+		return od.maxVolumesPerNode
+	}
+	available := od.maxVolumesPerNode - int64(existing)
+	if available < 1 {
+		log.FromContext(ctx).Warnw("more vhost controllers than allowed per node",
+			"dir", dir,
+			"controllers", existing,
+			"max", od.maxVolumesPerNode,
+		)
+		available = 1
+	}
+	return available
+}
+
+// countSockets returns the number of Unix domain sockets in the
+// directory. Each vhost controller has one.
+func countSockets(dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	sockets := 0
+	for _, file := range files {
+		if file.Mode()&os.ModeSocket != 0 {
+			sockets++
+		}
+	}
+	return sockets, nil
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestMaxVolumesPerNode(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "vhost")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	// Not a socket, ignored.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "spdk.pid"), nil, 0600))
+
+	maxVolumes := func(options ...Option) int64 {
+		od, fake, _ := newFakeDriver(t, append([]Option{WithVHostSocketDir(tmp)}, options...)...)
+		defer fake.Close()
+		info, err := od.oimDriver.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+		require.NoError(t, err)
+		return info.GetMaxVolumesPerNode()
+	}
+
+	assert.Equal(t, int64(0), maxVolumes(), "unlimited")
+	assert.Equal(t, int64(5), maxVolumes(WithMaxVolumesPerNode(5)), "no sockets")
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("unix", filepath.Join(tmp, fmt.Sprintf("oim-blk-%d", i)))
+		require.NoError(t, err)
+		defer listener.Close()
+	}
+	assert.Equal(t, int64(2), maxVolumes(WithMaxVolumesPerNode(5)), "three sockets")
+	assert.Equal(t, int64(1), maxVolumes(WithMaxVolumesPerNode(3)), "limit reached")
+	assert.Equal(t, int64(0), maxVolumes(), "still unlimited")
+}
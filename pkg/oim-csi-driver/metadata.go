@@ -0,0 +1,321 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// DefaultMetadataFile is where the oim-csi-driver command keeps the
+// metadata across restarts unless configured otherwise.
+const DefaultMetadataFile = "/var/lib/oim-csi/metadata.json"
+
+// VolumeMetadata is additional information about a volume that
+// is tracked by the driver itself because the storage backend has
+// no place for it.
+type VolumeMetadata struct {
+	// Name is the name from the CreateVolume request, or the
+	// one given later by RenameVolume.
+	Name string `json:"name,omitempty"`
+
+	// Benchmark is the result of the benchmark that ran when
+	// staging the volume, if requested.
+	Benchmark *BenchmarkResult `json:"benchmark,omitempty"`
+
+	// Labels are copied from the PVC labels with the oim.io/tag/
+	// prefix by the VolumeTagPropagator.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// StorageClassRevision identifies the parameters that the
+	// volume was created with, see parametersRevision.
+	StorageClassRevision string `json:"storage_class_revision,omitempty"`
+
+	// Claim is the PVC that the volume was created for, if
+	// known.
+	Claim *ClaimReference `json:"claim,omitempty"`
+
+	// SizeBytes is the capacity allocated by CreateVolume.
+	SizeBytes int64 `json:"size_bytes,omitempty"`
+
+	// Tenant owns the volume when it was created with token
+	// authentication, see TokenAuthInterceptor.
+	Tenant string `json:"tenant,omitempty"`
+
+	// ControllerID is set when MigrateVolume moved the volume
+	// away from the OIM controller in its volume ID.
+	ControllerID string `json:"controller_id,omitempty"`
+}
+
+// SnapshotMetadata is what the driver knows about a snapshot that
+// it created.
+type SnapshotMetadata struct {
+	// Name is the name from the CreateSnapshot request.
+	Name string `json:"name"`
+
+	// SourceVolumeID and SourceUUID identify the volume that the
+	// snapshot was taken of.
+	SourceVolumeID string `json:"source_volume_id"`
+	SourceUUID     string `json:"source_uuid"`
+
+	SizeBytes    int64     `json:"size_bytes"`
+	CreationTime time.Time `json:"creation_time"`
+
+	// ExpiryUnixSeconds is set when the snapshot was created with
+	// the retainFor parameter. The SnapshotGarbageCollector deletes
+	// the snapshot after that time.
+	ExpiryUnixSeconds int64 `json:"expiry_unix_seconds,omitempty"`
+
+	// Tenant owns the snapshot when it was created with token
+	// authentication.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// metadataStore holds the VolumeMetadata of all volumes, indexed by
+// volume ID, and the SnapshotMetadata of all snapshots, indexed by
+// snapshot ID. When it has a file, each modification gets written
+// to it, otherwise the metadata is lost when the driver restarts.
+type metadataStore struct {
+	mutex     sync.Mutex
+	volumes   map[string]VolumeMetadata
+	snapshots map[string]SnapshotMetadata
+	file      string
+	// shared is true when the drivers on other nodes use the
+	// same file. Then it gets read again whenever it was
+	// modified by someone else.
+	shared  bool
+	modTime time.Time
+}
+
+// metadataFileContent is the JSON representation of a metadataStore.
+type metadataFileContent struct {
+	Volumes   map[string]VolumeMetadata   `json:"volumes"`
+	Snapshots map[string]SnapshotMetadata `json:"snapshots"`
+}
+
+func newMetadataStore() *metadataStore {
+	return &metadataStore{
+		volumes:   map[string]VolumeMetadata{},
+		snapshots: map[string]SnapshotMetadata{},
+	}
+}
+
+// loadMetadataStore restores the metadata written by a previous
+// instance of the driver. A missing file is not an error, it gets
+// created by the first modification.
+func loadMetadataStore(file string) (*metadataStore, error) {
+	ms := newMetadataStore()
+	ms.file = file
+	if err := ms.read(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// read replaces the content with the one from the file.
+func (ms *metadataStore) read() error {
+	info, err := os.Stat(ms.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read metadata")
+	}
+	data, err := ioutil.ReadFile(ms.file) // nolint: gosec
+	if err != nil {
+		return errors.Wrap(err, "read metadata")
+	}
+	var content metadataFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return errors.Wrapf(err, "parse metadata file %s", ms.file)
+	}
+	ms.volumes = map[string]VolumeMetadata{}
+	for volumeID, metadata := range content.Volumes {
+		ms.volumes[volumeID] = metadata
+	}
+	ms.snapshots = map[string]SnapshotMetadata{}
+	for snapshotID, metadata := range content.Snapshots {
+		ms.snapshots[snapshotID] = metadata
+	}
+	ms.modTime = info.ModTime()
+	return nil
+}
+
+// refresh reads a shared file again if it was modified since it was
+// last read or written. The caller must hold the mutex.
+func (ms *metadataStore) refresh() {
+	if !ms.shared {
+		return
+	}
+	info, err := os.Stat(ms.file)
+	if err != nil || info.ModTime().Equal(ms.modTime) {
+		return
+	}
+	if err := ms.read(); err != nil {
+		log.L().Errorw("reloading shared metadata", "file", ms.file, "error", err)
+	}
+}
+
+// save writes the metadata to the file, if there is one. The new
+// content replaces the old file atomically, so a crash in the middle
+// leaves the previous state. The caller must hold the mutex.
+func (ms *metadataStore) save() {
+	if ms.file == "" {
+		return
+	}
+	if err := ms.write(); err != nil {
+		// The in-memory state is still correct, only a
+		// restart would lose the modification.
+		log.L().Errorw("saving metadata", "file", ms.file, "error", err)
+	}
+}
+
+func (ms *metadataStore) write() error {
+	data, err := json.Marshal(metadataFileContent{Volumes: ms.volumes, Snapshots: ms.snapshots})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(ms.file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(ms.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), ms.file); err != nil {
+		return err
+	}
+	if info, err := os.Stat(ms.file); err == nil {
+		ms.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// get returns a copy of the metadata and whether there was any.
+func (ms *metadataStore) get(volumeID string) (VolumeMetadata, bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	metadata, ok := ms.volumes[volumeID]
+	return metadata, ok
+}
+
+// update modifies the metadata of a volume in place. Metadata gets
+// created if it does not exist yet.
+func (ms *metadataStore) update(volumeID string, modify func(metadata *VolumeMetadata)) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	metadata := ms.volumes[volumeID]
+	modify(&metadata)
+	ms.volumes[volumeID] = metadata
+	ms.save()
+}
+
+// updateDurably is like update, but fails without modifying anything
+// when the metadata cannot be written to the file.
+func (ms *metadataStore) updateDurably(volumeID string, modify func(metadata *VolumeMetadata)) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	old, ok := ms.volumes[volumeID]
+	metadata := old
+	modify(&metadata)
+	ms.volumes[volumeID] = metadata
+	if ms.file == "" {
+		return errors.New("no metadata file")
+	}
+	if err := ms.write(); err != nil {
+		if ok {
+			ms.volumes[volumeID] = old
+		} else {
+			delete(ms.volumes, volumeID)
+		}
+		return errors.Wrap(err, "write metadata")
+	}
+	return nil
+}
+
+func (ms *metadataStore) delete(volumeID string) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	delete(ms.volumes, volumeID)
+	ms.save()
+}
+
+func (ms *metadataStore) getSnapshot(snapshotID string) (SnapshotMetadata, bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	metadata, ok := ms.snapshots[snapshotID]
+	return metadata, ok
+}
+
+func (ms *metadataStore) setSnapshot(snapshotID string, metadata SnapshotMetadata) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	ms.snapshots[snapshotID] = metadata
+	ms.save()
+}
+
+func (ms *metadataStore) deleteSnapshot(snapshotID string) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	delete(ms.snapshots, snapshotID)
+	ms.save()
+}
+
+// listSnapshots returns a copy of all snapshot metadata.
+func (ms *metadataStore) listSnapshots() map[string]SnapshotMetadata {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	snapshots := make(map[string]SnapshotMetadata, len(ms.snapshots))
+	for id, metadata := range ms.snapshots {
+		snapshots[id] = metadata
+	}
+	return snapshots
+}
+
+// namespaceUsage returns the total capacity of all volumes created
+// for PVCs in the namespace.
+func (ms *metadataStore) namespaceUsage(namespace string) int64 {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.refresh()
+	var used int64
+	for _, metadata := range ms.volumes {
+		if metadata.Claim != nil && metadata.Claim.Namespace == namespace {
+			used += metadata.SizeBytes
+		}
+	}
+	return used
+}
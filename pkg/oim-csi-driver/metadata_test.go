@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestMetadataStorePersistence(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	tmp, err := ioutil.TempDir("", "metadata")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "oim-csi", "metadata.json")
+
+	ms, err := loadMetadataStore(file)
+	require.NoError(t, err, "missing file")
+	ms.update("vol-1", func(metadata *VolumeMetadata) {
+		metadata.Labels = map[string]string{"app": "db"}
+	})
+	ms.update("vol-2", func(metadata *VolumeMetadata) {
+		metadata.StorageClassRevision = "abc"
+	})
+	ms.delete("vol-2")
+	snapshot := SnapshotMetadata{
+		Name:           "snap",
+		SourceVolumeID: "vol-1",
+		SourceUUID:     "uuid-1",
+		SizeBytes:      mib,
+		CreationTime:   time.Unix(1000, 0).UTC(),
+	}
+	ms.setSnapshot("snap-1", snapshot)
+	ms.setSnapshot("snap-2", snapshot)
+	ms.deleteSnapshot("snap-2")
+
+	// Restart.
+	restored, err := loadMetadataStore(file)
+	require.NoError(t, err, "restore")
+	metadata, ok := restored.get("vol-1")
+	assert.True(t, ok, "vol-1")
+	assert.Equal(t, map[string]string{"app": "db"}, metadata.Labels)
+	_, ok = restored.get("vol-2")
+	assert.False(t, ok, "vol-2 deleted")
+	assert.Equal(t, map[string]SnapshotMetadata{"snap-1": snapshot}, restored.listSnapshots())
+
+	// Modifications get written to the same file.
+	restored.delete("vol-1")
+	restored, err = loadMetadataStore(file)
+	require.NoError(t, err, "restore again")
+	_, ok = restored.get("vol-1")
+	assert.False(t, ok, "vol-1 deleted")
+
+	// Only the file itself remains, temporary files get renamed.
+	files, err := filepath.Glob(filepath.Join(tmp, "oim-csi", "*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{file}, files)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("{"), 0600))
+	_, err = loadMetadataStore(file)
+	assert.Error(t, err, "corrupted file")
+}
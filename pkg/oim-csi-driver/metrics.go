@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics records how long CSI operations take and how often they
+// fail. Each driver instance has its own registry, so several
+// drivers can coexist in the same process (as in tests).
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	panics   prometheus.Counter
+}
+
+// NewMetrics creates and registers all metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "oim",
+				Subsystem: "csi",
+				Name:      "operation_duration_seconds",
+				Help:      "Duration of CSI operations.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"operation", "backend"},
+		),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "oim",
+				Subsystem: "csi",
+				Name:      "operation_errors_total",
+				Help:      "Number of failed CSI operations.",
+			},
+			[]string{"operation", "grpc_code"},
+		),
+		panics: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "oim",
+				Subsystem: "csi",
+				Name:      "panics_total",
+				Help:      "Number of CSI calls which panicked.",
+			},
+		),
+	}
+	m.Registry.MustRegister(m.duration, m.errors, m.panics)
+	return m
+}
+
+// observe records one operation which started at the given time.
+func (m *Metrics) observe(operation, backend string, start time.Time, err error) {
+	m.duration.WithLabelValues(operation, backend).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(operation, status.Code(err).String()).Inc()
+	}
+}
+
+// ServeHTTP implements http.Handler by writing all metrics in the
+// format requested by the client.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	families, err := m.Registry.Gather()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	format := expfmt.Negotiate(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	encoder := expfmt.NewEncoder(w, format)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			// Too late for an error response, the header was sent.
+			return
+		}
+	}
+}
+
+// observe is meant to be deferred at the start of each CSI operation,
+// with a pointer to its named error result.
+func (od *oimDriver) observe(operation string, start time.Time, err *error) {
+	backend := "remote"
+	switch {
+	case od.dryRun != nil:
+		backend = "dry-run"
+	case od.local.enabled():
+		backend = "local"
+	}
+	od.metrics.observe(operation, backend, start, *err)
+}
+
+// ServeMetrics serves the metrics of the driver under /metrics on the
+// given address. It only returns when serving fails.
+func (od *oimDriver) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", od.metrics)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestMetrics(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, _ := newFakeDriver(t)
+	defer fake.Close()
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	_, err := od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol-0",
+		VolumeCapabilities: capabilities,
+	})
+	require.NoError(t, err)
+	_, err = od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		VolumeCapabilities: capabilities,
+	})
+	require.Error(t, err, "name missing")
+
+	server := httptest.NewServer(od.metrics)
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(response.Body)
+	require.NoError(t, err)
+
+	duration := families["oim_csi_operation_duration_seconds"]
+	require.NotNil(t, duration, "duration histogram")
+	require.Len(t, duration.GetMetric(), 1)
+	metric := duration.GetMetric()[0]
+	labels := map[string]string{}
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	assert.Equal(t, map[string]string{"operation": "CreateVolume", "backend": "local"}, labels)
+	assert.Equal(t, uint64(2), metric.GetHistogram().GetSampleCount())
+
+	errors := families["oim_csi_operation_errors_total"]
+	require.NotNil(t, errors, "error counter")
+	require.Len(t, errors.GetMetric(), 1)
+	assert.Equal(t, 1.0, errors.GetMetric()[0].GetCounter().GetValue())
+	for _, label := range errors.GetMetric()[0].GetLabel() {
+		if label.GetName() == "grpc_code" {
+			assert.Equal(t, "InvalidArgument", label.GetValue())
+		}
+	}
+}
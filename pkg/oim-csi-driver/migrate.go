@@ -0,0 +1,232 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// MigrateVolume is not part of CSI. It is provided as an additional
+// gRPC service with JSON encoding, like VolumeRename, for moving the
+// volumes of an OIM controller that gets decommissioned.
+const volumeMigrationService = "oim.csi.v1.VolumeMigration"
+
+// VolumeReplicator moves the content of volumes between OIM
+// controllers. The OIM controller API has no calls for quiescing,
+// copying or checksumming a BDev, therefore MigrateVolume depends on
+// an implementation provided by the deployment, for example one which
+// clones logical volumes over a dedicated replication stream.
+type VolumeReplicator interface {
+	// Quiesce blocks I/O of the BDev on the controller until
+	// resume gets called.
+	Quiesce(ctx context.Context, controllerID, bdevName string) (resume func(), err error)
+	// Replicate copies the content of the BDev from the source
+	// to the destination, which already has a BDev of the same
+	// name and size.
+	Replicate(ctx context.Context, sourceControllerID, destControllerID, bdevName string) error
+	// Checksum returns a checksum of the BDev content.
+	Checksum(ctx context.Context, controllerID, bdevName string) (string, error)
+}
+
+// MigrateVolumeRequest is the request for MigrateVolume via gRPC.
+type MigrateVolumeRequest struct {
+	VolumeID           string `json:"volume_id"`
+	SourceControllerID string `json:"source_controller_id"`
+	DestControllerID   string `json:"dest_controller_id"`
+	DryRun             bool   `json:"dry_run,omitempty"`
+}
+
+// MigrateVolumeReply lists the steps of MigrateVolume.
+type MigrateVolumeReply struct {
+	Steps []string `json:"steps"`
+}
+
+// migrationOwner is the owner of the volume lock while a volume gets
+// migrated. Node IDs are never empty, so this cannot clash with a
+// node.
+const migrationOwner = "migration"
+
+// MigrateVolume moves a volume from one OIM controller to another.
+// The volume ID stays the same, the volume metadata records the new
+// controller. Node drivers find the volume through that metadata,
+// therefore the metadata file must be shared with them and the
+// volume must not be staged anywhere, as recorded by the LockStore.
+// In dry-run mode, only the steps are returned. Only supported when
+// using a OIM registry and a VolumeReplicator.
+func (od *oimDriver) MigrateVolume(ctx context.Context, volumeID, sourceControllerID, destControllerID string, dryRun bool) ([]string, error) {
+	switch {
+	case volumeID == "":
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
+	case sourceControllerID == "" || destControllerID == "":
+		return nil, status.Error(codes.InvalidArgument, "source and destination controller required")
+	case sourceControllerID == destControllerID:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s already on controller %s", volumeID, destControllerID))
+	case od.backend != &od.remote:
+		return nil, status.Error(codes.Unimplemented, "migrating volumes is only supported with a OIM registry")
+	case od.replicator == nil:
+		return nil, status.Error(codes.FailedPrecondition, "no volume replicator configured")
+	case od.metadata.file == "" || !od.metadata.shared:
+		return nil, status.Error(codes.FailedPrecondition, "migrating volumes requires a metadata file shared with all nodes")
+	case od.lockStore == nil:
+		return nil, status.Error(codes.FailedPrecondition, "migrating volumes requires a lock store shared with all nodes")
+	}
+	if err := od.checkVolumeTenant(ctx, volumeID); err != nil {
+		return nil, err
+	}
+
+	// Serialize operations per volume by ID. The ID does not
+	// change when the volume moves to another controller.
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	r := &od.remote
+	controllerID, name := r.splitVolumeID(volumeID)
+	if controllerID != sourceControllerID {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is on controller %s, not %s", volumeID, controllerID, sourceControllerID))
+	}
+	metadata, _ := od.metadata.get(volumeID)
+	if metadata.SizeBytes == 0 {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("size of volume %s unknown", volumeID))
+	}
+	steps := []string{
+		fmt.Sprintf("lock volume %s", volumeID),
+		fmt.Sprintf("quiesce I/O of %s on %s", name, sourceControllerID),
+		fmt.Sprintf("provision %d bytes for %s on %s", metadata.SizeBytes, name, destControllerID),
+		fmt.Sprintf("replicate %s from %s to %s", name, sourceControllerID, destControllerID),
+		fmt.Sprintf("compare checksums of %s", name),
+		fmt.Sprintf("record %s as location of volume %s", destControllerID, volumeID),
+		fmt.Sprintf("delete %s on %s", name, sourceControllerID),
+		fmt.Sprintf("unlock volume %s", volumeID),
+	}
+	log.FromContext(ctx).Infow("migrating volume",
+		"volumeid", volumeID,
+		"source", sourceControllerID,
+		"destination", destControllerID,
+		"dryrun", dryRun,
+	)
+	if dryRun {
+		return steps, nil
+	}
+
+	// Holding the lock ensures that the volume is not staged and
+	// does not get staged while it moves.
+	if _, err := od.lockStore.Acquire(ctx, volumeID, migrationOwner, false); err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is in use: %s", volumeID, status.Convert(err).Message()))
+		}
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("lock volume %s: %s", volumeID, err))
+	}
+	defer func() {
+		if err := od.lockStore.Release(ctx, volumeID, migrationOwner); err != nil {
+			log.FromContext(ctx).Errorw("unlocking migrated volume",
+				"volumeid", volumeID,
+				"error", err,
+			)
+		}
+	}()
+
+	resume, err := od.replicator.Quiesce(ctx, sourceControllerID, name)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("quiesce %s on %s: %s", name, sourceControllerID, err))
+	}
+	defer resume()
+	if err := r.provision(ctx, destControllerID, name, metadata.SizeBytes); err != nil {
+		return nil, err
+	}
+	fail := func(code codes.Code, message string) error {
+		r.rollback(ctx, "ProvisionMallocBDev", func(ctx context.Context) error {
+			return r.provision(ctx, destControllerID, name, 0)
+		})
+		return status.Error(code, message)
+	}
+	if err := od.replicator.Replicate(ctx, sourceControllerID, destControllerID, name); err != nil {
+		return nil, fail(codes.Internal, fmt.Sprintf("replicate %s: %s", name, err))
+	}
+	sourceSum, err := od.replicator.Checksum(ctx, sourceControllerID, name)
+	if err != nil {
+		return nil, fail(codes.Internal, fmt.Sprintf("checksum of %s on %s: %s", name, sourceControllerID, err))
+	}
+	destSum, err := od.replicator.Checksum(ctx, destControllerID, name)
+	if err != nil {
+		return nil, fail(codes.Internal, fmt.Sprintf("checksum of %s on %s: %s", name, destControllerID, err))
+	}
+	if sourceSum != destSum {
+		return nil, fail(codes.DataLoss, fmt.Sprintf("checksum of %s on %s is %s, expected %s", name, destControllerID, destSum, sourceSum))
+	}
+
+	// The source copy must remain until the new location is
+	// recorded.
+	if err := od.metadata.updateDurably(volumeID, func(metadata *VolumeMetadata) {
+		metadata.ControllerID = destControllerID
+	}); err != nil {
+		return nil, fail(codes.Internal, fmt.Sprintf("record location of volume %s: %s", volumeID, err))
+	}
+	if err := r.provision(ctx, sourceControllerID, name, 0); err != nil {
+		// The volume was moved, only the old copy remains.
+		log.FromContext(ctx).Warnw("deleting migrated volume on source controller failed",
+			"volumeid", volumeID,
+			"controllerid", sourceControllerID,
+			"error", err,
+		)
+	}
+	return steps, nil
+}
+
+// MigrateVolume invokes MigrateVolume through a connection to the
+// CSI socket of the driver.
+func MigrateVolume(ctx context.Context, conn *grpc.ClientConn, request *MigrateVolumeRequest) (*MigrateVolumeReply, error) {
+	reply := &MigrateVolumeReply{}
+	if err := conn.Invoke(ctx, "/"+volumeMigrationService+"/MigrateVolume", request, reply,
+		grpc.CallContentSubtype(jsonCodecName)); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func registerVolumeMigrationServer(s *grpc.Server, od *oimDriver) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: volumeMigrationService,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "MigrateVolume",
+				Handler:    migrateVolumeHandler,
+			},
+		},
+		Streams: []grpc.StreamDesc{},
+	}, od)
+}
+
+func migrateVolumeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) { // nolint: golint
+	in := new(MigrateVolumeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		request := req.(*MigrateVolumeRequest)
+		steps, err := srv.(*oimDriver).MigrateVolume(ctx, request.VolumeID, request.SourceControllerID, request.DestControllerID, request.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		return &MigrateVolumeReply{Steps: steps}, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + volumeMigrationService + "/MigrateVolume",
+	}
+	return interceptor(ctx, in, info, handler)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spec/oim/v0"
+)
+
+// fakeReplicator keeps the content of BDevs, indexed by
+// <controller ID>/<BDev name>.
+type fakeReplicator struct {
+	mutex    sync.Mutex
+	content  map[string]string
+	quiesced map[string]bool
+	// corrupt makes Replicate write the wrong content.
+	corrupt bool
+}
+
+func (f *fakeReplicator) Quiesce(ctx context.Context, controllerID, bdevName string) (func(), error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.quiesced[controllerID+"/"+bdevName] = true
+	return func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		delete(f.quiesced, controllerID+"/"+bdevName)
+	}, nil
+}
+
+func (f *fakeReplicator) Replicate(ctx context.Context, sourceControllerID, destControllerID, bdevName string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	content := f.content[sourceControllerID+"/"+bdevName]
+	if f.corrupt {
+		content += "garbage"
+	}
+	f.content[destControllerID+"/"+bdevName] = content
+	return nil
+}
+
+func (f *fakeReplicator) Checksum(ctx context.Context, controllerID, bdevName string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.content[controllerID+"/"+bdevName], nil
+}
+
+func TestMigrateVolume(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	affinity := NodeAffinity{
+		"host-0": {},
+		"host-1": {},
+	}
+	registryAddress, controllers := startMockControllers(ctx, t, tmp, "host-0", "host-1")
+
+	replicator := &fakeReplicator{content: map[string]string{}, quiesced: map[string]bool{}}
+	driver, err := New(WithCSIEndpoint("unix://"+tmp+"/oim-driver.sock"),
+		WithOIMRegistryAddress(registryAddress),
+		WithRegistryCreds(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/host.host-0")),
+		WithOIMControllerID("host-0"),
+		WithNodeAffinity(affinity),
+		WithVolumeReplicator(replicator),
+		WithSharedMetadataStore(tmp+"/metadata.json"),
+		WithLockStore(NewMemLockStore()),
+	)
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	resp, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: mib},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	require.NoError(t, err)
+	volumeID := resp.GetVolume().GetVolumeId()
+	require.Equal(t, "vol", volumeID)
+	replicator.content["host-0/vol"] = "data"
+	provisioned := func(controllerID string) []oim.ProvisionMallocBDevRequest {
+		return controllers[controllerID].provisioned()
+	}
+	require.Len(t, provisioned("host-0"), 1)
+
+	// Volumes without tenant are not visible to tenants.
+	_, err = od.MigrateVolume(withTenant(ctx, "a"), volumeID, "host-0", "host-1", true)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "other tenant: %v", err)
+
+	// Node drivers only find the moved volume through shared metadata.
+	od.metadata.shared = false
+	_, err = od.MigrateVolume(ctx, volumeID, "host-0", "host-1", true)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "not shared: %v", err)
+	od.metadata.shared = true
+
+	// Dry-run only reports the steps.
+	steps, err := od.MigrateVolume(ctx, volumeID, "host-0", "host-1", true)
+	require.NoError(t, err)
+	assert.Len(t, steps, 8)
+	assert.Empty(t, provisioned("host-1"), "dry-run")
+
+	// Staged volumes are not moved.
+	_, err = od.lockStore.Acquire(ctx, volumeID, "node-1", false)
+	require.NoError(t, err)
+	_, err = od.MigrateVolume(ctx, volumeID, "host-0", "host-1", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "staged: %v", err)
+	assert.Empty(t, provisioned("host-1"), "staged")
+	require.NoError(t, od.lockStore.Release(ctx, volumeID, "node-1"))
+	_, err = od.lockStore.Acquire(ctx, volumeID, "node-1", true)
+	require.NoError(t, err)
+	_, err = od.MigrateVolume(ctx, volumeID, "host-0", "host-1", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "staged for reading: %v", err)
+	require.NoError(t, od.lockStore.Release(ctx, volumeID, "node-1"))
+
+	// A checksum mismatch removes the copy.
+	replicator.corrupt = true
+	_, err = od.MigrateVolume(ctx, volumeID, "host-0", "host-1", false)
+	assert.Equal(t, codes.DataLoss, status.Code(err), "corrupt copy: %v", err)
+	assert.Equal(t, []oim.ProvisionMallocBDevRequest{{BdevName: "vol", Size_: mib}, {BdevName: "vol"}}, provisioned("host-1"), "copy removed")
+	assert.Len(t, provisioned("host-0"), 1, "source kept")
+	assert.Empty(t, replicator.quiesced, "resumed")
+
+	replicator.corrupt = false
+
+	// The source is kept when the new location cannot be recorded.
+	od.metadata.file = tmp + "/metadata.json/not-a-dir"
+	_, err = od.MigrateVolume(ctx, volumeID, "host-0", "host-1", false)
+	assert.Equal(t, codes.Internal, status.Code(err), "metadata not written: %v", err)
+	assert.Len(t, provisioned("host-1"), 4, "copy removed")
+	assert.Len(t, provisioned("host-0"), 1, "source kept")
+	metadata, _ := od.metadata.get(volumeID)
+	assert.Equal(t, "", metadata.ControllerID, "location unchanged")
+	od.metadata.file = tmp + "/metadata.json"
+
+	steps, err = od.MigrateVolume(ctx, volumeID, "host-0", "host-1", false)
+	require.NoError(t, err)
+	assert.Len(t, steps, 8)
+	assert.Equal(t, "data", replicator.content["host-1/vol"])
+	assert.Empty(t, replicator.quiesced, "resumed")
+	assert.Equal(t, oim.ProvisionMallocBDevRequest{BdevName: "vol"}, provisioned("host-0")[1], "source deleted")
+	metadata, _ = od.metadata.get(volumeID)
+	assert.Equal(t, "host-1", metadata.ControllerID)
+	// Another node reads the new location from the shared file.
+	other, err := loadMetadataStore(tmp + "/metadata.json")
+	require.NoError(t, err)
+	metadata, _ = other.get(volumeID)
+	assert.Equal(t, "host-1", metadata.ControllerID, "other node")
+	_, err = od.lockStore.Acquire(ctx, volumeID, "node-1", false)
+	require.NoError(t, err, "unlocked after migration")
+	require.NoError(t, od.lockStore.Release(ctx, volumeID, "node-1"))
+
+	// The volume keeps its ID and is found on the new controller.
+	_, err = od.MigrateVolume(ctx, volumeID, "host-0", "host-1", false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "already migrated: %v", err)
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	assert.Equal(t, oim.ProvisionMallocBDevRequest{BdevName: "vol"}, provisioned("host-1")[5], "deleted on new controller")
+}
@@ -8,9 +8,17 @@ package oimcsidriver
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
@@ -18,15 +26,54 @@ import (
 
 	"github.com/intel/oim/pkg/log"
 	"github.com/intel/oim/pkg/mount"
+	"github.com/intel/oim/pkg/oim-common"
 )
 
-func (od *oimDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+// capacityContextKey is the volume context entry with the size of
+// the volume as allocated by CreateVolume.
+const capacityContextKey = "capacity_bytes"
+
+// checkDeviceSize ensures that the device still has the size that
+// CreateVolume allocated for the volume, if that is known.
+func checkDeviceSize(device string, volumeContext map[string]string) error {
+	value, ok := volumeContext[capacityContextKey]
+	if !ok {
+		return nil
+	}
+	expected, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s %q: %s", capacityContextKey, value, err))
+	}
+	file, err := os.Open(device) // nolint: gosec
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer file.Close()
+	size, err := oimcommon.GetBlkSize64(file)
+	if err != nil {
+		return status.Error(codes.Internal, errors.Wrapf(err, "size of %s", device).Error())
+	}
+	if size != expected {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("%s has %d bytes, expected %d", device, size, expected))
+	}
+	return nil
+}
+
+func (od *oimDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (_ *csi.NodeGetInfoResponse, err error) {
+	defer od.observe("NodeGetInfo", time.Now(), &err)
+	var topology *csi.Topology
+	if segments := od.nodeTopology(); segments != nil {
+		topology = &csi.Topology{Segments: segments}
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId: od.nodeID,
+		NodeId:             od.nodeID,
+		MaxVolumesPerNode:  od.availableVolumes(ctx),
+		AccessibleTopology: topology,
 	}, nil
 }
 
-func (od *oimDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+func (od *oimDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (_ *csi.NodeGetCapabilitiesResponse, err error) {
+	defer od.observe("NodeGetCapabilities", time.Now(), &err)
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
 			{
@@ -36,11 +83,20 @@ func (od *oimDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
-func (od *oimDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (od *oimDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodePublishVolume", req)
+	defer od.observe("NodePublishVolume", time.Now(), &err)
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
 	volumeID := req.GetVolumeId()
@@ -60,12 +116,25 @@ func (od *oimDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		return nil, status.Error(codes.InvalidArgument, "missing volume capability")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
 
+	log.FromContext(ctx).Infow("publishing",
+		"target", targetPath,
+		"staging", stagingTargetPath,
+		"readonly", readOnly,
+	)
+
 	mounter := mount.New("")
 
+	if volumeCapability.GetBlock() != nil {
+		if err := publishBlock(mounter, volumeID, stagingTargetPath, targetPath, readOnly); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	// The following code was copied from:
 	// https://github.com/kubernetes-sigs/gcp-compute-persistent-disk-csi-driver/blob/fa02b8971cb686b3e2e9cd965c18fde3ccadd10a/pkg/gce-pd-csi-driver/node.go#L45
 
@@ -83,6 +152,16 @@ func (od *oimDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	// Without NodeStageVolume, the bind mount would silently
+	// publish an empty directory.
+	notStaged, err := mounter.IsLikelyNotMountPoint(stagingTargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "validate staging target path").Error())
+	}
+	if notStaged {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s not staged at %s", volumeID, stagingTargetPath))
+	}
+
 	if err := mounter.MakeDir(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, errors.Wrap(err, "make target dir").Error())
 	}
@@ -119,7 +198,9 @@ func (od *oimDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (od *oimDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+func (od *oimDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (_ *csi.NodeUnpublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodeUnpublishVolume", req)
+	defer od.observe("NodeUnpublishVolume", time.Now(), &err)
 	targetPath := req.GetTargetPath()
 	volumeID := req.GetVolumeId()
 
@@ -130,15 +211,26 @@ func (od *oimDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
 
+	log.FromContext(ctx).Infow("unpublishing",
+		"target", targetPath,
+	)
+
+	mounter := mount.New("")
+	if block, err := unpublishBlock(mounter, targetPath); block {
+		if err != nil {
+			return nil, err
+		}
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
 	// The following code was copied from:
 	// https://github.com/kubernetes-sigs/gcp-compute-persistent-disk-csi-driver/blob/master/pkg/gce-pd-csi-driver/node.go#L128
 
-	mounter := mount.New("")
-	err := mount.UnmountPath(targetPath, mounter)
+	err = mount.UnmountPath(targetPath, mounter)
 	if err != nil {
 		return nil, status.Error(codes.Internal, errors.Wrap(err, "unmount failed").Error())
 	}
@@ -146,7 +238,9 @@ func (od *oimDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (od *oimDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (od *oimDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (_ *csi.NodeStageVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodeStageVolume", req)
+	defer od.observe("NodeStageVolume", time.Now(), &err)
 	targetPath := req.GetStagingTargetPath()
 	volumeID := req.GetVolumeId()
 	volumeCapability := req.GetVolumeCapability()
@@ -161,10 +255,23 @@ func (od *oimDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		return nil, status.Error(codes.InvalidArgument, "missing volume capability")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
 
+	lock, err := od.acquireVolume(ctx, volumeID, volumeCapability.GetAccessMode().GetMode())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { lock.done(ctx, err) }()
+
+	if volumeCapability.GetBlock() != nil {
+		if err := od.stageBlock(ctx, lock, volumeID, targetPath, req, req.GetVolumeContext()); err != nil {
+			return nil, err
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	// Check and prepare mount point.
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
 	if err != nil {
@@ -192,13 +299,21 @@ func (od *oimDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		"flags", mountFlags,
 	)
 
-	device, cleanup, err := od.backend.createDevice(ctx, volumeID, req)
+	device, cleanup, err := od.createDevice(ctx, volumeID, req, req.GetVolumeContext())
 	if cleanup != nil {
 		defer cleanup()
 	}
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+	lock.attach()
+	if err := checkDeviceSize(device, req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	if err := checkDeviceSerial(ctx, "/sys/dev/block", device, req.GetVolumeContext()); err != nil {
+		return nil, err
 	}
+	checkNUMANode(ctx, "/sys", "/proc", req.GetVolumeContext())
 
 	options := []string{}
 	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()}
@@ -207,10 +322,19 @@ func (od *oimDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		return nil, status.Error(codes.Internal, errors.Wrapf(err, "formatting as %s and mounting %s at %s", fsType, device, targetPath).Error())
 	}
 
+	if benchmarkEnabled(req.GetVolumeContext()) {
+		od.runBenchmark(ctx, volumeID, device)
+	}
+	if prewarmEnabled(req.GetVolumeContext()) {
+		od.prewarm.Start(ctx, volumeID, device)
+	}
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (od *oimDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+func (od *oimDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (_ *csi.NodeUnstageVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodeUnstageVolume", req)
+	defer od.observe("NodeUnstageVolume", time.Now(), &err)
 	targetPath := req.GetStagingTargetPath()
 	volumeID := req.GetVolumeId()
 
@@ -221,9 +345,21 @@ func (od *oimDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
+	defer func() {
+		if err == nil {
+			err = od.releaseVolume(ctx, volumeID)
+		}
+	}()
+
+	if block, err := od.unstageBlock(ctx, volumeID, targetPath); block {
+		if err != nil {
+			return nil, err
+		}
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
 
 	// Unmounting the image
 	// TODO: check whether this really is still a mount point. We might have removed it already.
@@ -231,18 +367,26 @@ func (od *oimDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 		"target", targetPath,
 		"volumeid", volumeID,
 	)
-	if err := mount.New("").Unmount(targetPath); err != nil {
+	mounter := mount.New("")
+	device, _, err := mount.GetDeviceNameFromMount(mounter, targetPath)
+	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-
-	if err := od.backend.deleteDevice(ctx, volumeID); err != nil {
+	if err := mounter.Unmount(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	od.prewarm.Stop(volumeID)
+	if err := od.deleteDevice(ctx, volumeID, device); err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (od *oimDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+func (od *oimDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (_ *csi.NodeGetVolumeStatsResponse, err error) {
+	ctx = od.withLogger(ctx, "NodeGetVolumeStats", req)
+	defer od.observe("NodeGetVolumeStats", time.Now(), &err)
 	volumeID := req.GetVolumeId()
 	volumePath := req.GetVolumePath()
 	if volumeID == "" {
@@ -252,10 +396,93 @@ func (od *oimDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 		return nil, status.Error(codes.InvalidArgument, "empty volume path")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
 
-	// TODO: actually check that the path exists and extract information about it.
-	return &csi.NodeGetVolumeStatsResponse{}, nil
+	// The vendored CSI 1.0 spec has no VolumeCondition, so a volume
+	// which is not mounted (anymore) is reported as an error.
+	info, err := os.Stat(volumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume path %s does not exist", volumePath))
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(volumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "check whether volume path is a mount point").Error())
+	}
+	if notMnt {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is not mounted at %s", volumeID, volumePath))
+	}
+
+	var usage []*csi.VolumeUsage
+	if info.Mode()&os.ModeDevice != 0 {
+		usage, err = blockUsage("/sys/dev/block", info)
+	} else {
+		usage, err = filesystemUsage(volumePath)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.FromContext(ctx).Debugw("volume usage",
+		"path", volumePath,
+		"usage", usage,
+	)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: usage,
+	}, nil
+}
+
+// filesystemUsage reports bytes and inodes of the filesystem mounted
+// at the path.
+func filesystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(path, &statfs); err != nil {
+		return nil, errors.Wrapf(err, "statfs %s", path)
+	}
+	bsize := statfs.Bsize
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * bsize,
+			Available: int64(statfs.Bavail) * bsize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * bsize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
+}
+
+// blockUsage reports the size of the block device, as found in the
+// <major>:<minor>/size file under sys (normally /sys/dev/block). The
+// used bytes are unknown for a raw block device.
+func blockUsage(sys string, info os.FileInfo) ([]*csi.VolumeUsage, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.Errorf("no device number for %s", info.Name())
+	}
+	rdev := uint64(stat.Rdev) // nolint: unconvert
+	sizeFile := filepath.Join(sys, fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev)), "size")
+	content, err := ioutil.ReadFile(sizeFile) // nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+	// The size is always in 512 byte sectors, regardless of the
+	// actual block size of the device.
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", sizeFile)
+	}
+	return []*csi.VolumeUsage{
+		{
+			Unit:  csi.VolumeUsage_BYTES,
+			Total: sectors * 512,
+		},
+	}, nil
 }
@@ -8,7 +8,9 @@ package oimcsidriver
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"google.golang.org/grpc/codes"
@@ -21,19 +23,28 @@ import (
 
 // Name is specified by generated interface, can't make it NodeGetID.
 // nolint: golint
-func (od *oimDriver03) NodeGetId(ctx context.Context, req *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
+func (od *oimDriver03) NodeGetId(ctx context.Context, req *csi.NodeGetIdRequest) (_ *csi.NodeGetIdResponse, err error) {
+	defer od.observe("NodeGetId", time.Now(), &err)
 	return &csi.NodeGetIdResponse{
 		NodeId: od.nodeID,
 	}, nil
 }
 
-func (od *oimDriver03) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+func (od *oimDriver03) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (_ *csi.NodeGetInfoResponse, err error) {
+	defer od.observe("NodeGetInfo", time.Now(), &err)
+	var topology *csi.Topology
+	if segments := od.nodeTopology(); segments != nil {
+		topology = &csi.Topology{Segments: segments}
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId: od.nodeID,
+		NodeId:             od.nodeID,
+		MaxVolumesPerNode:  od.availableVolumes(ctx),
+		AccessibleTopology: topology,
 	}, nil
 }
 
-func (od *oimDriver03) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+func (od *oimDriver03) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (_ *csi.NodeGetCapabilitiesResponse, err error) {
+	defer od.observe("NodeGetCapabilities", time.Now(), &err)
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
 			{
@@ -47,7 +58,9 @@ func (od *oimDriver03) NodeGetCapabilities(ctx context.Context, req *csi.NodeGet
 	}, nil
 }
 
-func (od *oimDriver03) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (od *oimDriver03) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodePublishVolume", req)
+	defer od.observe("NodePublishVolume", time.Now(), &err)
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
 	volumeID := req.GetVolumeId()
@@ -67,12 +80,25 @@ func (od *oimDriver03) NodePublishVolume(ctx context.Context, req *csi.NodePubli
 		return nil, status.Error(codes.InvalidArgument, "missing volume capability")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
 
+	log.FromContext(ctx).Infow("publishing",
+		"target", targetPath,
+		"staging", stagingTargetPath,
+		"readonly", readOnly,
+	)
+
 	mounter := mount.New("")
 
+	if volumeCapability.GetBlock() != nil {
+		if err := publishBlock(mounter, volumeID, stagingTargetPath, targetPath, readOnly); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	// The following code was copied from:
 	// https://github.com/kubernetes-sigs/gcp-compute-persistent-disk-csi-driver/blob/fa02b8971cb686b3e2e9cd965c18fde3ccadd10a/pkg/gce-pd-csi-driver/node.go#L45
 
@@ -90,6 +116,16 @@ func (od *oimDriver03) NodePublishVolume(ctx context.Context, req *csi.NodePubli
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	// Without NodeStageVolume, the bind mount would silently
+	// publish an empty directory.
+	notStaged, err := mounter.IsLikelyNotMountPoint(stagingTargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "validate staging target path").Error())
+	}
+	if notStaged {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s not staged at %s", volumeID, stagingTargetPath))
+	}
+
 	if err := mounter.MakeDir(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, errors.Wrap(err, "make target dir").Error())
 	}
@@ -126,7 +162,9 @@ func (od *oimDriver03) NodePublishVolume(ctx context.Context, req *csi.NodePubli
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (od *oimDriver03) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+func (od *oimDriver03) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (_ *csi.NodeUnpublishVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodeUnpublishVolume", req)
+	defer od.observe("NodeUnpublishVolume", time.Now(), &err)
 	targetPath := req.GetTargetPath()
 	volumeID := req.GetVolumeId()
 
@@ -137,15 +175,26 @@ func (od *oimDriver03) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnp
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
 
+	log.FromContext(ctx).Infow("unpublishing",
+		"target", targetPath,
+	)
+
+	mounter := mount.New("")
+	if block, err := unpublishBlock(mounter, targetPath); block {
+		if err != nil {
+			return nil, err
+		}
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
 	// The following code was copied from:
 	// https://github.com/kubernetes-sigs/gcp-compute-persistent-disk-csi-driver/blob/master/pkg/gce-pd-csi-driver/node.go#L128
 
-	mounter := mount.New("")
-	err := mount.UnmountPath(targetPath, mounter)
+	err = mount.UnmountPath(targetPath, mounter)
 	if err != nil {
 		return nil, status.Error(codes.Internal, errors.Wrap(err, "unmount failed").Error())
 	}
@@ -153,7 +202,9 @@ func (od *oimDriver03) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnp
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (od *oimDriver03) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (od *oimDriver03) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (_ *csi.NodeStageVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodeStageVolume", req)
+	defer od.observe("NodeStageVolume", time.Now(), &err)
 	targetPath := req.GetStagingTargetPath()
 	volumeID := req.GetVolumeId()
 	volumeCapability := req.GetVolumeCapability()
@@ -168,10 +219,23 @@ func (od *oimDriver03) NodeStageVolume(ctx context.Context, req *csi.NodeStageVo
 		return nil, status.Error(codes.InvalidArgument, "missing volume capability")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
 
+	lock, err := od.acquireVolume(ctx, volumeID, accessMode0(volumeCapability.GetAccessMode().GetMode()))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { lock.done(ctx, err) }()
+
+	if volumeCapability.GetBlock() != nil {
+		if err := od.stageBlock(ctx, lock, volumeID, targetPath, req, req.GetVolumeAttributes()); err != nil {
+			return nil, err
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	// Check and prepare mount point.
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
 	if err != nil {
@@ -201,13 +265,21 @@ func (od *oimDriver03) NodeStageVolume(ctx context.Context, req *csi.NodeStageVo
 		"flags", mountFlags,
 	)
 
-	device, cleanup, err := od.backend.createDevice(ctx, volumeID, req)
+	device, cleanup, err := od.createDevice(ctx, volumeID, req, attrib)
 	if cleanup != nil {
 		defer cleanup()
 	}
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+	lock.attach()
+	if err := checkDeviceSize(device, attrib); err != nil {
+		return nil, err
+	}
+	if err := checkDeviceSerial(ctx, "/sys/dev/block", device, attrib); err != nil {
+		return nil, err
 	}
+	checkNUMANode(ctx, "/sys", "/proc", attrib)
 
 	options := []string{}
 	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()}
@@ -216,10 +288,19 @@ func (od *oimDriver03) NodeStageVolume(ctx context.Context, req *csi.NodeStageVo
 		return nil, status.Error(codes.Internal, errors.Wrapf(err, "formatting as %s and mounting %s at %s", fsType, device, targetPath).Error())
 	}
 
+	if benchmarkEnabled(attrib) {
+		od.runBenchmark(ctx, volumeID, device)
+	}
+	if prewarmEnabled(attrib) {
+		od.prewarm.Start(ctx, volumeID, device)
+	}
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (od *oimDriver03) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+func (od *oimDriver03) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (_ *csi.NodeUnstageVolumeResponse, err error) {
+	ctx = od.withLogger(ctx, "NodeUnstageVolume", req)
+	defer od.observe("NodeUnstageVolume", time.Now(), &err)
 	targetPath := req.GetStagingTargetPath()
 	volumeID := req.GetVolumeId()
 
@@ -230,9 +311,21 @@ func (od *oimDriver03) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnsta
 		return nil, status.Error(codes.InvalidArgument, "empty volume ID")
 	}
 
-	// Volume ID is the same as the volume name in CreateVolume. Serialize by that.
+	// Serialize operations per volume by ID.
 	volumeNameMutex.LockKey(volumeID)
 	defer volumeNameMutex.UnlockKey(volumeID)
+	defer func() {
+		if err == nil {
+			err = od.releaseVolume(ctx, volumeID)
+		}
+	}()
+
+	if block, err := od.unstageBlock(ctx, volumeID, targetPath); block {
+		if err != nil {
+			return nil, err
+		}
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
 
 	// Unmounting the image
 	// TODO: check whether this really is still a mount point. We might have removed it already.
@@ -240,13 +333,19 @@ func (od *oimDriver03) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnsta
 		"target", targetPath,
 		"volumeid", volumeID,
 	)
-	if err := mount.New("").Unmount(targetPath); err != nil {
+	mounter := mount.New("")
+	device, _, err := mount.GetDeviceNameFromMount(mounter, targetPath)
+	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-
-	if err := od.backend.deleteDevice(ctx, volumeID); err != nil {
+	if err := mounter.Unmount(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	od.prewarm.Stop(volumeID)
+	if err := od.deleteDevice(ctx, volumeID, device); err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
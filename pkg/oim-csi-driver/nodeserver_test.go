@@ -15,10 +15,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/mount"
+	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
 	"github.com/intel/oim/pkg/spec/oim/v0"
 )
 
@@ -178,3 +183,138 @@ func TestFindDev(t *testing.T) {
 		assert.Equal(t, fmt.Sprintf("Unexpected entry in %s, not a major:minor symlink: a:b", tmp), err.Error())
 	}
 }
+
+func TestCheckDeviceSize(t *testing.T) {
+	file, err := ioutil.TempFile("", "device")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	require.NoError(t, file.Truncate(4096))
+	require.NoError(t, file.Close())
+
+	for name, tc := range map[string]struct {
+		volumeContext map[string]string
+		code          codes.Code
+	}{
+		"unknown": {nil, codes.OK},
+		"same":    {map[string]string{capacityContextKey: "4096"}, codes.OK},
+		"changed": {map[string]string{capacityContextKey: "8192"}, codes.FailedPrecondition},
+		"invalid": {map[string]string{capacityContextKey: "four"}, codes.InvalidArgument},
+		"no-such": {map[string]string{capacityContextKey: "4096"}, codes.Internal},
+	} {
+		t.Run(name, func(t *testing.T) {
+			device := file.Name()
+			if name == "no-such" {
+				device += ".no-such-file"
+			}
+			err := checkDeviceSize(device, tc.volumeContext)
+			assert.Equal(t, tc.code, status.Code(err), "%v", err)
+		})
+	}
+}
+
+func TestNodeStageUnstage(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, _ := newFakeDriver(t)
+	defer fake.Close()
+
+	caps, err := od.oimDriver.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err)
+	var types []csi.NodeServiceCapability_RPC_Type
+	for _, cap := range caps.GetCapabilities() {
+		types = append(types, cap.GetRpc().GetType())
+	}
+	assert.Contains(t, types, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME)
+
+	caps0, err := od.NodeGetCapabilities(ctx, &csi0.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err)
+	var types0 []csi0.NodeServiceCapability_RPC_Type
+	for _, cap := range caps0.GetCapabilities() {
+		types0 = append(types0, cap.GetRpc().GetType())
+	}
+	assert.Contains(t, types0, csi0.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME)
+
+	// Publishing without staging first must not bind-mount the
+	// empty staging directory.
+	tmp, err := ioutil.TempDir("", "publish")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	stagingTargetPath := filepath.Join(tmp, "staging")
+	require.NoError(t, os.Mkdir(stagingTargetPath, 0755))
+	targetPath := filepath.Join(tmp, "target")
+	_, err = od.oimDriver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingTargetPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  &csi.VolumeCapability{},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "%v", err)
+	_, err = od.NodePublishVolume(ctx, &csi0.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingTargetPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  &csi0.VolumeCapability{},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "%v", err)
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err), "target path created: %v", err)
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, _ := newFakeDriver(t)
+	defer fake.Close()
+
+	tmp, err := ioutil.TempDir("", "stats")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	getStats := func(volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+		return od.oimDriver.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   "vol",
+			VolumePath: volumePath,
+		})
+	}
+
+	_, err = getStats(filepath.Join(tmp, "no-such-dir"))
+	assert.Equal(t, codes.NotFound, status.Code(err), "%v", err)
+	_, err = getStats(tmp)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "not mounted: %v", err)
+
+	mounter := mount.New("")
+	if err := mounter.Mount("tmpfs", tmp, "tmpfs", []string{"size=1m"}); err != nil {
+		t.Skipf("mounting tmpfs failed: %s", err)
+	}
+	defer mounter.Unmount(tmp)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "data"), make([]byte, 64*1024), 0644))
+	stats, err := getStats(tmp)
+	require.NoError(t, err)
+	require.Len(t, stats.GetUsage(), 2)
+	bytes := stats.GetUsage()[0]
+	assert.Equal(t, csi.VolumeUsage_BYTES, bytes.GetUnit())
+	assert.Equal(t, int64(1024*1024), bytes.GetTotal())
+	assert.Equal(t, int64(64*1024), bytes.GetUsed())
+	assert.Equal(t, bytes.GetTotal()-bytes.GetUsed(), bytes.GetAvailable())
+	inodes := stats.GetUsage()[1]
+	assert.Equal(t, csi.VolumeUsage_INODES, inodes.GetUnit())
+	assert.NotZero(t, inodes.GetUsed())
+}
+
+func TestBlockUsage(t *testing.T) {
+	sys, err := ioutil.TempDir("", "sys")
+	require.NoError(t, err)
+	defer os.RemoveAll(sys)
+
+	// /dev/null is 1:3.
+	info, err := os.Stat("/dev/null")
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(sys, "1:3"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(sys, "1:3", "size"), []byte("2048\n"), 0644))
+	usage, err := blockUsage(sys, info)
+	require.NoError(t, err)
+	if assert.Len(t, usage, 1) {
+		assert.Equal(t, csi.VolumeUsage_BYTES, usage[0].GetUnit())
+		assert.Equal(t, int64(1024*1024), usage[0].GetTotal())
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// numaNodeContextKey is the volume context entry with the NUMA node
+// of the device that stores the data of a volume. Pods which use
+// the volume perform best when pinned to CPUs of that node. It is not
+// set when the device has no NUMA affinity or it is unknown.
+const numaNodeContextKey = "numa_node"
+
+// numaNode looks up the NUMA node of the device behind the base BDev
+// of a logical volume store: local NVMe controllers via their PCI
+// address, Linux block devices used by AIO BDevs via their device
+// directory. Because it is only a hint, failures are logged and
+// result in an empty string.
+func numaNode(ctx context.Context, client *spdk.Client, sys string, lvs spdk.LVStore) string {
+	if lvs.BaseBDev == "" {
+		return ""
+	}
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: lvs.BaseBDev})
+	if err != nil || len(bdevs) != 1 {
+		log.FromContext(ctx).Warnw("cannot determine NUMA node",
+			"lvstore", lvs.Name,
+			"basebdev", lvs.BaseBDev,
+			"error", err,
+		)
+		return ""
+	}
+	var path string
+	switch driver := bdevs[0].DriverSpecific; {
+	case driver == nil:
+		return ""
+	case driver.NVMe != nil && driver.NVMe.PCIAddress != "":
+		path = filepath.Join(sys, "bus/pci/devices", driver.NVMe.PCIAddress, "numa_node")
+	case driver.AIO != nil && strings.HasPrefix(driver.AIO.Filename, "/dev/"):
+		path = filepath.Join(sys, "block", filepath.Base(driver.AIO.Filename), "device/numa_node")
+	default:
+		return ""
+	}
+	content, err := ioutil.ReadFile(path) // nolint: gosec
+	if err != nil {
+		log.FromContext(ctx).Warnw("cannot determine NUMA node",
+			"lvstore", lvs.Name,
+			"basebdev", lvs.BaseBDev,
+			"error", err,
+		)
+		return ""
+	}
+	// -1 is used when the device has no NUMA affinity.
+	node, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || node < 0 {
+		return ""
+	}
+	return strconv.Itoa(node)
+}
+
+// checkNUMANode warns when the volume is stored on a different NUMA
+// node than the CPUs that the current process may run on. The pod
+// which is going to use the volume is not known while staging, so
+// this relies on the CPU pinning of the node plugin, which the
+// kernel derives from its cpuset cgroup. Problems are only logged.
+func checkNUMANode(ctx context.Context, sys, proc string, volumeContext map[string]string) {
+	node, ok := volumeContext[numaNodeContextKey]
+	if !ok {
+		return
+	}
+	nodeCPUs, err := readCPUList(filepath.Join(sys, "devices/system/node", "node"+node, "cpulist"))
+	if err != nil {
+		log.FromContext(ctx).Debugw("cannot check NUMA node", "error", err)
+		return
+	}
+	list, err := allowedCPUList(filepath.Join(proc, "self/status"))
+	if err != nil {
+		log.FromContext(ctx).Debugw("cannot check NUMA node", "error", err)
+		return
+	}
+	allowed, err := parseCPUList(list)
+	if err != nil {
+		log.FromContext(ctx).Debugw("cannot check NUMA node", "error", err)
+		return
+	}
+	for cpu := range allowed {
+		if nodeCPUs[cpu] {
+			return
+		}
+	}
+	log.FromContext(ctx).Warnw("volume is on a different NUMA node than the allowed CPUs",
+		"numanode", node,
+		"cpus", list,
+	)
+}
+
+// allowedCPUList returns the Cpus_allowed_list entry of a
+// /proc/<pid>/status file.
+func allowedCPUList(status string) (string, error) {
+	file, err := os.Open(status) // nolint: gosec
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Cpus_allowed_list:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Cpus_allowed_list:")), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.Errorf("no Cpus_allowed_list in %s", status)
+}
+
+func readCPUList(path string) (map[int]bool, error) {
+	content, err := ioutil.ReadFile(path) // nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(string(content))
+}
+
+// parseCPUList parses the Linux list format, for example "0-3,8,10-11".
+func parseCPUList(list string) (map[int]bool, error) {
+	cpus := map[int]bool{}
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, errors.Errorf("invalid CPU list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus[cpu] = true
+		}
+	}
+	return cpus, nil
+}
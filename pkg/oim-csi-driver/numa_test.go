@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/log/level"
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+// writeSysFile creates a file with the content below dir.
+func writeSysFile(t *testing.T, dir, path, content string) {
+	path = filepath.Join(dir, path)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func TestNUMANode(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	sys, err := ioutil.TempDir("", "sys")
+	require.NoError(t, err)
+	defer os.RemoveAll(sys)
+	writeSysFile(t, sys, "bus/pci/devices/0000:5e:00.0/numa_node", "1\n")
+	writeSysFile(t, sys, "bus/pci/devices/0000:18:00.0/numa_node", "-1\n")
+	writeSysFile(t, sys, "block/sdb/device/numa_node", "0\n")
+
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	bdevs := map[string]spdk.BDev{
+		"nvme1":   {Name: "nvme1", DriverSpecific: &spdk.DriverSpecific{NVMe: &spdk.NVMeDriverSpecific{PCIAddress: "0000:5e:00.0"}}},
+		"nvme-no": {Name: "nvme-no", DriverSpecific: &spdk.DriverSpecific{NVMe: &spdk.NVMeDriverSpecific{PCIAddress: "0000:18:00.0"}}},
+		"nvmf":    {Name: "nvmf", DriverSpecific: &spdk.DriverSpecific{NVMe: &spdk.NVMeDriverSpecific{}}},
+		"aio":     {Name: "aio", DriverSpecific: &spdk.DriverSpecific{AIO: &spdk.AIODriverSpecific{Filename: "/dev/sdb"}}},
+		"file":    {Name: "file", DriverSpecific: &spdk.DriverSpecific{AIO: &spdk.AIODriverSpecific{Filename: "/var/lib/disk.img"}}},
+		"missing": {Name: "missing", DriverSpecific: &spdk.DriverSpecific{AIO: &spdk.AIODriverSpecific{Filename: "/dev/sdz"}}},
+		"malloc":  {Name: "malloc", ProductName: mallocProductName},
+	}
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetBDevsArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		if bdev, ok := bdevs[args.Name]; ok {
+			return []spdk.BDev{bdev}, nil
+		}
+		return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+	})
+	client, err := spdk.New(fake.Path)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for baseBDev, expected := range map[string]string{
+		"nvme1":   "1",
+		"nvme-no": "",
+		"nvmf":    "",
+		"aio":     "0",
+		"file":    "",
+		"missing": "",
+		"malloc":  "",
+		"unknown": "",
+	} {
+		node := numaNode(ctx, client, sys, spdk.LVStore{Name: "lvs", BaseBDev: baseBDev})
+		assert.Equal(t, expected, node, baseBDev)
+	}
+}
+
+func TestCheckNUMANode(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	tmp, err := ioutil.TempDir("", "numa")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	sys := filepath.Join(tmp, "sys")
+	proc := filepath.Join(tmp, "proc")
+	writeSysFile(t, sys, "devices/system/node/node0/cpulist", "0-3,8-11\n")
+	writeSysFile(t, sys, "devices/system/node/node1/cpulist", "4-7,12-15\n")
+
+	for name, tc := range map[string]struct {
+		allowed string
+		context map[string]string
+		warning bool
+	}{
+		"same":      {"2-3", map[string]string{numaNodeContextKey: "0"}, false},
+		"overlap":   {"0-15", map[string]string{numaNodeContextKey: "1"}, false},
+		"different": {"8,10", map[string]string{numaNodeContextKey: "1"}, true},
+		"unknown":   {"8,10", map[string]string{}, false},
+	} {
+		writeSysFile(t, proc, "self/status", "Name:\toim-csi-driver\nCpus_allowed:\tffff\nCpus_allowed_list:\t"+tc.allowed+"\n")
+		var output bytes.Buffer
+		ctx := log.WithLogger(context.Background(), log.NewSimpleLogger(log.SimpleConfig{
+			Level:  level.Warn,
+			Output: &output,
+		}))
+		checkNUMANode(ctx, sys, proc, tc.context)
+		if tc.warning {
+			assert.Contains(t, output.String(), "different NUMA node", name)
+		} else {
+			assert.Empty(t, output.String(), name)
+		}
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for list, expected := range map[string][]int{
+		"":          nil,
+		"0":         {0},
+		"0-2,5\n":   {0, 1, 2, 5},
+		"1,3-4,7-7": {1, 3, 4, 7},
+	} {
+		cpus, err := parseCPUList(list)
+		if assert.NoError(t, err, list) {
+			var sorted []int
+			for cpu := 0; cpu < 16; cpu++ {
+				if cpus[cpu] {
+					sorted = append(sorted, cpu)
+				}
+			}
+			assert.Equal(t, expected, sorted, list)
+		}
+	}
+	for _, list := range []string{"a", "3-1", "1-b", "1,,2"} {
+		_, err := parseCPUList(list)
+		assert.Error(t, err, list)
+	}
+}
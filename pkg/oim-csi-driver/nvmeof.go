@@ -0,0 +1,248 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+const (
+	// transportContextKey selects how NodeStageVolume attaches
+	// the volume. Without it, the backend provides the device.
+	transportContextKey = "transport"
+	// nvmeofTransport attaches the volume as NVMe-oF namespace
+	// with "nvme connect", using the following entries.
+	nvmeofTransport   = "nvmeof"
+	nqnContextKey     = "nqn"
+	traddrContextKey  = "traddr"
+	trsvcidContextKey = "trsvcid"
+	// trtypeContextKey is optional, the default is rdma.
+	trtypeContextKey = "trtype"
+
+	// nvmeDeviceTimeout limits how long Connect waits for the
+	// block device of the namespace.
+	nvmeDeviceTimeout = 30 * time.Second
+)
+
+// NVMeOFTarget identifies a NVMe-oF subsystem.
+type NVMeOFTarget struct {
+	NQN     string
+	TrType  string
+	TrAddr  string
+	TrSvcID string
+}
+
+// NVMeExecutor attaches and detaches NVMe-oF subsystems. The default
+// implementation uses the nvme command line tool, tests replace it
+// with WithNVMeExecutor.
+type NVMeExecutor interface {
+	// Connect attaches the subsystem unless it already is
+	// attached and returns the block device of its namespace.
+	Connect(ctx context.Context, target NVMeOFTarget) (string, error)
+	// Disconnect detaches the subsystem.
+	Disconnect(ctx context.Context, nqn string) error
+	// SubsystemNQN returns the NQN of the subsystem that provides
+	// the block device, or an empty string for other devices.
+	SubsystemNQN(device string) (string, error)
+}
+
+// nvmeTarget extracts the NVMe-oF parameters from a volume
+// context. It returns nil when the volume is not attached via
+// NVMe-oF.
+func nvmeTarget(volumeContext map[string]string) (*NVMeOFTarget, error) {
+	transport := volumeContext[transportContextKey]
+	switch transport {
+	case "":
+		return nil, nil
+	case nvmeofTransport:
+	default:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unsupported %s %q", transportContextKey, transport))
+	}
+	target := &NVMeOFTarget{
+		NQN:     volumeContext[nqnContextKey],
+		TrType:  volumeContext[trtypeContextKey],
+		TrAddr:  volumeContext[traddrContextKey],
+		TrSvcID: volumeContext[trsvcidContextKey],
+	}
+	for key, value := range map[string]string{
+		nqnContextKey:     target.NQN,
+		traddrContextKey:  target.TrAddr,
+		trsvcidContextKey: target.TrSvcID,
+	} {
+		if value == "" {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s missing in volume context for transport %s", key, nvmeofTransport))
+		}
+	}
+	if target.TrType == "" {
+		target.TrType = "rdma"
+	}
+	return target, nil
+}
+
+// createDevice provides the block device for NodeStageVolume, either
+// via NVMe-oF or via the backend.
+func (od *oimDriver) createDevice(ctx context.Context, volumeID string, request interface{}, volumeContext map[string]string) (string, cleanup, error) {
+	target, err := nvmeTarget(volumeContext)
+	if err != nil {
+		return "", nil, err
+	}
+	if target == nil {
+		device, cleanup, err := od.backend.createDevice(ctx, volumeID, request)
+		if err != nil {
+			return "", cleanup, status.Error(codes.Internal, err.Error())
+		}
+		return device, cleanup, nil
+	}
+	log.FromContext(ctx).Infow("connecting NVMe-oF subsystem",
+		"volumeid", volumeID,
+		"nqn", target.NQN,
+		"trtype", target.TrType,
+		"traddr", target.TrAddr,
+		"trsvcid", target.TrSvcID,
+	)
+	device, err := od.nvme.Connect(ctx, *target)
+	if err != nil {
+		return "", nil, status.Error(codes.Internal, errors.Wrapf(err, "connect %s", target.NQN).Error())
+	}
+	return device, nil, nil
+}
+
+// deleteDevice undoes createDevice in NodeUnstageVolume. The device
+// is the one that was mounted at the staging path. When it is not
+// known anymore, for example because an earlier NodeUnstageVolume
+// was interrupted after unmounting, only the backend is called.
+func (od *oimDriver) deleteDevice(ctx context.Context, volumeID string, device string) error {
+	if device != "" {
+		nqn, err := od.nvme.SubsystemNQN(device)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if nqn != "" {
+			log.FromContext(ctx).Infow("disconnecting NVMe-oF subsystem",
+				"volumeid", volumeID,
+				"nqn", nqn,
+			)
+			if err := od.nvme.Disconnect(ctx, nqn); err != nil {
+				return status.Error(codes.Internal, errors.Wrapf(err, "disconnect %s", nqn).Error())
+			}
+			return nil
+		}
+	}
+	if err := od.backend.deleteDevice(ctx, volumeID); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// nvmeCLI implements NVMeExecutor with the nvme tool and sysfs.
+type nvmeCLI struct {
+	// sys is normally /sys.
+	sys string
+}
+
+var _ NVMeExecutor = &nvmeCLI{}
+
+var nvmeNamespace = regexp.MustCompile(`^nvme\d+n\d+$`)
+
+func (n *nvmeCLI) Connect(ctx context.Context, target NVMeOFTarget) (string, error) {
+	device, err := n.findNamespace(target.NQN)
+	if err != nil || device != "" {
+		return device, err
+	}
+	cmd := exec.CommandContext(ctx, "nvme", "connect", // nolint: gosec
+		"--transport="+target.TrType,
+		"--nqn="+target.NQN,
+		"--traddr="+target.TrAddr,
+		"--trsvcid="+target.TrSvcID,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "nvme connect: %s", string(out))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, nvmeDeviceTimeout)
+	defer cancel()
+	for {
+		device, err := n.findNamespace(target.NQN)
+		if err != nil || device != "" {
+			return device, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", errors.Errorf("no namespace for %s found in %s", target.NQN, n.sys)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (n *nvmeCLI) Disconnect(ctx context.Context, nqn string) error {
+	cmd := exec.CommandContext(ctx, "nvme", "disconnect", "--nqn="+nqn) // nolint: gosec
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "nvme disconnect: %s", string(out))
+	}
+	return nil
+}
+
+func (n *nvmeCLI) SubsystemNQN(device string) (string, error) {
+	name := filepath.Base(device)
+	if !nvmeNamespace.MatchString(name) {
+		return "", nil
+	}
+	// The device of a namespace is its controller, which knows
+	// the subsystem.
+	content, err := ioutil.ReadFile(filepath.Join(n.sys, "block", name, "device", "subsysnqn")) // nolint: gosec
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "read subsystem NQN")
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// findNamespace returns the first namespace of the subsystem, or an
+// empty string if the subsystem is not attached.
+func (n *nvmeCLI) findNamespace(nqn string) (string, error) {
+	subsystems := filepath.Join(n.sys, "class", "nvme-subsystem")
+	entries, err := ioutil.ReadDir(subsystems)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(subsystems, entry.Name())
+		content, err := ioutil.ReadFile(filepath.Join(dir, "subsysnqn")) // nolint: gosec
+		if err != nil || strings.TrimSpace(string(content)) != nqn {
+			continue
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", err
+		}
+		for _, file := range files {
+			if nvmeNamespace.MatchString(file.Name()) {
+				return "/dev/" + file.Name(), nil
+			}
+		}
+	}
+	return "", nil
+}
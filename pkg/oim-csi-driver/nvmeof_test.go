@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+// fakeNVMeExecutor pretends that each connected subsystem provides
+// one namespace.
+type fakeNVMeExecutor struct {
+	// device is returned by Connect, /dev/nvme0n1 by default.
+	device    string
+	connected map[string]string
+	calls     []string
+}
+
+func (f *fakeNVMeExecutor) Connect(ctx context.Context, target NVMeOFTarget) (string, error) {
+	f.calls = append(f.calls, "connect "+target.TrType+" "+target.NQN+" "+target.TrAddr+":"+target.TrSvcID)
+	if f.connected == nil {
+		f.connected = map[string]string{}
+	}
+	device := f.device
+	if device == "" {
+		device = "/dev/nvme0n1"
+	}
+	f.connected[device] = target.NQN
+	return device, nil
+}
+
+func (f *fakeNVMeExecutor) Disconnect(ctx context.Context, nqn string) error {
+	f.calls = append(f.calls, "disconnect "+nqn)
+	for device, n := range f.connected {
+		if n == nqn {
+			delete(f.connected, device)
+		}
+	}
+	return nil
+}
+
+func (f *fakeNVMeExecutor) SubsystemNQN(device string) (string, error) {
+	return f.connected[device], nil
+}
+
+func TestNVMeOFDevice(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	nvme := &fakeNVMeExecutor{}
+	od, fake, _ := newFakeDriver(t, WithNVMeExecutor(nvme))
+	defer fake.Close()
+
+	const nqn = "nqn.2016-06.io.spdk:cnode1"
+	for name, tc := range map[string]struct {
+		context map[string]string
+		code    codes.Code
+	}{
+		"unknown-transport": {map[string]string{transportContextKey: "iscsi"}, codes.InvalidArgument},
+		"no-nqn":            {map[string]string{transportContextKey: nvmeofTransport, traddrContextKey: "192.168.0.1", trsvcidContextKey: "4420"}, codes.InvalidArgument},
+		"no-traddr":         {map[string]string{transportContextKey: nvmeofTransport, nqnContextKey: nqn, trsvcidContextKey: "4420"}, codes.InvalidArgument},
+		"no-trsvcid":        {map[string]string{transportContextKey: nvmeofTransport, nqnContextKey: nqn, traddrContextKey: "192.168.0.1"}, codes.InvalidArgument},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := od.createDevice(ctx, "vol", nil, tc.context)
+			assert.Equal(t, tc.code, status.Code(err), "%v", err)
+		})
+	}
+	assert.Empty(t, nvme.calls, "invalid context")
+
+	device, cleanup, err := od.createDevice(ctx, "vol", nil, map[string]string{
+		transportContextKey: nvmeofTransport,
+		nqnContextKey:       nqn,
+		traddrContextKey:    "192.168.0.1",
+		trsvcidContextKey:   "4420",
+	})
+	require.NoError(t, err)
+	assert.Nil(t, cleanup)
+	assert.Equal(t, "/dev/nvme0n1", device)
+	require.NoError(t, od.deleteDevice(ctx, "vol", device))
+	assert.Equal(t, []string{
+		"connect rdma " + nqn + " 192.168.0.1:4420",
+		"disconnect " + nqn,
+	}, nvme.calls)
+	assert.Empty(t, nvme.connected)
+	assert.NotContains(t, fake.Methods(), "stop_nbd_disk", "backend not involved")
+}
+
+func TestNVMeCLISysfs(t *testing.T) {
+	sys, err := ioutil.TempDir("", "sys")
+	require.NoError(t, err)
+	defer os.RemoveAll(sys)
+	write := func(path, content string) {
+		path = filepath.Join(sys, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	const nqn = "nqn.2016-06.io.spdk:cnode1"
+	n := &nvmeCLI{sys: sys}
+
+	device, err := n.findNamespace(nqn)
+	require.NoError(t, err)
+	assert.Empty(t, device, "no subsystems")
+
+	write("class/nvme-subsystem/nvme-subsys0/subsysnqn", "nqn.2016-06.io.spdk:other\n")
+	write("class/nvme-subsystem/nvme-subsys0/nvme0n1/size", "0")
+	write("class/nvme-subsystem/nvme-subsys1/subsysnqn", nqn+"\n")
+	write("class/nvme-subsystem/nvme-subsys1/nvme1/dev", "0")
+	write("class/nvme-subsystem/nvme-subsys1/nvme1n1/size", "0")
+	write("block/nvme1n1/device/subsysnqn", nqn+"\n")
+	device, err = n.findNamespace(nqn)
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/nvme1n1", device)
+	device, err = n.Connect(context.Background(), NVMeOFTarget{NQN: nqn})
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/nvme1n1", device, "already connected")
+
+	for device, expected := range map[string]string{
+		"/dev/nvme1n1":        nqn,
+		"/dev/nvme0n1":        "",
+		"/dev/tmp123/vda":     "",
+		"/dev/nbd0":           "",
+		"/dev/tmp456/nvme1n1": nqn,
+	} {
+		actual, err := n.SubsystemNQN(device)
+		if assert.NoError(t, err, device) {
+			assert.Equal(t, expected, actual, device)
+		}
+	}
+}
@@ -10,12 +10,20 @@ package oimcsidriver
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pkg/errors"
 
+	"github.com/intel/oim/pkg/log"
 	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/spdk"
 	"google.golang.org/grpc"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
 	"github.com/intel/oim/pkg/spec/oim/v0"
@@ -28,12 +36,27 @@ const (
 	tib int64 = gib * 1024
 
 	maxStorageCapacity = tib // TODO: we don't really know the upper limit
+
+	// topologyKeyNode is the topology segment with the ID of the
+	// node on which the storage of the driver is accessible.
+	topologyKeyNode = "oim.intel.com/node"
 )
 
 // Driver is the public interface for managing the OIM CSI driver.
 type Driver interface {
 	Start(ctx context.Context) (*oimcommon.NonBlockingGRPCServer, error)
 	Run(ctx context.Context) error
+	ServeMetrics(addr string) error
+	// RegisterServices adds the CSI services and OIM extensions of
+	// the driver to a gRPC server. Start does that for its own
+	// server, tests can use it to serve the driver themselves.
+	RegisterServices(s *grpc.Server)
+	// GracefulStop lets in-flight calls finish before stopping
+	// the server started by Start.
+	GracefulStop(timeout time.Duration) error
+	// Reconfigure changes the settings which may change at
+	// runtime.
+	Reconfigure(settings RuntimeSettings) error
 }
 
 // oimDriver is the actual implementation based on CSI 1.0.
@@ -43,11 +66,51 @@ type oimDriver struct {
 	csiVersion            string
 	nodeID                string
 	csiEndpoint           string
+	logger                log.Logger
 	remote                remoteSPDK
 	local                 localSPDK
+	dryRun                *dryRunBackend
 	emulatedCSIDriverName string
 
-	backend OIMBackend
+	prewarmBandwidthLimit int
+	prewarmMaxBytes       int64
+	prewarm               *VolumePrewarmManager
+	benchmark             *FIOBenchmark
+	metadata              *metadataStore
+	imageDir              string
+	maxVolumesPerNode     int64
+	storageClassDefaults  DefaultStorageClassConfig
+	created               *idempotencyCache
+	metrics               *Metrics
+	kubeClient            kubernetes.Interface
+	revisionKubeClient    kubernetes.Interface
+	revisionDynamicClient dynamic.Interface
+	defragSchedule        *oimcommon.CronSchedule
+	defragIOPSThreshold   float64
+	probeTimeout          time.Duration
+	snapshotGCInterval    time.Duration
+
+	volumeNameValidator VolumeNameValidator
+	nvme                NVMeExecutor
+	auditLogger         AuditLogger
+	ops                 opLimiter
+	clones              *cloneLimiter
+	deadlines           *DeadlineEstimator
+	replicator          VolumeReplicator
+	quotas              quotaTracker
+	recorder            record.EventRecorder
+	lockStore           LockStore
+	tokens              TokenStore
+	drain               drainer
+	// limitsMutex protects ops and clones, which Reconfigure may
+	// replace while calls use them.
+	limitsMutex sync.RWMutex
+	// startupError is set while checkStartup fails.
+	startupMutex sync.Mutex
+	startupError error
+
+	backend     OIMBackend
+	accessModes accessModes
 
 	cap []*csi.ControllerServiceCapability
 	vc  []*csi.VolumeCapability_AccessMode
@@ -64,14 +127,38 @@ type oimDriver03 struct {
 
 type cleanup func() error
 
+// volumeInfo is what OIMBackend.listVolumes knows about a volume.
+type volumeInfo struct {
+	volumeID      string
+	capacityBytes int64
+	// bdevUUID is the UUID of the SPDK BDev, if known.
+	bdevUUID string
+	// lvstoreUUID is the UUID of the logical volume store which
+	// contains the volume, if it is a logical volume.
+	lvstoreUUID string
+	// latencyClass is a hint about the access latency, if known.
+	latencyClass string
+	// numaNode is the NUMA node of the storage device, if known.
+	numaNode string
+	// topology is set when the volume is only accessible from
+	// nodes with these labels.
+	topology map[string]string
+	// created is true when the volume did not exist before.
+	created bool
+}
+
 // OIMBackend defines the actual implementation of several operations.
 // It has two implementations:
 // - OIM CSI driver directly controlling SPDK running on the same host (local.go)
 // - OIM CSI driver controlling SPDK through OIM registry and controller (remote.go)
 type OIMBackend interface {
-	createVolume(ctx context.Context, volumeID string, requiredBytes int64) (int64, error)
+	createVolume(ctx context.Context, name string, request createRequest) (volumeInfo, error)
 	deleteVolume(ctx context.Context, volumeID string) error
 	checkVolumeExists(ctx context.Context, volumeID string) error
+	isReadOnly(ctx context.Context, volumeID string) (bool, error)
+	listVolumes(ctx context.Context) ([]volumeInfo, error)
+	getCapacity(ctx context.Context) (int64, error)
+	probe(ctx context.Context) error
 
 	createDevice(ctx context.Context, volumeID string, request interface{}) (string, cleanup, error)
 	deleteDevice(ctx context.Context, volumeID string) error
@@ -109,9 +196,13 @@ func WithDriverName(name string) Option {
 	}
 }
 
-// WithDriverVersion sets the version reported by the driver.
+// WithDriverVersion sets the version reported by the driver instead
+// of oimcommon.Version. It must be a semantic version.
 func WithDriverVersion(version string) Option {
 	return func(od *oimDriver) error {
+		if err := oimcommon.ValidateVersion(version); err != nil {
+			return errors.Wrapf(err, "driver version %q", version)
+		}
 		od.version = version
 		return nil
 	}
@@ -157,6 +248,116 @@ func WithVHostEndpoint(endpoint string) Option {
 	}
 }
 
+// WithLogger sets the logger that the driver uses instead of the
+// one from the context passed to Start.
+func WithLogger(logger log.Logger) Option {
+	return func(od *oimDriver) error {
+		od.logger = logger
+		return nil
+	}
+}
+
+// WithSPDKClient sets the client for talking to SPDK directly,
+// instead of connecting to the VHost endpoint. WithVHostSocketDir
+// must be used when creating vhost controllers.
+func WithSPDKClient(client *spdk.Client) Option {
+	return func(od *oimDriver) error {
+		od.local.client = client
+		return nil
+	}
+}
+
+// WithSPDKPoolSize sets the maximum number of connections to the
+// VHost endpoint that are used concurrently.
+func WithSPDKPoolSize(n int) Option {
+	return func(od *oimDriver) error {
+		od.local.poolSize = n
+		return nil
+	}
+}
+
+// WithSPDKTraceFile appends each SPDK call and its response as JSON
+// line to the file, for debugging. Has no effect in combination with
+// WithSPDKClient.
+func WithSPDKTraceFile(path string) Option {
+	return func(od *oimDriver) error {
+		od.local.traceFile = path
+		return nil
+	}
+}
+
+// WithSPDKCircuitBreaker stops sending requests to SPDK for the reset
+// timeout after maxFailures consecutive communication failures.
+// CreateVolume and DeleteVolume then fail with Unavailable. Has no
+// effect in combination with WithSPDKClient.
+func WithSPDKCircuitBreaker(maxFailures int, resetTimeout time.Duration) Option {
+	return func(od *oimDriver) error {
+		if maxFailures < 1 {
+			return errors.Errorf("invalid maximum number of SPDK failures: %d", maxFailures)
+		}
+		od.local.breaker = spdk.NewCircuitBreaker(maxFailures, resetTimeout)
+		return nil
+	}
+}
+
+// WithVHostSocketDir sets the directory in which SPDK creates the
+// sockets of vhost controllers. The default is the directory of
+// the VHost endpoint.
+func WithVHostSocketDir(dir string) Option {
+	return func(od *oimDriver) error {
+		od.local.vhostSocketDir = dir
+		return nil
+	}
+}
+
+// WithProbeTimeout limits how long Probe waits for SPDK or the OIM
+// registry, zero for no limit besides the deadline of the request.
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(od *oimDriver) error {
+		od.probeTimeout = timeout
+		return nil
+	}
+}
+
+// WithVolumeNameValidator replaces DefaultVolumeNameValidator for
+// checking the names of new volumes.
+func WithVolumeNameValidator(validator VolumeNameValidator) Option {
+	return func(od *oimDriver) error {
+		od.volumeNameValidator = validator
+		return nil
+	}
+}
+
+// WithNVMeExecutor replaces the nvme command line tool for
+// staging volumes with transport=nvmeof in their volume context.
+func WithNVMeExecutor(executor NVMeExecutor) Option {
+	return func(od *oimDriver) error {
+		od.nvme = executor
+		return nil
+	}
+}
+
+// WithAuditLogger enables recording of all mutating CSI operations.
+func WithAuditLogger(logger AuditLogger) Option {
+	return func(od *oimDriver) error {
+		od.auditLogger = logger
+		return nil
+	}
+}
+
+// WithDryRun replaces SPDK and the OIM controller with volumes that
+// only exist in memory, for testing the driver without either of them.
+// Volumes cannot be staged in this mode.
+func WithDryRun(enabled bool) Option {
+	return func(od *oimDriver) error {
+		od.dryRun = nil
+		if enabled {
+			od.dryRun = newDryRunBackend(dryRunCapacity)
+		}
+		return nil
+	}
+}
+
 // WithOIMRegistryAddress sets the gRPC dial string for
 // contacting the OIM registry.
 func WithOIMRegistryAddress(address string) Option {
@@ -185,6 +386,65 @@ func WithOIMControllerID(id string) Option {
 	}
 }
 
+// WithOIMCallRetries sets how often idempotent calls to the OIM
+// controller are tried when they time out or the controller is
+// unavailable, and the timeout for each attempt. Zero means no
+// timeout besides the deadline of the CSI request.
+func WithOIMCallRetries(attempts int, timeout time.Duration) Option {
+	return func(od *oimDriver) error {
+		od.remote.callAttempts = attempts
+		od.remote.callTimeout = timeout
+		return nil
+	}
+}
+
+// WithDeviceTimeout limits how long NodeStageVolume waits for the
+// block device of a volume provided by the OIM controller to appear
+// on the host. Zero waits until the request itself times out.
+func WithDeviceTimeout(timeout time.Duration) Option {
+	return func(od *oimDriver) error {
+		od.remote.deviceTimeout = timeout
+		return nil
+	}
+}
+
+// WithNodeAffinity enables provisioning of volumes through all
+// controllers in the affinity map, depending on the topology
+// requirements of each volume. The credentials for contacting
+// the other controllers must be stored next to the ones given
+// to WithRegistryCreds, as host.<controller ID>.key/crt.
+func WithNodeAffinity(affinity NodeAffinity) Option {
+	return func(od *oimDriver) error {
+		od.remote.nodeAffinity = affinity
+		return nil
+	}
+}
+
+// WithControllerSelector sets how the controller for a new volume
+// gets chosen when node affinity allows more than one. The default is
+// to prefer the controller of the host.
+func WithControllerSelector(selector ControllerSelector) Option {
+	return func(od *oimDriver) error {
+		od.remote.selector = selector
+		return nil
+	}
+}
+
+// WithMDNSDiscovery restricts new volumes to those controllers from
+// the node affinity map which are currently announced as
+// _oim._tcp.local services. The selector from WithControllerSelector,
+// if any, chooses among them. Provisioning calls get canceled and
+// retried on some other controller when a controller disappears.
+// No mDNS client is included, so the oim-csi-driver command cannot
+// enable this. The caller must provide the browser, for example an
+// adapter for github.com/grandcat/zeroconf.
+func WithMDNSDiscovery(browser ServiceBrowser) Option {
+	return func(od *oimDriver) error {
+		od.remote.discovery = newMDNSDiscovery(browser)
+		return nil
+	}
+}
+
 // WithEmulation switches between different personalities:
 // in this mode, the OIM CSI driver handles arguments for
 // some other, "emulated" CSI driver and redirects local
@@ -196,15 +456,272 @@ func WithEmulation(csiDriverName string) Option {
 	}
 }
 
+// WithPrewarmBandwidthLimit caps the I/O rate for prewarming volumes
+// with prewarm_on_attach=true. Zero disables the limit.
+func WithPrewarmBandwidthLimit(mbps int) Option {
+	return func(od *oimDriver) error {
+		if mbps < 0 {
+			return errors.Errorf("invalid prewarm bandwidth limit: %d", mbps)
+		}
+		od.prewarmBandwidthLimit = mbps
+		return nil
+	}
+}
+
+// WithPrewarmMaxBytes limits how much of a volume gets prewarmed.
+// Zero prewarms the entire volume.
+func WithPrewarmMaxBytes(maxBytes int64) Option {
+	return func(od *oimDriver) error {
+		if maxBytes < 0 {
+			return errors.Errorf("invalid prewarm max bytes: %d", maxBytes)
+		}
+		od.prewarmMaxBytes = maxBytes
+		return nil
+	}
+}
+
+// WithTagPropagation enables copying tag labels from PVCs into
+// the volume metadata, using the given client to watch PVCs
+// and PVs.
+func WithTagPropagation(client kubernetes.Interface) Option {
+	return func(od *oimDriver) error {
+		od.kubeClient = client
+		return nil
+	}
+}
+
+// WithStorageClassVersioning enables the
+// StorageClassVersioningController. It needs a normal client for
+// watching StorageClasses and a dynamic client for creating
+// OIMStorageClassRevision objects.
+func WithStorageClassVersioning(client kubernetes.Interface, dynamicClient dynamic.Interface) Option {
+	return func(od *oimDriver) error {
+		od.revisionKubeClient = client
+		od.revisionDynamicClient = dynamicClient
+		return nil
+	}
+}
+
+// WithDefragmentation enables the OnlineDefragmenter. The schedule
+// is a cron expression. Logical volumes are only defragmented if the
+// SPDK daemon handles less than iopsThreshold I/O operations per
+// second at the scheduled time. Only supported when using SPDK
+// directly.
+func WithDefragmentation(schedule string, iopsThreshold float64) Option {
+	return func(od *oimDriver) error {
+		cs, err := oimcommon.ParseCronSchedule(schedule)
+		if err != nil {
+			return err
+		}
+		od.defragSchedule = cs
+		od.defragIOPSThreshold = iopsThreshold
+		return nil
+	}
+}
+
+// WithSnapshotGarbageCollection enables the SnapshotGarbageCollector,
+// which checks for expired snapshots at the given interval. Only
+// supported when using SPDK directly.
+func WithSnapshotGarbageCollection(interval time.Duration) Option {
+	return func(od *oimDriver) error {
+		od.snapshotGCInterval = interval
+		return nil
+	}
+}
+
+// WithEventRecorder enables Kubernetes events about volumes for the
+// PVCs that they were created for, see NewEventRecorder. The PVC is
+// only known when the external-provisioner passes it as parameter.
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(od *oimDriver) error {
+		od.recorder = recorder
+		return nil
+	}
+}
+
+// WithSecretReader provides the keys of volumes created with
+// encrypted=true, see NewSecretReader. Only supported when using SPDK
+// directly.
+func WithSecretReader(secrets SecretReader) Option {
+	return func(od *oimDriver) error {
+		od.local.secrets = secrets
+		return nil
+	}
+}
+
+// WithMetadataStore keeps the volume and snapshot metadata in the
+// file, so that it survives a restart of the driver. Without it,
+// metadata is only kept in memory.
+func WithMetadataStore(path string) Option {
+	return func(od *oimDriver) error {
+		metadata, err := loadMetadataStore(path)
+		if err != nil {
+			return err
+		}
+		od.metadata = metadata
+		return nil
+	}
+}
+
+// WithSharedMetadataStore is like WithMetadataStore for a file that
+// is also used by the drivers on other nodes, for example on a
+// shared file system. The file gets read again when modified by
+// them. Required for MigrateVolume.
+func WithSharedMetadataStore(path string) Option {
+	return func(od *oimDriver) error {
+		metadata, err := loadMetadataStore(path)
+		if err != nil {
+			return err
+		}
+		metadata.shared = true
+		od.metadata = metadata
+		return nil
+	}
+}
+
+// WithImageDir enables the localImage StorageClass parameter for
+// populating new volumes with RAW images from the directory. Only
+// supported when using SPDK directly.
+func WithImageDir(dir string) Option {
+	return func(od *oimDriver) error {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		od.imageDir = abs
+		return nil
+	}
+}
+
+// WithStorageClassDefaults sets default values for parameters that
+// are not set in the StorageClass of a new volume, see
+// LoadDefaultStorageClassConfig.
+func WithStorageClassDefaults(defaults DefaultStorageClassConfig) Option {
+	return func(od *oimDriver) error {
+		od.storageClassDefaults = defaults
+		return nil
+	}
+}
+
+// WithCloneRateLimit limits how many volumes per second get cloned
+// from a volume or restored from a snapshot, with bursts of up to
+// the given size. Additional requests wait until the deadline of
+// their request. Zero removes the limit.
+func WithCloneRateLimit(rps float64, burst int) Option {
+	return func(od *oimDriver) error {
+		if rps < 0 {
+			return errors.Errorf("invalid clone rate limit: %g", rps)
+		}
+		if rps > 0 && burst < 1 {
+			return errors.Errorf("invalid clone burst: %d", burst)
+		}
+		od.clones = newCloneLimiter(rps, burst)
+		return nil
+	}
+}
+
+// WithDeadlineEstimator lets volume creation continue beyond the
+// deadline of the request when the estimator predicts that SPDK
+// needs more time.
+func WithDeadlineEstimator(estimator DeadlineEstimator) Option {
+	return func(od *oimDriver) error {
+		if estimator.Base < 0 || estimator.ThickBytesPerSecond < 0 {
+			return errors.Errorf("invalid deadline estimator: %+v", estimator)
+		}
+		od.deadlines = &estimator
+		return nil
+	}
+}
+
+// WithMaxVolumesPerNode sets the maximum number of volumes that can
+// be attached to the node. Zero means "unlimited".
+func WithMaxVolumesPerNode(max int64) Option {
+	return func(od *oimDriver) error {
+		if max < 0 {
+			return errors.Errorf("invalid maximum number of volumes per node: %d", max)
+		}
+		od.maxVolumesPerNode = max
+		return nil
+	}
+}
+
+// WithLVStoreCacheTTL determines how long the logical volume stores
+// used for selecting a store for new volumes are cached. Zero
+// disables caching. Only supported when using SPDK directly.
+func WithLVStoreCacheTTL(ttl time.Duration) Option {
+	return func(od *oimDriver) error {
+		if ttl < 0 {
+			return errors.Errorf("invalid logical volume store cache TTL: %s", ttl)
+		}
+		od.local.lvstores.ttl = ttl
+		return nil
+	}
+}
+
+// WithTokenAuth requires a bearer token for all calls of the CSI
+// controller service and restricts each caller to the volumes and
+// snapshots of the tenant of its token, see TokenAuthInterceptor.
+func WithTokenAuth(tokens TokenStore) Option {
+	return func(od *oimDriver) error {
+		od.tokens = tokens
+		return nil
+	}
+}
+
+// WithVolumeReplicator enables MigrateVolume. Only supported when
+// using a OIM registry.
+func WithVolumeReplicator(replicator VolumeReplicator) Option {
+	return func(od *oimDriver) error {
+		od.replicator = replicator
+		return nil
+	}
+}
+
+// WithLockStore prevents staging a volume on more than one node at
+// a time, except in the multi-node reader mode. The store must be
+// shared by the drivers on all nodes.
+func WithLockStore(store LockStore) Option {
+	return func(od *oimDriver) error {
+		od.lockStore = store
+		return nil
+	}
+}
+
+// WithMaxConcurrentOperations limits how many volume and snapshot
+// creations and deletions may run at the same time. Additional
+// operations wait until the deadline of their request. Zero removes
+// the limit.
+func WithMaxConcurrentOperations(max int) Option {
+	return func(od *oimDriver) error {
+		if max < 0 {
+			return fmt.Errorf("maximum number of concurrent operations must not be negative: %d", max)
+		}
+		od.ops = newOpLimiter(max)
+		return nil
+	}
+}
+
 // New constructs a new OIM driver instance.
 func New(options ...Option) (Driver, error) {
 	od := oimDriver03{
 		oimDriver: oimDriver{
 			driverName:  "oim-driver",
 			csiVersion:  csi10,
-			version:     "unknown",
+			version:     oimcommon.Version,
 			nodeID:      "unset-node-id",
 			csiEndpoint: "unix:///var/run/oim-driver.socket",
+			benchmark:   NewFIOBenchmark(),
+			metadata:    newMetadataStore(),
+			created:     newIdempotencyCache(),
+			metrics:     NewMetrics(),
+			// Well below the default timeout of the kubelet
+			// for liveness probes.
+			probeTimeout:        5 * time.Second,
+			volumeNameValidator: DefaultVolumeNameValidator,
+			nvme:                &nvmeCLI{sys: "/sys"},
+			remote: remoteSPDK{
+				callAttempts: defaultCallAttempts,
+			},
 		},
 	}
 	for _, op := range options {
@@ -213,10 +730,15 @@ func New(options ...Option) (Driver, error) {
 			return nil, err
 		}
 	}
-	if od.local.vhostEndpoint != "" && od.remote.oimRegistryAddress != "" {
+	// Migrated volumes are found via their metadata.
+	od.remote.metadata = od.metadata
+	if od.local.enabled() && od.remote.oimRegistryAddress != "" {
 		return nil, errors.New("SPDK and OIM registry usage are mutually exclusive")
 	}
-	if od.local.vhostEndpoint == "" && od.remote.oimRegistryAddress == "" {
+	if od.dryRun != nil && (od.local.enabled() || od.remote.oimRegistryAddress != "") {
+		return nil, errors.New("Dry-run mode cannot be combined with SPDK or OIM registry usage")
+	}
+	if !od.local.enabled() && od.remote.oimRegistryAddress == "" && od.dryRun == nil {
 		return nil, errors.New("Either SPDK or OIM registry must be selected")
 	}
 	if od.remote.oimRegistryAddress != "" && (od.remote.oimControllerID == "" ||
@@ -224,23 +746,102 @@ func New(options ...Option) (Driver, error) {
 		od.remote.registryKey == "") {
 		return nil, errors.New("Cannot use a OIM registry without a controller ID, CA file and key file")
 	}
+	if od.remote.oimRegistryAddress != "" {
+		rotator, err := NewCertificateRotator(od.remote.registryCA, od.remote.registryKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "load OIM registry credentials")
+		}
+		od.remote.rotator = rotator
+		od.remote.rotators = map[string]*CertificateRotator{}
+		for controllerID := range od.remote.nodeAffinity {
+			if controllerID == od.remote.oimControllerID {
+				continue
+			}
+			rotator, err := NewCertificateRotator(od.remote.registryCA, controllerKey(od.remote.registryKey, controllerID))
+			if err != nil {
+				return nil, errors.Wrapf(err, "load OIM registry credentials for controller %s", controllerID)
+			}
+			od.remote.rotators[controllerID] = rotator
+		}
+	} else if len(od.remote.nodeAffinity) > 0 {
+		return nil, errors.New("Node affinity requires a OIM registry")
+	}
+	if od.remote.discovery != nil {
+		if len(od.remote.nodeAffinity) == 0 {
+			return nil, errors.New("Controller discovery requires node affinity")
+		}
+		od.remote.discovery.selector = od.remote.selector
+		od.remote.discovery.hostControllerID = od.remote.oimControllerID
+		od.remote.selector = od.remote.discovery
+	}
+	od.prewarm = NewVolumePrewarmManager(od.prewarmBandwidthLimit, od.prewarmMaxBytes)
 	// malloc capabilities
 	switch od.csiVersion {
 	case csi03:
-		od.setControllerServiceCapabilities([]csi0.ControllerServiceCapability_RPC_Type{csi0.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+		caps := []csi0.ControllerServiceCapability_RPC_Type{
+			csi0.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi0.ControllerServiceCapability_RPC_GET_CAPACITY,
+		}
+		if od.local.enabled() {
+			caps = append(caps,
+				csi0.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				csi0.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+				csi0.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				csi0.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			)
+		} else if od.dryRun != nil {
+			caps = append(caps, csi0.ControllerServiceCapability_RPC_LIST_VOLUMES)
+		}
+		od.setControllerServiceCapabilities(caps)
 		od.setVolumeCapabilityAccessModes([]csi0.VolumeCapability_AccessMode_Mode{csi0.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 	case csi10:
-		od.oimDriver.setControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+		caps := []csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		}
+		if od.local.enabled() {
+			caps = append(caps,
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
+			)
+		} else if od.dryRun != nil {
+			caps = append(caps, csi.ControllerServiceCapability_RPC_LIST_VOLUMES)
+		}
+		od.oimDriver.setControllerServiceCapabilities(caps)
 		od.oimDriver.setVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 	default:
 		return nil, errors.Errorf("running as CSI version %q not supported", od.csiVersion)
 	}
-	if od.local.vhostEndpoint != "" {
+	switch {
+	case od.dryRun != nil:
+		if od.emulatedCSIDriverName != "" {
+			return nil, errors.Errorf("emulating CSI driver %q not supported in dry-run mode", od.emulatedCSIDriverName)
+		}
+		if od.defragSchedule != nil {
+			return nil, errors.New("defragmentation not supported in dry-run mode")
+		}
+		if od.snapshotGCInterval != 0 {
+			return nil, errors.New("snapshot garbage collection not supported in dry-run mode")
+		}
+		od.backend = od.dryRun
+		od.accessModes = localAccessModes
+	case od.local.enabled():
 		if od.emulatedCSIDriverName != "" {
 			return nil, errors.Errorf("emulating CSI driver %q not currently implemented when using SPDK directly", od.emulatedCSIDriverName)
 		}
 		od.backend = &od.local
-	} else {
+		od.accessModes = localAccessModes
+	default:
+		if od.defragSchedule != nil {
+			return nil, errors.New("defragmentation not supported when using a OIM registry")
+		}
+		if od.snapshotGCInterval != 0 {
+			return nil, errors.New("snapshot garbage collection not supported when using a OIM registry")
+		}
 		if od.emulatedCSIDriverName != "" {
 			switch od.csiVersion {
 			case csi03:
@@ -268,34 +869,113 @@ func New(options ...Option) (Driver, error) {
 			}
 		}
 		od.backend = &od.remote
+		od.accessModes = remoteAccessModes
 	}
 	return &od, nil
 }
 
 func (od *oimDriver03) Start(ctx context.Context) (*oimcommon.NonBlockingGRPCServer, error) {
+	if od.logger != nil {
+		ctx = log.WithLogger(ctx, od.logger)
+	}
 	s := oimcommon.NonBlockingGRPCServer{
-		Endpoint: od.csiEndpoint,
-	}
-	s.Start(ctx, func(s *grpc.Server) {
-		switch od.csiVersion {
-		case csi03:
-			csi0.RegisterIdentityServer(s, od)
-			csi0.RegisterNodeServer(s, od)
-			csi0.RegisterControllerServer(s, od)
-		case csi10:
-			csi.RegisterIdentityServer(s, &od.oimDriver)
-			csi.RegisterNodeServer(s, &od.oimDriver)
-			csi.RegisterControllerServer(s, &od.oimDriver)
-		}
-	})
+		Endpoint:     od.csiEndpoint,
+		Interceptors: od.interceptors(),
+	}
+	if od.remote.rotator != nil {
+		go func() {
+			if err := od.remote.rotator.Run(ctx); err != nil {
+				log.FromContext(ctx).Errorw("watching OIM registry credentials", "error", err)
+			}
+		}()
+	}
+	for controllerID, rotator := range od.remote.rotators {
+		controllerID, rotator := controllerID, rotator
+		go func() {
+			if err := rotator.Run(ctx); err != nil {
+				log.FromContext(ctx).Errorw("watching OIM registry credentials", "controllerid", controllerID, "error", err)
+			}
+		}()
+	}
+	if od.remote.discovery != nil {
+		go func() {
+			if err := od.remote.discovery.Run(ctx); err != nil {
+				log.FromContext(ctx).Errorw("discovering OIM controllers", "error", err)
+			}
+		}()
+	}
+	if od.defragSchedule != nil {
+		defrag := &OnlineDefragmenter{
+			local:          &od.local,
+			schedule:       od.defragSchedule,
+			iopsThreshold:  od.defragIOPSThreshold,
+			sampleInterval: 5 * time.Second,
+		}
+		go func() {
+			if err := defrag.Run(ctx); err != nil {
+				log.FromContext(ctx).Errorw("defragmentation", "error", err)
+			}
+		}()
+	}
+	if od.snapshotGCInterval != 0 {
+		gc := &SnapshotGarbageCollector{
+			od:       &od.oimDriver,
+			interval: od.snapshotGCInterval,
+		}
+		go gc.Run(ctx)
+	}
+	if od.kubeClient != nil {
+		tp := newVolumeTagPropagator(od.kubeClient, od.driverName, od.metadata)
+		go func() {
+			if err := tp.Run(ctx); err != nil {
+				log.FromContext(ctx).Errorw("propagating PVC tags", "error", err)
+			}
+		}()
+	}
+	if od.revisionKubeClient != nil {
+		sc := newStorageClassVersioningController(od.revisionKubeClient, od.revisionDynamicClient, od.driverName)
+		go func() {
+			if err := sc.Run(ctx); err != nil {
+				log.FromContext(ctx).Errorw("tracking StorageClass revisions", "error", err)
+			}
+		}()
+	}
+	// Failures are remembered and reported by Probe and
+	// CreateVolume.
+	_ = od.checkStartup(ctx)
+	od.drain.mutex.Lock()
+	od.drain.server = &s
+	od.drain.mutex.Unlock()
+	s.Start(ctx, od.RegisterServices)
 	return &s, nil
 }
 
+func (od *oimDriver03) RegisterServices(s *grpc.Server) {
+	switch od.csiVersion {
+	case csi03:
+		csi0.RegisterIdentityServer(s, od)
+		csi0.RegisterNodeServer(s, od)
+		csi0.RegisterControllerServer(s, od)
+	case csi10:
+		csi.RegisterIdentityServer(s, &od.oimDriver)
+		csi.RegisterNodeServer(s, &od.oimDriver)
+		csi.RegisterControllerServer(s, &od.oimDriver)
+	}
+	registerVolumeInspectServer(s, &od.oimDriver)
+	if od.local.enabled() {
+		registerSnapshotDiffServer(s, &VolumeSnapshotDiffAPI{local: &od.local, metadata: od.metadata})
+		registerVolumeRenameServer(s, &od.oimDriver)
+	}
+	if od.replicator != nil {
+		registerVolumeMigrationServer(s, &od.oimDriver)
+	}
+}
+
 func (od *oimDriver03) Run(ctx context.Context) error {
 	s, err := od.Start(ctx)
 	if err != nil {
 		return err
 	}
 	s.Wait(ctx)
-	return nil
+	return od.local.close()
 }
@@ -15,6 +15,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,6 +34,7 @@ import (
 	"github.com/intel/oim/test/pkg/spdk"
 
 	. "github.com/onsi/ginkgo"
+	ginkgoconfig "github.com/onsi/ginkgo/config"
 )
 
 // SudoMount provides wrappers around several commands used by the k8s
@@ -72,7 +74,8 @@ func (s SudoMount) Close() {
 	os.Setenv("PATH", s.searchPath)
 }
 
-// Runs tests in local SPDK mode.
+// Runs tests in local SPDK mode. Without a real SPDK, a fake one
+// is used and specs which need block devices are skipped.
 //
 // The corresponding test for non-local mode is in
 // test/e2e/storage/oim-csi.go.
@@ -85,8 +88,17 @@ func TestSPDK(t *testing.T) {
 	if err := spdk.Init(); err != nil {
 		require.NoError(t, err)
 	}
+	vhostEndpoint := spdk.SPDKPath
 	if spdk.SPDK == nil {
-		t.Skip("No VHost.")
+		fake := newSanityFake(t)
+		defer fake.Close()
+		vhostEndpoint = fake.Path
+		skip := ginkgoconfig.GinkgoConfig.SkipString
+		ginkgoconfig.GinkgoConfig.SkipString = sanitySkip
+		defer func() { ginkgoconfig.GinkgoConfig.SkipString = skip }()
+	} else {
+		sudo := SetupSudoMount(t)
+		defer sudo.Close()
 	}
 
 	tmp, err := ioutil.TempDir("", "oim-driver")
@@ -94,15 +106,12 @@ func TestSPDK(t *testing.T) {
 	defer os.RemoveAll(tmp)
 
 	endpoint := "unix://" + tmp + "/oim-driver.sock"
-	driver, err := New(WithCSIEndpoint(endpoint), WithVHostEndpoint(spdk.SPDKPath))
+	driver, err := New(WithCSIEndpoint(endpoint), WithVHostEndpoint(vhostEndpoint))
 	require.NoError(t, err)
 	s, err := driver.Start(ctx)
 	require.NoError(t, err)
 	defer s.ForceStop(ctx)
 
-	sudo := SetupSudoMount(t)
-	defer sudo.Close()
-
 	// Now call the test suite.
 	config := sanity.Config{
 		TargetPath:     tmp + "/target-path",
@@ -115,12 +124,44 @@ func TestSPDK(t *testing.T) {
 
 // MockController implements oim.Controller.
 type MockController struct {
-	MapVolumes   []oim.MapVolumeRequest
-	UnmapVolumes []oim.UnmapVolumeRequest
+	MapVolumes           []oim.MapVolumeRequest
+	UnmapVolumes         []oim.UnmapVolumeRequest
+	ProvisionMallocBDevs []oim.ProvisionMallocBDevRequest
+
+	// Stall is the number of calls which get recorded, but then
+	// never return, like a controller which times out after
+	// doing the work.
+	Stall int
+	// MapError is returned by MapVolume.
+	MapError error
+
+	mutex sync.Mutex
+}
+
+func (m *MockController) stall(ctx context.Context) error {
+	m.mutex.Lock()
+	stall := m.Stall > 0
+	if stall {
+		m.Stall--
+	}
+	m.mutex.Unlock()
+	if stall {
+		<-ctx.Done()
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	return nil
 }
 
 func (m *MockController) MapVolume(ctx context.Context, in *oim.MapVolumeRequest) (*oim.MapVolumeReply, error) {
+	m.mutex.Lock()
 	m.MapVolumes = append(m.MapVolumes, *in)
+	m.mutex.Unlock()
+	if err := m.stall(ctx); err != nil {
+		return nil, err
+	}
+	if m.MapError != nil {
+		return nil, m.MapError
+	}
 	return &oim.MapVolumeReply{
 		PciAddress: &oim.PCIAddress{
 			Bus:    8,
@@ -131,10 +172,19 @@ func (m *MockController) MapVolume(ctx context.Context, in *oim.MapVolumeRequest
 }
 
 func (m *MockController) UnmapVolume(ctx context.Context, in *oim.UnmapVolumeRequest) (*oim.UnmapVolumeReply, error) {
+	m.mutex.Lock()
+	m.UnmapVolumes = append(m.UnmapVolumes, *in)
+	m.mutex.Unlock()
 	return &oim.UnmapVolumeReply{}, nil
 }
 
 func (m *MockController) ProvisionMallocBDev(ctx context.Context, in *oim.ProvisionMallocBDevRequest) (*oim.ProvisionMallocBDevReply, error) {
+	m.mutex.Lock()
+	m.ProvisionMallocBDevs = append(m.ProvisionMallocBDevs, *in)
+	m.mutex.Unlock()
+	if err := m.stall(ctx); err != nil {
+		return nil, err
+	}
 	return &oim.ProvisionMallocBDevReply{}, nil
 }
 
@@ -142,6 +192,58 @@ func (m *MockController) CheckMallocBDev(ctx context.Context, in *oim.CheckMallo
 	return &oim.CheckMallocBDevReply{}, nil
 }
 
+// startMockControllers runs an OIM registry with a mock controller
+// for each ID, with sockets in the tmp directory. It returns the
+// registry address.
+func startMockControllers(ctx context.Context, t *testing.T, tmp string, controllerIDs ...string) (string, map[string]*MockController) {
+	adminCtx := oimregistry.RegistryClientContext(ctx, "user.admin")
+	registryAddress := "unix://" + tmp + "/oim-registry.sock"
+	tlsConfig, err := oimcommon.LoadTLSConfig(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/component.registry.key"), "")
+	require.NoError(t, err)
+	registry, err := oimregistry.New(oimregistry.TLS(tlsConfig))
+	require.NoError(t, err)
+	registryServer, service := registry.Server(registryAddress)
+	err = registryServer.Start(ctx, service)
+	require.NoError(t, err)
+	go func() {
+		<-ctx.Done()
+		registryServer.ForceStop(context.Background())
+	}()
+
+	controllers := map[string]*MockController{}
+	for _, controllerID := range controllerIDs {
+		controllerAddress := "unix://" + tmp + "/oim-controller-" + controllerID + ".sock"
+		controller := &MockController{}
+		controllerCreds, err := oimcommon.LoadTLS(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"),
+			os.ExpandEnv("${TEST_WORK}/ca/controller."+controllerID),
+			"component.registry")
+		require.NoError(t, err)
+		controllerServer, controllerService := oimcontroller.Server(controllerAddress, controller, controllerCreds)
+		err = controllerServer.Start(ctx, controllerService)
+		require.NoError(t, err)
+		go func() {
+			<-ctx.Done()
+			controllerServer.ForceStop(context.Background())
+		}()
+		_, err = registry.SetValue(adminCtx, &oim.SetValueRequest{
+			Value: &oim.Value{
+				Path:  controllerID + "/" + oimcommon.RegistryAddress,
+				Value: controllerAddress,
+			},
+		})
+		require.NoError(t, err)
+		controllers[controllerID] = controller
+	}
+	return registryAddress, controllers
+}
+
+// provisioned returns a copy of the recorded ProvisionMallocBDev calls.
+func (m *MockController) provisioned() []oim.ProvisionMallocBDevRequest {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]oim.ProvisionMallocBDevRequest{}, m.ProvisionMallocBDevs...)
+}
+
 // Runs tests with OIM registry and a mock controller.
 // This can only be used to test the communication paths, but not
 // the actual operation.
@@ -192,6 +294,7 @@ func TestMockOIM(t *testing.T) {
 		WithOIMRegistryAddress(registryAddress),
 		WithRegistryCreds(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/host."+controllerID)),
 		WithOIMControllerID(controllerID),
+		WithDeviceTimeout(2*time.Second),
 	)
 	require.NoError(t, err)
 	s, err := driver.Start(ctx)
@@ -204,6 +307,10 @@ func TestMockOIM(t *testing.T) {
 	require.NoError(t, err)
 	csiClient := csi.NewNodeClient(conn)
 
+	// The registry knows the controller.
+	_, err = csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+	require.NoError(t, err, "Probe")
+
 	// This will start waiting for a device that can never appear,
 	// so we force it to time out.
 	volumeID := "my-test-volume"
@@ -223,4 +330,265 @@ func TestMockOIM(t *testing.T) {
 		// What we can test reliably is that we get a DeadlineExceeded gRPC code.
 		assert.Equal(t, status.Convert(err).Code(), codes.DeadlineExceeded, fmt.Sprintf("expected DeadlineExceeded, got: %s", err))
 	}
+
+	// Without a deadline for the request, the device timeout
+	// must abort the wait.
+	_, err = csiClient.NodeStageVolume(ctx,
+		&csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: tmp + "/stagingtarget",
+			VolumeCapability:  &csi.VolumeCapability{},
+		})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out waiting for device")
+	}
+}
+
+// The connection to the OIM registry uses mutual TLS. A registry
+// with a certificate from a different CA must not be trusted.
+func TestUntrustedRegistry(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	controllerID := "host-0"
+
+	registryAddress := "unix://" + tmp + "/oim-registry.sock"
+	tlsConfig, err := oimcommon.LoadTLSConfig(os.ExpandEnv("${TEST_WORK}/evil-ca/evil-ca.crt"), os.ExpandEnv("${TEST_WORK}/evil-ca/component.registry.key"), "")
+	require.NoError(t, err)
+	registry, err := oimregistry.New(oimregistry.TLS(tlsConfig))
+	require.NoError(t, err)
+	registryServer, service := registry.Server(registryAddress)
+	err = registryServer.Start(ctx, service)
+	require.NoError(t, err)
+	defer registryServer.ForceStop(ctx)
+
+	driver, err := New(WithCSIEndpoint("unix://"+tmp+"/oim-driver.sock"),
+		WithOIMRegistryAddress(registryAddress),
+		WithRegistryCreds(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/host."+controllerID)),
+		WithOIMControllerID(controllerID),
+		WithOIMCallRetries(1, time.Second),
+	)
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	_, err = od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: mib},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate signed by unknown authority")
+	}
+}
+
+// Runs CreateVolume with two mock controllers in different zones.
+func TestTopology(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	adminCtx := oimregistry.RegistryClientContext(ctx, "user.admin")
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	registryAddress := "unix://" + tmp + "/oim-registry.sock"
+	tlsConfig, err := oimcommon.LoadTLSConfig(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/component.registry.key"), "")
+	require.NoError(t, err)
+	registry, err := oimregistry.New(oimregistry.TLS(tlsConfig))
+	require.NoError(t, err)
+	registryServer, service := registry.Server(registryAddress)
+	err = registryServer.Start(ctx, service)
+	require.NoError(t, err)
+	defer registryServer.ForceStop(ctx)
+
+	const zone = "oim.intel.com/zone"
+	affinity := NodeAffinity{
+		"host-0": {zone: "a"},
+		"host-1": {zone: "b"},
+	}
+	controllers := map[string]*MockController{}
+	for controllerID := range affinity {
+		controllerAddress := "unix://" + tmp + "/oim-controller-" + controllerID + ".sock"
+		controller := &MockController{}
+		controllerCreds, err := oimcommon.LoadTLS(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"),
+			os.ExpandEnv("${TEST_WORK}/ca/controller."+controllerID),
+			"component.registry")
+		require.NoError(t, err)
+		controllerServer, controllerService := oimcontroller.Server(controllerAddress, controller, controllerCreds)
+		err = controllerServer.Start(ctx, controllerService)
+		require.NoError(t, err)
+		defer controllerServer.ForceStop(ctx)
+		_, err = registry.SetValue(adminCtx, &oim.SetValueRequest{
+			Value: &oim.Value{
+				Path:  controllerID + "/" + oimcommon.RegistryAddress,
+				Value: controllerAddress,
+			},
+		})
+		require.NoError(t, err)
+		controllers[controllerID] = controller
+	}
+
+	driver, err := New(WithCSIEndpoint("unix://"+tmp+"/oim-driver.sock"),
+		WithOIMRegistryAddress(registryAddress),
+		WithRegistryCreds(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/host.host-0")),
+		WithOIMControllerID("host-0"),
+		WithNodeAffinity(affinity),
+	)
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	info, err := od.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{zone: "a"}, info.GetAccessibleTopology().GetSegments(), "node topology")
+
+	createVolume := func(name string, requisite ...string) (*csi.CreateVolumeResponse, error) {
+		var topologies []*csi.Topology
+		for _, value := range requisite {
+			topologies = append(topologies, &csi.Topology{Segments: map[string]string{zone: value}})
+		}
+		return od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			AccessibilityRequirements: &csi.TopologyRequirement{Requisite: topologies},
+		})
+	}
+
+	// Zone b is only served by the other controller.
+	resp, err := createVolume("vol-b", "b")
+	require.NoError(t, err)
+	assert.Equal(t, "host-1/vol-b", resp.GetVolume().GetVolumeId())
+	assert.Equal(t, "oim.intel.com/zone=b", resp.GetVolume().GetVolumeContext()[topologyContextKey])
+	if assert.Len(t, resp.GetVolume().GetAccessibleTopology(), 1) {
+		assert.Equal(t, map[string]string{zone: "b"}, resp.GetVolume().GetAccessibleTopology()[0].GetSegments())
+	}
+	assert.Empty(t, controllers["host-0"].ProvisionMallocBDevs, "host-0 provisioned")
+	if assert.Len(t, controllers["host-1"].ProvisionMallocBDevs, 1, "host-1 provisioned") {
+		assert.Equal(t, "vol-b", controllers["host-1"].ProvisionMallocBDevs[0].BdevName)
+	}
+
+	// Both zones are okay, the controller of the host wins.
+	resp, err = createVolume("vol-ab", "b", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "vol-ab", resp.GetVolume().GetVolumeId())
+	assert.Equal(t, "oim.intel.com/zone=a", resp.GetVolume().GetVolumeContext()[topologyContextKey])
+	assert.Len(t, controllers["host-0"].ProvisionMallocBDevs, 1, "host-0 provisioned")
+
+	// No controller in zone c.
+	_, err = createVolume("vol-c", "c")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "zone c: %v", err)
+
+	// Deleting goes to the controller which provisioned the volume.
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "host-1/vol-b"})
+	require.NoError(t, err)
+	if assert.Len(t, controllers["host-1"].ProvisionMallocBDevs, 2, "host-1 provisioned") {
+		assert.Equal(t, oim.ProvisionMallocBDevRequest{BdevName: "vol-b"}, controllers["host-1"].ProvisionMallocBDevs[1])
+	}
+}
+
+// Runs CreateVolume and NodeStageVolume with a controller that
+// times out or fails.
+func TestRetry(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	adminCtx := oimregistry.RegistryClientContext(ctx, "user.admin")
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	controllerID := "host-0"
+
+	registryAddress := "unix://" + tmp + "/oim-registry.sock"
+	tlsConfig, err := oimcommon.LoadTLSConfig(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/component.registry.key"), "")
+	require.NoError(t, err)
+	registry, err := oimregistry.New(oimregistry.TLS(tlsConfig))
+	require.NoError(t, err)
+	registryServer, service := registry.Server(registryAddress)
+	err = registryServer.Start(ctx, service)
+	require.NoError(t, err)
+	defer registryServer.ForceStop(ctx)
+
+	controllerAddress := "unix://" + tmp + "/oim-controller.sock"
+	controller := &MockController{}
+	controllerCreds, err := oimcommon.LoadTLS(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"),
+		os.ExpandEnv("${TEST_WORK}/ca/controller."+controllerID),
+		"component.registry")
+	require.NoError(t, err)
+	controllerServer, controllerService := oimcontroller.Server(controllerAddress, controller, controllerCreds)
+	err = controllerServer.Start(ctx, controllerService)
+	require.NoError(t, err)
+	defer controllerServer.ForceStop(ctx)
+
+	_, err = registry.SetValue(adminCtx, &oim.SetValueRequest{
+		Value: &oim.Value{
+			Path:  controllerID + "/" + oimcommon.RegistryAddress,
+			Value: controllerAddress,
+		},
+	})
+	require.NoError(t, err)
+
+	driver, err := New(WithCSIEndpoint("unix://"+tmp+"/oim-driver.sock"),
+		WithOIMRegistryAddress(registryAddress),
+		WithRegistryCreds(os.ExpandEnv("${TEST_WORK}/ca/ca.crt"), os.ExpandEnv("${TEST_WORK}/ca/host."+controllerID)),
+		WithOIMControllerID(controllerID),
+		WithOIMCallRetries(3, 500*time.Millisecond),
+	)
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	createVolume := func(name string) (*csi.CreateVolumeResponse, error) {
+		return od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: mib},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+	}
+
+	// The first attempt times out, the second one finds the
+	// existing BDev.
+	controller.Stall = 1
+	_, err = createVolume("vol")
+	require.NoError(t, err)
+	assert.Equal(t, []oim.ProvisionMallocBDevRequest{
+		{BdevName: "vol", Size_: mib},
+		{BdevName: "vol", Size_: mib},
+	}, controller.ProvisionMallocBDevs)
+
+	// All attempts time out, the BDev gets removed again.
+	controller.ProvisionMallocBDevs = nil
+	controller.Stall = 3
+	_, err = createVolume("vol2")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "timeout: %v", err)
+	assert.Equal(t, []oim.ProvisionMallocBDevRequest{
+		{BdevName: "vol2", Size_: mib},
+		{BdevName: "vol2", Size_: mib},
+		{BdevName: "vol2", Size_: mib},
+		{BdevName: "vol2"},
+	}, controller.ProvisionMallocBDevs)
+
+	// Mapping fails permanently and gets undone.
+	controller.MapError = status.Error(codes.InvalidArgument, "no such volume")
+	_, err = od.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: tmp + "/stagingtarget",
+		VolumeCapability:  &csi.VolumeCapability{},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no such volume")
+	}
+	assert.Len(t, controller.MapVolumes, 1, "MapVolume")
+	assert.Equal(t, []oim.UnmapVolumeRequest{{VolumeId: "vol"}}, controller.UnmapVolumes)
 }
@@ -0,0 +1,42 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/status"
+)
+
+// opLimiter is a counting semaphore for the number of volume
+// operations which may talk to the backend at the same time. A nil
+// opLimiter imposes no limit.
+type opLimiter chan struct{}
+
+func newOpLimiter(max int) opLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(opLimiter, max)
+}
+
+// acquire blocks until the operation may proceed or the context is
+// done. The returned function must be called once the operation is
+// complete.
+func (l opLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		s := status.FromContextError(ctx.Err())
+		return nil, status.Error(s.Code(), fmt.Sprintf("waiting for one of %d concurrent volume operations to finish: %s", cap(l), s.Message()))
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestMaxConcurrentOperations(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+
+	// Looking up the lvstore is the first SPDK call of CreateVolume.
+	// It takes a while and tracks how many run at the same time.
+	var mutex sync.Mutex
+	active, maxActive := 0, 0
+	fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+		return []spdk.LVStore{{UUID: fakeLVStoreUUID, Name: "lvs", TotalDataClusters: 100, FreeClusters: 100, BlockSize: 512, ClusterSize: mib}}, nil
+	})
+
+	// The pool has more connections than the limit, so SPDK calls
+	// could run in parallel without it.
+	const max = 2
+	driver, err := New(WithVHostEndpoint(fake.Path), WithSPDKPoolSize(4*max), WithMaxConcurrentOperations(max))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	create := func(ctx context.Context, name string) error {
+		_, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4*max)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = create(ctx, fmt.Sprintf("vol-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		assert.NoError(t, err, "volume #%d", i)
+	}
+	assert.Equal(t, max, maxActive, "concurrent operations")
+
+	// While all slots are taken, operations wait until their deadline.
+	var releases []func()
+	for i := 0; i < max; i++ {
+		release, err := od.ops.acquire(ctx)
+		require.NoError(t, err)
+		releases = append(releases, release)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = create(timeoutCtx, "blocked")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "%v", err)
+	for _, release := range releases {
+		release()
+	}
+	assert.NoError(t, create(ctx, "unblocked"))
+}
+
+func TestMaxConcurrentOperationsInvalid(t *testing.T) {
+	_, err := New(WithMaxConcurrentOperations(-1))
+	assert.Error(t, err)
+}
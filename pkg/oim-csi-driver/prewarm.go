@@ -0,0 +1,184 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/oim-common"
+)
+
+const (
+	// prewarmParameter is the StorageClass parameter which enables
+	// prewarming. It gets passed through to NodeStageVolume as
+	// volume context.
+	prewarmParameter = "prewarm_on_attach"
+
+	// prewarmChunkSize is the amount of data for which read-ahead
+	// gets requested at once.
+	prewarmChunkSize = 4 * mib
+
+	// See include/linux/ioprio.h.
+	ioprioClassShift = 13
+	ioprioClassIdle  = 3
+	ioprioWhoProcess = 1
+)
+
+// VolumePrewarmManager reads the beginning of volumes into the page
+// cache in the background after they were staged, to reduce the
+// latency of the first accesses by the application. The I/O runs
+// with idle priority and optionally with a bandwidth limit, so it
+// does not compete with other I/O on the node.
+type VolumePrewarmManager struct {
+	bandwidthLimit int64 // bytes per second, 0 for unlimited
+	maxBytes       int64 // 0 for entire volume
+
+	mutex   sync.Mutex
+	wg      sync.WaitGroup
+	running map[string]*prewarmOp
+}
+
+type prewarmOp struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewVolumePrewarmManager returns a manager with the given limits.
+// Zero means "no limit" for both.
+func NewVolumePrewarmManager(bandwidthLimitMBps int, maxBytes int64) *VolumePrewarmManager {
+	return &VolumePrewarmManager{
+		bandwidthLimit: int64(bandwidthLimitMBps) * mib,
+		maxBytes:       maxBytes,
+		running:        map[string]*prewarmOp{},
+	}
+}
+
+// prewarmEnabled checks the volume context for the prewarm parameter.
+func prewarmEnabled(volumeContext map[string]string) bool {
+	return volumeContext[prewarmParameter] == "true"
+}
+
+// Start begins prewarming the device in the background. An already
+// running prewarm of the same volume continues unchanged.
+func (pm *VolumePrewarmManager) Start(ctx context.Context, volumeID, device string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	if _, ok := pm.running[volumeID]; ok {
+		return
+	}
+
+	// The prewarming outlives the gRPC call which triggered it.
+	logger := log.FromContext(ctx).With("volumeid", volumeID, "device", device)
+	ctx, cancel := context.WithCancel(log.WithLogger(context.Background(), logger))
+	op := &prewarmOp{cancel: cancel, done: make(chan struct{})}
+	pm.running[volumeID] = op
+	pm.wg.Add(1)
+	go func() {
+		defer pm.wg.Done()
+		defer pm.finished(volumeID, op)
+		logger.Infow("prewarming volume")
+		advised, err := pm.prewarm(ctx, device)
+		switch {
+		case ctx.Err() != nil:
+			logger.Infow("prewarming canceled", "bytes", advised)
+		case err != nil:
+			logger.Warnw("prewarming failed", "bytes", advised, "error", err)
+		default:
+			logger.Infow("prewarming done", "bytes", advised)
+		}
+	}()
+}
+
+// Stop cancels prewarming of the volume, if running, and waits for
+// that to take effect. It must be called before removing the
+// device.
+func (pm *VolumePrewarmManager) Stop(volumeID string) {
+	pm.mutex.Lock()
+	op, ok := pm.running[volumeID]
+	pm.mutex.Unlock()
+	if !ok {
+		return
+	}
+	op.cancel()
+	<-op.done
+}
+
+// Wait blocks until all prewarm operations have finished.
+func (pm *VolumePrewarmManager) Wait() {
+	pm.wg.Wait()
+}
+
+func (pm *VolumePrewarmManager) finished(volumeID string, op *prewarmOp) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	op.cancel()
+	delete(pm.running, volumeID)
+	close(op.done)
+}
+
+// prewarm asks the kernel to read the device chunk by chunk and
+// returns the number of bytes for which that was requested.
+func (pm *VolumePrewarmManager) prewarm(ctx context.Context, device string) (int64, error) {
+	// The I/O priority is a property of the thread. The thread
+	// stays locked and thus terminates together with the
+	// goroutine, so the priority does not affect other
+	// goroutines later.
+	runtime.LockOSThread()
+	if err := setIdleIOPriority(); err != nil {
+		log.FromContext(ctx).Warnw("cannot lower I/O priority", "error", err)
+	}
+
+	file, err := os.Open(device)
+	if err != nil {
+		return 0, errors.Wrap(err, "open device")
+	}
+	defer file.Close()
+	size, err := oimcommon.GetBlkSize64(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "get device size")
+	}
+	if pm.maxBytes > 0 && size > pm.maxBytes {
+		size = pm.maxBytes
+	}
+
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if pm.bandwidthLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(pm.bandwidthLimit), int(prewarmChunkSize))
+	}
+	var offset int64
+	for offset < size {
+		length := prewarmChunkSize
+		if size-offset < length {
+			length = size - offset
+		}
+		if err := limiter.WaitN(ctx, int(length)); err != nil {
+			return offset, err
+		}
+		if err := unix.Fadvise(int(file.Fd()), offset, length, unix.FADV_WILLNEED); err != nil {
+			return offset, errors.Wrapf(err, "fadvise %d bytes at offset %d", length, offset)
+		}
+		offset += length
+	}
+	return offset, nil
+}
+
+// setIdleIOPriority does the same as "ionice -c 3" for the current thread.
+func setIdleIOPriority() error {
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(unix.Gettid()), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
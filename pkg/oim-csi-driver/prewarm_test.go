@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestPrewarm(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	// A regular file instead of a block device is good enough
+	// for posix_fadvise.
+	file, err := ioutil.TempFile("", "prewarm")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	size := 10*mib + 512
+	err = file.Truncate(size)
+	require.NoError(t, err)
+	file.Close()
+
+	advised, err := NewVolumePrewarmManager(0, 0).prewarm(ctx, file.Name())
+	require.NoError(t, err)
+	assert.Equal(t, size, advised, "entire volume")
+
+	advised, err = NewVolumePrewarmManager(0, 5*mib).prewarm(ctx, file.Name())
+	require.NoError(t, err)
+	assert.Equal(t, 5*mib, advised, "max bytes")
+
+	_, err = NewVolumePrewarmManager(0, 0).prewarm(ctx, file.Name()+"-no-such-file")
+	assert.Error(t, err, "missing device")
+
+	// With 1MB/s, the first chunk goes through immediately and
+	// the next one only after several seconds, which gives us
+	// time to cancel.
+	pm := NewVolumePrewarmManager(1, 0)
+	pm.Start(ctx, "vol", file.Name())
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	pm.Stop("vol")
+	assert.True(t, time.Since(start) < time.Second, "Stop took %s", time.Since(start))
+	pm.mutex.Lock()
+	assert.Empty(t, pm.running, "running operations")
+	pm.mutex.Unlock()
+	pm.Wait()
+}
+
+func TestPrewarmEnabled(t *testing.T) {
+	assert.True(t, prewarmEnabled(map[string]string{"prewarm_on_attach": "true"}))
+	assert.False(t, prewarmEnabled(map[string]string{"prewarm_on_attach": "false"}))
+	assert.False(t, prewarmEnabled(nil))
+}
@@ -0,0 +1,40 @@
+//go:build profiling
+// +build profiling
+
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// ServeProfiling serves the net/http/pprof handlers under
+// /debug/pprof/ on the given port of the loopback interface. It only
+// returns when serving fails.
+func ServeProfiling(port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	return serveProfiling(listener)
+}
+
+func serveProfiling(listener net.Listener) error {
+	// Not http.DefaultServeMux, which would expose the handlers
+	// on any other server which uses it.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return http.Serve(listener, mux)
+}
@@ -0,0 +1,21 @@
+//go:build !profiling
+// +build !profiling
+
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"errors"
+)
+
+// ServeProfiling is only available in binaries built with the
+// "profiling" build tag, which keeps the pprof handlers out of
+// production images.
+func ServeProfiling(port int) error {
+	return errors.New("profiling support not compiled in, rebuild with -tags profiling")
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// StorageClass parameters for rate limiting volumes with SPDK QoS.
+const (
+	limitReadMBPSParameter  = "limitReadMBPS"
+	limitWriteMBPSParameter = "limitWriteMBPS"
+	limitReadIOPSParameter  = "limitReadIOPS"
+	limitWriteIOPSParameter = "limitWriteIOPS"
+)
+
+// qosLimits checks the QoS parameters. It returns nil if none are
+// set. SPDK only limits the combined number of read and write
+// operations, so the IOPS limits get added up.
+func qosLimits(parameters map[string]string) (*spdk.QoSLimits, error) {
+	var limits spdk.QoSLimits
+	found := false
+	for _, limit := range []struct {
+		parameter string
+		value     *int64
+	}{
+		{limitReadMBPSParameter, &limits.RMBytesPerSec},
+		{limitWriteMBPSParameter, &limits.WMBytesPerSec},
+		{limitReadIOPSParameter, &limits.RWIOsPerSec},
+		{limitWriteIOPSParameter, &limits.RWIOsPerSec},
+	} {
+		value, ok := parameters[limit.parameter]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s parameter %q, must be a positive integer", limit.parameter, value))
+		}
+		*limit.value += n
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return &limits, nil
+}
+
+// setQoS applies rate limits to a new volume. Failures, for example
+// because SPDK was built without QoS support, do not prevent using
+// the volume and are therefore only logged.
+func setQoS(ctx context.Context, client *spdk.Client, volumeID string, limits spdk.QoSLimits) {
+	log.FromContext(ctx).Infow("setting QoS limits",
+		"volumeid", volumeID,
+		"limits", limits,
+	)
+	if err := spdk.SetQoSLimit(ctx, client, spdk.SetQoSLimitArgs{Name: volumeID, QoSLimits: limits}); err != nil {
+		log.FromContext(ctx).Warnw("QoS limits not set",
+			"volumeid", volumeID,
+			"error", err,
+		)
+	}
+}
+
+// clearQoS removes rate limits from a BDev before deleting it, if it
+// has any.
+func clearQoS(ctx context.Context, client *spdk.Client, bdev spdk.BDev) {
+	if bdev.AssignedRateLimits == nil || *bdev.AssignedRateLimits == (spdk.QoSLimits{}) {
+		return
+	}
+	if err := spdk.SetQoSLimit(ctx, client, spdk.SetQoSLimitArgs{Name: bdev.Name}); err != nil {
+		log.FromContext(ctx).Warnw("QoS limits not cleared",
+			"volumeid", bdev.Name,
+			"error", err,
+		)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestQoSLimits(t *testing.T) {
+	for name, tc := range map[string]struct {
+		parameters map[string]string
+		limits     *spdk.QoSLimits
+		code       codes.Code
+	}{
+		"none": {nil, nil, codes.OK},
+		"all": {map[string]string{
+			limitReadMBPSParameter:  "100",
+			limitWriteMBPSParameter: "50",
+			limitReadIOPSParameter:  "10000",
+			limitWriteIOPSParameter: "5000",
+		}, &spdk.QoSLimits{RMBytesPerSec: 100, WMBytesPerSec: 50, RWIOsPerSec: 15000}, codes.OK},
+		"write-iops": {map[string]string{limitWriteIOPSParameter: "1000"}, &spdk.QoSLimits{RWIOsPerSec: 1000}, codes.OK},
+		"zero":       {map[string]string{limitReadMBPSParameter: "0"}, nil, codes.InvalidArgument},
+		"negative":   {map[string]string{limitReadIOPSParameter: "-1"}, nil, codes.InvalidArgument},
+		"not-number": {map[string]string{limitWriteMBPSParameter: "fast"}, nil, codes.InvalidArgument},
+	} {
+		t.Run(name, func(t *testing.T) {
+			limits, err := qosLimits(tc.parameters)
+			assert.Equal(t, tc.code, status.Code(err), "%v", err)
+			assert.Equal(t, tc.limits, limits)
+		})
+	}
+}
+
+func TestQoS(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	create := func(name string, parameters map[string]string) (string, error) {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       name,
+			Parameters: parameters,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return response.GetVolume().GetVolumeId(), err
+	}
+	parameters := map[string]string{
+		limitReadMBPSParameter: "100",
+		limitReadIOPSParameter: "10000",
+	}
+
+	// Invalid parameters are rejected before creating anything.
+	_, err = create("invalid", map[string]string{limitWriteMBPSParameter: "x"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "%v", err)
+	assert.Nil(t, fl.find("lvs/invalid"))
+
+	// Without QoS support in SPDK, the volume gets created anyway.
+	_, err = create("no-qos", parameters)
+	require.NoError(t, err)
+	assert.NotNil(t, fl.find("lvs/no-qos"))
+
+	fake.Handle("bdev_set_qos_limit", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.SetQoSLimitArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.find(args.Name)
+		if lvol == nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+		}
+		lvol.AssignedRateLimits = &args.QoSLimits
+		return true, nil
+	})
+	calls := len(fake.Calls())
+	volumeID, err := create("qos", parameters)
+	require.NoError(t, err)
+	var methods []string
+	for _, call := range fake.Calls()[calls:] {
+		methods = append(methods, call.Method)
+	}
+	assert.Equal(t, []string{"bdev_lvol_get_lvstores", "get_bdevs", "bdev_lvol_create", "bdev_set_qos_limit"}, methods)
+	lvol := fl.find(volumeID)
+	require.NotNil(t, lvol)
+	assert.Equal(t, &spdk.QoSLimits{RMBytesPerSec: 100, RWIOsPerSec: 10000}, lvol.AssignedRateLimits)
+
+	// The limits get cleared before deleting the volume.
+	calls = len(fake.Calls())
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	methods = nil
+	var cleared spdk.SetQoSLimitArgs
+	for _, call := range fake.Calls()[calls:] {
+		methods = append(methods, call.Method)
+		if call.Method == "bdev_set_qos_limit" {
+			require.NoError(t, json.Unmarshal(call.Params, &cleared))
+		}
+	}
+	assert.Equal(t, []string{"get_bdevs", "bdev_set_qos_limit", "bdev_lvol_delete"}, methods)
+	assert.Equal(t, spdk.SetQoSLimitArgs{Name: volumeID}, cleared)
+	assert.Nil(t, fl.find(volumeID))
+
+	// Volumes without limits are deleted directly.
+	volumeID, err = create("no-limits", nil)
+	require.NoError(t, err)
+	calls = len(fake.Calls())
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	assert.NotContains(t, fake.Methods()[calls:], "bdev_set_qos_limit")
+}
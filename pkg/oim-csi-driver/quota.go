@@ -0,0 +1,152 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quotaParameter is the StorageClass parameter which limits the
+// total capacity of all volumes in the namespace of a new PVC. All
+// volumes of the namespace count, regardless of their
+// StorageClass. The namespace is only known when the
+// external-provisioner runs with --extra-create-metadata.
+const quotaParameter = "quotaBytes"
+
+// quotaBytes returns the value of quotaParameter, zero if not set.
+func quotaBytes(parameters map[string]string) (int64, error) {
+	value, ok := parameters[quotaParameter]
+	if !ok {
+		return 0, nil
+	}
+	quota, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || quota <= 0 {
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s parameter %q, must be a positive number of bytes", quotaParameter, value))
+	}
+	return quota, nil
+}
+
+// quotaTracker checks the capacity allocated per namespace. Volumes
+// which exist already are counted based on their metadata. The
+// capacity of volumes which are currently being created is reserved
+// until their metadata is complete.
+type quotaTracker struct {
+	mutex    sync.Mutex
+	reserved map[string]int64
+}
+
+// reserve checks whether the bytes fit into the quota of the
+// namespace. The reservation must be released once the volume was
+// created and its metadata is stored, or creating it failed.
+func (qt *quotaTracker) reserve(metadata *metadataStore, namespace string, quota, bytes int64) (*quotaReservation, error) {
+	r := &quotaReservation{
+		qt:        qt,
+		metadata:  metadata,
+		namespace: namespace,
+		quota:     quota,
+	}
+	if err := r.extend(bytes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// quotaReservation is the capacity reserved for one new volume. A
+// nil reservation is for a volume without quota.
+type quotaReservation struct {
+	qt        *quotaTracker
+	metadata  *metadataStore
+	namespace string
+	quota     int64
+	bytes     int64
+}
+
+// extend reserves additional bytes, for example when the volume
+// turned out to be larger than expected.
+func (r *quotaReservation) extend(bytes int64) error {
+	if r == nil || bytes <= 0 {
+		return nil
+	}
+	qt := r.qt
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+	used := r.metadata.namespaceUsage(r.namespace) + qt.reserved[r.namespace]
+	if used+bytes > r.quota {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("%d bytes for new volume exceed quota of namespace %s: %d of %d bytes used", r.bytes+bytes, r.namespace, used-r.bytes, r.quota))
+	}
+	if qt.reserved == nil {
+		qt.reserved = map[string]int64{}
+	}
+	qt.reserved[r.namespace] += bytes
+	r.bytes += bytes
+	return nil
+}
+
+// extendTo ensures that at least the given number of bytes are
+// reserved.
+func (r *quotaReservation) extendTo(bytes int64) error {
+	if r == nil {
+		return nil
+	}
+	return r.extend(bytes - r.bytes)
+}
+
+// release returns the reserved bytes.
+func (r *quotaReservation) release() {
+	if r == nil {
+		return
+	}
+	qt := r.qt
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+	qt.reserved[r.namespace] -= r.bytes
+	if qt.reserved[r.namespace] == 0 {
+		delete(qt.reserved, r.namespace)
+	}
+	r.bytes = 0
+}
+
+// reserveQuota reserves capacity for a new volume if its StorageClass
+// has a quota. A volume gets at least the requested size, 1MiB by
+// default, and at least the size of the volume or snapshot that it
+// is created from, as far as that is known. Rounding up by the
+// backend must be reserved with extend once the actual size is known.
+func (od *oimDriver) reserveQuota(request createRequest) (*quotaReservation, error) {
+	quota, err := quotaBytes(request.parameters)
+	if err != nil {
+		return nil, err
+	}
+	if quota == 0 {
+		return nil, nil
+	}
+	claim := claimFromParameters(request.parameters)
+	if claim == nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("%s parameter needs the PVC namespace, which is only provided by the external-provisioner with --extra-create-metadata", quotaParameter))
+	}
+	bytes := request.requiredBytes
+	if bytes == 0 {
+		bytes = mib
+	}
+	var sourceBytes int64
+	if request.sourceVolumeID != "" {
+		metadata, _ := od.metadata.get(request.sourceVolumeID)
+		sourceBytes = metadata.SizeBytes
+	}
+	if request.sourceSnapshotID != "" {
+		metadata, _ := od.metadata.getSnapshot(request.sourceSnapshotID)
+		sourceBytes = metadata.SizeBytes
+	}
+	if sourceBytes > bytes {
+		bytes = sourceBytes
+	}
+	return od.quotas.reserve(od.metadata, claim.Namespace, quota, bytes)
+}
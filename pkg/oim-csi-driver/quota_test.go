@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestQuota(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, _ := newFakeDriver(t)
+	defer fake.Close()
+
+	create := func(name, namespace string, bytes int64) (string, error) {
+		parameters := map[string]string{quotaParameter: "3145728"}
+		if namespace != "" {
+			parameters[pvcNamespaceParameter] = namespace
+			parameters[pvcNameParameter] = name
+		}
+		response, err := od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: bytes},
+			Parameters:    parameters,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return response.GetVolume().GetVolumeId(), err
+	}
+
+	_, err := create("no-namespace", "", mib)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "namespace unknown: %v", err)
+
+	vol1, err := create("vol-1", "team-a", 2*mib)
+	require.NoError(t, err)
+	_, err = create("vol-2", "team-a", 2*mib)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "over quota: %v", err)
+	assert.Contains(t, status.Convert(err).Message(), "2097152 of 3145728 bytes used")
+	_, err = create("vol-3", "team-b", 2*mib)
+	assert.NoError(t, err, "other namespace")
+	_, err = create("vol-4", "team-a", mib)
+	assert.NoError(t, err, "within quota")
+
+	// Deleting a volume releases its capacity.
+	_, err = od.oimDriver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol1})
+	require.NoError(t, err)
+	_, err = create("vol-2", "team-a", 2*mib)
+	assert.NoError(t, err, "capacity released")
+}
+
+func TestQuotaClone(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	// Not created by the driver, therefore its size is unknown
+	// until it was cloned.
+	unknownID := fl.add("unknown", 2*mib)
+
+	create := func(name, sourceID string, bytes int64) (string, error) {
+		request := &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: bytes},
+			Parameters: map[string]string{
+				quotaParameter:        "3145728",
+				pvcNamespaceParameter: "team-a",
+				pvcNameParameter:      name,
+			},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		}
+		if sourceID != "" {
+			request.VolumeContentSource = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID},
+				},
+			}
+		}
+		response, err := od.CreateVolume(ctx, request)
+		return response.GetVolume().GetVolumeId(), err
+	}
+
+	sourceID, err := create("source", "", 2*mib)
+	require.NoError(t, err)
+
+	// The clone gets the size of the source.
+	_, err = create("clone", sourceID, 0)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "clone over quota: %v", err)
+	assert.Contains(t, status.Convert(err).Message(), "2097152 bytes for new volume")
+	assert.Nil(t, fl.find("lvs/clone"), "clone not created")
+
+	// The size is only known after cloning.
+	_, err = create("clone-unknown", unknownID, 0)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "clone of unknown size over quota: %v", err)
+	assert.Nil(t, fl.find("lvs/clone-unknown"), "clone removed")
+
+	_, err = od.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: sourceID})
+	require.NoError(t, err)
+	_, err = create("clone-unknown", unknownID, 0)
+	assert.NoError(t, err, "within quota")
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// RuntimeSettings are the parameters which may change while the
+// driver is running.
+type RuntimeSettings struct {
+	MaxConcurrentOps int
+	CloneRateLimit   float64
+	CloneBurst       int
+}
+
+// Reconfigure replaces the limits for volume operations and clones.
+// Operations which already hold a slot of the old limit keep it
+// until they are done.
+func (od *oimDriver) Reconfigure(settings RuntimeSettings) error {
+	switch {
+	case settings.MaxConcurrentOps < 0:
+		return errors.Errorf("maximum number of concurrent operations must not be negative: %d", settings.MaxConcurrentOps)
+	case settings.CloneRateLimit < 0:
+		return errors.Errorf("invalid clone rate limit: %g", settings.CloneRateLimit)
+	case settings.CloneRateLimit > 0 && settings.CloneBurst < 1:
+		return errors.Errorf("invalid clone burst: %d", settings.CloneBurst)
+	}
+
+	od.limitsMutex.Lock()
+	defer od.limitsMutex.Unlock()
+	if settings.MaxConcurrentOps != cap(od.ops) {
+		od.ops = newOpLimiter(settings.MaxConcurrentOps)
+	}
+	if od.clones != nil && settings.CloneRateLimit > 0 && settings.CloneBurst == od.clones.limiter.Burst() {
+		// Keeps the tokens that are currently available.
+		od.clones.limiter.SetLimit(rate.Limit(settings.CloneRateLimit))
+	} else {
+		od.clones = newCloneLimiter(settings.CloneRateLimit, settings.CloneBurst)
+	}
+	return nil
+}
+
+// currentOps returns the limiter for concurrent volume operations.
+func (od *oimDriver) currentOps() opLimiter {
+	od.limitsMutex.RLock()
+	defer od.limitsMutex.RUnlock()
+	return od.ops
+}
+
+// currentClones returns the limiter for clones.
+func (od *oimDriver) currentClones() *cloneLimiter {
+	od.limitsMutex.RLock()
+	defer od.limitsMutex.RUnlock()
+	return od.clones
+}
+
+// ReloadOnSignal reads the config file again each time the process
+// receives one of the signals and applies the runtime settings to
+// the driver. The returned function stops waiting for them.
+func ReloadOnSignal(ctx context.Context, driver Driver, config *Config, signals ...os.Signal) func() {
+	received := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(received, signals...)
+	go func() {
+		current := config
+		for {
+			select {
+			case sig := <-received:
+				log.FromContext(ctx).Infow("reloading configuration", "signal", sig, "file", current.ConfigFile)
+				reloaded, err := current.Reload(ctx)
+				if err == nil {
+					err = driver.Reconfigure(reloaded.RuntimeSettings())
+				}
+				if err != nil {
+					log.FromContext(ctx).Errorw("reloading configuration", "error", err)
+					continue
+				}
+				current = reloaded
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(received)
+		close(done)
+	}
+}
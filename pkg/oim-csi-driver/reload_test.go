@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestReconfigure(t *testing.T) {
+	driver, err := New(WithDryRun(true), WithMaxConcurrentOperations(1), WithCloneRateLimit(1, 1))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	clones := od.currentClones()
+
+	// A slot of the old limit stays in use.
+	release, err := od.currentOps().acquire(context.Background())
+	require.NoError(t, err)
+	defer release()
+	require.NoError(t, driver.Reconfigure(RuntimeSettings{MaxConcurrentOps: 2, CloneRateLimit: 5, CloneBurst: 1}))
+	assert.Equal(t, 2, cap(od.currentOps()))
+	assert.Equal(t, clones, od.currentClones(), "limiter kept")
+	assert.Equal(t, rate.Limit(5), clones.limiter.Limit())
+
+	require.NoError(t, driver.Reconfigure(RuntimeSettings{CloneRateLimit: 5, CloneBurst: 3}))
+	assert.Nil(t, od.currentOps(), "unlimited operations")
+	assert.Equal(t, 3, od.currentClones().limiter.Burst())
+	require.NoError(t, driver.Reconfigure(RuntimeSettings{}))
+	assert.Nil(t, od.currentClones(), "unlimited clones")
+
+	assert.Error(t, driver.Reconfigure(RuntimeSettings{MaxConcurrentOps: -1}))
+	assert.Error(t, driver.Reconfigure(RuntimeSettings{CloneRateLimit: 1}))
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	filename := filepath.Join(tmp, "config")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("clone-rate-limit-rps=1\n"), 0600))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := NewConfigFromFlags(fs)
+	require.NoError(t, fs.Parse([]string{"--dry-run", "--config-file=" + filename}))
+	require.NoError(t, config.LoadConfigFile())
+	driver, err := New(WithDryRun(true), WithCloneRateLimit(config.CloneRateLimit, config.CloneBurst))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	assert.Equal(t, rate.Limit(1), od.currentClones().limiter.Limit())
+
+	stop := ReloadOnSignal(ctx, driver, config, syscall.SIGHUP)
+	defer stop()
+	require.NoError(t, ioutil.WriteFile(filename, []byte("clone-rate-limit-rps=5\nmax-concurrent-ops=2\nendpoint=unix:///tmp/other.sock\n"), 0600))
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for od.currentClones().limiter.Limit() != 5 {
+		require.True(t, time.Now().Before(deadline), "rate limit not updated within 100ms")
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 2, cap(od.currentOps()))
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"gopkg.in/fsnotify/fsnotify.v1"
@@ -35,77 +36,203 @@ type remoteSPDK struct {
 	registryCA         string
 	registryKey        string
 	oimControllerID    string
+	rotator            *CertificateRotator
+
+	// nodeAffinity enables provisioning on other controllers,
+	// using the credentials in rotators.
+	nodeAffinity NodeAffinity
+	rotators     map[string]*CertificateRotator
+	// selector chooses among several suitable controllers, nil
+	// for preferring the controller of the host.
+	selector ControllerSelector
+	// discovery, if set, restricts new volumes to controllers
+	// announced via DNS-SD and is also the selector.
+	discovery *mDNSDiscovery
+
+	// callAttempts and callTimeout control retrying of calls
+	// to the OIM controller.
+	callAttempts int
+	callTimeout  time.Duration
+
+	// deviceTimeout limits how long createDevice waits for the
+	// block device to appear, zero for no limit besides the
+	// deadline of the request.
+	deviceTimeout time.Duration
 
 	mapVolumeParams func(request interface{}, to *oim.MapVolumeRequest) error
+
+	// metadata, if set, overrides the controller in the volume
+	// ID of volumes moved by MigrateVolume.
+	metadata *metadataStore
 }
 
 var _ OIMBackend = &remoteSPDK{}
+var _ ControllerCapacity = &remoteSPDK{}
+
+func (r *remoteSPDK) createVolume(ctx context.Context, name string, request createRequest) (volumeInfo, error) {
+	if request.sourceVolumeID != "" || request.sourceSnapshotID != "" {
+		return volumeInfo{}, status.Error(codes.Unimplemented, "volume content sources not supported by the OIM controller")
+	}
+	if request.parameters[encryptedParameter] == "true" {
+		return volumeInfo{}, status.Error(codes.Unimplemented, "encrypted volumes not supported by the OIM controller")
+	}
 
-func (r *remoteSPDK) createVolume(ctx context.Context, volumeID string, requiredBytes int64) (int64, error) {
 	// Check for maximum available capacity
-	capacity := requiredBytes
-	if capacity >= maxStorageCapacity {
-		return 0, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, maxStorageCapacity)
+	if request.requiredBytes >= maxStorageCapacity {
+		return volumeInfo{}, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", request.requiredBytes, maxStorageCapacity)
 	}
 
-	if capacity == 0 {
-		// If capacity is unset, round up to minimum size (1MB?).
-		capacity = mib
-	} else {
-		// Round up to multiple of 512.
-		capacity = (capacity + 511) / 512 * 512
+	// Malloc BDevs are allocated in blocks of 512 bytes.
+	capacity, err := volumeSize(request.requiredBytes, request.limitBytes, 512)
+	if err != nil {
+		return volumeInfo{}, err
 	}
 
-	if err := r.provision(ctx, volumeID, capacity); err != nil {
-		return 0, err
+	controllerID, err := r.selectController(ctx, request.requisite, request.preferred)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+
+	// We use the unique name also as BDev name.
+	for {
+		err := r.provision(ctx, controllerID, name, capacity)
+		if err == nil {
+			break
+		}
+		// Some attempt might have created the BDev before
+		// failing. AlreadyExists is for a BDev that was there
+		// before and must be kept.
+		if status.Code(err) != codes.AlreadyExists {
+			r.rollback(ctx, "ProvisionMallocBDev", func(ctx context.Context) error {
+				return r.provision(ctx, controllerID, name, 0)
+			})
+		}
+		if status.Code(err) != codes.Unavailable || r.discovery == nil || r.discovery.available(controllerID) {
+			return volumeInfo{}, err
+		}
+		// The controller disappeared, try one of the remaining ones.
+		log.FromContext(ctx).Infow("retrying on other OIM controller",
+			"controllerid", controllerID,
+			"error", err,
+		)
+		controllerID, err = r.selectController(ctx, request.requisite, request.preferred)
+		if err != nil {
+			return volumeInfo{}, err
+		}
 	}
 
-	return capacity, nil
+	return volumeInfo{
+		volumeID:      r.volumeID(controllerID, name),
+		capacityBytes: capacity,
+		topology:      r.nodeAffinity[controllerID],
+	}, nil
 }
 
 func (r *remoteSPDK) deleteVolume(ctx context.Context, volumeID string) error {
-	return r.provision(ctx, volumeID, 0)
+	controllerID, name := r.splitVolumeID(volumeID)
+	return r.provision(ctx, controllerID, name, 0)
 }
 
-func (r *remoteSPDK) provision(ctx context.Context, bdevName string, size int64) error {
+func (r *remoteSPDK) provision(ctx context.Context, controllerID, bdevName string, size int64) error {
 	// Connect to OIM controller through OIM registry.
-	conn, err := r.dialRegistry(ctx)
+	conn, err := r.dialRegistry(ctx, controllerID)
 	if err != nil {
 		return status.Error(codes.FailedPrecondition, err.Error())
 	}
 	defer conn.Close()
 	controllerClient := oim.NewControllerClient(conn)
-	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", r.oimControllerID)
-	_, err = controllerClient.ProvisionMallocBDev(ctx, &oim.ProvisionMallocBDevRequest{
-		BdevName: bdevName,
-		Size_:    size,
+	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", controllerID)
+	if r.discovery != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = r.discovery.watch(ctx, controllerID)
+		defer cancel()
+	}
+	// Provisioning is idempotent and thus can be retried.
+	err = r.retry(ctx, "ProvisionMallocBDev", func(ctx context.Context) error {
+		_, err := controllerClient.ProvisionMallocBDev(ctx, &oim.ProvisionMallocBDevRequest{
+			BdevName: bdevName,
+			Size_:    size,
+		})
+		return err
 	})
+	if err != nil && r.discovery != nil && !r.discovery.available(controllerID) {
+		return status.Error(codes.Unavailable, fmt.Sprintf("OIM controller %s disappeared: %s", controllerID, err))
+	}
 	return err
 }
 
 func (r *remoteSPDK) checkVolumeExists(ctx context.Context, volumeID string) error {
+	controllerID, name := r.splitVolumeID(volumeID)
+
 	// Connect to OIM controller through OIM registry.
-	conn, err := r.dialRegistry(ctx)
+	conn, err := r.dialRegistry(ctx, controllerID)
 	if err != nil {
 		return status.Error(codes.FailedPrecondition, err.Error())
 	}
 	defer conn.Close()
 	controllerClient := oim.NewControllerClient(conn)
-	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", r.oimControllerID)
+	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", controllerID)
 	_, err = controllerClient.CheckMallocBDev(ctx, &oim.CheckMallocBDevRequest{
-		BdevName: volumeID,
+		BdevName: name,
 	})
 	return err
 }
 
-func (r *remoteSPDK) dialRegistry(ctx context.Context) (*grpc.ClientConn, error) {
-	// Intentionally loaded anew for each connection attempt.
-	// File content can change over time.
-	transportCreds, err := oimcommon.LoadTLS(r.registryCA, r.registryKey, "component.registry")
+func (r *remoteSPDK) isReadOnly(ctx context.Context, volumeID string) (bool, error) {
+	// The OIM controller only creates writable Malloc BDevs.
+	return false, nil
+}
+
+func (r *remoteSPDK) listVolumes(ctx context.Context) ([]volumeInfo, error) {
+	// The OIM controller API has no call for this.
+	return nil, status.Error(codes.Unimplemented, "listing volumes not supported by OIM controller")
+}
+
+func (r *remoteSPDK) getCapacity(ctx context.Context) (int64, error) {
+	return r.FreeBytes(ctx, r.oimControllerID)
+}
+
+// FreeBytes returns the capacity that the OIM controller has published
+// in the registry.
+func (r *remoteSPDK) FreeBytes(ctx context.Context, controllerID string) (int64, error) {
+	conn, err := r.dialRegistry(ctx, controllerID)
+	if err != nil {
+		return 0, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	defer conn.Close()
+	registryClient := oim.NewRegistryClient(conn)
+	path := controllerID + "/" + oimcommon.RegistryFreeBytes
+	valuesReply, err := registryClient.GetValues(ctx, &oim.GetValuesRequest{
+		Path: path,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(valuesReply.GetValues()) != 1 {
+		return 0, status.Errorf(codes.Unavailable, "expected one capacity value in registry at path %s: %s", path, valuesReply.GetValues())
+	}
+	free, err := strconv.ParseInt(valuesReply.GetValues()[0].Value, 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "invalid capacity value in registry at path %s: %s", path, err)
+	}
+	return free, nil
+}
+
+// dialRegistry connects to the OIM registry with the credentials
+// that grant access to the given controller.
+func (r *remoteSPDK) dialRegistry(ctx context.Context, controllerID string) (*grpc.ClientConn, error) {
+	rotator := r.rotator
+	if other, ok := r.rotators[controllerID]; ok {
+		rotator = other
+	}
+	// The CA is intentionally loaded anew for each connection attempt
+	// and the rotator keeps the key pair up-to-date. File content
+	// can change over time.
+	tlsConfig, err := rotator.TLSConfig("component.registry")
 	if err != nil {
 		return nil, errors.Wrap(err, "load TLS certs")
 	}
-	opts := oimcommon.ChooseDialOpts(r.oimRegistryAddress, grpc.WithTransportCredentials(transportCreds))
+	opts := oimcommon.ChooseDialOpts(r.oimRegistryAddress, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	conn, err := grpc.Dial(r.oimRegistryAddress, opts...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "connect to OIM registry at %s", r.oimRegistryAddress)
@@ -114,8 +241,10 @@ func (r *remoteSPDK) dialRegistry(ctx context.Context) (*grpc.ClientConn, error)
 }
 
 func (r *remoteSPDK) createDevice(ctx context.Context, volumeID string, csiRequest interface{}) (string, cleanup, error) {
+	controllerID, name := r.splitVolumeID(volumeID)
+
 	// Connect to OIM controller through OIM registry.
-	conn, err := r.dialRegistry(ctx)
+	conn, err := r.dialRegistry(ctx, controllerID)
 	if err != nil {
 		return "", nil, errors.Wrap(err, "connect to OIM registry")
 	}
@@ -126,7 +255,7 @@ func (r *remoteSPDK) createDevice(ctx context.Context, volumeID string, csiReque
 	// Find out about configured PCI address before
 	// triggering the more complex MapVolume operation.
 	var defPCIAddress oim.PCIAddress
-	path := r.oimControllerID + "/" + oimcommon.RegistryPCI
+	path := controllerID + "/" + oimcommon.RegistryPCI
 	valuesReply, err := registryClient.GetValues(ctx, &oim.GetValuesRequest{
 		Path: path,
 	})
@@ -145,9 +274,9 @@ func (r *remoteSPDK) createDevice(ctx context.Context, volumeID string, csiReque
 	}
 
 	// Make volume available and/or find out where it is.
-	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", r.oimControllerID)
+	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", controllerID)
 	request := &oim.MapVolumeRequest{
-		VolumeId: volumeID,
+		VolumeId: name,
 		// Malloc BDev is the default. It takes no special parameters.
 		Params: &oim.MapVolumeRequest_Malloc{
 			Malloc: &oim.MallocParams{},
@@ -162,8 +291,18 @@ func (r *remoteSPDK) createDevice(ctx context.Context, volumeID string, csiReque
 			return "", nil, errors.Wrap(err, "create MapVolumeRequest parameters")
 		}
 	}
-	reply, err := controllerClient.MapVolume(ctx, request)
-	if err != nil {
+	// The OIM controller returns the existing mapping when called
+	// again, so MapVolume can be retried.
+	var reply *oim.MapVolumeReply
+	if err := r.retry(ctx, "MapVolume", func(ctx context.Context) error {
+		var err error
+		reply, err = controllerClient.MapVolume(ctx, request)
+		return err
+	}); err != nil {
+		r.rollback(ctx, "MapVolume", func(ctx context.Context) error {
+			_, err := controllerClient.UnmapVolume(ctx, &oim.UnmapVolumeRequest{VolumeId: name})
+			return err
+		})
 		return "", nil, errors.Wrapf(err, "MapVolume for %s", volumeID)
 	}
 
@@ -189,7 +328,13 @@ func (r *remoteSPDK) createDevice(ctx context.Context, volumeID string, csiReque
 			path)
 	}
 
-	dev, major, minor, err := waitForDevice(ctx, "/sys/dev/block", &complete, reply.GetScsiDisk())
+	waitCtx := ctx
+	if r.deviceTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, r.deviceTimeout)
+		defer cancel()
+	}
+	dev, major, minor, err := waitForDevice(waitCtx, "/sys/dev/block", &complete, reply.GetScsiDisk())
 	if err != nil {
 		return "", nil, errors.Wrap(err, "wait for device")
 	}
@@ -216,17 +361,19 @@ func (r *remoteSPDK) createDevice(ctx context.Context, volumeID string, csiReque
 }
 
 func (r *remoteSPDK) deleteDevice(ctx context.Context, volumeID string) error {
+	controllerID, name := r.splitVolumeID(volumeID)
+
 	// Connect to OIM controller through OIM registry.
-	conn, err := r.dialRegistry(ctx)
+	conn, err := r.dialRegistry(ctx, controllerID)
 	if err != nil {
 		return errors.Wrap(err, "connect to registry")
 	}
 	controllerClient := oim.NewControllerClient(conn)
 
 	// Make volume available and/or find out where it is.
-	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", r.oimControllerID)
+	ctx = metadata.AppendToOutgoingContext(ctx, "controllerid", controllerID)
 	if _, err := controllerClient.UnmapVolume(ctx, &oim.UnmapVolumeRequest{
-		VolumeId: volumeID,
+		VolumeId: name,
 	}); err != nil {
 		return errors.Wrapf(err, "UnmapVolume for %s", volumeID)
 	}
@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// RenameVolume is not part of CSI. It is provided as an additional
+// gRPC service with JSON encoding, like VolumeInspect, for the live
+// migration of VMs between hosts with different naming conventions.
+const volumeRenameService = "oim.csi.v1.VolumeRename"
+
+// RenameVolumeRequest is the request for RenameVolume via gRPC.
+type RenameVolumeRequest struct {
+	VolumeID string `json:"volume_id"`
+	NewName  string `json:"new_name"`
+}
+
+// RenameVolumeReply is the empty reply of RenameVolume via gRPC.
+type RenameVolumeReply struct{}
+
+// RenameVolume gives an existing logical volume a new name. The
+// volume ID stays the same. Only supported when using SPDK
+// directly.
+func (od *oimDriver) RenameVolume(ctx context.Context, volumeID, newName string) error {
+	if volumeID == "" {
+		return status.Error(codes.InvalidArgument, "empty volume ID")
+	}
+	if newName == "" {
+		return status.Error(codes.InvalidArgument, "empty new name")
+	}
+	if err := od.validateVolumeName(ctx, newName); err != nil {
+		return err
+	}
+	if !od.local.enabled() {
+		return status.Error(codes.Unimplemented, "renaming volumes is only supported with local SPDK")
+	}
+	if err := od.checkVolumeTenant(ctx, volumeID); err != nil {
+		return err
+	}
+	newName = tenantName(ctx, newName)
+
+	// Serialize with other operations on the volume, which lock
+	// its ID, and with CreateVolume for the new name. Names get
+	// locked before IDs, like in CreateVolume.
+	volumeNameMutex.LockKey(newName)
+	defer volumeNameMutex.UnlockKey(newName)
+	if volumeID != newName {
+		volumeNameMutex.LockKey(volumeID)
+		defer volumeNameMutex.UnlockKey(volumeID)
+	}
+
+	if err := od.local.renameVolume(ctx, volumeID, newName); err != nil {
+		return err
+	}
+	// CreateVolume with the old name must not find the volume
+	// anymore.
+	od.created.forget(volumeID)
+	od.metadata.update(volumeID, func(metadata *VolumeMetadata) {
+		metadata.Name = newName
+	})
+	return nil
+}
+
+func (l *localSPDK) renameVolume(ctx context.Context, volumeID, newName string) (err error) {
+	defer l.checkCircuit(&err)
+	client, err := l.connect()
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+	lvol, err := getLVol(ctx, client, volumeID)
+	if err != nil {
+		return err
+	}
+	if lvol == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", volumeID))
+	}
+	if lvol.DriverSpecific.LVol.Snapshot {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s is a snapshot, not a volume", volumeID))
+	}
+	// Aliases have the format <lvstore>/<name>.
+	lvstoreName := strings.SplitN(lvol.Aliases[0], "/", 2)[0]
+	newAlias := lvstoreName + "/" + newName
+	if lvol.Aliases[0] == newAlias {
+		return nil
+	}
+	existing, err := getLVol(ctx, client, newAlias)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("volume with name %s already exists", newName))
+	}
+	log.FromContext(ctx).Infow("renaming logical volume",
+		"volumeid", volumeID,
+		"old", lvol.Aliases[0],
+		"new", newAlias,
+	)
+	if err := spdk.RenameLVol(ctx, client, spdk.RenameLVolArgs{OldName: volumeID, NewName: newName}); err != nil {
+		return spdk.GRPCError(err, "Failed to rename logical volume")
+	}
+	return nil
+}
+
+// RenameVolume invokes RenameVolume through a connection to the CSI
+// socket of the driver.
+func RenameVolume(ctx context.Context, conn *grpc.ClientConn, volumeID, newName string) error {
+	request := &RenameVolumeRequest{
+		VolumeID: volumeID,
+		NewName:  newName,
+	}
+	return conn.Invoke(ctx, "/"+volumeRenameService+"/RenameVolume", request, &RenameVolumeReply{},
+		grpc.CallContentSubtype(jsonCodecName))
+}
+
+func registerVolumeRenameServer(s *grpc.Server, od *oimDriver) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: volumeRenameService,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "RenameVolume",
+				Handler:    renameVolumeHandler,
+			},
+		},
+		Streams: []grpc.StreamDesc{},
+	}, od)
+}
+
+func renameVolumeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) { // nolint: golint
+	in := new(RenameVolumeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		request := req.(*RenameVolumeRequest)
+		if err := srv.(*oimDriver).RenameVolume(ctx, request.VolumeID, request.NewName); err != nil {
+			return nil, err
+		}
+		return &RenameVolumeReply{}, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + volumeRenameService + "/RenameVolume",
+	}
+	return interceptor(ctx, in, info, handler)
+}
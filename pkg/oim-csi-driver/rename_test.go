@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/oim-common"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestRenameVolume(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	fl.add("other", mib)
+	snapshotID := fl.add("snapshot", mib)
+	fl.find(snapshotID).DriverSpecific.LVol.Snapshot = true
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	endpoint := "unix://" + tmp + "/oim-driver.sock"
+	driver, err := New(WithCSIEndpoint(endpoint), WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	s, err := driver.Start(ctx)
+	require.NoError(t, err)
+	defer s.ForceStop(ctx)
+	conn, err := grpc.Dial(endpoint, oimcommon.ChooseDialOpts(endpoint, grpc.WithBlock(), grpc.WithInsecure())...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	require.NoError(t, err)
+	volumeID := response.GetVolume().GetVolumeId()
+
+	require.NoError(t, RenameVolume(ctx, conn, volumeID, "migrated"))
+	assert.Nil(t, fl.find("lvs/vol"), "old name gone")
+	lvol := fl.find("lvs/migrated")
+	require.NotNil(t, lvol, "new name")
+	assert.Equal(t, volumeID, lvol.UUID)
+	metadata, err := VolumeInspect(ctx, conn, volumeID)
+	require.NoError(t, err)
+	assert.Equal(t, "migrated", metadata.Name)
+	require.NoError(t, RenameVolume(ctx, conn, volumeID, "migrated"), "idempotent")
+
+	// CreateVolume for the new name must not run concurrently.
+	volumeNameMutex.LockKey("renamed")
+	renamed := make(chan error)
+	go func() {
+		renamed <- RenameVolume(ctx, conn, volumeID, "renamed")
+	}()
+	select {
+	case err := <-renamed:
+		require.FailNow(t, "RenameVolume not blocked", "%v", err)
+	case <-time.After(time.Second):
+	}
+	volumeNameMutex.UnlockKey("renamed")
+	require.NoError(t, <-renamed)
+
+	err = RenameVolume(ctx, conn, volumeID, "other")
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "name in use: %v", err)
+	err = RenameVolume(ctx, conn, "no-such-volume", "new")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %v", err)
+	err = RenameVolume(ctx, conn, snapshotID, "new")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "snapshot: %v", err)
+	assert.NotNil(t, fl.find("lvs/snapshot"), "snapshot not renamed")
+	err = RenameVolume(ctx, conn, volumeID, "")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "empty name: %v", err)
+}
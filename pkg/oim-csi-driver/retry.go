@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+const (
+	// defaultCallAttempts is how often calls to the OIM controller
+	// are tried by default.
+	defaultCallAttempts = 3
+
+	// retryDelay is the initial delay between attempts, doubled
+	// after each attempt.
+	retryDelay = 100 * time.Millisecond
+
+	// rollbackTimeout limits the time for undoing a failed call.
+	// The context of the failed call cannot be used for that
+	// because it might have expired.
+	rollbackTimeout = 10 * time.Second
+)
+
+// retriable is true for errors which indicate that a call to the OIM
+// controller might succeed when tried again. The call itself might
+// also have succeeded, so only idempotent calls may be retried.
+func retriable(err error) bool {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Unavailable:
+		return true
+	}
+	return false
+}
+
+// retry invokes an idempotent call of the OIM controller until it
+// succeeds, fails with an error that is not retriable, the maximum
+// number of attempts is reached or the context expires. Each attempt
+// is limited by the call timeout.
+func (r *remoteSPDK) retry(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	attempts := r.callAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if r.callTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, r.callTimeout)
+		}
+		err := call(attemptCtx)
+		cancel()
+		if err == nil || !retriable(err) || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+		log.FromContext(ctx).Infow("retrying",
+			"method", method,
+			"attempt", attempt,
+			"error", err,
+		)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// rollback undoes the potential effect of a failed call. Its
+// context keeps the logger and gRPC metadata of the original one,
+// but not the deadline. Errors are only logged.
+func (r *remoteSPDK) rollback(ctx context.Context, method string, undo func(ctx context.Context) error) {
+	rollbackCtx, cancel := context.WithTimeout(log.WithLogger(context.Background(), log.FromContext(ctx)), rollbackTimeout)
+	defer cancel()
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		rollbackCtx = metadata.NewOutgoingContext(rollbackCtx, md)
+	}
+	log.FromContext(ctx).Infow("rolling back", "method", method)
+	if err := undo(rollbackCtx); err != nil {
+		log.FromContext(ctx).Errorw("rollback failed",
+			"method", method,
+			"error", err,
+		)
+	}
+}
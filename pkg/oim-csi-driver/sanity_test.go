@@ -0,0 +1,37 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+// sanitySkip matches the sanity specs which cannot pass with
+// newSanityFake: staging a volume on the node needs a NBD device
+// exported by a real SPDK.
+const sanitySkip = "Node Service should work"
+
+// newSanityFake returns a fake SPDK with logical volumes and vhost-blk
+// controllers, which is enough for the controller and identity specs
+// of the CSI sanity suite.
+func newSanityFake(t *testing.T) *testspdk.Fake {
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	newFakeLVols(fake)
+	fakeVHostBlk(fake)
+	// Only reached for BDevs that do not exist.
+	fake.Handle("delete_bdev", func(params json.RawMessage) (interface{}, error) {
+		return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+	})
+	return fake
+}
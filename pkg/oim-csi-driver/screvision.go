@@ -0,0 +1,192 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+const (
+	// revisionContextKey is the volume context entry with the
+	// revision of the parameters that the volume was created with.
+	revisionContextKey = "storage_class_revision"
+
+	// kubernetesParameterPrefix is used for parameters which are
+	// interpreted by the external-provisioner and removed before
+	// calling CreateVolume.
+	kubernetesParameterPrefix = "csi.storage.k8s.io/"
+)
+
+// storageClassRevisionResource is defined by
+// deploy/kubernetes/oim-storageclassrevision-crd.yaml.
+var storageClassRevisionResource = schema.GroupVersionResource{
+	Group:    "oim.intel.com",
+	Version:  "v1alpha1",
+	Resource: "oimstorageclassrevisions",
+}
+
+// parametersRevision returns a short, stable hash of the parameters
+// as seen by CreateVolume. The StorageClassVersioningController
+// uses the same hash in the names of the revisions that it creates,
+// so volumes can be matched with the revision of their StorageClass.
+func parametersRevision(parameters map[string]string) string {
+	var keys []string
+	for key := range parameters {
+		if strings.HasPrefix(key, kubernetesParameterPrefix) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		// Length prefixes make the encoding unambiguous.
+		for _, s := range []string{key, parameters[key]} {
+			hash.Write([]byte{byte(len(s) >> 8), byte(len(s))}) // nolint: gosec
+			hash.Write([]byte(s))                               // nolint: gosec
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:10]
+}
+
+// volumeContext returns the volume context for a new volume: all
+// parameters, plus the revision of the StorageClass. The revision
+// must be computed from the parameters of the request, because the
+// StorageClassVersioningController does not know about defaults
+// added by the driver.
+func volumeContext(parameters map[string]string, revision string) map[string]string {
+	result := map[string]string{}
+	for key, value := range parameters {
+		result[key] = value
+	}
+	result[revisionContextKey] = revision
+	return result
+}
+
+// storageClassRevisionWriter stores revisions. Revisions are
+// immutable, so storing one that already exists is not an error.
+type storageClassRevisionWriter interface {
+	createRevision(ctx context.Context, revision *unstructured.Unstructured) error
+}
+
+type dynamicRevisionWriter struct {
+	client dynamic.Interface
+}
+
+func (d dynamicRevisionWriter) createRevision(ctx context.Context, revision *unstructured.Unstructured) error {
+	_, err := d.client.Resource(storageClassRevisionResource).Create(revision, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// StorageClassVersioningController records the parameters of
+// StorageClasses for this driver as OIMStorageClassRevision objects
+// whenever a StorageClass gets updated, so that it remains possible
+// to determine which parameters were used for older volumes.
+type StorageClassVersioningController struct {
+	driverName string
+	factory    informers.SharedInformerFactory
+	writer     storageClassRevisionWriter
+	now        func() time.Time
+}
+
+func newStorageClassVersioningController(client kubernetes.Interface, dynamicClient dynamic.Interface, driverName string) *StorageClassVersioningController {
+	return &StorageClassVersioningController{
+		driverName: driverName,
+		factory:    informers.NewSharedInformerFactory(client, 10*time.Minute),
+		writer:     dynamicRevisionWriter{client: dynamicClient},
+		now:        time.Now,
+	}
+}
+
+// Run processes changes until the context is done.
+func (sc *StorageClassVersioningController) Run(ctx context.Context) error {
+	sc.factory.Storage().V1().StorageClasses().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldClass := oldObj.(*storagev1.StorageClass)
+			newClass := newObj.(*storagev1.StorageClass)
+			if oldClass.ResourceVersion == newClass.ResourceVersion {
+				// Periodic resync, nothing changed.
+				return
+			}
+			if err := sc.recordRevision(ctx, oldClass); err != nil {
+				log.FromContext(ctx).Warnw("recording StorageClass revision failed",
+					"storageclass", oldClass.Name,
+					"error", err,
+				)
+			}
+		},
+	})
+	sc.factory.Start(ctx.Done())
+	for informer, synced := range sc.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return errors.Errorf("failed to sync informer for %s", informer)
+		}
+	}
+	log.FromContext(ctx).Infow("tracking StorageClass revisions")
+	<-ctx.Done()
+	return nil
+}
+
+// recordRevision creates a revision for the StorageClass, unless it
+// is for some other driver.
+func (sc *StorageClassVersioningController) recordRevision(ctx context.Context, class *storagev1.StorageClass) error {
+	if class.Provisioner != sc.driverName {
+		return nil
+	}
+	revision := parametersRevision(class.Parameters)
+	parameters := map[string]interface{}{}
+	for key, value := range class.Parameters {
+		parameters[key] = value
+	}
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": storageClassRevisionResource.GroupVersion().String(),
+			"kind":       "OIMStorageClassRevision",
+			"metadata": map[string]interface{}{
+				"name": class.Name + "-" + revision,
+				"labels": map[string]interface{}{
+					"storageclass": class.Name,
+				},
+			},
+			"spec": map[string]interface{}{
+				"storageClassName": class.Name,
+				"revision":         revision,
+				"parameters":       parameters,
+				"timestamp":        sc.now().UTC().Format(time.RFC3339),
+			},
+		},
+	}
+	if err := sc.writer.createRevision(ctx, obj); err != nil {
+		return errors.Wrapf(err, "create %s", obj.GetName())
+	}
+	log.FromContext(ctx).Infow("recorded StorageClass revision",
+		"storageclass", class.Name,
+		"revision", revision,
+	)
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type fakeRevisionWriter struct {
+	revisions map[string]*unstructured.Unstructured
+}
+
+func (f *fakeRevisionWriter) createRevision(ctx context.Context, revision *unstructured.Unstructured) error {
+	if _, ok := f.revisions[revision.GetName()]; !ok {
+		f.revisions[revision.GetName()] = revision
+	}
+	return nil
+}
+
+func TestParametersRevision(t *testing.T) {
+	a := parametersRevision(map[string]string{"a": "b", "c": "d"})
+	assert.Len(t, a, 10)
+	assert.Equal(t, a, parametersRevision(map[string]string{"c": "d", "a": "b"}), "order")
+	assert.Equal(t, a, parametersRevision(map[string]string{"a": "b", "c": "d", "csi.storage.k8s.io/fstype": "xfs"}), "Kubernetes parameters")
+	assert.NotEqual(t, a, parametersRevision(map[string]string{"a": "bc", "": "d"}), "ambiguous")
+	assert.NotEqual(t, a, parametersRevision(nil), "empty")
+
+	vc := volumeContext(map[string]string{"a": "b", "c": "d"}, a)
+	assert.Equal(t, map[string]string{"a": "b", "c": "d", revisionContextKey: a}, vc)
+}
+
+func TestStorageClassVersioningController(t *testing.T) {
+	ctx := context.Background()
+	writer := &fakeRevisionWriter{revisions: map[string]*unstructured.Unstructured{}}
+	sc := &StorageClassVersioningController{
+		driverName: "oim-driver",
+		writer:     writer,
+		now: func() time.Time {
+			return time.Date(2018, 10, 15, 10, 0, 0, 0, time.UTC)
+		},
+	}
+	parameters := map[string]string{"prewarm_on_attach": "true"}
+	revision := parametersRevision(parameters)
+
+	err := sc.recordRevision(ctx, &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "other"},
+		Provisioner: "other-driver",
+		Parameters:  parameters,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, writer.revisions, "other driver")
+
+	err = sc.recordRevision(ctx, &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "fast"},
+		Provisioner: "oim-driver",
+		Parameters:  parameters,
+	})
+	require.NoError(t, err)
+	obj := writer.revisions["fast-"+revision]
+	require.NotNil(t, obj, "revision created")
+	assert.Equal(t, "OIMStorageClassRevision", obj.GetKind())
+	assert.Equal(t, map[string]interface{}{
+		"storageClassName": "fast",
+		"revision":         revision,
+		"parameters":       map[string]interface{}{"prewarm_on_attach": "true"},
+		"timestamp":        "2018-10-15T10:00:00Z",
+	}, obj.Object["spec"])
+}
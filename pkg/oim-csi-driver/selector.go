@@ -0,0 +1,91 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// ControllerCapacity provides the free capacity of OIM controllers.
+type ControllerCapacity interface {
+	FreeBytes(ctx context.Context, controllerID string) (int64, error)
+}
+
+// ControllerSelector picks the OIM controller for a new volume among
+// several controllers which all match the topology requirements of
+// the volume. The candidates are sorted by ID.
+type ControllerSelector interface {
+	SelectController(ctx context.Context, capacity ControllerCapacity, candidates []string) (string, error)
+}
+
+// RoundRobinSelector spreads volumes evenly across controllers.
+type RoundRobinSelector struct {
+	mutex sync.Mutex
+	next  int
+}
+
+var _ ControllerSelector = &RoundRobinSelector{}
+
+// SelectController returns the candidates in turn.
+func (rr *RoundRobinSelector) SelectController(ctx context.Context, capacity ControllerCapacity, candidates []string) (string, error) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	controllerID := candidates[rr.next%len(candidates)]
+	rr.next++
+	return controllerID, nil
+}
+
+// CapacityWeightedSelector places volumes on the controller with the
+// most free space.
+type CapacityWeightedSelector struct{}
+
+var _ ControllerSelector = CapacityWeightedSelector{}
+
+// SelectController asks all candidates for their free capacity.
+// Controllers whose capacity is unknown are skipped. Ties are resolved
+// by ID.
+func (CapacityWeightedSelector) SelectController(ctx context.Context, capacity ControllerCapacity, candidates []string) (string, error) {
+	var selected string
+	var maxFree int64 = -1
+	for _, controllerID := range candidates {
+		free, err := capacity.FreeBytes(ctx, controllerID)
+		if err != nil {
+			log.FromContext(ctx).Warnw("skipping OIM controller with unknown capacity",
+				"controllerid", controllerID,
+				"error", err,
+			)
+			continue
+		}
+		if free > maxFree {
+			selected, maxFree = controllerID, free
+		}
+	}
+	if selected == "" {
+		return "", status.Error(codes.Unavailable, fmt.Sprintf("free capacity of OIM controllers %v unknown", candidates))
+	}
+	return selected, nil
+}
+
+// NewControllerSelector returns the selector for the given strategy,
+// "round-robin" or "capacity".
+func NewControllerSelector(strategy string) (ControllerSelector, error) {
+	switch strategy {
+	case "round-robin":
+		return &RoundRobinSelector{}, nil
+	case "capacity":
+		return CapacityWeightedSelector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown OIM controller selection strategy %q", strategy)
+	}
+}
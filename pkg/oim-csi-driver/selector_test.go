@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+// fakeCapacity is a registry with the free bytes of some controllers.
+type fakeCapacity map[string]int64
+
+func (f fakeCapacity) FreeBytes(ctx context.Context, controllerID string) (int64, error) {
+	free, ok := f[controllerID]
+	if !ok {
+		return 0, errors.New("no capacity in registry")
+	}
+	return free, nil
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	registry := fakeCapacity{"host-0": mib, "host-1": 2 * mib, "host-2": 3 * mib}
+	candidates := []string{"host-0", "host-1", "host-2"}
+
+	selector := &RoundRobinSelector{}
+	var selected []string
+	for i := 0; i < 4; i++ {
+		controllerID, err := selector.SelectController(ctx, registry, candidates)
+		require.NoError(t, err)
+		selected = append(selected, controllerID)
+	}
+	assert.Equal(t, []string{"host-0", "host-1", "host-2", "host-0"}, selected)
+}
+
+func TestCapacityWeightedSelector(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	candidates := []string{"host-0", "host-1", "host-2"}
+
+	for name, tc := range map[string]struct {
+		registry fakeCapacity
+		selected string
+		code     codes.Code
+	}{
+		"most-free": {fakeCapacity{"host-0": mib, "host-1": 3 * mib, "host-2": 2 * mib}, "host-1", codes.OK},
+		"tie":       {fakeCapacity{"host-0": mib, "host-1": 2 * mib, "host-2": 2 * mib}, "host-1", codes.OK},
+		"unknown":   {fakeCapacity{"host-0": mib, "host-2": 0}, "host-0", codes.OK},
+		"none":      {fakeCapacity{}, "", codes.Unavailable},
+	} {
+		controllerID, err := CapacityWeightedSelector{}.SelectController(ctx, tc.registry, candidates)
+		assert.Equal(t, tc.code, status.Code(err), "%s: %v", name, err)
+		assert.Equal(t, tc.selected, controllerID, name)
+	}
+}
+
+func TestSelectController(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	r := &remoteSPDK{
+		oimControllerID: "host-1",
+		nodeAffinity: NodeAffinity{
+			"host-0": {"zone": "a"},
+			"host-1": {"zone": "a"},
+			"host-2": {"zone": "b"},
+		},
+	}
+	zoneA := []map[string]string{{"zone": "a"}}
+
+	// Default: controller of the host.
+	for i := 0; i < 2; i++ {
+		controllerID, err := r.selectController(ctx, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "host-1", controllerID)
+	}
+
+	// Only candidates which match the topology get selected.
+	r.selector = &RoundRobinSelector{}
+	var selected []string
+	for i := 0; i < 3; i++ {
+		controllerID, err := r.selectController(ctx, zoneA, nil)
+		require.NoError(t, err)
+		selected = append(selected, controllerID)
+	}
+	assert.Equal(t, []string{"host-0", "host-1", "host-0"}, selected)
+	controllerID, err := r.selectController(ctx, nil, []map[string]string{{"zone": "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, "host-2", controllerID, "preferred")
+}
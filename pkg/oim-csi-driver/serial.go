@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// bdevUUIDContextKey is the volume context entry with the UUID of
+// the SPDK BDev, if CreateVolume knew it.
+const bdevUUIDContextKey = "bdev_uuid"
+
+// serialFiles are the files under a <major>:<minor> entry in sys
+// which may contain the serial number of the disk. SCSI disks
+// have it in their device directory, virtio-blk disks in the
+// block device directory.
+var serialFiles = []string{"device/serial", "serial"}
+
+// checkDeviceSerial ensures that the device really is the volume,
+// and not some other volume that ended up at the same place after
+// a crash, by comparing its serial number against the BDev UUID.
+// Devices without serial number (like NBD) and volumes without
+// UUID cannot be checked.
+func checkDeviceSerial(ctx context.Context, sys, device string, volumeContext map[string]string) error {
+	uuid, ok := volumeContext[bdevUUIDContextKey]
+	if !ok {
+		return nil
+	}
+	info, err := os.Stat(device)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return status.Error(codes.Internal, fmt.Sprintf("no device number for %s", device))
+	}
+	rdev := uint64(stat.Rdev) // nolint: unconvert
+	serial, err := deviceSerial(sys, unix.Major(rdev), unix.Minor(rdev))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if serial == "" {
+		log.FromContext(ctx).Debugw("no serial number, cannot check device",
+			"device", device,
+			"uuid", uuid,
+		)
+		return nil
+	}
+	if !serialMatches(serial, uuid) {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("%s has serial number %q, expected BDev UUID %s", device, serial, uuid))
+	}
+	return nil
+}
+
+// deviceSerial returns the serial number of the block device, or
+// an empty string if it has none.
+func deviceSerial(sys string, major, minor uint32) (string, error) {
+	for _, file := range serialFiles {
+		path := filepath.Join(sys, fmt.Sprintf("%d:%d", major, minor), file)
+		content, err := ioutil.ReadFile(path) // nolint: gosec
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "read serial number")
+		}
+		return strings.Trim(string(content), " \t\n\x00"), nil
+	}
+	return "", nil
+}
+
+// serialMatches compares case-insensitively. The serial may also be
+// a prefix of the UUID because virtio-blk truncates serial numbers
+// to 20 characters.
+func serialMatches(serial, uuid string) bool {
+	serial = strings.ToLower(serial)
+	uuid = strings.ToLower(uuid)
+	return serial == uuid || len(serial) == 20 && strings.HasPrefix(uuid, serial)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestCheckDeviceSerial(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	const uuid = "4b6d6a36-5d8e-4c7f-9a3b-1f2e3d4c5b6a"
+
+	// /dev/null is 1:3, the sysfs entries for it are mocked.
+	sys, err := ioutil.TempDir("", "sys")
+	require.NoError(t, err)
+	defer os.RemoveAll(sys)
+	dir := filepath.Join(sys, "1:3")
+	setSerial := func(file, serial string) {
+		require.NoError(t, os.RemoveAll(dir))
+		if file == "" {
+			return
+		}
+		path := filepath.Join(dir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(serial), 0644))
+	}
+
+	for name, tc := range map[string]struct {
+		file, serial string
+		context      map[string]string
+		code         codes.Code
+	}{
+		"no-uuid":         {"device/serial", "foo\n", nil, codes.OK},
+		"no-serial":       {"", "", map[string]string{bdevUUIDContextKey: uuid}, codes.OK},
+		"scsi":            {"device/serial", uuid + "\n", map[string]string{bdevUUIDContextKey: uuid}, codes.OK},
+		"upper-case":      {"device/serial", "4B6D6A36-5D8E-4C7F-9A3B-1F2E3D4C5B6A", map[string]string{bdevUUIDContextKey: uuid}, codes.OK},
+		"virtio-blk":      {"serial", uuid[:20], map[string]string{bdevUUIDContextKey: uuid}, codes.OK},
+		"other-volume":    {"device/serial", "0b6d6a36-5d8e-4c7f-9a3b-1f2e3d4c5b6a", map[string]string{bdevUUIDContextKey: uuid}, codes.FailedPrecondition},
+		"short-prefix":    {"serial", uuid[:8], map[string]string{bdevUUIDContextKey: uuid}, codes.FailedPrecondition},
+		"truncated-other": {"serial", "0b6d6a36-5d8e-4c7f-9", map[string]string{bdevUUIDContextKey: uuid}, codes.FailedPrecondition},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setSerial(tc.file, tc.serial)
+			err := checkDeviceSerial(ctx, sys, "/dev/null", tc.context)
+			assert.Equal(t, tc.code, status.Code(err), "%v", err)
+		})
+	}
+}
+
+func TestBDevUUIDContext(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	require.NoError(t, err)
+	lvol := fl.find("lvs/vol")
+	require.NotNil(t, lvol)
+	assert.Equal(t, lvol.UUID, response.GetVolume().GetVolumeContext()[bdevUUIDContextKey])
+}
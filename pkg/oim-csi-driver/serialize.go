@@ -7,10 +7,79 @@ SPDX-License-Identifier: Apache-2.0
 package oimcsidriver
 
 import (
+	"sync"
+
+	"github.com/pkg/errors"
 	"k8s.io/utils/keymutex"
 )
 
 var (
-	// Volume names are the keys.
-	volumeNameMutex = keymutex.NewHashed(-1)
+	// Volume names and volume IDs are the keys. They differ
+	// for volumes in a local logical volume store, which are
+	// identified by UUID, and for volumes on other OIM
+	// controllers. When locking both, the name must be locked
+	// first.
+	volumeNameMutex keymutex.KeyMutex = newRefCountedKeyMutex()
 )
+
+// refCountedKeyMutex has one mutex per key. In contrast to
+// keymutex.NewHashed, operations on different keys never block
+// each other. Entries are reference counted and removed as soon
+// as no goroutine holds or waits for them, so the map only grows
+// with the number of concurrent operations, not with the number
+// of keys seen over time.
+type refCountedKeyMutex struct {
+	mutex sync.Mutex
+	keys  map[string]*refCountedMutex
+}
+
+type refCountedMutex struct {
+	sync.Mutex
+	// refs counts the goroutines which hold or wait for the mutex.
+	refs int
+}
+
+var _ keymutex.KeyMutex = &refCountedKeyMutex{}
+
+func newRefCountedKeyMutex() *refCountedKeyMutex {
+	return &refCountedKeyMutex{
+		keys: map[string]*refCountedMutex{},
+	}
+}
+
+// LockKey acquires the mutex for the key, blocking if necessary.
+func (km *refCountedKeyMutex) LockKey(id string) {
+	km.mutex.Lock()
+	m := km.keys[id]
+	if m == nil {
+		m = &refCountedMutex{}
+		km.keys[id] = m
+	}
+	m.refs++
+	km.mutex.Unlock()
+
+	m.Lock()
+}
+
+// UnlockKey releases the mutex for the key.
+func (km *refCountedKeyMutex) UnlockKey(id string) error {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	m := km.keys[id]
+	if m == nil {
+		return errors.Errorf("key %q not locked", id)
+	}
+	m.refs--
+	if m.refs == 0 {
+		delete(km.keys, id)
+	}
+	m.Unlock()
+	return nil
+}
+
+// size returns the number of keys which are currently in use.
+func (km *refCountedKeyMutex) size() int {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	return len(km.keys)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestRefCountedKeyMutex(t *testing.T) {
+	km := newRefCountedKeyMutex()
+	const numVolumes = 10000
+	const numWorkers = 4
+
+	// Simulates CreateVolume and DeleteVolume for each volume name,
+	// with several workers competing for the same names. The
+	// counters detect when two workers hold the same key.
+	var wg sync.WaitGroup
+	var inUse [numVolumes]int
+	var violations int
+	var violationsMutex sync.Mutex
+	for worker := 0; worker < numWorkers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < numVolumes; i++ {
+				name := fmt.Sprintf("volume-%d", i)
+				for _, op := range []string{"create", "delete"} {
+					km.LockKey(name)
+					inUse[i]++
+					if inUse[i] != 1 {
+						violationsMutex.Lock()
+						violations++
+						violationsMutex.Unlock()
+					}
+					inUse[i]--
+					if err := km.UnlockKey(name); err != nil {
+						t.Errorf("%s %s: %s", op, name, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Zero(t, violations, "mutual exclusion")
+	assert.Zero(t, km.size(), "map size")
+	assert.Error(t, km.UnlockKey("volume-0"), "not locked")
+}
+
+func TestCreateVolumeLocksID(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	// The fake assigns UUIDs in order. Holding the lock for the
+	// UUID of the new volume, as DeleteVolume would, must block
+	// CreateVolume after the volume was created.
+	volumeNameMutex.LockKey("uuid-1")
+	created := make(chan error)
+	go func() {
+		_, err := od.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: "vol",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		created <- err
+	}()
+	select {
+	case err := <-created:
+		require.FailNow(t, "CreateVolume not blocked", "%v", err)
+	case <-time.After(time.Second):
+	}
+	volumeNameMutex.UnlockKey("uuid-1")
+	assert.NoError(t, <-created)
+	_, ok := od.metadata.get("uuid-1")
+	assert.True(t, ok, "metadata stored")
+}
@@ -0,0 +1,63 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"time"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// SnapshotGarbageCollector deletes snapshots after the duration
+// given with the retainFor parameter in CreateSnapshot. Snapshots
+// which cannot be deleted yet, for example because volumes were
+// created from them, are tried again later.
+type SnapshotGarbageCollector struct {
+	od       *oimDriver
+	interval time.Duration
+}
+
+// Run checks for expired snapshots at the interval until the
+// context is done.
+func (gc *SnapshotGarbageCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			gc.collect(ctx, time.Now())
+		}
+	}
+}
+
+// collect deletes all snapshots which expired before now and returns
+// the IDs of those that were deleted.
+func (gc *SnapshotGarbageCollector) collect(ctx context.Context, now time.Time) []string {
+	var deleted []string
+	for snapshotID, metadata := range gc.od.metadata.listSnapshots() {
+		if metadata.ExpiryUnixSeconds == 0 || metadata.ExpiryUnixSeconds > now.Unix() {
+			continue
+		}
+		log.FromContext(ctx).Infow("deleting expired snapshot",
+			"snapshotid", snapshotID,
+			"name", metadata.Name,
+			"expiry", time.Unix(metadata.ExpiryUnixSeconds, 0),
+		)
+		if err := gc.od.deleteSnapshot(ctx, snapshotID); err != nil {
+			log.FromContext(ctx).Warnw("deleting expired snapshot failed",
+				"snapshotid", snapshotID,
+				"error", err,
+			)
+			continue
+		}
+		deleted = append(deleted, snapshotID)
+	}
+	return deleted
+}
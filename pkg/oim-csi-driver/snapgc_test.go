@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestSnapshotRetention(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := driver.(*oimDriver03)
+	volumeID := fl.add("vol", 4*mib)
+
+	create := func(name, retainFor string) (*csi.Snapshot, error) {
+		var parameters map[string]string
+		if retainFor != "" {
+			parameters = map[string]string{retainForParameter: retainFor}
+		}
+		response, err := od.oimDriver.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           name,
+			SourceVolumeId: volumeID,
+			Parameters:     parameters,
+		})
+		return response.GetSnapshot(), err
+	}
+
+	for _, invalid := range []string{"1", "forever", "-1h", "0s"} {
+		_, err := create("invalid", invalid)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%s: %v", invalid, err)
+	}
+	assert.Nil(t, fl.find("lvs/invalid"))
+
+	start := time.Now()
+	hour, err := create("hour", "1h")
+	require.NoError(t, err)
+	day, err := create("day", "24h")
+	require.NoError(t, err)
+	forever, err := create("forever", "")
+	require.NoError(t, err)
+	metadata, ok := od.metadata.getSnapshot(hour.GetSnapshotId())
+	require.True(t, ok)
+	assert.InDelta(t, start.Add(time.Hour).Unix(), metadata.ExpiryUnixSeconds, 1)
+
+	list, err := od.ListSnapshots(ctx, &csi0.ListSnapshotsRequest{SnapshotId: hour.GetSnapshotId()})
+	require.NoError(t, err)
+	require.Len(t, list.GetEntries(), 1)
+	details := list.GetEntries()[0].GetSnapshot().GetStatus().GetDetails()
+	assert.True(t, strings.HasPrefix(details, "expires "), details)
+	list, err = od.ListSnapshots(ctx, &csi0.ListSnapshotsRequest{SnapshotId: forever.GetSnapshotId()})
+	require.NoError(t, err)
+	require.Len(t, list.GetEntries(), 1)
+	assert.Empty(t, list.GetEntries()[0].GetSnapshot().GetStatus().GetDetails())
+
+	gc := &SnapshotGarbageCollector{od: &od.oimDriver}
+	assert.Empty(t, gc.collect(ctx, start), "nothing expired yet")
+
+	// A clone keeps the expired snapshot alive until it is gone.
+	cloneID := fl.clone(day.GetSnapshotId(), "clone")
+	later := start.Add(48 * time.Hour)
+	assert.Equal(t, []string{hour.GetSnapshotId()}, gc.collect(ctx, later))
+	assert.Nil(t, fl.find(hour.GetSnapshotId()))
+	assert.NotNil(t, fl.find(day.GetSnapshotId()))
+	fl.mutex.Lock()
+	delete(fl.lvols, cloneID)
+	fl.find(day.GetSnapshotId()).DriverSpecific.LVol.Clones = nil
+	fl.mutex.Unlock()
+	assert.Equal(t, []string{day.GetSnapshotId()}, gc.collect(ctx, later))
+	assert.Nil(t, fl.find(day.GetSnapshotId()))
+	_, ok = od.metadata.getSnapshot(day.GetSnapshotId())
+	assert.False(t, ok, "metadata removed")
+
+	assert.NotNil(t, fl.find(forever.GetSnapshotId()), "no expiry")
+}
+
+func TestSnapshotGarbageCollectionOptions(t *testing.T) {
+	_, err := New(WithVHostEndpoint("/no/such/socket"), WithSnapshotGarbageCollection(time.Minute))
+	assert.NoError(t, err, "local")
+	_, err = New(WithDryRun(true), WithSnapshotGarbageCollection(time.Minute))
+	assert.Error(t, err, "dry-run")
+}
@@ -0,0 +1,294 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log"
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// snapshotInfo is what ListSnapshots returns about a snapshot.
+type snapshotInfo struct {
+	snapshotID string
+	SnapshotMetadata
+}
+
+// retainForParameter is the VolumeSnapshotClass parameter with the
+// duration after which the snapshot expires, in the format accepted
+// by time.ParseDuration.
+const retainForParameter = "retainFor"
+
+// retention checks the retainForParameter. Zero means that the
+// snapshot does not expire.
+func retention(parameters map[string]string) (time.Duration, error) {
+	value, ok := parameters[retainForParameter]
+	if !ok {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s parameter %q, must be a positive duration", retainForParameter, value))
+	}
+	return duration, nil
+}
+
+// expiry returns the ExpiryUnixSeconds for a snapshot created now.
+func expiry(creationTime time.Time, retainFor time.Duration) int64 {
+	if retainFor == 0 {
+		return 0
+	}
+	return creationTime.Add(retainFor).Unix()
+}
+
+// createSnapshot takes a snapshot of a logical volume. The ID of the
+// snapshot is the UUID of the read-only logical volume that SPDK
+// creates for it. Only supported with local SPDK.
+func (od *oimDriver) createSnapshot(ctx context.Context, name, sourceVolumeID string, parameters map[string]string) (snapshotInfo, error) {
+	if !od.local.enabled() {
+		return snapshotInfo{}, status.Error(codes.Unimplemented, "")
+	}
+	if name == "" {
+		return snapshotInfo{}, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if sourceVolumeID == "" {
+		return snapshotInfo{}, status.Error(codes.InvalidArgument, "Source Volume ID missing in request")
+	}
+	retainFor, err := retention(parameters)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	if err := od.checkVolumeTenant(ctx, sourceVolumeID); err != nil {
+		return snapshotInfo{}, err
+	}
+	name = tenantName(ctx, name)
+
+	// Serialize by snapshot name.
+	volumeNameMutex.LockKey(name)
+	defer volumeNameMutex.UnlockKey(name)
+
+	release, err := od.currentOps().acquire(ctx)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	defer release()
+
+	// Connect to SPDK.
+	client, err := od.local.connect()
+	if err != nil {
+		return snapshotInfo{}, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	source, err := getLVol(ctx, client, sourceVolumeID)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	if source == nil {
+		return snapshotInfo{}, status.Error(codes.NotFound, fmt.Sprintf("source volume %s not found", sourceVolumeID))
+	}
+	if source.DriverSpecific.LVol.Snapshot {
+		return snapshotInfo{}, status.Error(codes.InvalidArgument, fmt.Sprintf("%s is a snapshot, not a volume", sourceVolumeID))
+	}
+	lvstores, err := spdk.GetLVStores(ctx, client, spdk.GetLVStoresArgs{UUID: source.DriverSpecific.LVol.LVolStoreUUID})
+	if err != nil || len(lvstores) != 1 {
+		return snapshotInfo{}, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get logical volume store of %s: %v", sourceVolumeID, err))
+	}
+
+	// Snapshots are logical volumes in the same store as the
+	// source and can be found via their alias.
+	existing, err := getLVol(ctx, client, lvstores[0].Name+"/"+name)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	if existing != nil {
+		if !existing.DriverSpecific.LVol.Snapshot {
+			return snapshotInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("volume with the same name %s already exists", name))
+		}
+		metadata, ok := od.metadata.getSnapshot(existing.UUID)
+		if ok && metadata.SourceVolumeID != sourceVolumeID {
+			return snapshotInfo{}, status.Error(codes.AlreadyExists, fmt.Sprintf("snapshot %s already exists for volume %s", name, metadata.SourceVolumeID))
+		}
+		if !ok {
+			now := time.Now()
+			metadata = SnapshotMetadata{
+				Name:              name,
+				SourceVolumeID:    sourceVolumeID,
+				SourceUUID:        source.UUID,
+				SizeBytes:         existing.BlockSize * existing.NumBlocks,
+				CreationTime:      now,
+				ExpiryUnixSeconds: expiry(now, retainFor),
+				Tenant:            tenantFromContext(ctx),
+			}
+			od.metadata.setSnapshot(existing.UUID, metadata)
+		}
+		return snapshotInfo{snapshotID: existing.UUID, SnapshotMetadata: metadata}, nil
+	}
+
+	log.FromContext(ctx).Infow("creating snapshot",
+		"name", name,
+		"volumeid", sourceVolumeID,
+	)
+	snapshotID, err := spdk.SnapshotLVol(ctx, client, spdk.SnapshotLVolArgs{
+		LVolName:     sourceVolumeID,
+		SnapshotName: name,
+	})
+	if err != nil {
+		return snapshotInfo{}, status.Error(codes.Internal, fmt.Sprintf("Failed to create snapshot: %s", err))
+	}
+	now := time.Now()
+	metadata := SnapshotMetadata{
+		Name:              name,
+		SourceVolumeID:    sourceVolumeID,
+		SourceUUID:        source.UUID,
+		SizeBytes:         source.BlockSize * source.NumBlocks,
+		CreationTime:      now,
+		ExpiryUnixSeconds: expiry(now, retainFor),
+		Tenant:            tenantFromContext(ctx),
+	}
+	od.metadata.setSnapshot(snapshotID, metadata)
+	return snapshotInfo{snapshotID: snapshotID, SnapshotMetadata: metadata}, nil
+}
+
+// deleteSnapshot removes a snapshot unless some volume other than
+// the source still depends on it.
+func (od *oimDriver) deleteSnapshot(ctx context.Context, snapshotID string) error {
+	if !od.local.enabled() {
+		return status.Error(codes.Unimplemented, "")
+	}
+	if snapshotID == "" {
+		return status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+	if err := od.checkSnapshotTenant(ctx, snapshotID); err != nil {
+		return err
+	}
+
+	// Serialize by snapshot ID.
+	volumeNameMutex.LockKey(snapshotID)
+	defer volumeNameMutex.UnlockKey(snapshotID)
+
+	release, err := od.currentOps().acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Connect to SPDK.
+	client, err := od.local.connect()
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	snapshot, err := getLVol(ctx, client, snapshotID)
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		// Already gone (idempotency!).
+		od.metadata.deleteSnapshot(snapshotID)
+		return nil
+	}
+	if !snapshot.DriverSpecific.LVol.Snapshot {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s is not a snapshot", snapshotID))
+	}
+	dependent, err := dependentClones(ctx, client, snapshot, od.metadata)
+	if err != nil {
+		return err
+	}
+	if len(dependent) > 0 {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("snapshot %s is still used by %v", snapshotID, dependent))
+	}
+
+	log.FromContext(ctx).Infow("deleting snapshot", "snapshotid", snapshotID)
+	if err := spdk.DeleteLVol(ctx, client, spdk.LVolArgs{Name: snapshotID}); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("Failed to delete snapshot: %s", err))
+	}
+	od.metadata.deleteSnapshot(snapshotID)
+	return nil
+}
+
+// dependentClones returns the clones of the snapshot which would lose
+// their data if the snapshot was deleted. The source volume is itself
+// a clone of its snapshot, but SPDK merges the snapshot into it when
+// it is the only clone, so that one does not count.
+func dependentClones(ctx context.Context, client *spdk.Client, snapshot *spdk.BDev, metadata *metadataStore) ([]string, error) {
+	clones := snapshot.DriverSpecific.LVol.Clones
+	if len(clones) == 0 {
+		return nil, nil
+	}
+	if len(clones) == 1 {
+		info, ok := metadata.getSnapshot(snapshot.UUID)
+		if !ok {
+			return clones, nil
+		}
+		lvstores, err := spdk.GetLVStores(ctx, client, spdk.GetLVStoresArgs{UUID: snapshot.DriverSpecific.LVol.LVolStoreUUID})
+		if err != nil || len(lvstores) != 1 {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get logical volume store of %s: %v", snapshot.UUID, err))
+		}
+		clone, err := getLVol(ctx, client, lvstores[0].Name+"/"+clones[0])
+		if err != nil {
+			return nil, err
+		}
+		if clone != nil && clone.UUID == info.SourceUUID {
+			return nil, nil
+		}
+	}
+	return clones, nil
+}
+
+// listSnapshots returns one page of the snapshots created by the
+// driver, sorted by ID and optionally filtered by ID or source volume.
+func (od *oimDriver) listSnapshots(ctx context.Context, snapshotID, sourceVolumeID, startingToken string, maxEntries int32) ([]snapshotInfo, string, error) {
+	if !od.local.enabled() {
+		return nil, "", status.Error(codes.Unimplemented, "")
+	}
+	after, err := decodeToken(startingToken, maxEntries)
+	if err != nil {
+		return nil, "", err
+	}
+	var snapshots []snapshotInfo
+	for id, metadata := range od.metadata.listSnapshots() {
+		if snapshotID != "" && id != snapshotID ||
+			sourceVolumeID != "" && metadata.SourceVolumeID != sourceVolumeID ||
+			!visibleTo(ctx, metadata.Tenant) {
+			continue
+		}
+		snapshots = append(snapshots, snapshotInfo{snapshotID: id, SnapshotMetadata: metadata})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].snapshotID < snapshots[j].snapshotID
+	})
+	start, end, nextToken := paginate(len(snapshots), func(i int) string { return snapshots[i].snapshotID }, after, maxEntries)
+	return snapshots[start:end], nextToken, nil
+}
+
+// getLVol returns the logical volume with the given name, UUID or
+// alias, nil if not found, and an error if it is some other kind of
+// BDev.
+func getLVol(ctx context.Context, client *spdk.Client, name string) (*spdk.BDev, error) {
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: name})
+	if err != nil {
+		if spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS) {
+			return nil, nil
+		}
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to get BDevs from SPDK: %s", err))
+	}
+	if len(bdevs) != 1 {
+		return nil, nil
+	}
+	bdev := bdevs[0]
+	if bdev.DriverSpecific == nil || bdev.DriverSpecific.LVol == nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("%s is not a logical volume", name))
+	}
+	return &bdev, nil
+}
@@ -0,0 +1,446 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+// fakeLVols emulates the SPDK calls for logical volumes in a single
+// logical volume store "lvs" in a Fake. Logical volumes are indexed
+// by UUID and can be found by UUID or alias.
+type fakeLVols struct {
+	mutex   sync.Mutex
+	lvols   map[string]*spdk.BDev
+	counter int
+}
+
+const (
+	fakeLVStoreUUID     = "lvs-uuid"
+	fakeLVStoreClusters = 100
+)
+
+func newFakeLVols(fake *testspdk.Fake) *fakeLVols {
+	fl := &fakeLVols{lvols: map[string]*spdk.BDev{}}
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetBDevsArgs
+		if params != nil {
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, err
+			}
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		result := []spdk.BDev{}
+		for _, lvol := range fl.lvols {
+			if args.Name == "" || args.Name == lvol.UUID || args.Name == lvol.Aliases[0] {
+				result = append(result, *lvol)
+			}
+		}
+		if args.Name != "" && len(result) == 0 {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "bdev not found"}
+		}
+		return result, nil
+	})
+	fake.Handle("bdev_lvol_get_lvstores", func(params json.RawMessage) (interface{}, error) {
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		free := int64(fakeLVStoreClusters)
+		for _, lvol := range fl.lvols {
+			free -= (lvol.NumBlocks*lvol.BlockSize + mib - 1) / mib
+		}
+		return []spdk.LVStore{{
+			UUID:              fakeLVStoreUUID,
+			Name:              "lvs",
+			TotalDataClusters: fakeLVStoreClusters,
+			FreeClusters:      free,
+			BlockSize:         512,
+			ClusterSize:       mib,
+		}}, nil
+	})
+	fake.Handle("bdev_lvol_create", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.CreateLVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		if fl.find("lvs/"+args.LVolName) != nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol with the same name exists"}
+		}
+		lvol := fl.create(args.LVolName, (args.Size+mib-1)/mib*mib)
+		lvol.DriverSpecific.LVol.ThinProvision = args.ThinProvision
+		return lvol.UUID, nil
+	})
+	fake.Handle("bdev_lvol_rename", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.RenameLVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.find(args.OldName)
+		if lvol == nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol not found"}
+		}
+		if fl.find("lvs/"+args.NewName) != nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol with the same name exists"}
+		}
+		lvol.Aliases[0] = "lvs/" + args.NewName
+		return true, nil
+	})
+	fake.Handle("bdev_lvol_resize", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.ResizeLVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.find(args.Name)
+		if lvol == nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol not found"}
+		}
+		lvol.NumBlocks = (args.Size + mib - 1) / mib * mib / lvol.BlockSize
+		return true, nil
+	})
+	fake.Handle("bdev_lvol_snapshot", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.SnapshotLVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		source := fl.find(args.LVolName)
+		if source == nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol not found"}
+		}
+		snapshot := fl.create(args.SnapshotName, source.NumBlocks*source.BlockSize)
+		snapshot.DriverSpecific.LVol.Snapshot = true
+		// The source becomes a clone of the snapshot.
+		fl.link(snapshot, source)
+		return snapshot.UUID, nil
+	})
+	fake.Handle("bdev_lvol_clone", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.CloneLVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		snapshot := fl.find(args.SnapshotName)
+		if snapshot == nil || !snapshot.DriverSpecific.LVol.Snapshot {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "snapshot not found"}
+		}
+		clone := fl.create(args.CloneName, snapshot.NumBlocks*snapshot.BlockSize)
+		fl.link(snapshot, clone)
+		return clone.UUID, nil
+	})
+	fake.Handle("bdev_lvol_inflate", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.LVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.find(args.Name)
+		if lvol == nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol not found"}
+		}
+		if snapshot := fl.find("lvs/" + lvol.DriverSpecific.LVol.BaseSnapshot); snapshot != nil {
+			name := lvol.Aliases[0][len("lvs/"):]
+			var clones []string
+			for _, clone := range snapshot.DriverSpecific.LVol.Clones {
+				if clone != name {
+					clones = append(clones, clone)
+				}
+			}
+			snapshot.DriverSpecific.LVol.Clones = clones
+		}
+		lvol.DriverSpecific.LVol.Clone = false
+		lvol.DriverSpecific.LVol.BaseSnapshot = ""
+		return true, nil
+	})
+	fake.Handle("bdev_lvol_delete", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.LVolArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		fl.mutex.Lock()
+		defer fl.mutex.Unlock()
+		lvol := fl.find(args.Name)
+		if lvol == nil {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol not found"}
+		}
+		if len(lvol.DriverSpecific.LVol.Clones) > 1 {
+			return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "snapshot has more than one clone"}
+		}
+		for _, clone := range lvol.DriverSpecific.LVol.Clones {
+			fl.find("lvs/" + clone).DriverSpecific.LVol.Clone = false
+			fl.find("lvs/" + clone).DriverSpecific.LVol.BaseSnapshot = ""
+		}
+		delete(fl.lvols, lvol.UUID)
+		return true, nil
+	})
+	return fl
+}
+
+// add creates a new logical volume and returns its UUID.
+func (fl *fakeLVols) add(name string, size int64) string {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+	return fl.create(name, size).UUID
+}
+
+// clone creates a clone of a snapshot and returns its UUID.
+func (fl *fakeLVols) clone(snapshotID, name string) string {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+	snapshot := fl.find(snapshotID)
+	clone := fl.create(name, snapshot.NumBlocks*snapshot.BlockSize)
+	fl.link(snapshot, clone)
+	return clone.UUID
+}
+
+func (fl *fakeLVols) create(name string, size int64) *spdk.BDev {
+	fl.counter++
+	lvol := &spdk.BDev{
+		Name:        fmt.Sprintf("uuid-%d", fl.counter),
+		UUID:        fmt.Sprintf("uuid-%d", fl.counter),
+		Aliases:     []string{"lvs/" + name},
+		ProductName: lvolProductName,
+		BlockSize:   512,
+		NumBlocks:   size / 512,
+		DriverSpecific: &spdk.DriverSpecific{
+			LVol: &spdk.LVolDriverSpecific{
+				LVolStoreUUID: fakeLVStoreUUID,
+			},
+		},
+	}
+	fl.lvols[lvol.UUID] = lvol
+	return lvol
+}
+
+func (fl *fakeLVols) link(snapshot, clone *spdk.BDev) {
+	snapshot.DriverSpecific.LVol.Clones = append(snapshot.DriverSpecific.LVol.Clones, clone.Aliases[0][len("lvs/"):])
+	clone.DriverSpecific.LVol.Clone = true
+	clone.DriverSpecific.LVol.BaseSnapshot = snapshot.Aliases[0][len("lvs/"):]
+}
+
+func (fl *fakeLVols) find(name string) *spdk.BDev {
+	for _, lvol := range fl.lvols {
+		if name == lvol.UUID || name == lvol.Aliases[0] {
+			return lvol
+		}
+	}
+	return nil
+}
+
+func TestSnapshots(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	volumeID := fl.add("vol", 4*mib)
+
+	create := func(name, source string) (*csi.Snapshot, error) {
+		response, err := od.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           name,
+			SourceVolumeId: source,
+		})
+		return response.GetSnapshot(), err
+	}
+	remove := func(snapshotID string) error {
+		_, err := od.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+		return err
+	}
+
+	snap1, err := create("snap1", volumeID)
+	require.NoError(t, err)
+	assert.Equal(t, volumeID, snap1.GetSourceVolumeId())
+	assert.Equal(t, 4*mib, snap1.GetSizeBytes())
+	assert.True(t, snap1.GetReadyToUse())
+	assert.NotNil(t, snap1.GetCreationTime())
+
+	// Idempotent.
+	again, err := create("snap1", volumeID)
+	require.NoError(t, err)
+	assert.Equal(t, snap1.GetSnapshotId(), again.GetSnapshotId())
+	assert.Len(t, fl.lvols, 2, "no duplicate snapshot")
+
+	otherVolumeID := fl.add("other", mib)
+	_, err = create("snap1", otherVolumeID)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "same name, other source: %s", err)
+	_, err = create("snap2", "no-such-volume")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown source: %s", err)
+	_, err = create("snap2", snap1.GetSnapshotId())
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "snapshot of snapshot: %s", err)
+
+	// The source volume alone does not prevent deletion.
+	snap2, err := create("snap2", otherVolumeID)
+	require.NoError(t, err)
+	require.NoError(t, remove(snap2.GetSnapshotId()))
+	assert.Nil(t, fl.find(snap2.GetSnapshotId()), "snap2 deleted")
+	require.NoError(t, remove(snap2.GetSnapshotId()), "idempotent")
+
+	// A clone of the snapshot does.
+	fl.clone(snap1.GetSnapshotId(), "clone")
+	err = remove(snap1.GetSnapshotId())
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "snapshot with clone: %s", err)
+	assert.NotNil(t, fl.find(snap1.GetSnapshotId()), "snap1 not deleted")
+
+	// Even without the source volume.
+	delete(fl.lvols, volumeID)
+	fl.find(snap1.GetSnapshotId()).DriverSpecific.LVol.Clones = []string{"clone"}
+	err = remove(snap1.GetSnapshotId())
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "snapshot with clone: %s", err)
+
+	_, err = od.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: otherVolumeID})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "not a snapshot: %s", err)
+}
+
+func TestListSnapshots(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+
+	var ids []string
+	for _, volume := range []string{"vol-a", "vol-b"} {
+		volumeID := fl.add(volume, mib)
+		for i := 0; i < 3; i++ {
+			response, err := od.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+				Name:           fmt.Sprintf("%s-snap%d", volume, i),
+				SourceVolumeId: volumeID,
+			})
+			require.NoError(t, err)
+			ids = append(ids, response.GetSnapshot().GetSnapshotId())
+		}
+	}
+
+	list := func(req *csi.ListSnapshotsRequest) ([]string, string, error) {
+		response, err := od.ListSnapshots(ctx, req)
+		if err != nil {
+			return nil, "", err
+		}
+		var ids []string
+		for _, entry := range response.GetEntries() {
+			ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+		}
+		return ids, response.GetNextToken(), nil
+	}
+
+	var all []string
+	token := ""
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 6, "too many pages")
+		page, next, err := list(&csi.ListSnapshotsRequest{StartingToken: token, MaxEntries: 4})
+		require.NoError(t, err)
+		all = append(all, page...)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.ElementsMatch(t, ids, all, "paged")
+	assert.Len(t, all, 6, "no duplicates")
+
+	page, _, err := list(&csi.ListSnapshotsRequest{SourceVolumeId: "uuid-1"})
+	require.NoError(t, err)
+	assert.Equal(t, ids[0:3], page, "by source")
+	page, _, err = list(&csi.ListSnapshotsRequest{SnapshotId: ids[4]})
+	require.NoError(t, err)
+	assert.Equal(t, ids[4:5], page, "by ID")
+	page, _, err = list(&csi.ListSnapshotsRequest{SnapshotId: "no-such-snapshot"})
+	require.NoError(t, err)
+	assert.Empty(t, page, "unknown ID")
+
+	_, _, err = list(&csi.ListSnapshotsRequest{StartingToken: "!!!"})
+	assert.Equal(t, codes.Aborted, status.Code(err), "invalid token: %s", err)
+}
+
+func TestValidateMultiNodeReader(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fl := newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	od := driver.(*oimDriver03)
+
+	volumeID := fl.add("vol", mib)
+	response, err := od.oimDriver.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           "snap",
+		SourceVolumeId: volumeID,
+	})
+	require.NoError(t, err)
+	snapshotID := response.GetSnapshot().GetSnapshotId()
+
+	validate := func(volumeID string) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+		return od.oimDriver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId: volumeID,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			}},
+		})
+	}
+	validate0 := func(volumeID string) (*csi0.ValidateVolumeCapabilitiesResponse, error) {
+		return od.ValidateVolumeCapabilities(ctx, &csi0.ValidateVolumeCapabilitiesRequest{
+			VolumeId: volumeID,
+			VolumeCapabilities: []*csi0.VolumeCapability{{
+				AccessType: &csi0.VolumeCapability_Mount{Mount: &csi0.VolumeCapability_MountVolume{}},
+				AccessMode: &csi0.VolumeCapability_AccessMode{Mode: csi0.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			}},
+		})
+	}
+
+	result, err := validate(snapshotID)
+	require.NoError(t, err)
+	assert.NotNil(t, result.GetConfirmed(), "snapshot")
+	result0, err := validate0(snapshotID)
+	require.NoError(t, err)
+	assert.True(t, result0.GetSupported(), "snapshot, CSI 0.3")
+
+	result, err = validate(volumeID)
+	require.NoError(t, err)
+	assert.Nil(t, result.GetConfirmed(), "volume")
+	assert.Contains(t, result.GetMessage(), "not a snapshot")
+	result0, err = validate0(volumeID)
+	require.NoError(t, err)
+	assert.False(t, result0.GetSupported(), "volume, CSI 0.3")
+	assert.Contains(t, result0.GetMessage(), "not a snapshot")
+
+	_, err = validate("no-such-volume")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %s", err)
+}
@@ -0,0 +1,272 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// BlockRange is a contiguous range of bytes inside a volume.
+type BlockRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// VolumeSnapshotDiffAPI determines which parts of a logical volume
+// differ from a snapshot and reads only those. Incremental backup
+// tools use it to avoid copying the entire volume.
+//
+// It is only available when the driver controls SPDK directly.
+type VolumeSnapshotDiffAPI struct {
+	local *localSPDK
+	// metadata is set when served by the driver and used for
+	// checking the tenant.
+	metadata *metadataStore
+}
+
+// NewVolumeSnapshotDiffAPI returns an instance which talks to
+// the SPDK daemon at the given RPC socket.
+func NewVolumeSnapshotDiffAPI(vhostEndpoint string) *VolumeSnapshotDiffAPI {
+	return &VolumeSnapshotDiffAPI{
+		local: &localSPDK{vhostEndpoint: vhostEndpoint},
+	}
+}
+
+// GetSnapshotDiff returns the ranges in which the content of the
+// target snapshot differs from the base snapshot. The granularity
+// is the cluster size of the lvol store. Both snapshots must be in
+// the same lvol store. A volume name can be used instead of the
+// target snapshot to find the changes since the base snapshot.
+func (v *VolumeSnapshotDiffAPI) GetSnapshotDiff(ctx context.Context, baseSnapshotID, targetSnapshotID string) ([]BlockRange, error) {
+	for _, id := range []string{baseSnapshotID, targetSnapshotID} {
+		if err := v.checkTenant(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	client, err := v.local.connect()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Failed to connect to SPDK: %s", err))
+	}
+
+	base, err := spdk.GetLVolClusterMap(ctx, client, spdk.GetLVolClusterMapArgs{Name: baseSnapshotID})
+	if err != nil {
+		return nil, clusterMapError(baseSnapshotID, err)
+	}
+	target, err := spdk.GetLVolClusterMap(ctx, client, spdk.GetLVolClusterMapArgs{Name: targetSnapshotID})
+	if err != nil {
+		return nil, clusterMapError(targetSnapshotID, err)
+	}
+	ranges, err := diffClusterMaps(base, target)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Cannot compare %s and %s: %s", baseSnapshotID, targetSnapshotID, err))
+	}
+	return ranges, nil
+}
+
+// checkTenant rejects snapshots and volumes of another tenant, like
+// DeleteSnapshot does.
+func (v *VolumeSnapshotDiffAPI) checkTenant(ctx context.Context, id string) error {
+	var (
+		tenant string
+		ok     bool
+	)
+	if v.metadata != nil {
+		var snapshot SnapshotMetadata
+		if snapshot, ok = v.metadata.getSnapshot(id); ok {
+			tenant = snapshot.Tenant
+		} else {
+			var volume VolumeMetadata
+			volume, ok = v.metadata.get(id)
+			tenant = volume.Tenant
+		}
+	}
+	if !ownedBy(ctx, tenant, ok) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s belongs to another tenant", id))
+	}
+	return nil
+}
+
+func clusterMapError(name string, err error) error {
+	code := codes.FailedPrecondition
+	// Same ambiguity as for get_bdevs: invalid parameters
+	// most likely means that the lvol does not exist.
+	if spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS) {
+		code = codes.NotFound
+	}
+	return status.Error(code, fmt.Sprintf("Failed to get cluster map of %s: %s", name, err))
+}
+
+// ReadChangedBlocks writes the current content of all ranges in the
+// volume which differ from the snapshot to w. The data is written
+// in the order of the ranges returned by GetSnapshotDiff for the
+// same arguments, without any framing.
+func (v *VolumeSnapshotDiffAPI) ReadChangedBlocks(ctx context.Context, volumeID, snapshotID string, w io.Writer) error {
+	ranges, err := v.GetSnapshotDiff(ctx, snapshotID, volumeID)
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	// Serialize operations per volume by ID.
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	// Reuse the NBD disk if the volume is staged, otherwise
+	// create one just for reading.
+	client, err := v.local.connect()
+	if err != nil {
+		return errors.Wrap(err, "connect to SPDK")
+	}
+	device, err := findNBDDevice(ctx, client, volumeID)
+	if err != nil {
+		return err
+	}
+	if device == "" {
+		device, _, err = v.local.createDevice(ctx, volumeID, nil)
+		if err != nil {
+			return err
+		}
+		defer v.local.deleteDevice(ctx, volumeID)
+	}
+
+	file, err := os.Open(device)
+	if err != nil {
+		return errors.Wrap(err, "open volume")
+	}
+	defer file.Close()
+	for _, r := range ranges {
+		if _, err := io.Copy(w, io.NewSectionReader(file, r.Offset, r.Length)); err != nil {
+			return errors.Wrapf(err, "copy %d bytes at offset %d", r.Length, r.Offset)
+		}
+	}
+	return nil
+}
+
+// diffClusterMaps compares the cluster maps position by position
+// and merges adjacent differences into one range. Clusters beyond
+// the end of the shorter map count as changed.
+func diffClusterMaps(base, target spdk.LVolClusterMap) ([]BlockRange, error) {
+	if base.ClusterSize != target.ClusterSize {
+		return nil, errors.Errorf("cluster size %d != %d", base.ClusterSize, target.ClusterSize)
+	}
+	clusters := len(base.Clusters)
+	if len(target.Clusters) > clusters {
+		clusters = len(target.Clusters)
+	}
+	ranges := []BlockRange{}
+	var current *BlockRange
+	for i := 0; i < clusters; i++ {
+		if i < len(base.Clusters) &&
+			i < len(target.Clusters) &&
+			base.Clusters[i] == target.Clusters[i] {
+			current = nil
+			continue
+		}
+		if current == nil {
+			ranges = append(ranges, BlockRange{Offset: int64(i) * base.ClusterSize})
+			current = &ranges[len(ranges)-1]
+		}
+		current.Length += base.ClusterSize
+	}
+	return ranges, nil
+}
+
+// The snapshot diff API is not part of CSI, so there is no
+// protobuf definition for it. Instead it is provided as an
+// additional gRPC service on the CSI socket with JSON encoding.
+const (
+	snapshotDiffService = "oim.csi.v1.SnapshotDiff"
+	jsonCodecName       = "json"
+)
+
+// GetSnapshotDiffRequest is the request for GetSnapshotDiff via gRPC.
+type GetSnapshotDiffRequest struct {
+	BaseSnapshotID   string `json:"base_snapshot_id"`
+	TargetSnapshotID string `json:"target_snapshot_id"`
+}
+
+// GetSnapshotDiffReply is the response for GetSnapshotDiff via gRPC.
+type GetSnapshotDiffReply struct {
+	Ranges []BlockRange `json:"ranges"`
+}
+
+// GetSnapshotDiff invokes VolumeSnapshotDiffAPI.GetSnapshotDiff through
+// a connection to the CSI socket of the driver.
+func GetSnapshotDiff(ctx context.Context, conn *grpc.ClientConn, baseSnapshotID, targetSnapshotID string) ([]BlockRange, error) {
+	request := &GetSnapshotDiffRequest{
+		BaseSnapshotID:   baseSnapshotID,
+		TargetSnapshotID: targetSnapshotID,
+	}
+	reply := &GetSnapshotDiffReply{}
+	if err := conn.Invoke(ctx, "/"+snapshotDiffService+"/GetSnapshotDiff", request, reply,
+		grpc.CallContentSubtype(jsonCodecName)); err != nil {
+		return nil, err
+	}
+	return reply.Ranges, nil
+}
+
+func registerSnapshotDiffServer(s *grpc.Server, v *VolumeSnapshotDiffAPI) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: snapshotDiffService,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "GetSnapshotDiff",
+				Handler:    getSnapshotDiffHandler,
+			},
+		},
+		Streams: []grpc.StreamDesc{},
+	}, v)
+}
+
+func getSnapshotDiffHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) { // nolint: golint
+	in := new(GetSnapshotDiffRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		in := req.(*GetSnapshotDiffRequest)
+		ranges, err := srv.(*VolumeSnapshotDiffAPI).GetSnapshotDiff(ctx, in.BaseSnapshotID, in.TargetSnapshotID)
+		if err != nil {
+			return nil, err
+		}
+		return &GetSnapshotDiffReply{Ranges: ranges}, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + snapshotDiffService + "/GetSnapshotDiff",
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// jsonCodec is selected by gRPC for calls with the "json" content subtype.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return jsonCodecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
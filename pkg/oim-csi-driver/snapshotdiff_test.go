@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/oim-common"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestDiffClusterMaps(t *testing.T) {
+	for name, tc := range map[string]struct {
+		base, target []int64
+		expected     []BlockRange
+	}{
+		"empty": {
+			expected: []BlockRange{},
+		},
+		"identical": {
+			base:     []int64{1, 2, -1, 4},
+			target:   []int64{1, 2, -1, 4},
+			expected: []BlockRange{},
+		},
+		"one": {
+			base:     []int64{1, 2, 3, 4},
+			target:   []int64{1, 5, 3, 4},
+			expected: []BlockRange{{Offset: 10, Length: 10}},
+		},
+		"merged": {
+			base:     []int64{1, 2, 3, 4},
+			target:   []int64{1, 5, 6, -1},
+			expected: []BlockRange{{Offset: 10, Length: 30}},
+		},
+		"separate": {
+			base:     []int64{1, 2, 3, 4},
+			target:   []int64{7, 2, 3, 8},
+			expected: []BlockRange{{Offset: 0, Length: 10}, {Offset: 30, Length: 10}},
+		},
+		"grown": {
+			base:     []int64{1, 2},
+			target:   []int64{1, 2, 3},
+			expected: []BlockRange{{Offset: 20, Length: 10}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ranges, err := diffClusterMaps(
+				spdk.LVolClusterMap{ClusterSize: 10, Clusters: tc.base},
+				spdk.LVolClusterMap{ClusterSize: 10, Clusters: tc.target},
+			)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, ranges)
+		})
+	}
+
+	_, err := diffClusterMaps(spdk.LVolClusterMap{ClusterSize: 10}, spdk.LVolClusterMap{ClusterSize: 20})
+	assert.Error(t, err, "different cluster size")
+}
+
+func TestGetSnapshotDiff(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	maps := map[string]spdk.LVolClusterMap{
+		"snap1": {ClusterSize: 4096, Clusters: []int64{1, 2, 3}},
+		"snap2": {ClusterSize: 4096, Clusters: []int64{1, 4, 3}},
+	}
+	fake.Handle("bdev_lvol_get_cluster_map", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetLVolClusterMapArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		if m, ok := maps[args.Name]; ok {
+			return m, nil
+		}
+		return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "no such lvol"}
+	})
+
+	tmp, err := ioutil.TempDir("", "oim-driver")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	endpoint := "unix://" + tmp + "/oim-driver.sock"
+	driver, err := New(WithCSIEndpoint(endpoint), WithVHostEndpoint(fake.Path))
+	require.NoError(t, err)
+	s, err := driver.Start(ctx)
+	require.NoError(t, err)
+	defer s.ForceStop(ctx)
+
+	opts := oimcommon.ChooseDialOpts(endpoint, grpc.WithBlock(), grpc.WithInsecure())
+	conn, err := grpc.Dial(endpoint, opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ranges, err := GetSnapshotDiff(ctx, conn, "snap1", "snap2")
+	require.NoError(t, err)
+	assert.Equal(t, []BlockRange{{Offset: 4096, Length: 4096}}, ranges)
+
+	_, err = GetSnapshotDiff(ctx, conn, "snap1", "no-such-snapshot")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown snapshot: %s", err)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// tagLabelPrefix selects the PVC labels which get copied into the
+// volume metadata. The prefix itself is removed.
+const tagLabelPrefix = "oim.io/tag/"
+
+// VolumeTagPropagator watches PersistentVolumeClaims and copies
+// their tag labels into the Labels of the VolumeMetadata of the
+// volume that is bound to them. Only volumes provisioned by this
+// driver are considered.
+type VolumeTagPropagator struct {
+	driverName string
+	metadata   *metadataStore
+	factory    informers.SharedInformerFactory
+	pvcLister  corelisters.PersistentVolumeClaimLister
+	pvLister   corelisters.PersistentVolumeLister
+}
+
+func newVolumeTagPropagator(client kubernetes.Interface, driverName string, metadata *metadataStore) *VolumeTagPropagator {
+	factory := informers.NewSharedInformerFactory(client, 10*time.Minute)
+	tp := &VolumeTagPropagator{
+		driverName: driverName,
+		metadata:   metadata,
+		factory:    factory,
+		pvcLister:  factory.Core().V1().PersistentVolumeClaims().Lister(),
+		pvLister:   factory.Core().V1().PersistentVolumes().Lister(),
+	}
+	return tp
+}
+
+// Run processes changes until the context is done.
+func (tp *VolumeTagPropagator) Run(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	sync := func(pvc *v1.PersistentVolumeClaim) {
+		if err := tp.syncPVC(pvc); err != nil {
+			logger.Warnw("propagating PVC labels failed",
+				"pvc", pvc.Namespace+"/"+pvc.Name,
+				"error", err,
+			)
+		}
+	}
+	tp.factory.Core().V1().PersistentVolumeClaims().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			sync(obj.(*v1.PersistentVolumeClaim))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			sync(newObj.(*v1.PersistentVolumeClaim))
+		},
+	})
+	// The PV might show up after the PVC was already bound to it.
+	tp.factory.Core().V1().PersistentVolumes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pvc := tp.claimFor(obj.(*v1.PersistentVolume)); pvc != nil {
+				sync(pvc)
+			}
+		},
+	})
+
+	tp.factory.Start(ctx.Done())
+	for informer, synced := range tp.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return errors.Errorf("failed to sync informer for %s", informer)
+		}
+	}
+	logger.Infow("propagating PVC labels", "prefix", tagLabelPrefix)
+	<-ctx.Done()
+	return nil
+}
+
+func (tp *VolumeTagPropagator) claimFor(pv *v1.PersistentVolume) *v1.PersistentVolumeClaim {
+	ref := pv.Spec.ClaimRef
+	if ref == nil {
+		return nil
+	}
+	pvc, err := tp.pvcLister.PersistentVolumeClaims(ref.Namespace).Get(ref.Name)
+	if err != nil {
+		return nil
+	}
+	return pvc
+}
+
+// syncPVC replaces the labels of the volume bound to the PVC.
+func (tp *VolumeTagPropagator) syncPVC(pvc *v1.PersistentVolumeClaim) error {
+	if pvc.Spec.VolumeName == "" {
+		// Not bound yet.
+		return nil
+	}
+	pv, err := tp.pvLister.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		// Not known yet, will be handled when the PV shows up.
+		return nil
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != tp.driverName {
+		return nil
+	}
+	labels := tagsFromLabels(pvc.Labels)
+	volumeID := pv.Spec.CSI.VolumeHandle
+
+	// Serialize operations per volume by ID.
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	tp.metadata.update(volumeID, func(metadata *VolumeMetadata) {
+		metadata.Labels = labels
+	})
+	return nil
+}
+
+// tagsFromLabels returns the labels with tagLabelPrefix, without the
+// prefix, or nil if there are none.
+func tagsFromLabels(labels map[string]string) map[string]string {
+	var tags map[string]string
+	for key, value := range labels {
+		if !strings.HasPrefix(key, tagLabelPrefix) {
+			continue
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[strings.TrimPrefix(key, tagLabelPrefix)] = value
+	}
+	return tags
+}
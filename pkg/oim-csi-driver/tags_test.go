@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestVolumeTagPropagator(t *testing.T) {
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pvcIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	tp := &VolumeTagPropagator{
+		driverName: "oim-driver",
+		metadata:   newMetadataStore(),
+		pvLister:   corelisters.NewPersistentVolumeLister(pvIndexer),
+		pvcLister:  corelisters.NewPersistentVolumeClaimLister(pvcIndexer),
+	}
+	newPV := func(name, driver, handle string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "claim-" + name},
+			},
+		}
+		if driver != "" {
+			pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: handle}
+		}
+		return pv
+	}
+	newPVC := func(volumeName string, labels map[string]string) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-" + volumeName, Labels: labels},
+			Spec:       v1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+		}
+	}
+	for _, pv := range []*v1.PersistentVolume{
+		newPV("pv-1", "oim-driver", "vol-1"),
+		newPV("pv-2", "other-driver", "vol-2"),
+		newPV("pv-3", "", ""),
+	} {
+		require.NoError(t, pvIndexer.Add(pv))
+	}
+	labels := map[string]string{
+		"oim.io/tag/cost-centre": "1234",
+		"oim.io/tag/owner":       "alice",
+		"app":                    "db",
+	}
+
+	// Our volume.
+	err := tp.syncPVC(newPVC("pv-1", labels))
+	require.NoError(t, err)
+	metadata, _ := tp.metadata.get("vol-1")
+	assert.Equal(t, map[string]string{"cost-centre": "1234", "owner": "alice"}, metadata.Labels)
+
+	// Removing labels.
+	err = tp.syncPVC(newPVC("pv-1", map[string]string{"app": "db"}))
+	require.NoError(t, err)
+	metadata, _ = tp.metadata.get("vol-1")
+	assert.Nil(t, metadata.Labels, "labels removed")
+
+	// Ignored: other driver, no CSI, unbound, unknown PV.
+	for _, pvc := range []*v1.PersistentVolumeClaim{
+		newPVC("pv-2", labels),
+		newPVC("pv-3", labels),
+		newPVC("", labels),
+		newPVC("pv-4", labels),
+	} {
+		err = tp.syncPVC(pvc)
+		require.NoError(t, err)
+	}
+	tp.metadata.mutex.Lock()
+	assert.Equal(t, []string{"vol-1"}, keys(tp.metadata.volumes))
+	tp.metadata.mutex.Unlock()
+
+	// Finding the PVC for a PV.
+	require.NoError(t, pvcIndexer.Add(newPVC("pv-1", labels)))
+	pv, err := tp.pvLister.Get("pv-1")
+	require.NoError(t, err)
+	pvc := tp.claimFor(pv)
+	if assert.NotNil(t, pvc) {
+		assert.Equal(t, "claim-pv-1", pvc.Name)
+	}
+	pv, err = tp.pvLister.Get("pv-2")
+	require.NoError(t, err)
+	assert.Nil(t, tp.claimFor(pv), "unknown PVC")
+}
+
+func keys(m map[string]VolumeMetadata) []string {
+	var result []string
+	for key := range m {
+		result = append(result, key)
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authorizationMetadata is the gRPC metadata entry with the bearer
+// token of the caller.
+const authorizationMetadata = "authorization"
+
+// TokenStore maps the bearer tokens of container orchestrators to
+// the tenants on whose behalf they manage volumes.
+type TokenStore interface {
+	Tenant(token string) (string, bool)
+}
+
+// TenantTokens is a TokenStore with a fixed set of tokens, for
+// example {"secret-a": "tenant-a"}.
+type TenantTokens map[string]string
+
+var _ TokenStore = TenantTokens{}
+
+// Tenant returns the tenant of a known token.
+func (tt TenantTokens) Tenant(token string) (string, bool) {
+	tenant, ok := tt[token]
+	return tenant, ok && tenant != ""
+}
+
+// LoadTenantTokens reads TenantTokens from a JSON file, typically
+// a Secret mounted into the pod of the driver.
+func LoadTenantTokens(filename string) (TenantTokens, error) {
+	content, err := ioutil.ReadFile(filename) // nolint: gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "read tenant tokens")
+	}
+	var tokens TenantTokens
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return nil, errors.Wrapf(err, "parse tenant tokens %s", filename)
+	}
+	return tokens, nil
+}
+
+type tenantKey struct{}
+
+// withTenant returns a context for requests of the tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant set by TokenAuthInterceptor,
+// empty if authentication is disabled.
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantName returns the name under which a volume or snapshot of
+// the tenant gets created. The tenant prefix keeps the names of
+// different tenants apart. It starts with the length of the tenant,
+// because tenants and names both may contain the separator: "a" and
+// "b-x" become "1-a-b-x", "a-b" and "x" become "3-a-b-x".
+func tenantName(ctx context.Context, name string) string {
+	if tenant := tenantFromContext(ctx); tenant != "" {
+		return fmt.Sprintf("%d-%s-%s", len(tenant), tenant, name)
+	}
+	return name
+}
+
+// validateVolumeName checks the name given by the caller and, with a
+// tenant, also the longer name of the volume.
+func (od *oimDriver) validateVolumeName(ctx context.Context, name string) error {
+	if err := od.volumeNameValidator.ValidateVolumeName(name); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if prefixed := tenantName(ctx, name); prefixed != name {
+		if err := od.volumeNameValidator.ValidateVolumeName(prefixed); err != nil {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("with tenant prefix: %s", err))
+		}
+	}
+	return nil
+}
+
+// visibleTo is true when the caller may see or modify an object that
+// was created for the owner. Without authentication, all objects are
+// visible.
+func visibleTo(ctx context.Context, owner string) bool {
+	tenant := tenantFromContext(ctx)
+	return tenant == "" || tenant == owner
+}
+
+// ownedBy is true when the caller may modify an object with the given
+// metadata. A caller with a tenant cannot tell whether an object
+// without metadata was created for it, for example after the metadata
+// was lost, therefore such objects are denied.
+func ownedBy(ctx context.Context, owner string, ok bool) bool {
+	if !ok {
+		return tenantFromContext(ctx) == ""
+	}
+	return visibleTo(ctx, owner)
+}
+
+// checkVolumeTenant rejects requests for volumes of another tenant
+// and, when the caller has a tenant, for volumes without metadata.
+func (od *oimDriver) checkVolumeTenant(ctx context.Context, volumeID string) error {
+	if metadata, ok := od.metadata.get(volumeID); !ownedBy(ctx, metadata.Tenant, ok) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("volume %s belongs to another tenant", volumeID))
+	}
+	return nil
+}
+
+// checkSnapshotTenant is the same as checkVolumeTenant for snapshots.
+func (od *oimDriver) checkSnapshotTenant(ctx context.Context, snapshotID string) error {
+	if metadata, ok := od.metadata.getSnapshot(snapshotID); !ownedBy(ctx, metadata.Tenant, ok) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("snapshot %s belongs to another tenant", snapshotID))
+	}
+	return nil
+}
+
+// TokenAuthInterceptor authenticates calls of the CSI controller
+// service and of the OIM extensions like VolumeRename with the bearer
+// token in the authorization metadata and adds the tenant of the
+// token to the context. The identity and node services remain
+// accessible without token because they are called by the kubelet,
+// which has no tenant.
+func TokenAuthInterceptor(tokens TokenStore) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.Contains(info.FullMethod, ".Controller/") &&
+			!strings.HasPrefix(info.FullMethod, "/oim.csi.v1.") {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get(authorizationMetadata)
+		if len(values) != 1 || !strings.HasPrefix(values[0], "Bearer ") {
+			return nil, status.Error(codes.Unauthenticated, "bearer token missing in authorization metadata")
+		}
+		tenant, ok := tokens.Tenant(strings.TrimPrefix(values[0], "Bearer "))
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+		}
+		return handler(withTenant(ctx, tenant), req)
+	}
+}
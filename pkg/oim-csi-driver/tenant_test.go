@@ -0,0 +1,225 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestTokenAuthInterceptor(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	interceptor := TokenAuthInterceptor(TenantTokens{"secret-a": "tenant-a"})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return tenantFromContext(ctx), nil
+	}
+
+	for name, tc := range map[string]struct {
+		method        string
+		authorization []string
+		tenant        string
+		code          codes.Code
+	}{
+		"valid":     {"/csi.v1.Controller/CreateVolume", []string{"Bearer secret-a"}, "tenant-a", codes.OK},
+		"csi-0.3":   {"/csi.v0.Controller/ListVolumes", []string{"Bearer secret-a"}, "tenant-a", codes.OK},
+		"missing":   {"/csi.v1.Controller/CreateVolume", nil, "", codes.Unauthenticated},
+		"invalid":   {"/csi.v1.Controller/CreateVolume", []string{"Bearer secret-b"}, "", codes.Unauthenticated},
+		"no-bearer": {"/csi.v1.Controller/CreateVolume", []string{"secret-a"}, "", codes.Unauthenticated},
+		"identity":  {"/csi.v1.Identity/Probe", nil, "", codes.OK},
+		"node":      {"/csi.v1.Node/NodeStageVolume", nil, "", codes.OK},
+		"extension": {"/" + volumeRenameService + "/RenameVolume", nil, "", codes.Unauthenticated},
+	} {
+		ctx := context.Background()
+		if tc.authorization != nil {
+			ctx = metadata.NewIncomingContext(ctx, metadata.MD{authorizationMetadata: tc.authorization})
+		}
+		tenant, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+		assert.Equal(t, tc.code, status.Code(err), "%s: %v", name, err)
+		if err == nil {
+			assert.Equal(t, tc.tenant, tenant, name)
+		}
+	}
+}
+
+func TestLoadTenantTokens(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tenant")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	filename := filepath.Join(tmp, "tokens.json")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`{"secret-a": "tenant-a", "secret-b": ""}`), 0600))
+
+	tokens, err := LoadTenantTokens(filename)
+	require.NoError(t, err)
+	tenant, ok := tokens.Tenant("secret-a")
+	assert.True(t, ok)
+	assert.Equal(t, "tenant-a", tenant)
+	_, ok = tokens.Tenant("secret-b")
+	assert.False(t, ok, "empty tenant")
+
+	_, err = LoadTenantTokens(filepath.Join(tmp, "no-such-file.json"))
+	assert.Error(t, err)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+	driver, err := New(WithVHostEndpoint(fake.Path), WithTokenAuth(TenantTokens{"secret-a": "a", "secret-b": "b"}))
+	require.NoError(t, err)
+	od := &driver.(*oimDriver03).oimDriver
+	tenantA := withTenant(context.Background(), "a")
+	tenantB := withTenant(context.Background(), "b")
+	admin := context.Background()
+
+	create := func(ctx context.Context, name string) string {
+		response, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		require.NoError(t, err)
+		return response.GetVolume().GetVolumeId()
+	}
+	listVolumes := func(ctx context.Context) []string {
+		response, err := od.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		require.NoError(t, err)
+		var ids []string
+		for _, entry := range response.GetEntries() {
+			ids = append(ids, entry.GetVolume().GetVolumeId())
+		}
+		return ids
+	}
+	listSnapshots := func(ctx context.Context) []string {
+		response, err := od.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+		require.NoError(t, err)
+		var ids []string
+		for _, entry := range response.GetEntries() {
+			ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+		}
+		return ids
+	}
+
+	// Both tenants may use the same name.
+	volumeA := create(tenantA, "vol")
+	volumeB := create(tenantB, "vol")
+	volume, _ := od.metadata.get(volumeA)
+	assert.Equal(t, "1-a-vol", volume.Name)
+	assert.Equal(t, "a", volume.Tenant)
+	volume, _ = od.metadata.get(volumeB)
+	assert.Equal(t, "1-b-vol", volume.Name)
+	assert.Equal(t, "b", volume.Tenant)
+
+	assert.Equal(t, []string{volumeA}, listVolumes(tenantA))
+	assert.Equal(t, []string{volumeB}, listVolumes(tenantB))
+	assert.Equal(t, []string{volumeA, volumeB}, listVolumes(admin), "without authentication")
+
+	// Tenant and volume names containing the separator do not
+	// collide.
+	volumeAX := create(tenantA, "b-x")
+	volumeABX := create(withTenant(context.Background(), "a-b"), "x")
+	assert.NotEqual(t, volumeAX, volumeABX)
+	for _, volumeID := range []string{volumeAX, volumeABX} {
+		_, err := od.DeleteVolume(admin, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		require.NoError(t, err)
+	}
+
+	// The tenant prefix counts towards the maximum name length.
+	_, err = od.CreateVolume(tenantA, &csi.CreateVolumeRequest{
+		Name: strings.Repeat("x", 254),
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "name too long with prefix: %v", err)
+
+	snapshotA, err := od.CreateSnapshot(tenantA, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volumeA})
+	require.NoError(t, err)
+	_, err = od.CreateSnapshot(tenantB, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volumeA})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "snapshot of other tenant's volume: %v", err)
+	assert.Equal(t, []string{snapshotA.GetSnapshot().GetSnapshotId()}, listSnapshots(tenantA))
+	assert.Empty(t, listSnapshots(tenantB))
+
+	// Content of another tenant cannot be copied.
+	for name, source := range map[string]*csi.VolumeContentSource{
+		"clone": {Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeA},
+		}},
+		"restore": {Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotA.GetSnapshot().GetSnapshotId()},
+		}},
+	} {
+		_, err = od.CreateVolume(tenantB, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			VolumeContentSource: source,
+		})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err), "%s from other tenant's volume: %v", name, err)
+	}
+
+	// Volumes of another tenant cannot be used or modified.
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	_, err = od.ControllerPublishVolume(tenantB, &csi.ControllerPublishVolumeRequest{VolumeId: volumeA, NodeId: od.nodeID, VolumeCapability: capability})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "publish other tenant's volume: %v", err)
+	_, err = od.ControllerUnpublishVolume(tenantB, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeA, NodeId: od.nodeID})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "unpublish other tenant's volume: %v", err)
+	_, err = od.ValidateVolumeCapabilities(tenantB, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volumeA, VolumeCapabilities: []*csi.VolumeCapability{capability}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "validate other tenant's volume: %v", err)
+	err = od.RenameVolume(tenantB, volumeA, "stolen")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "rename other tenant's volume: %v", err)
+	_, err = od.VolumeInspect(tenantB, volumeA)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "inspect other tenant's volume: %v", err)
+	require.NoError(t, od.RenameVolume(tenantA, volumeA, "renamed"))
+	volume, _ = od.metadata.get(volumeA)
+	assert.Equal(t, "1-a-renamed", volume.Name, "new name with tenant prefix")
+
+	diff := &VolumeSnapshotDiffAPI{local: &od.local, metadata: od.metadata}
+	_, err = diff.GetSnapshotDiff(tenantB, snapshotA.GetSnapshot().GetSnapshotId(), volumeA)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "diff of other tenant's snapshot: %v", err)
+	_, err = diff.GetSnapshotDiff(tenantB, "no-such-snapshot", volumeB)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "diff of snapshot without metadata: %v", err)
+
+	// Objects without metadata might belong to anyone.
+	_, err = od.VolumeInspect(tenantB, "no-such-volume")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "inspect volume without metadata: %v", err)
+	_, err = od.DeleteSnapshot(tenantB, &csi.DeleteSnapshotRequest{SnapshotId: "no-such-snapshot"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "delete snapshot without metadata: %v", err)
+
+	_, err = od.DeleteSnapshot(tenantB, &csi.DeleteSnapshotRequest{SnapshotId: snapshotA.GetSnapshot().GetSnapshotId()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "delete other tenant's snapshot: %v", err)
+	_, err = od.DeleteVolume(tenantB, &csi.DeleteVolumeRequest{VolumeId: volumeA})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "delete other tenant's volume: %v", err)
+	_, err = od.DeleteVolume(tenantB, &csi.DeleteVolumeRequest{VolumeId: volumeB})
+	assert.NoError(t, err)
+	assert.Empty(t, listVolumes(tenantB))
+	assert.Equal(t, []string{volumeA}, listVolumes(tenantA))
+}
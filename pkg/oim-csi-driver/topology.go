@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// topologyContextKey is the entry in the volume context which
+// describes the topology of the controller that provides the
+// volume, as comma-separated key=value pairs.
+const topologyContextKey = "topology"
+
+// NodeAffinity maps the IDs of OIM controllers to the topology
+// labels of the nodes which can access the storage of each
+// controller, for example {"host-0": {"oim.intel.com/zone": "a"}}.
+type NodeAffinity map[string]map[string]string
+
+// LoadNodeAffinity reads a NodeAffinity from a JSON file, typically
+// a ConfigMap mounted into the pod of the driver.
+func LoadNodeAffinity(filename string) (NodeAffinity, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "read topology config")
+	}
+	var affinity NodeAffinity
+	if err := json.Unmarshal(content, &affinity); err != nil {
+		return nil, errors.Wrapf(err, "parse topology config %s", filename)
+	}
+	return affinity, nil
+}
+
+// selectController picks the OIM controller for a new volume. Without
+// node affinity, that is always the controller of the host. Otherwise
+// it is one of the controllers whose labels match one of the requisite
+// topologies and, with discovery, are currently announced. Those
+// which match the first satisfiable preferred topology take
+// precedence. The selector chooses among the remaining candidates.
+// Without selector, the controller of the host is used if possible,
+// otherwise the first one by ID.
+func (r *remoteSPDK) selectController(ctx context.Context, requisite, preferred []map[string]string) (string, error) {
+	if len(r.nodeAffinity) == 0 {
+		return r.oimControllerID, nil
+	}
+	var candidates []string
+	for controllerID, labels := range r.nodeAffinity {
+		if len(requisite) == 0 || matchesAny(labels, requisite) {
+			candidates = append(candidates, controllerID)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", status.Error(codes.ResourceExhausted, fmt.Sprintf("no OIM controller matches the requisite topology %v", requisite))
+	}
+	if r.discovery != nil {
+		var err error
+		if candidates, err = r.discovery.discovered(ctx, candidates); err != nil {
+			return "", err
+		}
+	}
+	sort.Strings(candidates)
+	for _, segments := range preferred {
+		var matching []string
+		for _, controllerID := range candidates {
+			if matches(r.nodeAffinity[controllerID], segments) {
+				matching = append(matching, controllerID)
+			}
+		}
+		if len(matching) > 0 {
+			if r.selector == nil {
+				return matching[0], nil
+			}
+			return r.selector.SelectController(ctx, r, matching)
+		}
+	}
+	if r.selector != nil {
+		return r.selector.SelectController(ctx, r, candidates)
+	}
+	for _, controllerID := range candidates {
+		if controllerID == r.oimControllerID {
+			return controllerID, nil
+		}
+	}
+	return candidates[0], nil
+}
+
+// volumeID returns the ID for a volume provided by the given
+// controller. Volumes of the controller of the host are identified
+// by name, all others by controller ID and name.
+func (r *remoteSPDK) volumeID(controllerID, name string) string {
+	if controllerID == r.oimControllerID {
+		return name
+	}
+	return controllerID + "/" + name
+}
+
+// splitVolumeID is the reverse of volumeID.
+// Volumes moved by MigrateVolume are on the controller recorded in
+// their metadata instead.
+func (r *remoteSPDK) splitVolumeID(volumeID string) (controllerID, name string) {
+	controllerID, name = r.oimControllerID, volumeID
+	if i := strings.Index(volumeID, "/"); i >= 0 {
+		controllerID, name = volumeID[:i], volumeID[i+1:]
+	}
+	if r.metadata != nil {
+		if metadata, ok := r.metadata.get(volumeID); ok && metadata.ControllerID != "" {
+			controllerID = metadata.ControllerID
+		}
+	}
+	return controllerID, name
+}
+
+// controllerKey returns the base name of the key files for the
+// registry connection on behalf of another controller. They must be
+// stored next to the ones of the controller of the host.
+func controllerKey(key, controllerID string) string {
+	return filepath.Join(filepath.Dir(key), "host."+controllerID)
+}
+
+// matches is true if the labels contain all segments.
+func matches(labels, segments map[string]string) bool {
+	for key, value := range segments {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(labels map[string]string, topologies []map[string]string) bool {
+	for _, segments := range topologies {
+		if matches(labels, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeTopology turns segments into the value stored under
+// topologyContextKey.
+func encodeTopology(segments map[string]string) string {
+	var pairs []string
+	for key, value := range segments {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// nodeTopology returns the labels of the controller of the host, nil
+// without node affinity.
+func (od *oimDriver) nodeTopology() map[string]string {
+	return od.remote.nodeAffinity[od.remote.oimControllerID]
+}
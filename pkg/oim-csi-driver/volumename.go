@@ -0,0 +1,54 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultVolumeNamePattern is what CreateVolume accepts as volume
+// names by default. The names become names of SPDK BDevs, which
+// may be at most 255 characters long.
+const DefaultVolumeNamePattern = `^[a-zA-Z0-9_-]{1,255}$`
+
+// VolumeNameValidator checks the names given to CreateVolume before
+// anything gets created. The error explains why a name is invalid.
+type VolumeNameValidator interface {
+	ValidateVolumeName(name string) error
+}
+
+// RegexpVolumeNameValidator accepts names which match a regular
+// expression.
+type RegexpVolumeNameValidator struct {
+	re *regexp.Regexp
+}
+
+var _ VolumeNameValidator = &RegexpVolumeNameValidator{}
+
+// NewRegexpVolumeNameValidator compiles the pattern. It should
+// be anchored with ^ and $.
+func NewRegexpVolumeNameValidator(pattern string) (*RegexpVolumeNameValidator, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "volume name pattern")
+	}
+	return &RegexpVolumeNameValidator{re: re}, nil
+}
+
+// ValidateVolumeName implements VolumeNameValidator.
+func (v *RegexpVolumeNameValidator) ValidateVolumeName(name string) error {
+	if !v.re.MatchString(name) {
+		return fmt.Errorf("volume name %q does not match %s", name, v.re)
+	}
+	return nil
+}
+
+// DefaultVolumeNameValidator uses DefaultVolumeNamePattern.
+var DefaultVolumeNameValidator VolumeNameValidator = &RegexpVolumeNameValidator{re: regexp.MustCompile(DefaultVolumeNamePattern)}
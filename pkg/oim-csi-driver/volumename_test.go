@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	csi0 "github.com/intel/oim/pkg/spec/csi/v0"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestDefaultVolumeNameValidator(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"a":                      true,
+		"pvc-1234_ABCD":          true,
+		strings.Repeat("x", 255): true,
+		strings.Repeat("x", 256): false,
+		"with space":             false,
+		"with/slash":             false,
+		"lvs/alias":              false,
+		"dot.ted":                false,
+		"new\nline":              false,
+		"umlaut-ä":               false,
+		"trailing-newline\n":     false,
+	} {
+		err := DefaultVolumeNameValidator.ValidateVolumeName(name)
+		if valid {
+			assert.NoError(t, err, "%q", name)
+		} else {
+			assert.Error(t, err, "%q", name)
+		}
+	}
+}
+
+func TestInvalidVolumeName(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	od, fake, _ := newFakeDriver(t)
+	defer fake.Close()
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	_, err := od.oimDriver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               strings.Repeat("x", 256),
+		VolumeCapabilities: capabilities,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "too long: %v", err)
+	_, err = od.CreateVolume(ctx, &csi0.CreateVolumeRequest{
+		Name: "with/slash",
+		VolumeCapabilities: []*csi0.VolumeCapability{{
+			AccessType: &csi0.VolumeCapability_Mount{Mount: &csi0.VolumeCapability_MountVolume{}},
+			AccessMode: &csi0.VolumeCapability_AccessMode{Mode: csi0.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "invalid character, CSI 0.3: %v", err)
+	assert.Empty(t, fake.Methods(), "no SPDK calls")
+}
+
+type prefixValidator string
+
+func (p prefixValidator) ValidateVolumeName(name string) error {
+	if !strings.HasPrefix(name, string(p)) {
+		return errors.New("wrong prefix")
+	}
+	return nil
+}
+
+func TestCustomVolumeNameValidator(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	newFakeLVols(fake)
+
+	validator, err := NewRegexpVolumeNameValidator(`^pvc-[a-z0-9-]{1,20}$`)
+	require.NoError(t, err)
+	_, err = NewRegexpVolumeNameValidator(`[`)
+	assert.Error(t, err, "invalid pattern")
+
+	for name, tc := range map[string]struct {
+		validator VolumeNameValidator
+		valid     []string
+		invalid   []string
+	}{
+		"regexp": {validator, []string{"pvc-1"}, []string{"vol-1", "pvc-" + strings.Repeat("x", 21)}},
+		"custom": {prefixValidator("pvc-"), []string{"pvc-with space"}, []string{"vol-1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			driver, err := New(WithVHostEndpoint(fake.Path), WithVolumeNameValidator(tc.validator))
+			require.NoError(t, err)
+			od := &driver.(*oimDriver03).oimDriver
+			create := func(name string) error {
+				_, err := od.CreateVolume(ctx, &csi.CreateVolumeRequest{
+					Name: name,
+					VolumeCapabilities: []*csi.VolumeCapability{{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					}},
+				})
+				return err
+			}
+			for _, name := range tc.valid {
+				assert.NoError(t, create(name), "%q", name)
+			}
+			for _, name := range tc.invalid {
+				assert.Equal(t, codes.InvalidArgument, status.Code(create(name)), "%q", name)
+			}
+		})
+	}
+}
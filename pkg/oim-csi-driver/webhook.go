@@ -0,0 +1,199 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/status"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// webhookImageDir stands in for the image directory of the driver,
+// which is not known to the webhook, when checking localImage.
+const webhookImageDir = "/images"
+
+// ValidateStorageClassParameters applies the same checks to
+// StorageClass parameters as CreateVolume and returns one message per
+// invalid parameter. Parameters that depend on the state of SPDK,
+// like the name of a logical volume store, or on files, like the
+// image itself, cannot be checked.
+func ValidateStorageClassParameters(parameters map[string]string) []string {
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, status.Convert(err).Message())
+		}
+	}
+	if name, ok := parameters[lvstoreParameter]; ok && name == "" {
+		// CreateVolume would silently pick some store.
+		problems = append(problems, fmt.Sprintf("empty %s parameter, remove it to select the logical volume store automatically", lvstoreParameter))
+	}
+	_, err := thinProvisioning(parameters)
+	check(err)
+	_, err = clearMethod(parameters)
+	check(err)
+	_, err = qosLimits(parameters)
+	check(err)
+	_, _, err = cryptoKeySecret(parameters)
+	check(err)
+	_, err = quotaBytes(parameters)
+	check(err)
+	if image, ok := parameters[localImageParameter]; ok {
+		_, err = imagePath(webhookImageDir, image)
+		check(err)
+	}
+	return problems
+}
+
+// ValidateVolumeSnapshotClassParameters is the same as
+// ValidateStorageClassParameters for the parameters of
+// CreateSnapshot.
+func ValidateVolumeSnapshotClassParameters(parameters map[string]string) []string {
+	if _, err := retention(parameters); err != nil {
+		return []string{status.Convert(err).Message()}
+	}
+	return nil
+}
+
+// volumeSnapshotClass contains the fields of a VolumeSnapshotClass
+// which are needed by the webhook.
+type volumeSnapshotClass struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Snapshotter       string            `json:"snapshotter"`
+	Parameters        map[string]string `json:"parameters,omitempty"`
+}
+
+// WebhookServer is a validating admission webhook which rejects
+// StorageClasses and VolumeSnapshotClasses of the driver with invalid
+// parameters, so that mistakes are found when creating the class
+// instead of when provisioning volumes or taking snapshots.
+type WebhookServer struct {
+	// DriverName is the provisioner of the StorageClasses that get
+	// checked. All other objects are allowed.
+	DriverName string
+
+	server *http.Server
+}
+
+var _ http.Handler = &WebhookServer{}
+
+// NewWebhookServer creates a webhook for StorageClasses of the driver.
+func NewWebhookServer(driverName string) *WebhookServer {
+	return &WebhookServer{DriverName: driverName}
+}
+
+// Start serves the webhook via HTTPS in the background. The API
+// server only connects via TLS, so tlsConfig must contain the server
+// certificate.
+func (ws *WebhookServer) Start(addr string, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "listen for webhook")
+	}
+	ws.server = &http.Server{Handler: ws, TLSConfig: tlsConfig}
+	go func() {
+		if err := ws.server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+			log.L().Errorw("webhook server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Stop shuts down a server started with Start.
+func (ws *WebhookServer) Stop(ctx context.Context) error {
+	if ws.server == nil {
+		return nil
+	}
+	return ws.server.Shutdown(ctx)
+}
+
+// ServeHTTP handles one AdmissionReview.
+func (ws *WebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = ws.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.L().Warnw("sending AdmissionReview response", "error", err)
+	}
+}
+
+func (ws *WebhookServer) review(request *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	var (
+		kind, name, driverName string
+		problems               []string
+		err                    error
+	)
+	switch request.Kind.Kind {
+	case "VolumeSnapshotClass":
+		kind = request.Kind.Kind
+		var vsc volumeSnapshotClass
+		if err = json.Unmarshal(request.Object.Raw, &vsc); err == nil {
+			name, driverName = vsc.Name, vsc.Snapshotter
+			problems = ValidateVolumeSnapshotClassParameters(vsc.Parameters)
+		}
+	default:
+		kind = "StorageClass"
+		var sc storagev1.StorageClass
+		if err = json.Unmarshal(request.Object.Raw, &sc); err == nil {
+			name, driverName = sc.Name, sc.Provisioner
+			problems = ValidateStorageClassParameters(sc.Parameters)
+		}
+	}
+	if err != nil {
+		return &admissionv1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: fmt.Sprintf("decoding %s: %s", kind, err),
+				Reason:  metav1.StatusReasonBadRequest,
+				Code:    http.StatusBadRequest,
+			},
+		}
+	}
+	if driverName != ws.DriverName || len(problems) == 0 {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	log.L().Infow("rejecting "+kind,
+		"name", name,
+		"problems", problems,
+	)
+	return &admissionv1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: fmt.Sprintf("invalid parameters for %s: %s", ws.DriverName, strings.Join(problems, "; ")),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/intel/oim/pkg/log/testlog"
+)
+
+func TestValidateStorageClassParameters(t *testing.T) {
+	assert.Empty(t, ValidateStorageClassParameters(nil), "no parameters")
+	assert.Empty(t, ValidateStorageClassParameters(map[string]string{
+		thinProvisionParameter:      "false",
+		clearMethodParameter:        "unmap",
+		limitReadIOPSParameter:      "1000",
+		encryptedParameter:          "true",
+		cryptoKeySecretRefParameter: "default/keys",
+		lvstoreParameter:            "lvs",
+		quotaParameter:              "1073741824",
+		localImageParameter:         "ubuntu/disk.img",
+	}), "valid parameters")
+	assert.Equal(t, []string{
+		`empty lvstoreName parameter, remove it to select the logical volume store automatically`,
+		`invalid thinProvision parameter "maybe", must be "true" or "false"`,
+		`invalid clearMethod parameter "shred", must be one of none, unmap, write_zeroes`,
+		`invalid limitWriteMBPS parameter "-1", must be a positive integer`,
+		`cryptoKeySecretRef parameter "keys" must have the format <namespace>/<name>`,
+		`invalid quotaBytes parameter "1Gi", must be a positive number of bytes`,
+		`localImage parameter "../etc/shadow" is outside of the image directory`,
+	}, ValidateStorageClassParameters(map[string]string{
+		lvstoreParameter:            "",
+		thinProvisionParameter:      "maybe",
+		clearMethodParameter:        "shred",
+		limitWriteMBPSParameter:     "-1",
+		encryptedParameter:          "true",
+		cryptoKeySecretRefParameter: "keys",
+		quotaParameter:              "1Gi",
+		localImageParameter:         "../etc/shadow",
+	}))
+	assert.Equal(t, []string{
+		`localImage parameter "/images/disk.img" must be a relative path`,
+	}, ValidateStorageClassParameters(map[string]string{localImageParameter: "/images/disk.img"}))
+
+	assert.Empty(t, ValidateVolumeSnapshotClassParameters(map[string]string{retainForParameter: "24h"}), "valid snapshot parameters")
+	assert.Equal(t, []string{
+		`invalid retainFor parameter "forever", must be a positive duration`,
+	}, ValidateVolumeSnapshotClassParameters(map[string]string{retainForParameter: "forever"}))
+}
+
+func TestWebhookServer(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	server := httptest.NewTLSServer(NewWebhookServer("oim-malloc"))
+	defer server.Close()
+	client := server.Client()
+
+	reviewObject := func(kind string, obj interface{}) *admissionv1beta1.AdmissionResponse {
+		object, err := json.Marshal(obj)
+		require.NoError(t, err)
+		body, err := json.Marshal(admissionv1beta1.AdmissionReview{
+			Request: &admissionv1beta1.AdmissionRequest{
+				UID:    types.UID("1234"),
+				Kind:   metav1.GroupVersionKind{Kind: kind},
+				Object: runtime.RawExtension{Raw: object},
+			},
+		})
+		require.NoError(t, err)
+		resp, err := client.Post(server.URL, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result admissionv1beta1.AdmissionReview
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		require.NotNil(t, result.Response)
+		assert.Equal(t, types.UID("1234"), result.Response.UID)
+		return result.Response
+	}
+	review := func(sc storagev1.StorageClass) *admissionv1beta1.AdmissionResponse {
+		return reviewObject("StorageClass", sc)
+	}
+
+	response := review(storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "fast"},
+		Provisioner: "oim-malloc",
+		Parameters:  map[string]string{thinProvisionParameter: "false"},
+	})
+	assert.True(t, response.Allowed, "valid")
+
+	response = review(storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "broken"},
+		Provisioner: "oim-malloc",
+		Parameters:  map[string]string{clearMethodParameter: "invalid", limitReadMBPSParameter: "fast"},
+	})
+	assert.False(t, response.Allowed, "invalid")
+	if assert.NotNil(t, response.Result, "invalid") {
+		assert.Equal(t, `invalid parameters for oim-malloc: invalid clearMethod parameter "invalid", must be one of none, unmap, write_zeroes; invalid limitReadMBPS parameter "fast", must be a positive integer`, response.Result.Message)
+	}
+
+	response = review(storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "other"},
+		Provisioner: "other-driver",
+		Parameters:  map[string]string{clearMethodParameter: "invalid"},
+	})
+	assert.True(t, response.Allowed, "other provisioner")
+
+	response = reviewObject("VolumeSnapshotClass", volumeSnapshotClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "short-lived"},
+		Snapshotter: "oim-malloc",
+		Parameters:  map[string]string{retainForParameter: "-1h"},
+	})
+	assert.False(t, response.Allowed, "invalid snapshot class")
+	if assert.NotNil(t, response.Result, "invalid snapshot class") {
+		assert.Equal(t, `invalid parameters for oim-malloc: invalid retainFor parameter "-1h", must be a positive duration`, response.Result.Message)
+	}
+	response = reviewObject("VolumeSnapshotClass", volumeSnapshotClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "other"},
+		Snapshotter: "other-driver",
+		Parameters:  map[string]string{retainForParameter: "-1h"},
+	})
+	assert.True(t, response.Allowed, "other snapshotter")
+
+	resp, err := client.Post(server.URL, "application/json", bytes.NewReader([]byte("{")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "malformed")
+}
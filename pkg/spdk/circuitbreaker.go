@@ -0,0 +1,125 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of invoking a method while the
+// circuit breaker considers SPDK to be unavailable.
+var ErrCircuitOpen = errors.New("SPDK unavailable, circuit breaker open")
+
+// State of a CircuitBreaker.
+type State int
+
+const (
+	// Closed is the normal state, all calls are passed through.
+	Closed State = iota
+	// Open rejects all calls with ErrCircuitOpen.
+	Open
+	// HalfOpen lets a single trial call through to find out
+	// whether SPDK has recovered.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker protects a recovering SPDK daemon against callers
+// which retry failed calls in a tight loop. After a certain number
+// of consecutive failures it opens and rejects calls until the reset
+// timeout has passed, then lets one trial call through. The circuit
+// closes again when that call succeeds.
+//
+// Only failures of the communication with SPDK count, errors reported
+// by SPDK itself (like "not found") show that it is alive.
+type CircuitBreaker struct {
+	maxFailures  int
+	resetTimeout time.Duration
+
+	mutex    sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// NewCircuitBreaker creates a closed circuit breaker which opens
+// after maxFailures consecutive failures.
+func NewCircuitBreaker(maxFailures int, resetTimeout time.Duration) *CircuitBreaker {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &CircuitBreaker{
+		maxFailures:  maxFailures,
+		resetTimeout: resetTimeout,
+	}
+}
+
+// State returns the current state. An open circuit breaker whose
+// reset timeout has passed is reported as half-open.
+func (cb *CircuitBreaker) State() State {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.update()
+	return cb.state
+}
+
+func (cb *CircuitBreaker) update() {
+	if cb.state == Open && time.Since(cb.openedAt) >= cb.resetTimeout {
+		cb.state = HalfOpen
+		cb.trial = false
+	}
+}
+
+// allow must be called before each call and returns ErrCircuitOpen if
+// the call must not be made. Otherwise done must be called with the
+// result of the call.
+func (cb *CircuitBreaker) allow() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.update()
+	switch cb.state {
+	case Open:
+		return ErrCircuitOpen
+	case HalfOpen:
+		if cb.trial {
+			// Some other call is already trying.
+			return ErrCircuitOpen
+		}
+		cb.trial = true
+	}
+	return nil
+}
+
+func (cb *CircuitBreaker) done(err error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if _, ok := err.(rpc.ServerError); err == nil || ok {
+		cb.state = Closed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == HalfOpen || cb.failures >= cb.maxFailures {
+		cb.state = Open
+		cb.openedAt = time.Now()
+	}
+}
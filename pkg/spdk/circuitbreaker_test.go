@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+// outage lets a Fake fail at the communication level: while down,
+// get_bdevs returns something which cannot be decoded.
+type outage struct {
+	mutex sync.Mutex
+	down  bool
+}
+
+func (o *outage) set(down bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.down = down
+}
+
+func (o *outage) handle(params json.RawMessage) (interface{}, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.down {
+		return "garbage", nil
+	}
+	return []spdk.BDev{}, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	var o outage
+	fake.Handle("get_bdevs", o.handle)
+	fake.Handle("bdev_lvol_delete", func(params json.RawMessage) (interface{}, error) {
+		return nil, testspdk.FakeError{Code: spdk.ERROR_INVALID_PARAMS, Message: "lvol not found"}
+	})
+
+	resetTimeout := 100 * time.Millisecond
+	cb := spdk.NewCircuitBreaker(2, resetTimeout)
+	client, err := spdk.New(fake.Path, spdk.WithCircuitBreaker(cb))
+	require.NoError(t, err)
+	defer client.Close()
+	getBDevs := func() error {
+		_, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{})
+		return err
+	}
+	calls := func() int {
+		return len(fake.Calls())
+	}
+
+	// Closed: calls pass through, errors from SPDK do not count.
+	assert.NoError(t, getBDevs())
+	for i := 0; i < 3; i++ {
+		err := spdk.DeleteLVol(ctx, client, spdk.LVolArgs{Name: "no-such-lvol"})
+		assert.True(t, spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS), "SPDK error: %v", err)
+	}
+	assert.Equal(t, spdk.Closed, cb.State())
+
+	// Closed -> Open after two failures.
+	o.set(true)
+	assert.Error(t, getBDevs())
+	assert.Equal(t, spdk.Closed, cb.State(), "after first failure")
+	assert.Error(t, getBDevs())
+	assert.Equal(t, spdk.Open, cb.State(), "after second failure")
+
+	// Open: calls are rejected without reaching SPDK.
+	before := calls()
+	assert.Equal(t, spdk.ErrCircuitOpen, getBDevs())
+	assert.Equal(t, before, calls(), "calls while open")
+
+	// Open -> Half-Open after the reset timeout, -> Open again
+	// when the trial call fails.
+	time.Sleep(resetTimeout)
+	assert.Equal(t, spdk.HalfOpen, cb.State(), "after reset timeout")
+	err = getBDevs()
+	assert.Error(t, err)
+	assert.NotEqual(t, spdk.ErrCircuitOpen, err, "trial call")
+	assert.Equal(t, spdk.Open, cb.State(), "after failed trial")
+
+	// Half-Open -> Closed when the trial call succeeds.
+	o.set(false)
+	time.Sleep(resetTimeout)
+	assert.Equal(t, spdk.HalfOpen, cb.State(), "after second reset timeout")
+	assert.NoError(t, getBDevs())
+	assert.Equal(t, spdk.Closed, cb.State(), "after successful trial")
+	assert.NoError(t, getBDevs())
+}
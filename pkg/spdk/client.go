@@ -51,6 +51,7 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/intel/oim/pkg/log"
 )
@@ -222,9 +223,41 @@ func (c *clientCodec) Close() error {
 	return c.c.Close()
 }
 
-// Client encapsulates the connection to a SPDK JSON server.
+// Client encapsulates the connections to a SPDK JSON server.
+// Concurrent calls are multiplexed over a fixed-size pool of
+// connections, with the JSON-RPC id matching responses to
+// requests. Broken connections are re-established on demand.
 type Client struct {
-	client *rpc.Client
+	path    string
+	breaker *CircuitBreaker
+
+	tracePath string
+	tracer    *tracer
+
+	mutex  sync.Mutex
+	conns  []*rpc.Client
+	next   int
+	closed bool
+}
+
+// Option configures a Client.
+type Option func(c *Client)
+
+// WithPoolSize sets the number of connections that the client
+// opens at most. The default is one.
+func WithPoolSize(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.conns = make([]*rpc.Client, n)
+		}
+	}
+}
+
+// WithCircuitBreaker passes all calls through the circuit breaker.
+func WithCircuitBreaker(cb *CircuitBreaker) Option {
+	return func(c *Client) {
+		c.breaker = cb
+	}
 }
 
 type logConn struct {
@@ -250,23 +283,157 @@ func (lc *logConn) Write(b []byte) (int, error) {
 	return n, err
 }
 
-// New constructs a new SPDK JSON client.
-func New(path string) (*Client, error) {
+// New constructs a new SPDK JSON client. It connects once
+// immediately, so an invalid path is detected right away.
+func New(path string, options ...Option) (*Client, error) {
+	c := &Client{
+		path:  path,
+		conns: make([]*rpc.Client, 1),
+	}
+	for _, op := range options {
+		op(c)
+	}
+	if c.tracePath != "" {
+		t, err := newTracer(c.tracePath)
+		if err != nil {
+			return nil, err
+		}
+		c.tracer = t
+	}
+	conn, err := dial(path)
+	if err != nil {
+		if c.tracer != nil {
+			c.tracer.close()
+		}
+		return nil, err
+	}
+	c.conns[0] = conn
+	return c, nil
+}
+
+func dial(path string) (*rpc.Client, error) {
 	conn, err := net.Dial("unix", path)
 	if err != nil {
 		return nil, err
 	}
 	conn = &logConn{conn, log.L().With("at", "spdk-rpc")}
-	client := rpc.NewClientWithCodec(newClientCodec(conn))
-	return &Client{client: client}, nil
+	return rpc.NewClientWithCodec(newClientCodec(conn)), nil
 }
 
-// Close the connection to the server.
+// Close the connections to the server.
 func (c *Client) Close() error {
-	return c.client.Close()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	var err error
+	if c.tracer != nil {
+		err = c.tracer.close()
+	}
+	for i, conn := range c.conns {
+		if conn == nil {
+			continue
+		}
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		c.conns[i] = nil
+	}
+	return err
 }
 
 // Invoke a certain method, get the reply and return the error (if any).
-func (c *Client) Invoke(_ context.Context, method string, args, reply interface{}) error {
-	return c.client.Call(method, args, reply)
+func (c *Client) Invoke(ctx context.Context, method string, args, reply interface{}) error {
+	if c.breaker == nil {
+		return c.invoke(ctx, method, args, reply)
+	}
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.invoke(ctx, method, args, reply)
+	c.breaker.done(err)
+	return err
+}
+
+func (c *Client) invoke(ctx context.Context, method string, args, reply interface{}) error {
+	if c.tracer == nil {
+		return c.call(ctx, method, args, reply)
+	}
+	start := time.Now()
+	seq := c.tracer.request(method, args)
+	err := c.call(ctx, method, args, reply)
+	c.tracer.response(seq, method, start, reply, err)
+	return err
+}
+
+func (c *Client) call(_ context.Context, method string, args, reply interface{}) error {
+	c.mutex.Lock()
+	i := c.next
+	c.next = (c.next + 1) % len(c.conns)
+	c.mutex.Unlock()
+
+	conn, err := c.connection(i)
+	if err != nil {
+		return err
+	}
+	err = conn.Call(method, args, reply)
+	if notSent(err) {
+		// The connection was already broken when sending the
+		// request, so the server has not seen it and it is safe
+		// to try again once with a new connection.
+		c.discard(i, conn)
+		conn, err = c.connection(i)
+		if err != nil {
+			return err
+		}
+		err = conn.Call(method, args, reply)
+	}
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		// Not an error returned by SPDK, so the connection is
+		// broken. We cannot tell whether the request was
+		// executed, therefore it is not repeated.
+		c.discard(i, conn)
+	}
+	return err
+}
+
+// notSent checks for errors which indicate that a request did not
+// reach the server.
+func notSent(err error) bool {
+	if err == rpc.ErrShutdown {
+		return true
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "write"
+}
+
+// connection returns the connection with the given index in the
+// pool, connecting if necessary.
+func (c *Client) connection(i int) (*rpc.Client, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if c.conns[i] == nil {
+		conn, err := dial(c.path)
+		if err != nil {
+			return nil, err
+		}
+		c.conns[i] = conn
+	}
+	return c.conns[i], nil
+}
+
+// discard closes and removes a broken connection, unless it was
+// already replaced.
+func (c *Client) discard(i int, conn *rpc.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conns[i] == conn {
+		conn.Close() // nolint: gosec
+		c.conns[i] = nil
+	}
 }
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestClientPool(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		var args spdk.GetBDevsArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		return []spdk.BDev{{Name: args.Name}}, nil
+	})
+
+	client, err := spdk.New(fake.Path, spdk.WithPoolSize(3))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: "x"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.Connections(), "initial connection")
+
+	// Responses must match their requests even when calls
+	// run concurrently.
+	var wg sync.WaitGroup
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, name := range names {
+		name := name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: name})
+				if assert.NoError(t, err) && assert.Len(t, bdevs, 1) {
+					assert.Equal(t, name, bdevs[0].Name)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, fake.Connections(), "pool size")
+
+	// SPDK errors keep the connection.
+	_, err = spdk.GetNBDDisks(ctx, client)
+	assert.True(t, spdk.IsJSONError(err, spdk.ERROR_METHOD_NOT_FOUND), "unknown method: %v", err)
+	assert.Equal(t, 3, fake.Connections(), "after SPDK error")
+
+	// Connections are re-established after the server drops them.
+	fake.Disconnect()
+	for i := 0; i < 3; i++ {
+		_, err = spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: "x"})
+		assert.NoError(t, err, "after disconnect")
+	}
+	assert.Equal(t, 6, fake.Connections(), "reconnected")
+
+	require.NoError(t, client.Close())
+	_, err = spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: "x"})
+	assert.Error(t, err, "closed")
+}
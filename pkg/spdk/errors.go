@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk
+
+import (
+	"fmt"
+	"net/rpc"
+	"strconv"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errnoCodes maps the negative errno values which SPDK methods
+// return as JSON-RPC error codes.
+var errnoCodes = map[syscall.Errno]codes.Code{
+	syscall.EPERM:   codes.FailedPrecondition, // also ERROR_INVALID_STATE
+	syscall.ENOENT:  codes.NotFound,
+	syscall.ENODEV:  codes.NotFound,
+	syscall.EEXIST:  codes.AlreadyExists,
+	syscall.EINVAL:  codes.InvalidArgument,
+	syscall.ENOMEM:  codes.ResourceExhausted,
+	syscall.ENOSPC:  codes.ResourceExhausted,
+	syscall.EBUSY:   codes.Unavailable,
+	syscall.EAGAIN:  codes.Unavailable,
+	syscall.ENOTSUP: codes.Unimplemented,
+}
+
+// GRPCCode maps a SPDK JSON-RPC error code to a gRPC code. Unknown
+// codes are Internal. SPDK uses ERROR_INVALID_PARAMS also for
+// missing BDevs, so callers which need to detect that case still
+// have to check for it themselves.
+func GRPCCode(code int) codes.Code {
+	switch code {
+	case ERROR_PARSE_ERROR, ERROR_INVALID_REQUEST, ERROR_INTERNAL_ERROR:
+		return codes.Internal
+	case ERROR_METHOD_NOT_FOUND:
+		return codes.Unimplemented
+	case ERROR_INVALID_PARAMS:
+		return codes.InvalidArgument
+	}
+	if code < 0 {
+		if c, ok := errnoCodes[syscall.Errno(-code)]; ok {
+			return c
+		}
+	}
+	return codes.Internal
+}
+
+// ErrorToGRPC returns a gRPC status error for a SPDK JSON-RPC error.
+func ErrorToGRPC(code int, msg string) error {
+	return status.Error(GRPCCode(code), fmt.Sprintf("SPDK error %d: %s", code, msg))
+}
+
+// GRPCError converts an error returned by Client.Invoke into a gRPC
+// status error, with what describing the failed operation. Errors
+// which were not returned by SPDK, like a lost connection, are
+// Unavailable because trying again later might work.
+func GRPCError(err error, what string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(rpc.ServerError); !ok {
+		return status.Error(codes.Unavailable, fmt.Sprintf("%s: %s", what, err))
+	}
+	m := jsonError.FindStringSubmatch(err.Error())
+	if m == nil {
+		return status.Error(codes.Internal, fmt.Sprintf("%s: %s", what, err))
+	}
+	code, _ := strconv.Atoi(m[1])
+	s := status.Convert(ErrorToGRPC(code, m[2]))
+	return status.Error(s.Code(), fmt.Sprintf("%s: %s", what, s.Message()))
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorToGRPC(t *testing.T) {
+	for code, expected := range map[int]codes.Code{
+		ERROR_PARSE_ERROR:      codes.Internal,
+		ERROR_INVALID_REQUEST:  codes.Internal,
+		ERROR_METHOD_NOT_FOUND: codes.Unimplemented,
+		ERROR_INVALID_PARAMS:   codes.InvalidArgument,
+		ERROR_INTERNAL_ERROR:   codes.Internal,
+		ERROR_INVALID_STATE:    codes.FailedPrecondition,
+		-2:                     codes.NotFound,          // ENOENT
+		-19:                    codes.NotFound,          // ENODEV
+		-17:                    codes.AlreadyExists,     // EEXIST
+		-22:                    codes.InvalidArgument,   // EINVAL
+		-12:                    codes.ResourceExhausted, // ENOMEM
+		-28:                    codes.ResourceExhausted, // ENOSPC
+		-16:                    codes.Unavailable,       // EBUSY
+		-11:                    codes.Unavailable,       // EAGAIN
+		-95:                    codes.Unimplemented,     // ENOTSUP
+		-5:                     codes.Internal,          // EIO
+		0:                      codes.Internal,
+		1:                      codes.Internal,
+		-12345:                 codes.Internal,
+	} {
+		err := ErrorToGRPC(code, "some message")
+		assert.Equal(t, expected, status.Code(err), "code %d: %v", code, err)
+		assert.Contains(t, err.Error(), "some message", "code %d", code)
+	}
+}
+
+func TestGRPCError(t *testing.T) {
+	assert.NoError(t, GRPCError(nil, "nothing"))
+
+	err := GRPCError(rpc.ServerError("code: -19 msg: No such device"), "delete foo")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, "delete foo: SPDK error -19: No such device", status.Convert(err).Message())
+
+	err = GRPCError(rpc.ServerError("something else"), "delete foo")
+	assert.Equal(t, codes.Internal, status.Code(err), "%v", err)
+
+	err = GRPCError(rpc.ErrShutdown, "delete foo")
+	assert.Equal(t, codes.Unavailable, status.Code(err), "%v", err)
+	err = GRPCError(errors.New("connection refused"), "delete foo")
+	assert.Equal(t, codes.Unavailable, status.Code(err), "%v", err)
+}
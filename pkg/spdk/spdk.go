@@ -38,6 +38,47 @@ type BDev struct {
 	NumBlocks        int64            `json:"num_blocks"`
 	Claimed          bool             `json:"claimed"`
 	SupportedIOTypes SupportedIOTypes `json:"supported_io_types"`
+	Aliases          []string         `json:"aliases,omitempty"`
+	DriverSpecific   *DriverSpecific  `json:"driver_specific,omitempty"`
+	// AssignedRateLimits is only reported by SPDK versions with
+	// QoS support.
+	AssignedRateLimits *QoSLimits `json:"assigned_rate_limits,omitempty"`
+	// Error is set for degraded block devices by SPDK versions
+	// which detect that.
+	Error string `json:"error,omitempty"`
+}
+
+// nolint: golint
+type DriverSpecific struct {
+	LVol *LVolDriverSpecific `json:"lvol,omitempty"`
+	NVMe *NVMeDriverSpecific `json:"nvme,omitempty"`
+	AIO  *AIODriverSpecific  `json:"aio,omitempty"`
+}
+
+// nolint: golint
+type NVMeDriverSpecific struct {
+	// PCIAddress is only set for local NVMe controllers.
+	PCIAddress string `json:"pci_address,omitempty"`
+}
+
+// nolint: golint
+type AIODriverSpecific struct {
+	Filename string `json:"filename"`
+}
+
+// nolint: golint
+type LVolDriverSpecific struct {
+	LVolStoreUUID string `json:"lvol_store_uuid"`
+	BaseBDev      string `json:"base_bdev"`
+	ThinProvision bool   `json:"thin_provision"`
+	Snapshot      bool   `json:"snapshot"`
+	Clone         bool   `json:"clone"`
+	// Clones lists the names of the logical volumes which are
+	// clones of a snapshot.
+	Clones []string `json:"clones,omitempty"`
+	// BaseSnapshot is the name of the snapshot that a clone is
+	// based on.
+	BaseSnapshot string `json:"base_snapshot,omitempty"`
 }
 
 // nolint: golint
@@ -103,6 +144,25 @@ func ConstructRBDBDev(ctx context.Context, client *Client, args ConstructRBDBDev
 	return response, err
 }
 
+// nolint: golint
+type GetVersionResponse struct {
+	Version string `json:"version"`
+	Fields  struct {
+		Major  int    `json:"major"`
+		Minor  int    `json:"minor"`
+		Patch  int    `json:"patch"`
+		Suffix string `json:"suffix"`
+	} `json:"fields"`
+}
+
+// GetVersion returns the version of the SPDK daemon. Older SPDK
+// releases do not implement it and return a "Method not found" error.
+func GetVersion(ctx context.Context, client *Client) (GetVersionResponse, error) {
+	var response GetVersionResponse
+	err := client.Invoke(ctx, "spdk_get_version", nil, &response)
+	return response, err
+}
+
 // nolint: golint
 type StartNBDDiskArgs struct {
 	BDevName  string `json:"bdev_name"`
@@ -178,6 +238,19 @@ func RemoveVHostController(ctx context.Context, client *Client, args RemoveVHost
 	return client.Invoke(ctx, "remove_vhost_controller", args, nil)
 }
 
+// nolint: golint
+type ConstructVHostBlkControllerArgs struct {
+	CPUMask    string `json:"cpumask,omitempty"`
+	Controller string `json:"ctrlr"`
+	DevName    string `json:"dev_name"`
+	ReadOnly   bool   `json:"readonly,omitempty"`
+}
+
+// nolint: golint
+func ConstructVHostBlkController(ctx context.Context, client *Client, args ConstructVHostBlkControllerArgs) error {
+	return client.Invoke(ctx, "vhost_create_blk_controller", args, nil)
+}
+
 // nolint: golint
 type GetVHostControllersResponse []Controller
 
@@ -211,6 +284,27 @@ type SCSIControllerLUN struct {
 	BDevName string
 }
 
+// nolint: golint
+type BlkControllerSpecific struct {
+	BDevName string
+	ReadOnly bool
+}
+
+// getBlkBackendSpecific interprets the Controller.BackendSpecific value for
+// map entries with key "block", see spdk_vhost_blk_dump_info_json().
+func getBlkBackendSpecific(in interface{}) BlkControllerSpecific {
+	result := BlkControllerSpecific{}
+	if hash, ok := in.(map[string]interface{}); ok {
+		if name, ok := hash["bdev"].(string); ok {
+			result.BDevName = name
+		}
+		if readonly, ok := hash["readonly"].(bool); ok {
+			result.ReadOnly = readonly
+		}
+	}
+	return result
+}
+
 // getSCSIBackendSpecific interprets the Controller.BackendSpecific value for
 // map entries with key "scsi". See https://github.com/spdk/spdk/issues/329#issuecomment-396266197
 // and spdk_vhost_scsi_dump_info_json().
@@ -278,9 +372,253 @@ func GetVHostControllers(ctx context.Context, client *Client) (GetVHostControlle
 				switch backend {
 				case "scsi":
 					controller.BackendSpecific[backend] = getSCSIBackendSpecific(specific)
+				case "block":
+					controller.BackendSpecific[backend] = getBlkBackendSpecific(specific)
 				}
 			}
 		}
 	}
 	return response, err
 }
+
+// nolint: golint
+type GetLVolClusterMapArgs struct {
+	Name string `json:"name"`
+}
+
+// nolint: golint
+type LVolClusterMap struct {
+	ClusterSize int64 `json:"cluster_size"`
+	// Clusters has one entry per cluster of the logical volume
+	// with the ID of the blobstore cluster that backs it, -1 for
+	// clusters which are not allocated. Snapshots and volumes
+	// which share a cluster have the same ID at that position.
+	Clusters []int64 `json:"clusters"`
+}
+
+// nolint: golint
+func GetLVolClusterMap(ctx context.Context, client *Client, args GetLVolClusterMapArgs) (LVolClusterMap, error) {
+	var response LVolClusterMap
+	err := client.Invoke(ctx, "bdev_lvol_get_cluster_map", args, &response)
+	return response, err
+}
+
+// nolint: golint
+type BDevIOStat struct {
+	Name              string `json:"name"`
+	BytesRead         int64  `json:"bytes_read"`
+	NumReadOps        int64  `json:"num_read_ops"`
+	BytesWritten      int64  `json:"bytes_written"`
+	NumWriteOps       int64  `json:"num_write_ops"`
+	ReadLatencyTicks  int64  `json:"read_latency_ticks"`
+	WriteLatencyTicks int64  `json:"write_latency_ticks"`
+}
+
+// nolint: golint
+type GetBDevsIOStatResponse struct {
+	TickRate int64        `json:"tick_rate"`
+	Ticks    int64        `json:"ticks"`
+	BDevs    []BDevIOStat `json:"bdevs"`
+}
+
+// nolint: golint
+func GetBDevsIOStat(ctx context.Context, client *Client, args GetBDevsArgs) (GetBDevsIOStatResponse, error) {
+	var response GetBDevsIOStatResponse
+	err := client.Invoke(ctx, "get_bdevs_iostat", args, &response)
+	return response, err
+}
+
+// nolint: golint
+type LVolArgs struct {
+	Name string `json:"name"`
+}
+
+// nolint: golint
+func InflateLVol(ctx context.Context, client *Client, args LVolArgs) error {
+	return client.Invoke(ctx, "bdev_lvol_inflate", args, nil)
+}
+
+// nolint: golint
+func ThinProvisionLVol(ctx context.Context, client *Client, args LVolArgs) error {
+	return client.Invoke(ctx, "bdev_lvol_thin_provision", args, nil)
+}
+
+// nolint: golint
+type GetLVStoresArgs struct {
+	UUID    string `json:"uuid,omitempty"`
+	LVSName string `json:"lvs_name,omitempty"`
+}
+
+// nolint: golint
+type LVStore struct {
+	UUID              string `json:"uuid"`
+	Name              string `json:"name"`
+	BaseBDev          string `json:"base_bdev"`
+	TotalDataClusters int64  `json:"total_data_clusters"`
+	FreeClusters      int64  `json:"free_clusters"`
+	BlockSize         int64  `json:"block_size"`
+	ClusterSize       int64  `json:"cluster_size"`
+}
+
+// FreeBytes returns the amount of space that is still available
+// for logical volumes in the store.
+func (lvs LVStore) FreeBytes() int64 {
+	return lvs.FreeClusters * lvs.ClusterSize
+}
+
+// nolint: golint
+func GetLVStores(ctx context.Context, client *Client, args GetLVStoresArgs) ([]LVStore, error) {
+	var response []LVStore
+	err := client.Invoke(ctx, "bdev_lvol_get_lvstores", args, &response)
+	return response, err
+}
+
+// nolint: golint
+type SnapshotLVolArgs struct {
+	LVolName     string `json:"lvol_name"`
+	SnapshotName string `json:"snapshot_name"`
+}
+
+// SnapshotLVol creates a read-only snapshot of a logical volume in
+// the same logical volume store and returns the UUID of the snapshot.
+// The logical volume becomes a clone of the snapshot.
+func SnapshotLVol(ctx context.Context, client *Client, args SnapshotLVolArgs) (string, error) {
+	var response string
+	err := client.Invoke(ctx, "bdev_lvol_snapshot", args, &response)
+	return response, err
+}
+
+// nolint: golint
+type CloneLVolArgs struct {
+	SnapshotName string `json:"snapshot_name"`
+	CloneName    string `json:"clone_name"`
+}
+
+// CloneLVol creates a writable logical volume which shares all
+// clusters with the snapshot and returns its UUID. The clone
+// depends on the snapshot until it gets inflated.
+func CloneLVol(ctx context.Context, client *Client, args CloneLVolArgs) (string, error) {
+	var response string
+	err := client.Invoke(ctx, "bdev_lvol_clone", args, &response)
+	return response, err
+}
+
+// nolint: golint
+func DeleteLVol(ctx context.Context, client *Client, args LVolArgs) error {
+	return client.Invoke(ctx, "bdev_lvol_delete", args, nil)
+}
+
+// nolint: golint
+type CreateLVolArgs struct {
+	LVolName      string `json:"lvol_name"`
+	Size          int64  `json:"size"`
+	ThinProvision bool   `json:"thin_provision,omitempty"`
+	UUID          string `json:"uuid,omitempty"`
+	LVSName       string `json:"lvs_name,omitempty"`
+	ClearMethod   string `json:"clear_method,omitempty"`
+}
+
+// Values for CreateLVolArgs.ClearMethod, which determines how SPDK
+// clears the data of a new logical volume. The default depends on
+// the SPDK version.
+const (
+	LVolClearMethodNone        = "none"
+	LVolClearMethodUnmap       = "unmap"
+	LVolClearMethodWriteZeroes = "write_zeroes"
+)
+
+// CreateLVol creates a logical volume in the logical volume store
+// identified by UUID or LVSName and returns the UUID of the new
+// logical volume. The size gets rounded up to the cluster size of the
+// store.
+func CreateLVol(ctx context.Context, client *Client, args CreateLVolArgs) (string, error) {
+	var response string
+	err := client.Invoke(ctx, "bdev_lvol_create", args, &response)
+	return response, err
+}
+
+// QoSLimits are the rate limits of a BDev. Zero means unlimited.
+type QoSLimits struct {
+	RWIOsPerSec    int64 `json:"rw_ios_per_sec"`
+	RWMBytesPerSec int64 `json:"rw_mbytes_per_sec"`
+	RMBytesPerSec  int64 `json:"r_mbytes_per_sec"`
+	WMBytesPerSec  int64 `json:"w_mbytes_per_sec"`
+}
+
+// nolint: golint
+type SetQoSLimitArgs struct {
+	Name string `json:"name"`
+	QoSLimits
+}
+
+// SetQoSLimit replaces all rate limits of a BDev. It fails when SPDK
+// was built without QoS support.
+func SetQoSLimit(ctx context.Context, client *Client, args SetQoSLimitArgs) error {
+	return client.Invoke(ctx, "bdev_set_qos_limit", args, nil)
+}
+
+// nolint: golint
+type CreateCryptoBDevArgs struct {
+	BaseBDevName string `json:"base_bdev_name"`
+	Name         string `json:"name"`
+	CryptoPMD    string `json:"crypto_pmd"`
+	Key          string `json:"key"`
+	Cipher       string `json:"cipher,omitempty"`
+	Key2         string `json:"key2,omitempty"`
+}
+
+// CreateCryptoBDev creates a BDev which encrypts all data before
+// passing it to the base BDev and returns its name. The base BDev
+// gets claimed by the new BDev. SPDK must have been built with
+// crypto support.
+func CreateCryptoBDev(ctx context.Context, client *Client, args CreateCryptoBDevArgs) (string, error) {
+	var response string
+	err := client.Invoke(ctx, "bdev_crypto_create", args, &response)
+	return response, err
+}
+
+// nolint: golint
+type DeleteCryptoBDevArgs struct {
+	Name string `json:"name"`
+}
+
+// DeleteCryptoBDev removes a crypto BDev, but not its base BDev.
+func DeleteCryptoBDev(ctx context.Context, client *Client, args DeleteCryptoBDevArgs) error {
+	return client.Invoke(ctx, "bdev_crypto_delete", args, nil)
+}
+
+// nolint: golint
+type ResizeLVolArgs struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// ResizeLVol changes the size of a logical volume. The size gets
+// rounded up to the cluster size of the logical volume store.
+func ResizeLVol(ctx context.Context, client *Client, args ResizeLVolArgs) error {
+	return client.Invoke(ctx, "bdev_lvol_resize", args, nil)
+}
+
+// nolint: golint
+type RenameLVolArgs struct {
+	OldName string `json:"old_name"`
+	NewName string `json:"new_name"`
+}
+
+// RenameLVol changes the name of a logical volume. OldName may be the
+// UUID or the <lvstore>/<name> alias, NewName is only the name
+// without the logical volume store. The UUID stays the same.
+func RenameLVol(ctx context.Context, client *Client, args RenameLVolArgs) error {
+	return client.Invoke(ctx, "bdev_lvol_rename", args, nil)
+}
+
+// nolint: golint
+type ExamineLVStoreArgs struct {
+	UUID string `json:"uuid"`
+}
+
+// ExamineLVStore checks the metadata of a logical volume store. It
+// fails when the store is inaccessible.
+func ExamineLVStore(ctx context.Context, client *Client, args ExamineLVStoreArgs) error {
+	return client.Invoke(ctx, "bdev_lvs_examine", args, nil)
+}
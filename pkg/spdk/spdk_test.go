@@ -118,10 +118,55 @@ func TestMallocBDev(t *testing.T) {
 		if arg.UUID == "" {
 			expected.UUID = bdev.UUID
 		}
+		// Not relevant for Malloc BDevs.
+		expected.Aliases = bdev.Aliases
+		expected.DriverSpecific = bdev.DriverSpecific
 		assert.Equal(t, expected, bdev)
 	}
 }
 
+// TestCryptoBDev needs a SPDK built with --with-crypto. It uses the
+// software crypto module, so no crypto hardware is required.
+func TestCryptoBDev(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	defer testspdk.Finalize()
+	client := connect(t)
+	defer client.Close()
+
+	base, err := spdk.ConstructMallocBDev(ctx, client, spdk.ConstructMallocBDevArgs{ConstructBDevArgs: spdk.ConstructBDevArgs{NumBlocks: 2048, BlockSize: 512}})
+	require.NoError(t, err, "Failed to create base bdev")
+	defer func() {
+		err := spdk.DeleteBDev(ctx, client, spdk.DeleteBDevArgs{Name: string(base)})
+		assert.NoError(t, err, "Failed to delete base bdev %s", base)
+	}()
+
+	args := spdk.CreateCryptoBDevArgs{
+		BaseBDevName: string(base),
+		Name:         "MyCryptoBDev",
+		CryptoPMD:    "crypto_aesni_mb",
+		Key:          "0123456789123456",
+		Cipher:       "AES_XTS",
+		Key2:         "9876543210987654",
+	}
+	name, err := spdk.CreateCryptoBDev(ctx, client, args)
+	if spdk.IsJSONError(err, spdk.ERROR_METHOD_NOT_FOUND) {
+		t.Skip("SPDK without crypto support.")
+	}
+	require.NoError(t, err, "Failed to create %+v", args)
+	assert.Equal(t, args.Name, name, "crypto bdev name")
+
+	bdevs, err := spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: string(base)})
+	require.NoError(t, err, "Failed to retrieve base bdev")
+	require.Len(t, bdevs, 1)
+	assert.True(t, bdevs[0].Claimed, "base bdev claimed")
+
+	err = spdk.DeleteCryptoBDev(ctx, client, spdk.DeleteCryptoBDevArgs{Name: name})
+	require.NoError(t, err, "Failed to delete crypto bdev")
+	_, err = spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: name})
+	assert.True(t, spdk.IsJSONError(err, spdk.ERROR_INVALID_PARAMS), "crypto bdev gone: %v", err)
+}
+
 func TestNBDDev(t *testing.T) {
 	defer testlog.SetGlobal(t)()
 	ctx := context.Background()
@@ -0,0 +1,196 @@
+/*
+Copyright (C) 2018 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intel/oim/pkg/log"
+)
+
+// traceBufferSize is the number of trace records that may wait for
+// being written. When writing falls behind, the oldest records get
+// dropped instead of blocking calls.
+const traceBufferSize = 1024
+
+// redacted replaces key material in trace records.
+const redacted = "<redacted>"
+
+// TraceRecord is one line in the trace file: either the request of
+// a call or the response to it, with the same sequence number.
+type TraceRecord struct {
+	Type     string        `json:"type"`
+	Seq      uint64        `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Params   interface{}   `json:"params,omitempty"`
+	Result   interface{}   `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// WithTraceFile appends each call and its response as JSON lines to
+// the file. Key material is replaced with "<redacted>".
+func WithTraceFile(path string) Option {
+	return func(c *Client) {
+		c.tracePath = path
+	}
+}
+
+// tracer writes TraceRecords in the background.
+type tracer struct {
+	mutex   sync.Mutex
+	seq     uint64
+	dropped int
+	closed  bool
+	records chan TraceRecord
+	done    chan struct{}
+	file    *os.File
+}
+
+func newTracer(path string) (*tracer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &tracer{
+		records: make(chan TraceRecord, traceBufferSize),
+		done:    make(chan struct{}),
+		file:    file,
+	}
+	go t.write()
+	return t, nil
+}
+
+// request records a call and returns its sequence number.
+func (t *tracer) request(method string, params interface{}) uint64 {
+	t.mutex.Lock()
+	t.seq++
+	seq := t.seq
+	t.mutex.Unlock()
+	t.add(TraceRecord{
+		Type:   "request",
+		Seq:    seq,
+		Time:   time.Now(),
+		Method: method,
+		Params: sanitize(params),
+	})
+	return seq
+}
+
+// response records the result of a call.
+func (t *tracer) response(seq uint64, method string, start time.Time, result interface{}, err error) {
+	record := TraceRecord{
+		Type:     "response",
+		Seq:      seq,
+		Time:     time.Now(),
+		Method:   method,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Result = sanitize(result)
+	}
+	t.add(record)
+}
+
+// add queues a record without blocking, dropping the oldest one if
+// the buffer is full.
+func (t *tracer) add(record TraceRecord) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	for {
+		select {
+		case t.records <- record:
+			return
+		default:
+		}
+		select {
+		case <-t.records:
+			t.dropped++
+		default:
+		}
+	}
+}
+
+func (t *tracer) write() {
+	defer close(t.done)
+	enc := json.NewEncoder(t.file)
+	for record := range t.records {
+		if err := enc.Encode(record); err != nil {
+			log.L().Errorw("writing SPDK trace", "error", err)
+		}
+	}
+}
+
+// close writes all pending records and closes the file.
+func (t *tracer) close() error {
+	t.mutex.Lock()
+	t.closed = true
+	close(t.records)
+	dropped := t.dropped
+	t.mutex.Unlock()
+	<-t.done
+	if dropped > 0 {
+		log.L().Warnw("SPDK trace incomplete", "dropped", dropped)
+	}
+	return t.file.Close()
+}
+
+// sanitize converts the value into its generic JSON representation
+// and redacts all entries whose name contains "key", "secret" or
+// "password".
+func sanitize(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil
+	}
+	return redact(generic)
+}
+
+func redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, entry := range value {
+			if sensitive(name) {
+				value[name] = redacted
+			} else {
+				value[name] = redact(entry)
+			}
+		}
+	case []interface{}:
+		for i, entry := range value {
+			value[i] = redact(entry)
+		}
+	}
+	return value
+}
+
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"key", "secret", "password"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
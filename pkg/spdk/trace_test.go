@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/oim/pkg/log/testlog"
+	"github.com/intel/oim/pkg/spdk"
+	testspdk "github.com/intel/oim/test/pkg/spdk"
+)
+
+func TestTraceFile(t *testing.T) {
+	defer testlog.SetGlobal(t)()
+	ctx := context.Background()
+	fake, err := testspdk.NewFake()
+	require.NoError(t, err)
+	defer fake.Close()
+	fake.Handle("get_bdevs", func(params json.RawMessage) (interface{}, error) {
+		return []spdk.BDev{{Name: "malloc0"}}, nil
+	})
+	fake.Handle("bdev_crypto_create", func(params json.RawMessage) (interface{}, error) {
+		return "crypto0", nil
+	})
+	tmp, err := ioutil.TempDir("", "trace")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "trace.json")
+
+	client, err := spdk.New(fake.Path, spdk.WithTraceFile(path))
+	require.NoError(t, err)
+	_, err = spdk.GetBDevs(ctx, client, spdk.GetBDevsArgs{Name: "malloc0"})
+	require.NoError(t, err)
+	_, err = spdk.CreateCryptoBDev(ctx, client, spdk.CreateCryptoBDevArgs{Name: "crypto0", Key: "0123456789abcdef"})
+	require.NoError(t, err)
+	_, err = spdk.GetNBDDisks(ctx, client)
+	require.Error(t, err)
+	require.NoError(t, client.Close(), "flush trace")
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var records []spdk.TraceRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record spdk.TraceRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+		assert.NotContains(t, scanner.Text(), "0123456789abcdef", "key material")
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, records, 6)
+	for i, method := range []string{"get_bdevs", "bdev_crypto_create", "get_nbd_disks"} {
+		request, response := records[2*i], records[2*i+1]
+		assert.Equal(t, "request", request.Type, method)
+		assert.Equal(t, "response", response.Type, method)
+		assert.Equal(t, method, request.Method)
+		assert.Equal(t, method, response.Method)
+		assert.Equal(t, uint64(i+1), request.Seq, method)
+		assert.Equal(t, request.Seq, response.Seq, method)
+	}
+	assert.Equal(t, "<redacted>", records[2].Params.(map[string]interface{})["key"])
+	assert.Equal(t, "crypto0", records[3].Result)
+	assert.NotEmpty(t, records[5].Error, "get_nbd_disks not implemented")
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package spdk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/oim/pkg/spdk"
+)
+
+// FakeHandler implements one SPDK RPC method in a Fake. The
+// result is sent back as JSON, with nil replaced by true because
+// SPDK always returns some result for successful calls. A
+// FakeError is sent back as JSON error with the given code, any
+// other error as internal error.
+type FakeHandler func(params json.RawMessage) (interface{}, error)
+
+// FakeError is an error with a specific JSON-RPC error code.
+type FakeError struct {
+	Code    int
+	Message string
+}
+
+func (e FakeError) Error() string {
+	return e.Message
+}
+
+// FakeCall records one method invocation.
+type FakeCall struct {
+	Method string
+	Params json.RawMessage
+}
+
+// Fake is a minimal SPDK JSON-RPC server for unit tests which
+// cannot use a real SPDK daemon. Methods without a handler
+// fail with ERROR_METHOD_NOT_FOUND.
+type Fake struct {
+	// Path is the Unix domain socket that the server listens on.
+	Path string
+
+	tmpDir   string
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mutex       sync.Mutex
+	handlers    map[string]FakeHandler
+	calls       []FakeCall
+	conns       map[net.Conn]bool
+	connections int
+}
+
+// NewFake starts a server on a new socket in a temporary directory.
+func NewFake() (*Fake, error) {
+	tmpDir, err := ioutil.TempDir("", "fake-spdk")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(tmpDir, "spdk.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "listen")
+	}
+	f := &Fake{
+		Path:     path,
+		tmpDir:   tmpDir,
+		listener: listener,
+		handlers: map[string]FakeHandler{},
+		conns:    map[net.Conn]bool{},
+	}
+	f.wg.Add(1)
+	go f.accept()
+	return f, nil
+}
+
+// Handle sets or replaces the handler for a method.
+func (f *Fake) Handle(method string, handler FakeHandler) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.handlers[method] = handler
+}
+
+// Calls returns all method invocations so far.
+func (f *Fake) Calls() []FakeCall {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]FakeCall{}, f.calls...)
+}
+
+// Methods returns the names of all invoked methods so far.
+func (f *Fake) Methods() []string {
+	var methods []string
+	for _, call := range f.Calls() {
+		methods = append(methods, call.Method)
+	}
+	return methods
+}
+
+// Connections returns the number of connections accepted so far.
+func (f *Fake) Connections() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.connections
+}
+
+// Disconnect closes all current connections, as if the SPDK
+// daemon had been restarted.
+func (f *Fake) Disconnect() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+		delete(f.conns, conn)
+	}
+}
+
+// Close stops the server and removes the socket.
+func (f *Fake) Close() {
+	f.listener.Close()
+	f.wg.Wait()
+	f.Disconnect()
+	os.RemoveAll(f.tmpDir)
+}
+
+func (f *Fake) accept() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.conns[conn] = true
+		f.connections++
+		f.mutex.Unlock()
+		go f.serve(conn)
+	}
+}
+
+type fakeRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     interface{}     `json:"id"`
+}
+
+type fakeResponse struct {
+	Version string      `json:"jsonrpc"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   interface{} `json:"error,omitempty"`
+	ID      interface{} `json:"id"`
+}
+
+func (f *Fake) serve(conn net.Conn) {
+	defer func() {
+		f.mutex.Lock()
+		delete(f.conns, conn)
+		f.mutex.Unlock()
+		conn.Close()
+	}()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var request fakeRequest
+		if err := dec.Decode(&request); err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.calls = append(f.calls, FakeCall{Method: request.Method, Params: request.Params})
+		handler := f.handlers[request.Method]
+		f.mutex.Unlock()
+
+		response := fakeResponse{Version: "2.0", ID: request.ID}
+		if handler == nil {
+			response.Error = map[string]interface{}{
+				"code":    spdk.ERROR_METHOD_NOT_FOUND,
+				"message": "Method not found",
+			}
+		} else {
+			result, err := handler(request.Params)
+			switch err := err.(type) {
+			case nil:
+				if result == nil {
+					result = true
+				}
+				response.Result = result
+			case FakeError:
+				response.Error = map[string]interface{}{
+					"code":    err.Code,
+					"message": err.Message,
+				}
+			default:
+				response.Error = map[string]interface{}{
+					"code":    spdk.ERROR_INTERNAL_ERROR,
+					"message": err.Error(),
+				}
+			}
+		}
+		if err := enc.Encode(&response); err != nil {
+			return
+		}
+	}
+}